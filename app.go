@@ -8,6 +8,8 @@ import (
     "encoding/binary"
     "github.com/jrm-1535/exif"
     "io"
+    "strings"
+    "unicode/utf16"
 )
 
 // metadata interface for all apps
@@ -15,6 +17,8 @@ type metadata interface {
     mFormat( w io.Writer, mid int, sids []int ) (int, error)
     mRemove( appId int, sId []int ) error
     mThumbnail( tid int, path string ) (int, error)
+    mThumbnailInfo( ) []ThumbnailInfo
+    mThumbnailData( index int ) ([]byte, error)
 //    mExtract( mid int,  ) (int, error)
 }
 
@@ -38,11 +42,17 @@ func getUnitsString( units uint8 ) (string, string) {
 const (
     _APP0_JFIF = iota
     _APP0_JFXX
+    _APP0_AVI1
+)
+
+const (
+    _AVI1_SIGNATURE = "AVI1"    // Motion JPEG (AVI) APP0
 )
 
 func markerAPP0discriminator( h5 []byte ) int {
     if bytes.Equal( h5, []byte( "JFIF\x00" ) ) { return _APP0_JFIF }
     if bytes.Equal( h5, []byte( "JFXX\x00" ) ) { return _APP0_JFXX }
+    if bytes.HasPrefix( h5, []byte( _AVI1_SIGNATURE ) ) { return _APP0_AVI1 }
     return -1
 }
 
@@ -73,6 +83,10 @@ type app0   struct {
     thbnail  []byte
 }
 
+func (a0 *app0)marker( ) uint {
+    return _APP0
+}
+
 func (a0 *app0)serialize( w io.Writer ) (int, error) {
     if a0.removed {
         return 0, nil
@@ -169,6 +183,54 @@ func (a0 *app0)mThumbnail( tid int, path string ) (n int, err error) {
     return
 }
 
+func (a0 *app0)mThumbnailInfo( ) (ti []ThumbnailInfo) {
+    if a0.removed {
+        return
+    }
+    switch a0.sType {
+    case _JFIF_BASE:
+        if a0.htNail == 0 || a0.vtNail == 0 {
+            return
+        }
+        ti = append( ti, ThumbnailInfo{ "APP0 JFIF", -1, uint(a0.htNail),
+                                        uint(a0.vtNail), uint(len(a0.thbnail)),
+                                        "uncompressed 24-bit RGB" } )
+    case _THUMBNAIL_BASELINE:
+        w, h := jpegDimensions( a0.thbnail )
+        ti = append( ti, ThumbnailInfo{ "APP0 JFXX", -1, w, h,
+                                        uint(len(a0.thbnail)), "JPEG" } )
+    case _THUMBNAIL_PALETTE:
+        ti = append( ti, ThumbnailInfo{ "APP0 JFXX", -1, uint(a0.htNail),
+                                        uint(a0.vtNail), uint(len(a0.thbnail)),
+                                        "8-bit palette" } )
+    case _THUMBNAIL_RGB:
+        ti = append( ti, ThumbnailInfo{ "APP0 JFXX", -1, uint(a0.htNail),
+                                        uint(a0.vtNail), uint(len(a0.thbnail)),
+                                        "uncompressed 24-bit RGB" } )
+    }
+    return
+}
+
+func (a0 *app0)mThumbnailData( index int ) ([]byte, error) {
+    if index != 0 || len(a0.thbnail) == 0 {
+        return nil, fmt.Errorf( "mThumbnailData: no thumbnail #%d\n", index )
+    }
+    data := make( []byte, len(a0.thbnail) )
+    copy( data, a0.thbnail )
+    return data, nil
+}
+
+// jpegDimensions returns the width and height of an embedded JPEG image, or
+// 0, 0 if the image cannot be parsed.
+func jpegDimensions( data []byte ) (width, height uint) {
+    tn, err := Parse( data, &Control{ } )
+    if err != nil || len(tn.frames) == 0 {
+        return
+    }
+    frm := &tn.frames[0]
+    return frm.nSamplesLine( ), uint(frm.actualLines( ))
+}
+
 func (jpg *Desc) app0( marker, sLen uint ) error {
     if sLen < 8 {
         return fmt.Errorf( "app0: Wrong APP0 (JFIF) header (invalid length %d)\n", sLen )
@@ -182,9 +244,12 @@ func (jpg *Desc) app0( marker, sLen uint ) error {
     if appType == -1 {
         return fmt.Errorf( "app0: Wrong APP0 header (%s)\n", jpg.data[offset:offset+4] )
     }
+    if appType == _APP0_AVI1 {  // Motion JPEG frame, kept as raw APP0
+        return jpg.appn( marker, sLen )
+    }
 
     if appType == _APP0_JFIF {
-        if len(jpg.segments) != 0 {
+        if len(jpg.segments) != 0 && ! jpg.normalizingApps( ) {
             return fmt.Errorf( "app0: JFIF is not the first segment\n" )
         }
         if sLen < 16 {
@@ -213,7 +278,7 @@ func (jpg *Desc) app0( marker, sLen uint ) error {
         jpg.addSeg( a )
 //        jpg.addApp( a )
     } else {
-        if len(jpg.segments) != 1 {
+        if len(jpg.segments) != 1 && ! jpg.normalizingApps( ) {
             return fmt.Errorf( "app0: JFIF extension does not follow JFIF\n" )
         }
         if jpg.app0Extension {
@@ -252,7 +317,13 @@ const (
     _APP1_XMP
 )
 
+// XMP data, standard or extended, is kept as a raw APP1 segment
 func (jpg *Desc) xmpApplication( offset, sLen uint ) error {
+    a, err := newAppSeg( 1, jpg.data[offset:offset+sLen] )
+    if err != nil {
+        return fmt.Errorf( "xmpApplication: %v", err )
+    }
+    jpg.addSeg( a )
 /*
     fmt.Printf( "APP1 (XMP)\n" )
     fmt.Printf( "  ----------------- Length %d -----------------\n", sLen )
@@ -268,6 +339,10 @@ type exifData struct {
     desc *exif.Desc
 }
 
+func (ed *exifData)marker( ) uint {
+    return _APP1
+}
+
 func (ed *exifData) serialize( w io.Writer) (n int, err error) {
     if ed.removed {
         return
@@ -345,6 +420,272 @@ func (ed *exifData) mThumbnail( tid int, path string ) (n int, err error) {
     return
 }
 
+func (ed *exifData) mThumbnailInfo( ) (ti []ThumbnailInfo) {
+    if ed.removed {
+        return
+    }
+    for _, thbn := range ed.desc.GetThumbnailInfo() {
+        t := ThumbnailInfo{ Source: "APP1 EXIF", Id: -1,
+                            Size: uint(thbn.Size),
+                            Compression: exif.GetCompressionName(thbn.Comp) }
+        switch thbn.Origin {
+        case exif.THUMBNAIL:
+            t.Id = 0
+        case exif.EMBEDDED:
+            t.Id = 1
+        }
+        if thbn.Comp == exif.JPEG {
+            if data, err := ed.desc.GetThumbnailData( thbn.Origin ); err == nil {
+                t.Width, t.Height = jpegDimensions( data )
+            }
+        } else {
+            t.Width = ed.ifdUint( thbn.Origin, 0x100 )     // ImageWidth
+            t.Height = ed.ifdUint( thbn.Origin, 0x101 )    // ImageLength
+        }
+        ti = append( ti, t )
+    }
+    return
+}
+
+func (ed *exifData) mThumbnailData( index int ) ([]byte, error) {
+    thbns := ed.desc.GetThumbnailInfo()
+    if index < 0 || index >= len(thbns) {
+        return nil, fmt.Errorf( "mThumbnailData: no thumbnail #%d\n", index )
+    }
+    return ed.desc.GetThumbnailData( thbns[index].Origin )
+}
+
+// ifdUint returns the value of a single SHORT or LONG tag in the given IFD,
+// or 0 if the tag is not available.
+func (ed *exifData) ifdUint( id exif.IfdId, tag int ) uint {
+    st, v, err := ed.desc.GetIfdTagValue( id, tag )
+    if err != nil {
+        return 0
+    }
+    switch st {
+    case exif.U16Slice:
+        if sl := v.([]uint16); len(sl) == 1 {
+            return uint(sl[0])
+        }
+    case exif.U32Slice:
+        if sl := v.([]uint32); len(sl) == 1 {
+            return uint(sl[0])
+        }
+    }
+    return 0
+}
+
+// ifdString returns the value of an ASCII tag in the given IFD, without
+// trailing NUL or spaces, or "" if the tag is not available.
+func (ed *exifData) ifdString( id exif.IfdId, tag int ) string {
+    st, v, err := ed.desc.GetIfdTagValue( id, tag )
+    if err != nil || st != exif.String {
+        return ""
+    }
+    return strings.TrimRight( v.(string), "\x00 " )
+}
+
+// ifdUTF16 returns the value of a BYTE tag holding a NUL terminated UTF-16LE
+// string, as written by Windows for the XP* tags, or "" if the tag is not
+// available.
+func (ed *exifData) ifdUTF16( id exif.IfdId, tag int ) string {
+    st, v, err := ed.desc.GetIfdTagValue( id, tag )
+    var b []byte
+    switch {
+    case err != nil:
+        return ""
+    case st == exif.U8Slice:
+        b = v.([]uint8)
+    case st == exif.String:
+        b = []byte(v.(string))
+    default:
+        return ""
+    }
+    u := make( []uint16, 0, len(b)/2 )
+    for i := 0; i+1 < len(b); i += 2 {
+        c := binary.LittleEndian.Uint16( b[i:] )
+        if c == 0 {
+            break
+        }
+        u = append( u, c )
+    }
+    return string( utf16.Decode( u ) )
+}
+
+// XPTags gives the Windows Explorer properties stored in EXIF IFD0
+type XPTags struct {
+    Title, Comment, Author, Keywords, Subject   string
+}
+
+const (                             // Windows XP* tags in IFD0
+    _XP_TITLE       = 0x9c9b
+    _XP_COMMENT     = 0x9c9c
+    _XP_AUTHOR      = 0x9c9d
+    _XP_KEYWORDS    = 0x9c9e
+    _XP_SUBJECT     = 0x9c9f
+)
+
+// GetXPTags returns the XPTitle, XPComment, XPAuthor, XPKeywords and
+// XPSubject tags written by Windows Explorer, decoded from UTF-16LE. Keywords
+// are separated by semicolons. It returns nil if there is no EXIF metadata.
+func (jpg *Desc) GetXPTags( ) *XPTags {
+    for _, seg := range jpg.segments {
+        if ed, ok := seg.(*exifData); ok && ! ed.removed {
+            return &XPTags{ Title: ed.ifdUTF16( exif.PRIMARY, _XP_TITLE ),
+                            Comment: ed.ifdUTF16( exif.PRIMARY, _XP_COMMENT ),
+                            Author: ed.ifdUTF16( exif.PRIMARY, _XP_AUTHOR ),
+                            Keywords: ed.ifdUTF16( exif.PRIMARY, _XP_KEYWORDS ),
+                            Subject: ed.ifdUTF16( exif.PRIMARY, _XP_SUBJECT ) }
+        }
+    }
+    return nil
+}
+
+// InteropInfo gives the content of the EXIF Interoperability IFD
+type InteropInfo struct {
+    Index                   string  // e.g. "R98" (DCF basic) or "THM"
+    Version                 string  // e.g. "0100"
+    RelatedImageFileFormat  string  // file format of a related image
+    RelatedImageWidth       uint    // related image width
+    RelatedImageLength      uint    // related image height
+}
+
+const (                             // Interoperability IFD tags
+    _IOP_INDEX              = 0x0001
+    _IOP_VERSION            = 0x0002
+    _IOP_RELATED_FORMAT     = 0x1000
+    _IOP_RELATED_WIDTH      = 0x1001
+    _IOP_RELATED_LENGTH     = 0x1002
+)
+
+// GetInteropInfo returns the tags of the EXIF Interoperability IFD, or nil
+// if there is no such IFD. The IFD can be removed by calling RemoveMetadata
+// with appId 1 and the sub-id exif.IOP.
+func (jpg *Desc) GetInteropInfo( ) *InteropInfo {
+    for _, seg := range jpg.segments {
+        ed, ok := seg.(*exifData)
+        if ! ok || ed.removed {
+            continue
+        }
+        info := &InteropInfo{
+            Index: ed.ifdString( exif.IOP, _IOP_INDEX ),
+            RelatedImageFileFormat: ed.ifdString( exif.IOP, _IOP_RELATED_FORMAT ),
+            RelatedImageWidth: ed.ifdUint( exif.IOP, _IOP_RELATED_WIDTH ),
+            RelatedImageLength: ed.ifdUint( exif.IOP, _IOP_RELATED_LENGTH ),
+        }
+        st, v, err := ed.desc.GetIfdTagValue( exif.IOP, _IOP_VERSION )
+        if err == nil && st == exif.U8Slice {
+            info.Version = string( v.([]uint8) )
+        }
+        if *info == (InteropInfo{ }) {
+            return nil
+        }
+        return info
+    }
+    return nil
+}
+
+const (                             // EXIF tags giving the image dimensions
+    _TIFF_IMAGE_WIDTH   = 0x100     // in IFD0 (PRIMARY)
+    _TIFF_IMAGE_LENGTH  = 0x101
+    _TIFF_EXIF_IFD      = 0x8769    // pointer to EXIF IFD in IFD0
+    _EXIF_PIXEL_X       = 0xa002    // in EXIF IFD
+    _EXIF_PIXEL_Y       = 0xa003
+)
+
+// checkDimensions compares the image dimensions given in EXIF metadata with
+// the actual frame dimensions. In case of mismatch, it returns true after
+// issuing a warning, if requested.
+func (jpg *Desc) checkDimensions( ed *exifData, width, height uint ) bool {
+    mismatch := false
+    check := func( id exif.IfdId, wTag, hTag int, names string ) {
+        w, h := ed.ifdUint( id, wTag ), ed.ifdUint( id, hTag )
+        if (w != 0 && w != width) || (h != 0 && h != height) {
+            mismatch = true
+            if jpg.Warn {
+                jpg.warning( "  WARNING: EXIF %s %dx%d do not match frame %dx%d\n",
+                             names, w, h, width, height )
+            }
+        }
+    }
+    check( exif.PRIMARY, _TIFF_IMAGE_WIDTH, _TIFF_IMAGE_LENGTH,
+           "ImageWidth/ImageLength" )
+    check( exif.EXIF, _EXIF_PIXEL_X, _EXIF_PIXEL_Y,
+           "PixelXDimension/PixelYDimension" )
+    return mismatch
+}
+
+// setDimensions rewrites the EXIF image dimensions, if they are present. Since
+// the exif package does not allow modifying tag values, the serialized EXIF
+// data is patched and parsed again.
+func (ed *exifData) setDimensions( width, height uint ) error {
+    var b bytes.Buffer
+    if _, err := ed.desc.Serialize( &b ); err != nil {
+        return fmt.Errorf( "setDimensions: %v", err )
+    }
+    data := b.Bytes()
+    if len(data) < 14 {
+        return fmt.Errorf( "setDimensions: EXIF data too short\n" )
+    }
+    tiff := data[6:]        // after "Exif\0\0"
+    var order binary.ByteOrder = binary.BigEndian
+    if tiff[0] == 'I' {
+        order = binary.LittleEndian
+    }
+    ifd0 := order.Uint32( tiff[4:] )
+    exifIfd := patchIfdDimensions( tiff, order, ifd0, _TIFF_IMAGE_WIDTH,
+                                   _TIFF_IMAGE_LENGTH, width, height )
+    if exifIfd != 0 {
+        patchIfdDimensions( tiff, order, exifIfd, _EXIF_PIXEL_X,
+                            _EXIF_PIXEL_Y, width, height )
+    }
+    ec := exif.Control{ Unknown: exif.KeepTag }
+    d, err := exif.Parse( data, 0, uint(len(data)), &ec )
+    if err != nil {
+        return fmt.Errorf( "setDimensions: %v", err )
+    }
+    ed.desc = d
+    return nil
+}
+
+// patchIfdDimensions replaces in place the SHORT or LONG values of the tags
+// wTag and hTag found in the IFD at offset in tiff. It returns the EXIF IFD
+// offset if that IFD is referred to, or 0.
+func patchIfdDimensions( tiff []byte, order binary.ByteOrder, offset uint32,
+                         wTag, hTag uint16, width, height uint ) (exifIfd uint32) {
+    const (
+        _SHORT      = 3
+        _LONG       = 4
+        _ENTRY_SIZE = 12
+    )
+    if uint(offset) + 2 > uint(len(tiff)) {
+        return
+    }
+    n := uint(order.Uint16( tiff[offset:] ))
+    for e := uint(offset) + 2; e + _ENTRY_SIZE <= uint(len(tiff)) && n > 0; n-- {
+        tag, typ := order.Uint16( tiff[e:] ), order.Uint16( tiff[e+2:] )
+        count := order.Uint32( tiff[e+4:] )
+        var v uint
+        switch tag {
+        case wTag:      v = width
+        case hTag:      v = height
+        case _TIFF_EXIF_IFD:
+            exifIfd = order.Uint32( tiff[e+8:] )
+        }
+        if v != 0 && count == 1 {
+            switch typ {
+            case _SHORT:
+                if v <= 0xffff {
+                    order.PutUint16( tiff[e+8:], uint16(v) )
+                }
+            case _LONG:
+                order.PutUint32( tiff[e+8:], uint32(v) )
+            }
+        }
+        e += _ENTRY_SIZE
+    }
+    return
+}
 
 func (ed *exifData)parseThumbnails( ) (err error) {
 
@@ -441,9 +782,75 @@ func (jpg *Desc) setTiffOrientation( ed *exifData ) {
     jpg.orientation = orientation
 }
 
+// parseExif calls exif.Parse, turning a panic caused by malformed metadata
+// that checkExifBounds does not catch, such as an invalid maker note, into an
+// error, with invalid set.
+func parseExif( data []byte, offset, sLen uint,
+                ec *exif.Control ) (d *exif.Desc, invalid bool, err error) {
+    defer func( ) {
+        if r := recover( ); r != nil {
+            d, invalid, err = nil, true, fmt.Errorf( "%v\n", r )
+        }
+    }()
+    d, err = exif.Parse( data, offset, sLen, ec )
+    return
+}
+
+// exifApplication parses EXIF metadata. Entries with offsets or counts beyond
+// the segment are reported and removed from the parsed metadata, the rest of
+// which is kept. Metadata whose TIFF header or IFD0 does not fit in the segment,
+// or that the exif package cannot parse without panicking, is reported and
+// kept as a raw APP1 segment, instead of failing the whole parsing.
 func (jpg *Desc) exifApplication( offset, sLen uint ) error {
-    ec := exif.Control{ Unknown: exif.KeepTag, Warn: true }
-    d, err := exif.Parse( jpg.data, offset, sLen, &ec )
+    var data []byte
+    var issues, notes []string
+    var err error
+    invalid := true
+    if sLen < 2 * _EXIF_SIGNATURE_SIZE {
+        err = fmt.Errorf( "EXIF segment too short (%d bytes)\n", sLen )
+    } else {
+        // copy, since invalid entries are removed, with 4 zero bytes beyond
+        // the end, read by the exif package as the next IFD offset when it is
+        // omitted at the end of the data
+        data = make( []byte, sLen, sLen + 4 )
+        copy( data, jpg.data[offset:offset+sLen] )
+        issues, notes, err = checkExifBounds( data[_EXIF_SIGNATURE_SIZE:] )
+        invalid = err != nil
+    }
+    var d *exif.Desc
+    if ! invalid {
+        ec := exif.Control{ Unknown: exif.KeepTag, Warn: true }
+        d, invalid, err = parseExif( data, 0, sLen, &ec )
+    }
+    if invalid {
+        if jpg.Warn {
+            jpg.warning( "  WARNING: invalid EXIF metadata kept as raw data: %v", err )
+        }
+        jpg.exifIssues = append( jpg.exifIssues, fmt.Sprintf(
+                                 "metadata kept as raw data: %s",
+                                 strings.TrimSpace( err.Error() ) ) )
+        a, err := newAppSeg( 1, jpg.data[offset:offset+sLen] )
+        if err != nil {
+            return fmt.Errorf( "exifApplication: %v", err )
+        }
+        jpg.addSeg( a )
+        return nil
+    }
+    for _, issue := range issues {
+        if jpg.Warn {
+            jpg.warning( "  WARNING: invalid EXIF entry: %s\n", issue )
+        }
+        if jpg.TidyUp {
+            jpg.fixing( "  FIXING: removing invalid EXIF entry: %s\n", issue )
+        }
+    }
+    if jpg.Warn {
+        for _, note := range notes {
+            jpg.warning( "  WARNING: EXIF entry kept: %s\n", note )
+        }
+    }
+    jpg.exifIssues = append( jpg.exifIssues, issues... )
+    jpg.exifIssues = append( jpg.exifIssues, notes... )
 
     if err == nil {
         ed := new(exifData)
@@ -460,11 +867,314 @@ func (jpg *Desc) exifApplication( offset, sLen uint ) error {
     return err
 }
 
+// GetExifIssues returns the description of each invalid EXIF entry, with an
+// offset or a count beyond its APP1 segment, found while parsing. Those entries
+// are removed from the parsed metadata, and from the serialized metadata if
+// TidyUp was requested. Without TidyUp, the EXIF segment is written as it was.
+// Entries of unknown TIFF type are also described, but kept, as well as EXIF
+// segments kept as raw data because they could not be parsed.
+func (jpg *Desc) GetExifIssues( ) []string {
+    return jpg.exifIssues
+}
+
+// generic application segment support (any APPn kept as raw data)
+
+const (
+    _MAX_APP_PAYLOAD    = 0xffff - 2    // segment length includes its 2 bytes
+)
+
+type appSeg struct {
+    id      uint8                       // application segment number [0-15]
+    payload []byte                      // data following the segment length
+}
+
+func (a *appSeg)marker( ) uint {
+    return _APP0 + uint(a.id)
+}
+
+func (a *appSeg)serialize( w io.Writer ) (int, error) {
+    seg := make( []byte, 4 + len(a.payload) )
+    binary.BigEndian.PutUint16( seg, _APP0 + uint16(a.id) )
+    binary.BigEndian.PutUint16( seg[2:], uint16(len(a.payload) + 2) )
+    copy( seg[4:], a.payload )
+    return w.Write( seg )
+}
+
+func (a *appSeg)format( w io.Writer ) (n int, err error) {
+    n, err = fmt.Fprintf( w, "APP%d:\n  %d bytes of application data\n",
+                          a.id, len(a.payload) )
+    if err != nil { err = fmt.Errorf( "format: %w", err ) }
+    return
+}
+
+func newAppSeg( id uint, payload []byte ) (*appSeg, error) {
+    if id > 15 {
+        return nil, fmt.Errorf( "newAppSeg: invalid application segment %d\n", id )
+    }
+    if len(payload) > _MAX_APP_PAYLOAD {
+        return nil, fmt.Errorf( "newAppSeg: payload too large (%d bytes, max %d)\n",
+                                len(payload), _MAX_APP_PAYLOAD )
+    }
+    a := new(appSeg)
+    a.id = uint8(id)
+    a.payload = make( []byte, len(payload) )
+    copy( a.payload, payload )
+    return a, nil
+}
+
+func (jpg *Desc) appn( marker, sLen uint ) error {
+    if sLen < 2 {
+        return fmt.Errorf( "appn: Wrong APP%d header (invalid length %d)\n",
+                           marker - _APP0, sLen )
+    }
+    if jpg.offset + 2 + sLen > uint(len(jpg.data)) {
+        return fmt.Errorf( "appn: APP%d length %d beyond end of data\n",
+                           marker - _APP0, sLen )
+    }
+    offset := jpg.offset + 4    // points 1 byte after length
+    a, err := newAppSeg( marker - _APP0, jpg.data[offset:offset+sLen-2] )
+    if err == nil {
+        jpg.addSeg( a )
+    }
+    return err
+}
+
+func isAppSegment( seg segmenter ) bool {
+    switch seg.(type) {
+    case *app0, *exifData, *appSeg:
+        return true
+    }
+    return false
+}
+
+// removeDuplicateApps removes the application segments that are exact
+// duplicates of a previous one, keeping the first occurrence. It returns the
+// number of segments removed and the number of bytes saved.
+func (jpg *Desc)removeDuplicateApps( ) (removed, saved int) {
+    var kept [][]byte
+    segments := jpg.segments[:0]
+segLoop:
+    for _, seg := range jpg.segments {
+        if isAppSegment( seg ) {
+            var b bytes.Buffer
+            if _, err := seg.serialize( &b ); err == nil && b.Len() > 0 {
+                for _, k := range kept {
+                    if bytes.Equal( k, b.Bytes() ) {
+                        removed ++
+                        saved += b.Len()
+                        continue segLoop
+                    }
+                }
+                kept = append( kept, b.Bytes() )
+            }
+        }
+        segments = append( segments, seg )
+    }
+    jpg.segments = segments
+    return
+}
+
+// AppPreference indicates which application markers to keep when JFIF and
+// Adobe APP14 segments are contradictory.
+type AppPreference int
+const (
+    NoAppPreference AppPreference = iota    // leave application markers as is
+    PreferJFIF                              // keep JFIF, remove Adobe APP14
+    PreferAdobe                             // keep Adobe APP14, remove JFIF
+)
+
+const (
+    _ADOBE_SIGNATURE    = "Adobe"
+    _ADOBE_SIZE         = 12    // payload size, including the 5-byte signature
+    _ADOBE_TRANSFORM    = 11    // transform offset in payload
+    _ADOBE_YCC          = 1     // YCbCr transform (0 RGB or CMYK, 2 YCCK)
+    _ADOBE_CMYK         = 0     // no transform (RGB or CMYK)
+    _ADOBE_YCCK         = 2     // YCCK transform
+)
+
+// NormalizeAppMarkers makes the set of application markers consistent and
+// minimal, according to the given preference:
+//
+//  - if both JFIF and Adobe APP14 segments are present and contradictory
+//  (Adobe transform other than YCbCr for 3 components, or 4 components that
+//  JFIF cannot describe), PreferJFIF removes the Adobe segments, whereas
+//  PreferAdobe removes the JFIF and JFIF extension segments.
+//
+//  - if JFIF extension segments are present without JFIF, PreferJFIF inserts
+//  a default JFIF segment first, whereas PreferAdobe removes the extensions.
+//
+//  - extra JFIF or Adobe segments are removed and the JFIF segment, if any, is
+//  moved first.
+//
+// It returns true if any segment was modified. An error is returned if the
+// preference cannot be satisfied (e.g. JFIF with 4 components).
+func (jpg *Desc)NormalizeAppMarkers( pref AppPreference ) (changed bool, err error) {
+    if pref == NoAppPreference {
+        return
+    }
+    var jfif, adobe segmenter
+    var nJfxx int
+    var segments []segmenter
+    for _, seg := range jpg.segments {
+        switch {
+        case isJfifSegment( seg ):
+            if jfif != nil {
+                continue        // remove extra JFIF
+            }
+            jfif = seg
+        case isJfxxSegment( seg ):
+            nJfxx ++
+        case isAdobeSegment( seg ):
+            if adobe != nil {
+                continue        // remove extra Adobe
+            }
+            adobe = seg
+        }
+        segments = append( segments, seg )
+    }
+
+    var nComps int
+    if len(jpg.frames) > 0 {
+        nComps = len(jpg.frames[0].components)
+    }
+    conflict := jfif != nil && adobe != nil &&
+                (nComps == 4 ||
+                 (nComps == 3 && adobe.(*appSeg).payload[_ADOBE_TRANSFORM] != _ADOBE_YCC))
+    if pref == PreferJFIF && nComps == 4 && (jfif != nil || nJfxx > 0) {
+        return false, fmt.Errorf( "NormalizeAppMarkers: JFIF cannot describe 4 components\n" )
+    }
+
+    keepJfif := pref == PreferJFIF || (jfif != nil && ! conflict)
+    var head, tail []segmenter  // JFIF & extensions first, then other segments
+    for _, seg := range segments {
+        switch {
+        case pref == PreferJFIF && conflict && seg == adobe:
+                                // removed
+        case isJfifSegment( seg ) || isJfxxSegment( seg ):
+            if keepJfif {
+                head = append( head, seg )
+            }
+        default:
+            tail = append( tail, seg )
+        }
+    }
+    if keepJfif && jfif == nil && nJfxx > 0 {
+        jfif = &app0{ sType: _JFIF_BASE, major: 1, minor: 2,
+                      unit: _DOTS_PER_ARBITRARY_UNIT, hDensity: 1, vDensity: 1 }
+        head = append( []segmenter{ jfif }, head... )
+    }
+    segments = append( head, tail... )
+    if len(segments) != len(jpg.segments) {
+        changed = true
+    } else {
+        for i, seg := range segments {
+            if seg != jpg.segments[i] {
+                changed = true
+                break
+            }
+        }
+    }
+    jpg.segments = segments
+    return
+}
+
+// normalizingApps returns true if application markers will be normalized at
+// the end of parsing, in which case their order is not checked while parsing
+func (jpg *Desc)normalizingApps( ) bool {
+    return jpg.TidyUp && jpg.AppMarkers != NoAppPreference
+}
+
+// isJfifSegment returns true if seg is a JFIF APP0 segment
+func isJfifSegment( seg segmenter ) bool {
+    a0, ok := seg.(*app0)
+    return ok && ! a0.removed && a0.sType == _JFIF_BASE
+}
+
+// isJfxxSegment returns true if seg is a JFIF extension APP0 segment
+func isJfxxSegment( seg segmenter ) bool {
+    a0, ok := seg.(*app0)
+    return ok && ! a0.removed && a0.sType != _JFIF_BASE
+}
+
+// isAdobeSegment returns true if seg is a valid Adobe APP14 segment
+func isAdobeSegment( seg segmenter ) bool {
+    a, ok := seg.(*appSeg)
+    return ok && len(a.payload) >= _ADOBE_SIZE &&
+           isAppSignature( seg, 14, _ADOBE_SIGNATURE )
+}
+
+const (
+    _EXIF_SIGNATURE = "Exif\x00\x00"
+    _XMP_SIGNATURE = "http://ns.adobe.com/xap/1.0/\x00"
+    _ICC_SIGNATURE = "ICC_PROFILE\x00"
+)
+
+// true if seg is a raw APPn segment whose payload starts with signature
+func isAppSignature( seg segmenter, id uint8, signature string ) bool {
+    a, ok := seg.(*appSeg)
+    return ok && a.id == id && bytes.HasPrefix( a.payload, []byte(signature) )
+}
+
+// Flavour is the container convention given by the application markers
+type Flavour int
+const (
+    RawFlavour Flavour = iota   // raw interchange format, without JFIF, Exif,
+                                // Adobe or AVI1 application segment
+    JFIFFlavour                 // JFIF APP0, possibly with Exif or Adobe
+    ExifFlavour                 // Exif APP1 without JFIF
+    AdobeFlavour                // Adobe APP14 without JFIF or Exif
+    MotionJPEGFlavour           // AVI1 APP0 (Motion JPEG frame)
+)
+
+func (f Flavour)String( ) string {
+    switch f {
+    case RawFlavour:        return "Raw interchange"
+    case JFIFFlavour:       return "JFIF"
+    case ExifFlavour:       return "Exif"
+    case AdobeFlavour:      return "Adobe"
+    case MotionJPEGFlavour: return "Motion JPEG (AVI1)"
+    }
+    return "Unknown Flavour"
+}
+
+// Flavour classifies the container convention in use, according to the
+// application segments currently present. If several conventions are mixed,
+// AVI1 takes precedence over JFIF, which takes precedence over Exif, which
+// takes precedence over Adobe: a JFIF file with Exif metadata is a JFIF file,
+// whereas an Exif file with an Adobe segment is an Exif file.
+func (jpg *Desc)Flavour( ) Flavour {
+    var jfif, exifApp, adobe bool
+    for _, seg := range jpg.segments {
+        switch {
+        case isAppSignature( seg, 0, _AVI1_SIGNATURE ):
+            return MotionJPEGFlavour
+        case isJfifSegment( seg ):
+            jfif = true
+        case isAdobeSegment( seg ):
+            adobe = true
+        default:
+            if ed, ok := seg.(*exifData); ok && ! ed.removed {
+                exifApp = true
+            }
+        }
+    }
+    switch {
+    case jfif:
+        return JFIFFlavour
+    case exifApp:
+        return ExifFlavour
+    case adobe:
+        return AdobeFlavour
+    }
+    return RawFlavour
+}
+
 func markerAPP1discriminator( header []byte ) int {
     if bytes.Equal( header[0:6], []byte( "Exif\x00\x00" ) ) {
         return _APP1_EXIF
     }
-    if bytes.Equal( header[0:29], []byte( "http://ns.adobe.com/xap/1.0/\x00" ) ) {
+    if bytes.HasPrefix( header, []byte( _XMP_SIGNATURE ) ) ||
+       bytes.HasPrefix( header, []byte( _XMP_EXT_SIGNATURE ) ) {
         return _APP1_XMP
     }
     return -1
@@ -474,6 +1184,9 @@ func (jpg *Desc) app1( marker, sLen uint ) error {
     if sLen < 8 {
         return fmt.Errorf( "app1: Wrong APP1 (EXIF, TIFF) header (invalid length %d)\n", sLen )
     }
+    if jpg.offset + 2 + sLen > uint(len(jpg.data)) {
+        return fmt.Errorf( "app1: APP1 length %d beyond end of data\n", sLen )
+    }
     if jpg.state != _APPLICATION {
         return fmt.Errorf( "app1: Wrong sequence %s in state %s\n",
                            getJPEGmarkerName(_APP1), jpg.getJPEGStateName() )
@@ -492,3 +1205,108 @@ func (jpg *Desc) app1( marker, sLen uint ) error {
     return err
 }
 
+
+// Redaction selects the metadata removed by Redact. Values can be combined.
+type Redaction uint
+const (
+    RedactGPS Redaction = 1 << iota // remove GPS information from EXIF and
+                                    // XMP metadata (see Redact)
+    RedactAll                       // remove all application segments except
+                                    // JFIF and Adobe APP14, and all comments
+    KeepICC                         // with RedactAll, keep the ICC profile
+    KeepOrientation                 // with RedactAll, keep the EXIF orientation
+)
+
+// exifOrientation returns a minimal EXIF payload that contains only the
+// orientation tag in IFD0.
+func exifOrientation( orientation uint16 ) []byte {
+    const tiffOrientation = 0x112
+    const tiffShort = 3
+    p := make( []byte, 32 )
+    copy( p, "Exif\x00\x00MM\x00\x2a\x00\x00\x00\x08" )
+    binary.BigEndian.PutUint16( p[14:], 1 )                 // 1 entry
+    binary.BigEndian.PutUint16( p[16:], tiffOrientation )
+    binary.BigEndian.PutUint16( p[18:], tiffShort )
+    binary.BigEndian.PutUint32( p[20:], 1 )                 // count
+    binary.BigEndian.PutUint16( p[24:], orientation )
+    return p                    // padding and next IFD offset (none) are 0
+}
+
+// Redact removes privacy sensitive metadata, as selected by r. With RedactAll,
+// the JFIF and Adobe APP14 segments are kept since they are needed to decode
+// the image colors; if KeepOrientation is also given and the EXIF metadata
+// had an orientation, a minimal EXIF segment with only that orientation
+// replaces the original EXIF segment.
+//
+// With RedactGPS, the GPS IFD is removed from EXIF metadata, and the GPS
+// properties of the EXIF namespace (exif:GPSLatitude, exif:GPSLongitude...)
+// from the standard and extended XMP packets. EXIF metadata kept as raw data,
+// because it could not be parsed, is removed entirely, since its GPS IFD
+// cannot be located safely, as well as extended XMP chunks that cannot be
+// reassembled.
+//
+// It returns true if any metadata was removed.
+func (jpg *Desc)Redact( r Redaction ) (changed bool, err error) {
+    var orientation uint16
+    var segments []segmenter
+    for _, seg := range jpg.segments {
+        ed, isExif := seg.(*exifData)
+        if isExif && ed.removed {
+            continue
+        }
+        if r & RedactAll == 0 {
+            if r & RedactGPS != 0 && isAppSignature( seg, 1, _EXIF_SIGNATURE ) {
+                changed = true              // raw EXIF, not parsed
+                continue
+            }
+            if isExif && r & RedactGPS != 0 {
+                // the only possible error is an absent GPS IFD
+                if ed.desc.Remove( exif.GPS, -1 ) == nil {
+                    jpg.modified( ed )
+                    changed = true
+                }
+            }
+            segments = append( segments, seg )
+            continue
+        }
+        switch {
+        case isJfifSegment( seg ), isAdobeSegment( seg ):
+        case r & KeepICC != 0 && isAppSignature( seg, 2, _ICC_SIGNATURE ):
+        case isExif:
+            if orientation == 0 {
+                st, v, err := ed.desc.GetIfdTagValue( exif.PRIMARY, 0x112 )
+                if err == nil && st == exif.U16Slice && len(v.([]uint16)) == 1 {
+                    orientation = v.([]uint16)[0]
+                }
+            }
+            changed = true
+            continue
+        default:
+            if _, isCom := seg.(*comSeg); isCom || isAppSegment( seg ) {
+                changed = true
+                continue
+            }
+        }
+        segments = append( segments, seg )
+    }
+    jpg.segments = segments
+    if r & (RedactAll | RedactGPS) == RedactGPS {
+        xmpChanged, err := jpg.redactXMPGPS( )
+        changed = changed || xmpChanged
+        if err != nil {
+            return changed, jpgForwardError( "Redact", err )
+        }
+    }
+    if r & (RedactAll | KeepOrientation) == RedactAll | KeepOrientation &&
+       orientation != 0 {
+        payload := exifOrientation( orientation )
+        d, err := exif.Parse( payload, 0, uint(len(payload)),
+                              &exif.Control{ Unknown: exif.KeepTag } )
+        if err != nil {
+            return changed, jpgForwardError( "Redact", err )
+        }
+        index, _ := jpg.getInsertionIndex( FirstApplication )
+        jpg.insertSeg( index, &exifData{ desc: d } )
+    }
+    return
+}
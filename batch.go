@@ -0,0 +1,141 @@
+package jpeg
+
+// support for processing many files in parallel
+
+import (
+    "fmt"
+    "bytes"
+    "io"
+    "io/fs"
+    "os"
+    "path/filepath"
+    "strings"
+    "sync"
+)
+
+// IsJPEGFileName returns true if the file name has one of the usual JPEG
+// extensions (.jpg, .jpeg, .jpe, .jfif), regardless of case.
+func IsJPEGFileName( name string ) bool {
+    switch strings.ToLower( filepath.Ext( name ) ) {
+    case ".jpg", ".jpeg", ".jpe", ".jfif":
+        return true
+    }
+    return false
+}
+
+// ExpandPaths returns the list of files designated by the arguments, in the
+// argument order. Each argument can be a file, a directory or a glob pattern.
+// Directories, including those matched by a pattern, are walked recursively
+// and only the files with a JPEG extension are kept. A file given explicitly
+// is kept whatever its extension.
+func ExpandPaths( args []string ) ([]string, error) {
+    var paths []string
+    walk := func( root string ) error {
+        return filepath.WalkDir( root,
+            func( path string, d fs.DirEntry, err error ) error {
+                if err != nil {
+                    return err
+                }
+                if ! d.IsDir() && IsJPEGFileName( path ) {
+                    paths = append( paths, path )
+                }
+                return nil
+            } )
+    }
+    for _, arg := range args {
+        matches := []string{ arg }
+        if strings.ContainsAny( arg, "*?[" ) {
+            var err error
+            if matches, err = filepath.Glob( arg ); err != nil {
+                return nil, fmt.Errorf( "ExpandPaths: %v\n", err )
+            }
+            if len(matches) == 0 {
+                return nil, fmt.Errorf( "ExpandPaths: no match for %s\n", arg )
+            }
+        }
+        for _, m := range matches {
+            fi, err := os.Stat( m )
+            if err != nil {
+                return nil, fmt.Errorf( "ExpandPaths: %v\n", err )
+            }
+            if ! fi.IsDir() {
+                paths = append( paths, m )
+            } else if err = walk( m ); err != nil {
+                return nil, fmt.Errorf( "ExpandPaths: %v\n", err )
+            }
+        }
+    }
+    return paths, nil
+}
+
+// BatchStatus is the result of processing one file in a batch
+type BatchStatus int
+const (
+    BatchOK BatchStatus = iota      // file processed, nothing to report
+    BatchChanged                    // file processed and modified (fixed)
+    BatchFailed                     // file could not be processed
+)
+
+// BatchSummary counts the files processed in a batch by status
+type BatchSummary struct {
+    OK, Changed, Failed int
+}
+
+func (s BatchSummary) String( ) string {
+    return fmt.Sprintf( "%d file(s): %d ok, %d fixed, %d failed",
+                        s.OK + s.Changed + s.Failed, s.OK, s.Changed, s.Failed )
+}
+
+// Batch calls process for each path, using up to workers goroutines (at least
+// one). Each call receives the path index and its own writer, in which it
+// can write its report: the reports are copied to out in the path order, as
+// soon as all previous ones are complete, so that the output does not depend
+// on the number of workers. If out is nil, reports are discarded.
+//
+// Since calls happen concurrently, process must not modify shared state
+// without synchronization. Batch returns the number of files for each status
+// returned by process.
+func Batch( paths []string, workers int, out io.Writer,
+            process func( index int, path string, w io.Writer ) BatchStatus ) BatchSummary {
+    if workers < 1 {
+        workers = 1
+    }
+    if out == nil {
+        out = io.Discard
+    }
+    reports := make( []bytes.Buffer, len(paths) )
+    done := make( []chan BatchStatus, len(paths) )
+    for i := range done {
+        done[i] = make( chan BatchStatus, 1 )
+    }
+
+    jobs := make( chan int )
+    var wg sync.WaitGroup
+    for w := 0; w < workers; w++ {
+        wg.Add( 1 )
+        go func() {
+            defer wg.Done()
+            for i := range jobs {
+                done[i] <- process( i, paths[i], &reports[i] )
+            }
+        }()
+    }
+    go func() {
+        for i := range paths {
+            jobs <- i
+        }
+        close( jobs )
+    }()
+
+    var summary BatchSummary
+    for i := range paths {          // collect in order
+        switch <-done[i] {
+        case BatchOK:       summary.OK ++
+        case BatchChanged:  summary.Changed ++
+        default:            summary.Failed ++
+        }
+        reports[i].WriteTo( out )
+    }
+    wg.Wait()
+    return summary
+}
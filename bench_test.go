@@ -0,0 +1,162 @@
+package jpeg
+
+// support for benchmarking the stages of decoding and serializing a picture:
+// Parse (including entropy decoding), entropy decoding alone, inverse DCT,
+// color conversion and Generate.
+
+import (
+    "bytes"
+    "image"
+    stdjpeg "image/jpeg"
+    "sync"
+    "testing"
+)
+
+const (
+    benchWidth      = 640
+    benchHeight     = 480
+    benchQuality    = 85
+)
+
+var (
+    benchOnce       sync.Once
+    benchPictures   map[string][]byte
+)
+
+// benchPicture returns one of the benchmark pictures: "420" encoded by
+// image/jpeg, "444" and "progressive" (4:2:0) encoded by encodeTestPicture.
+func benchPicture( name string ) []byte {
+    benchOnce.Do( func( ) {
+        p := testPicture{ width: benchWidth, height: benchHeight, precision: 8,
+                          sampling: [][2]uint8{ {1, 1}, {1, 1}, {1, 1} },
+                          quality: benchQuality }
+        img := image.NewYCbCr( image.Rect( 0, 0, benchWidth, benchHeight ),
+                               image.YCbCrSubsampleRatio444 )
+        for y := 0; y < benchHeight; y++ {
+            for x := 0; x < benchWidth; x++ {
+                img.Y[img.YOffset( x, y )] = uint8(p.sample( 0, x, y ))
+                img.Cb[img.COffset( x, y )] = uint8(p.sample( 1, x, y ))
+                img.Cr[img.COffset( x, y )] = uint8(p.sample( 2, x, y ))
+            }
+        }
+        var buf bytes.Buffer
+        if err := stdjpeg.Encode( &buf, img,
+                                  &stdjpeg.Options{ Quality: benchQuality } ); err != nil {
+            panic( err )
+        }
+        benchPictures = map[string][]byte{ "420": buf.Bytes( ) }
+        benchPictures["444"] = encodeTestPicture( p )
+        p.sampling[0] = [2]uint8{ 2, 2 }
+        p.progressive = true
+        benchPictures["progressive"] = encodeTestPicture( p )
+    } )
+    return benchPictures[name]
+}
+
+func benchParse( b *testing.B, name string ) *Desc {
+    jpg, err := Parse( benchPicture( name ), &Control{ } )
+    if err != nil {
+        b.Fatal( err )
+    }
+    return jpg
+}
+
+func BenchmarkParse( b *testing.B ) {
+    for _, name := range []string{ "420", "444", "progressive" } {
+        b.Run( name, func( b *testing.B ) {
+            data := benchPicture( name )
+            b.SetBytes( int64(len(data)) )
+            b.ResetTimer( )
+            for i := 0; i < b.N; i++ {
+                if _, err := Parse( data, &Control{ } ); err != nil {
+                    b.Fatal( err )
+                }
+            }
+        } )
+    }
+}
+
+// BenchmarkEntropyDecode decodes again the entropy coded segment of the single
+// scan of a parsed sequential picture, in the data units already allocated.
+// The 4:2:0 picture uses the fast path (process420Ecs).
+func BenchmarkEntropyDecode( b *testing.B ) {
+    for _, name := range []string{ "420", "444" } {
+        b.Run( name, func( b *testing.B ) {
+            jpg := benchParse( b, name )
+            frm := &jpg.frames[0]
+            sc := &frm.scans[0]
+            processECS, err := jpg.getEcsFct( frm, sc )
+            if err != nil {
+                b.Fatal( err )
+            }
+            start := uint(bytes.Index( jpg.data, sc.ECSs ))
+            b.SetBytes( int64(len(sc.ECSs)) )
+            b.ResetTimer( )
+            for i := 0; i < b.N; i++ {
+                jpg.offset = start
+                if _, err := processECS( 0, sc ); err != nil {
+                    b.Fatal( err )
+                }
+            }
+        } )
+    }
+}
+
+func BenchmarkInverseDCT( b *testing.B ) {
+    jpg := benchParse( b, "444" )
+    frm := &jpg.frames[0]
+    qzs, err := jpg.quantizationTables( frm )
+    if err != nil {
+        b.Fatal( err )
+    }
+    var units []dataUnit
+    for _, row := range frm.components[0].iDCTdata {
+        for _, du := range row {
+            dequantizeUnit( &du, &qzs[0] )
+            units = append( units, du )
+        }
+    }
+    var samples [64]uint8
+    b.SetBytes( 64 )
+    b.ResetTimer( )
+    for i := 0; i < b.N; i++ {
+        inverseDCT8( &units[i % len(units)], samples[:], 8 )
+    }
+}
+
+func BenchmarkColorConversion( b *testing.B ) {
+    img, err := benchParse( b, "444" ).YCbCrImage( 0 )
+    if err != nil {
+        b.Fatal( err )
+    }
+    for _, c := range []struct{
+        name    string
+        toRGB   func( y, cb, cr uint8 ) (uint8, uint8, uint8)
+    }{ { "fixed", yccToRGB }, { "float", yccToRGBFloat } } {
+        b.Run( c.name, func( b *testing.B ) {
+            var rgb [3]uint8
+            b.SetBytes( int64(len(img.Y)) )
+            b.ResetTimer( )
+            for i := 0; i < b.N; i++ {
+                for k, y := range img.Y {
+                    rgb[0], rgb[1], rgb[2] = c.toRGB( y, img.Cb[k], img.Cr[k] )
+                }
+            }
+        } )
+    }
+}
+
+func BenchmarkGenerate( b *testing.B ) {
+    for _, name := range []string{ "420", "progressive" } {
+        b.Run( name, func( b *testing.B ) {
+            jpg := benchParse( b, name )
+            b.SetBytes( int64(len(benchPicture( name ))) )
+            b.ResetTimer( )
+            for i := 0; i < b.N; i++ {
+                if _, err := jpg.Generate( ); err != nil {
+                    b.Fatal( err )
+                }
+            }
+        } )
+    }
+}
@@ -0,0 +1,543 @@
+package jpeg
+
+// support for C2PA manifests (Content Credentials) in APP11 JUMBF boxes
+
+import (
+    "bytes"
+    "crypto/sha256"
+    "crypto/sha512"
+    "encoding/binary"
+    "fmt"
+    "hash"
+    "math"
+    "sort"
+    "strings"
+)
+
+const (
+    _JUMBF_SIGNATURE    = "JP"  // APP11 common identifier
+    _JUMBF_HEADER       = 8     // CI (2), box instance En (2), sequence Z (4)
+    _CBOR_MAX_DEPTH     = 32    // nested arrays & maps
+)
+
+// jumbfBox is a JUMBF box: either a superbox (jumb) described by its label
+// and content type, with its content boxes, or a content box with its data.
+type jumbfBox struct {
+    tBox    string          // box type
+    label   string          // superbox label, from its description box
+    cType   string          // superbox content type (first 4 bytes of UUID)
+    boxes   []jumbfBox      // superbox content boxes
+    data    []byte          // content box data
+}
+
+func parseJumbfBoxes( data []byte, depth int ) ([]jumbfBox, error) {
+    if depth > _CBOR_MAX_DEPTH {
+        return nil, fmt.Errorf( "JUMBF boxes too deeply nested\n" )
+    }
+    var boxes []jumbfBox
+    for len(data) > 0 {
+        if len(data) < 8 {
+            return nil, fmt.Errorf( "truncated JUMBF box header\n" )
+        }
+        lBox := uint64(binary.BigEndian.Uint32( data ))
+        box := jumbfBox{ tBox: string(data[4:8]) }
+        hLen := uint64(8)
+        switch lBox {
+        case 0:                 // up to the end of data
+            lBox = uint64(len(data))
+        case 1:                 // extended length
+            if len(data) < 16 {
+                return nil, fmt.Errorf( "truncated JUMBF box header\n" )
+            }
+            lBox = binary.BigEndian.Uint64( data[8:] )
+            hLen = 16
+        }
+        if lBox < hLen || lBox > uint64(len(data)) {
+            return nil, fmt.Errorf( "invalid JUMBF box %q length %d\n",
+                                    box.tBox, lBox )
+        }
+        content := data[hLen:lBox]
+        if box.tBox == "jumb" {
+            sub, err := parseJumbfBoxes( content, depth + 1 )
+            if err != nil {
+                return nil, err
+            }
+            if len(sub) == 0 || sub[0].tBox != "jumd" || len(sub[0].data) < 17 {
+                return nil, fmt.Errorf( "JUMBF superbox without description\n" )
+            }
+            desc := sub[0].data     // type UUID (16), toggles (1), label...
+            box.cType = string(desc[0:4])
+            if desc[16] & 0x02 != 0 {
+                label := desc[17:]
+                if i := bytes.IndexByte( label, 0 ); i >= 0 {
+                    label = label[:i]
+                }
+                box.label = string(label)
+            }
+            box.boxes = sub[1:]
+        } else {
+            box.data = content
+        }
+        boxes = append( boxes, box )
+        data = data[lBox:]
+    }
+    return boxes, nil
+}
+
+// first content box of type t in a superbox
+func (b *jumbfBox) content( t string ) []byte {
+    for _, c := range b.boxes {
+        if c.tBox == t {
+            return c.data
+        }
+    }
+    return nil
+}
+
+// jumbfData reassembles the JUMBF boxes split across APP11 segments, in the
+// order of their box instance number.
+func (jpg *Desc) jumbfData( ) []byte {
+    type packet struct {
+        seq     uint32
+        data    []byte
+    }
+    instances := make( map[uint16][]packet )
+    var order []uint16
+    for _, s := range jpg.segments {
+        if ! isAppSignature( s, 11, _JUMBF_SIGNATURE ) {
+            continue
+        }
+        payload := s.(*appSeg).payload
+        if len(payload) < _JUMBF_HEADER + 8 {
+            continue
+        }
+        en := binary.BigEndian.Uint16( payload[2:] )
+        if _, ok := instances[en]; ! ok {
+            order = append( order, en )
+        }
+        instances[en] = append( instances[en],
+                                packet{ binary.BigEndian.Uint32( payload[4:] ),
+                                        payload[_JUMBF_HEADER:] } )
+    }
+    var data []byte
+    for _, en := range order {
+        packets := instances[en]
+        sort.SliceStable( packets, func( i, j int ) bool {
+            return packets[i].seq < packets[j].seq
+        } )
+        for i, p := range packets {
+            if i > 0 {          // box header is repeated in each packet
+                hLen := 8
+                if binary.BigEndian.Uint32( p.data ) == 1 {
+                    hLen = 16
+                }
+                if len(p.data) < hLen {
+                    continue
+                }
+                p.data = p.data[hLen:]
+            }
+            data = append( data, p.data... )
+        }
+    }
+    return data
+}
+
+// minimal CBOR decoder, enough for C2PA claims and assertions: maps are
+// returned as map[string]interface{} (keys formatted if not text), arrays as
+// []interface{}, integers as int64 (or uint64 if too large), byte strings as
+// []byte, floats as float64. Tags are ignored.
+type cborDecoder struct {
+    data    []byte
+    pos     int
+}
+
+var errCborBreak = fmt.Errorf( "unexpected CBOR break\n" )
+
+func (d *cborDecoder) argument( info byte ) (uint64, error) {
+    var n int
+    switch {
+    case info < 24:
+        return uint64(info), nil
+    case info == 24: n = 1
+    case info == 25: n = 2
+    case info == 26: n = 4
+    case info == 27: n = 8
+    default:
+        return 0, fmt.Errorf( "invalid CBOR argument %d\n", info )
+    }
+    if d.pos + n > len(d.data) {
+        return 0, fmt.Errorf( "truncated CBOR data\n" )
+    }
+    var v uint64
+    for _, b := range d.data[d.pos:d.pos+n] {
+        v = v << 8 | uint64(b)
+    }
+    d.pos += n
+    return v, nil
+}
+
+func (d *cborDecoder) item( depth int ) (interface{}, error) {
+    if depth > _CBOR_MAX_DEPTH {
+        return nil, fmt.Errorf( "CBOR data too deeply nested\n" )
+    }
+    if d.pos >= len(d.data) {
+        return nil, fmt.Errorf( "truncated CBOR data\n" )
+    }
+    major, info := d.data[d.pos] >> 5, d.data[d.pos] & 0x1f
+    d.pos ++
+    if info == 31 {             // indefinite length or break
+        switch major {
+        case 7:
+            return nil, errCborBreak
+        case 2, 3, 4, 5:
+            return d.indefinite( major, depth )
+        }
+        return nil, fmt.Errorf( "invalid CBOR indefinite length\n" )
+    }
+    if major == 7 {
+        return d.simple( info )
+    }
+    arg, err := d.argument( info )
+    if err != nil {
+        return nil, err
+    }
+    switch major {
+    case 0:
+        if arg > math.MaxInt64 {
+            return arg, nil
+        }
+        return int64(arg), nil
+    case 1:
+        return -1 - int64(arg & math.MaxInt64), nil
+    case 2, 3:
+        if arg > uint64(len(d.data) - d.pos) {
+            return nil, fmt.Errorf( "truncated CBOR string\n" )
+        }
+        b := d.data[d.pos:d.pos+int(arg)]
+        d.pos += int(arg)
+        if major == 3 {
+            return string(b), nil
+        }
+        return b, nil
+    case 4:
+        if arg > uint64(len(d.data) - d.pos) {  // at least 1 byte per item
+            return nil, fmt.Errorf( "truncated CBOR array\n" )
+        }
+        a := make( []interface{}, arg )
+        for i := range a {
+            if a[i], err = d.item( depth + 1 ); err != nil {
+                return nil, err
+            }
+        }
+        return a, nil
+    case 5:
+        if arg > uint64(len(d.data) - d.pos) / 2 {
+            return nil, fmt.Errorf( "truncated CBOR map\n" )
+        }
+        m := make( map[string]interface{}, arg )
+        for i := uint64(0); i < arg; i++ {
+            if err = d.pair( m, depth ); err != nil {
+                return nil, err
+            }
+        }
+        return m, nil
+    }
+    return d.item( depth + 1 )  // tag (6): ignored
+}
+
+func (d *cborDecoder) pair( m map[string]interface{}, depth int ) error {
+    k, err := d.item( depth + 1 )
+    if err != nil {
+        return err
+    }
+    v, err := d.item( depth + 1 )
+    if err == errCborBreak {
+        return fmt.Errorf( "unexpected CBOR break\n" )
+    }
+    if err != nil {
+        return err
+    }
+    if s, ok := k.(string); ok {
+        m[s] = v
+    } else {
+        m[fmt.Sprintf( "%v", k )] = v
+    }
+    return nil
+}
+
+func (d *cborDecoder) indefinite( major byte, depth int ) (interface{}, error) {
+    var a []interface{}
+    var b []byte
+    m := make( map[string]interface{} )
+    for {
+        if major == 5 {
+            if err := d.pair( m, depth ); err == errCborBreak {
+                return m, nil
+            } else if err != nil {
+                return nil, err
+            }
+            continue
+        }
+        v, err := d.item( depth + 1 )
+        if err == errCborBreak {
+            break
+        }
+        if err != nil {
+            return nil, err
+        }
+        switch major {
+        case 2:
+            c, ok := v.([]byte)
+            if ! ok {
+                return nil, fmt.Errorf( "invalid CBOR byte string chunk\n" )
+            }
+            b = append( b, c... )
+        case 3:
+            c, ok := v.(string)
+            if ! ok {
+                return nil, fmt.Errorf( "invalid CBOR text string chunk\n" )
+            }
+            b = append( b, c... )
+        default:
+            a = append( a, v )
+        }
+    }
+    switch major {
+    case 2:
+        return b, nil
+    case 3:
+        return string(b), nil
+    }
+    return a, nil
+}
+
+func (d *cborDecoder) simple( info byte ) (interface{}, error) {
+    switch info {
+    case 20:
+        return false, nil
+    case 21:
+        return true, nil
+    case 22, 23:
+        return nil, nil
+    case 25, 26, 27:
+        v, err := d.argument( info )
+        if err != nil {
+            return nil, err
+        }
+        switch info {
+        case 25:
+            return halfFloat( uint16(v) ), nil
+        case 26:
+            return float64(math.Float32frombits( uint32(v) )), nil
+        }
+        return math.Float64frombits( v ), nil
+    }
+    if info < 24 {
+        return int64(info), nil
+    }
+    if info == 24 && d.pos < len(d.data) {
+        d.pos ++
+        return int64(d.data[d.pos-1]), nil
+    }
+    return nil, fmt.Errorf( "invalid CBOR simple value\n" )
+}
+
+func halfFloat( h uint16 ) float64 {
+    exp, mant := int(h >> 10) & 0x1f, float64(h & 0x3ff)
+    var v float64
+    switch exp {
+    case 0:
+        v = math.Ldexp( mant, -24 )
+    case 31:
+        if mant == 0 {
+            v = math.Inf( 1 )
+        } else {
+            v = math.NaN( )
+        }
+    default:
+        v = math.Ldexp( mant + 1024, exp - 25 )
+    }
+    if h & 0x8000 != 0 {
+        v = -v
+    }
+    return v
+}
+
+func decodeCbor( data []byte ) (interface{}, error) {
+    d := cborDecoder{ data: data }
+    v, err := d.item( 0 )
+    if err == errCborBreak {
+        err = fmt.Errorf( "unexpected CBOR break\n" )
+    }
+    return v, err
+}
+
+// C2PAReport describes the C2PA manifest store (Content Credentials)
+// embedded in APP11 segments.
+type C2PAReport struct {
+    Manifests       int     // number of manifests in the store
+    Active          string  // label of the active (last) manifest
+    ClaimGenerator  string  // claim generator of the active manifest
+    Signed          bool    // a claim signature is present (not validated)
+    HashAlgorithm   string  // data hash algorithm, empty without data hash
+    HashMatches     bool    // data hash matches the current data
+}
+
+// claimGenerator returns the claim generator from a decoded claim, either
+// claim_generator (claim v1) or claim_generator_info (claim v2).
+func claimGenerator( claim map[string]interface{} ) string {
+    if g, ok := claim["claim_generator"].(string); ok {
+        return g
+    }
+    info := claim["claim_generator_info"]
+    if a, ok := info.([]interface{}); ok && len(a) > 0 {
+        info = a[0]
+    }
+    if m, ok := info.(map[string]interface{}); ok {
+        name, _ := m["name"].(string)
+        if version, ok := m["version"].(string); ok {
+            return name + " " + version
+        }
+        return name
+    }
+    return ""
+}
+
+// dataHash computes the hash of data with the algorithm alg, excluding the
+// given byte ranges, as specified by a c2pa.hash.data assertion.
+func dataHash( data []byte, alg string, exclusions []interface{} ) ([]byte, error) {
+    var h hash.Hash
+    switch alg {
+    case "sha256":
+        h = sha256.New()
+    case "sha384":
+        h = sha512.New384()
+    case "sha512":
+        h = sha512.New()
+    default:
+        return nil, fmt.Errorf( "unsupported hash algorithm %q\n", alg )
+    }
+    type byteRange struct{ start, length int64 }
+    var ranges []byteRange
+    for _, e := range exclusions {
+        m, ok := e.(map[string]interface{})
+        if ! ok {
+            return nil, fmt.Errorf( "invalid hash exclusion\n" )
+        }
+        start, ok1 := m["start"].(int64)
+        length, ok2 := m["length"].(int64)
+        if ! ok1 || ! ok2 || start < 0 || length < 0 {
+            return nil, fmt.Errorf( "invalid hash exclusion\n" )
+        }
+        ranges = append( ranges, byteRange{ start, length } )
+    }
+    sort.Slice( ranges, func( i, j int ) bool {
+        return ranges[i].start < ranges[j].start
+    } )
+    var pos int64
+    for _, r := range ranges {
+        if r.start < pos || r.start + r.length > int64(len(data)) {
+            return nil, nil     // exclusions do not fit the current data
+        }
+        h.Write( data[pos:r.start] )
+        pos = r.start + r.length
+    }
+    h.Write( data[pos:] )
+    return h.Sum( nil ), nil
+}
+
+// C2PA detects a C2PA manifest store (Content Credentials) in APP11 JUMBF
+// boxes and returns what it contains, or nil if there is none. The active
+// manifest is the last one in the store. If it includes a data hash assertion
+// (c2pa.hash.data), the hash is computed over the data as it would be written
+// now, excluding the byte ranges given in the assertion, and compared with
+// the hash in the assertion: any change to the file outside the manifest
+// makes it fail. The claim signature is not validated.
+func (jpg *Desc) C2PA( ) (*C2PAReport, error) {
+    data := jpg.jumbfData( )
+    if data == nil {
+        return nil, nil
+    }
+    boxes, err := parseJumbfBoxes( data, 0 )
+    if err != nil {
+        return nil, jpgForwardError( "C2PA", err )
+    }
+    var store *jumbfBox
+    for i := range boxes {
+        if boxes[i].tBox == "jumb" && boxes[i].cType == "c2pa" {
+            store = &boxes[i]
+            break
+        }
+    }
+    if store == nil {
+        return nil, nil
+    }
+    cr := new(C2PAReport)
+    var active *jumbfBox
+    for i := range store.boxes {
+        if b := &store.boxes[i]; b.cType == "c2ma" || b.cType == "c2um" {
+            cr.Manifests ++
+            active = b
+        }
+    }
+    if active == nil {
+        return cr, nil
+    }
+    cr.Active = active.label
+
+    var claim map[string]interface{}
+    var hashData []byte
+    for i := range active.boxes {
+        b := &active.boxes[i]
+        switch b.cType {
+        case "c2cl":
+            v, err := decodeCbor( b.content( "cbor" ) )
+            if err != nil {
+                return cr, fmt.Errorf( "C2PA: claim: %v", err )
+            }
+            claim, _ = v.(map[string]interface{})
+        case "c2cs":
+            cr.Signed = b.content( "cbor" ) != nil
+        case "c2as":
+            for j := range b.boxes {
+                if strings.HasPrefix( b.boxes[j].label, "c2pa.hash.data" ) {
+                    hashData = b.boxes[j].content( "cbor" )
+                    break
+                }
+            }
+        }
+    }
+    if claim != nil {
+        cr.ClaimGenerator = claimGenerator( claim )
+    }
+    if hashData == nil {
+        return cr, nil
+    }
+    v, err := decodeCbor( hashData )
+    if err != nil {
+        return cr, fmt.Errorf( "C2PA: data hash: %v", err )
+    }
+    assertion, ok := v.(map[string]interface{})
+    if ! ok {
+        return cr, fmt.Errorf( "C2PA: invalid data hash assertion\n" )
+    }
+    cr.HashAlgorithm, _ = assertion["alg"].(string)
+    if cr.HashAlgorithm == "" {
+        cr.HashAlgorithm, _ = claim["alg"].(string)
+    }
+    if cr.HashAlgorithm == "" {
+        cr.HashAlgorithm = "sha256"
+    }
+    expected, _ := assertion["hash"].([]byte)
+    exclusions, _ := assertion["exclusions"].([]interface{})
+    current, err := jpg.Generate( )
+    if err != nil {
+        return cr, jpgForwardError( "C2PA", err )
+    }
+    computed, err := dataHash( current, cr.HashAlgorithm, exclusions )
+    if err != nil {
+        return cr, fmt.Errorf( "C2PA: data hash: %v", err )
+    }
+    cr.HashMatches = computed != nil && bytes.Equal( computed, expected )
+    return cr, nil
+}
@@ -0,0 +1,395 @@
+package jpeg
+
+// support for ICC profiles and XMP packets split across application segments
+
+import (
+    "bytes"
+    "crypto/md5"
+    "encoding/binary"
+    "encoding/hex"
+    "fmt"
+    "sort"
+    "strings"
+)
+
+const (
+    _XMP_EXT_SIGNATURE = "http://ns.adobe.com/xmp/extension/\x00"
+
+    // ICC chunk: signature, sequence number (1 based) and number of chunks
+    _ICC_CHUNK_HEADER  = len(_ICC_SIGNATURE) + 2
+    _MAX_ICC_CHUNK     = _MAX_APP_PAYLOAD - _ICC_CHUNK_HEADER
+    _MAX_ICC_CHUNKS    = 255
+
+    // extended XMP chunk: signature, GUID (32 hexadecimal digits), full
+    // length and offset of the chunk in the extended XMP (2 x 32 bits)
+    _XMP_GUID_SIZE     = 32
+    _XMP_EXT_HEADER    = len(_XMP_EXT_SIGNATURE) + _XMP_GUID_SIZE + 8
+    _MAX_XMP_EXT_CHUNK = _MAX_APP_PAYLOAD - _XMP_EXT_HEADER
+
+    // standard XMP packet referring to an extended XMP by its GUID
+    _XMP_EXT_REFERENCE = "<?xpacket begin=\"\ufeff\" id=\"W5M0MpCehiHzreSzNTczkc9d\"?>" +
+        "<x:xmpmeta xmlns:x=\"adobe:ns:meta/\">" +
+        "<rdf:RDF xmlns:rdf=\"http://www.w3.org/1999/02/22-rdf-syntax-ns#\">" +
+        "<rdf:Description rdf:about=\"\" " +
+        "xmlns:xmpNote=\"http://ns.adobe.com/xmp/note/\" " +
+        "xmpNote:HasExtendedXMP=\"%s\"/>" +
+        "</rdf:RDF></x:xmpmeta><?xpacket end=\"w\"?>"
+)
+
+// removeAppSignatures removes all raw APPn segments whose payload starts with
+// one of the given signatures, and returns the index of the first removed
+// segment, or -1 if none was removed.
+func (jpg *Desc)removeAppSignatures( id uint8, signatures ...string ) int {
+    first := -1
+    segments := jpg.segments[:0]
+    for i, seg := range jpg.segments {
+        matched := false
+        for _, signature := range signatures {
+            if isAppSignature( seg, id, signature ) {
+                matched = true
+                break
+            }
+        }
+        if ! matched {
+            segments = append( segments, seg )
+        } else if first == -1 {
+            first = i
+        }
+    }
+    jpg.segments = segments
+    return first
+}
+
+// insertAppChunks inserts the APPn segments made of each payload in order,
+// at the index of the segments they replace, if any, or at position.
+func (jpg *Desc)insertAppChunks( id uint, payloads [][]byte, index int,
+                                 position SegmentPosition ) (err error) {
+    if index == -1 {
+        if index, err = jpg.getInsertionIndex( position ); err != nil {
+            return
+        }
+    }
+    for i, payload := range payloads {
+        var a *appSeg
+        if a, err = newAppSeg( id, payload ); err != nil {
+            return
+        }
+        jpg.insertSeg( index + i, a )
+    }
+    return
+}
+
+// SetICCProfile replaces the ICC profile, if any, with the argument profile.
+// The profile is split in as many APP2 segments as needed, each one starting
+// with the ICC_PROFILE signature followed by the chunk sequence number and
+// the number of chunks, as specified by the ICC. The new segments replace the
+// previous profile segments, or are inserted at position if there was no
+// profile. An empty profile just removes the previous profile.
+//
+// GetICCProfile returns the profile reassembled from its chunks.
+func (jpg *Desc)SetICCProfile( profile []byte, position SegmentPosition ) error {
+    nChunks := (len(profile) + _MAX_ICC_CHUNK - 1) / _MAX_ICC_CHUNK
+    if nChunks > _MAX_ICC_CHUNKS {
+        return fmt.Errorf( "SetICCProfile: profile too large (%d bytes, max %d)\n",
+                           len(profile), _MAX_ICC_CHUNKS * _MAX_ICC_CHUNK )
+    }
+    payloads := make( [][]byte, nChunks )
+    for i := range payloads {
+        chunk := profile[i*_MAX_ICC_CHUNK:]
+        if len(chunk) > _MAX_ICC_CHUNK {
+            chunk = chunk[:_MAX_ICC_CHUNK]
+        }
+        p := make( []byte, 0, _ICC_CHUNK_HEADER + len(chunk) )
+        p = append( p, _ICC_SIGNATURE... )
+        p = append( p, byte(i+1), byte(nChunks) )
+        payloads[i] = append( p, chunk... )
+    }
+    index := jpg.removeAppSignatures( 2, _ICC_SIGNATURE )
+    if err := jpg.insertAppChunks( 2, payloads, index, position ); err != nil {
+        return jpgForwardError( "SetICCProfile", err )
+    }
+    return nil
+}
+
+// SetXMP replaces the XMP metadata, if any, with the argument packet. A packet
+// that fits in one APP1 segment is stored as the standard XMP packet. A larger
+// packet is stored as an extended XMP, as specified by the XMP specification
+// part 3: it is split in as many APP1 extension segments as needed, and the
+// standard packet only refers to it by its GUID (the MD5 digest of the
+// packet). In that case GetXMP returns the referring packet and GetExtendedXMP
+// returns the packet reassembled from its chunks.
+//
+// The new segments replace the previous XMP segments, or are inserted at
+// position if there was no XMP metadata. An empty packet just removes the
+// previous XMP metadata.
+func (jpg *Desc)SetXMP( packet []byte, position SegmentPosition ) error {
+    var payloads [][]byte
+    if len(packet) > 0 && len(_XMP_SIGNATURE) + len(packet) <= _MAX_APP_PAYLOAD {
+        payloads = append( payloads,
+                           append( []byte(_XMP_SIGNATURE), packet... ) )
+    } else if len(packet) > 0 {
+        if uint64(len(packet)) > 0xffffffff {
+            return fmt.Errorf( "SetXMP: packet too large (%d bytes)\n",
+                               len(packet) )
+        }
+        guid, chunks := extendedXMPChunks( packet )
+        payloads = append( payloads,
+                           []byte(_XMP_SIGNATURE +
+                                  fmt.Sprintf( _XMP_EXT_REFERENCE, guid )) )
+        payloads = append( payloads, chunks... )
+    }
+    index := jpg.removeAppSignatures( 1, _XMP_SIGNATURE, _XMP_EXT_SIGNATURE )
+    if err := jpg.insertAppChunks( 1, payloads, index, position ); err != nil {
+        return jpgForwardError( "SetXMP", err )
+    }
+    return nil
+}
+
+// extendedXMPChunks returns the GUID of an extended XMP packet (the MD5
+// digest of the packet) and the payloads of the APP1 extension segments it is
+// split in.
+func extendedXMPChunks( packet []byte ) (guid string, payloads [][]byte) {
+    digest := md5.Sum( packet )
+    guid = strings.ToUpper( hex.EncodeToString( digest[:] ) )
+    for offset := 0; offset < len(packet); offset += _MAX_XMP_EXT_CHUNK {
+        chunk := packet[offset:]
+        if len(chunk) > _MAX_XMP_EXT_CHUNK {
+            chunk = chunk[:_MAX_XMP_EXT_CHUNK]
+        }
+        p := make( []byte, _XMP_EXT_HEADER, _XMP_EXT_HEADER + len(chunk) )
+        copy( p, _XMP_EXT_SIGNATURE + guid )
+        binary.BigEndian.PutUint32( p[_XMP_EXT_HEADER-8:], uint32(len(packet)) )
+        binary.BigEndian.PutUint32( p[_XMP_EXT_HEADER-4:], uint32(offset) )
+        payloads = append( payloads, append( p, chunk... ) )
+    }
+    return
+}
+
+// extendedXMPGuid returns the GUID given by the xmpNote:HasExtendedXMP
+// property of the standard XMP packet, either as an attribute or as an
+// element, or an empty string if there is none.
+func extendedXMPGuid( packet []byte ) string {
+    i := bytes.Index( packet, []byte("HasExtendedXMP") )
+    if i == -1 {
+        return ""
+    }
+    guid := bytes.TrimLeft( packet[i+len("HasExtendedXMP"):], "=\"'> \t\r\n" )
+    if len(guid) < _XMP_GUID_SIZE {
+        return ""
+    }
+    guid = guid[:_XMP_GUID_SIZE]
+    if _, err := hex.DecodeString( string(guid) ); err != nil {
+        return ""
+    }
+    return string(guid)
+}
+
+// GetExtendedXMP returns the extended XMP referred to by the standard XMP
+// packet, after reassembling its chunks from the APP1 extension segments, or
+// nil if there is no extended XMP or if some of its chunks are missing.
+func (j *Desc)GetExtendedXMP( ) []byte {
+    guid := extendedXMPGuid( j.GetXMP( ) )
+    if guid == "" {
+        return nil
+    }
+    type xmpChunk struct {
+        offset  uint
+        data    []byte
+    }
+    var chunks []xmpChunk
+    var size, total uint
+    for _, s := range j.segments {
+        if ! isAppSignature( s, 1, _XMP_EXT_SIGNATURE + guid ) {
+            continue
+        }
+        payload := s.(*appSeg).payload
+        if len(payload) < _XMP_EXT_HEADER {
+            continue
+        }
+        cSize := uint(binary.BigEndian.Uint32( payload[_XMP_EXT_HEADER-8:] ))
+        offset := uint(binary.BigEndian.Uint32( payload[_XMP_EXT_HEADER-4:] ))
+        chunk := payload[_XMP_EXT_HEADER:]
+        if len(chunks) == 0 {
+            size = cSize
+        }
+        if cSize != size || offset + uint(len(chunk)) > size {
+            return nil                      // inconsistent chunks
+        }
+        chunks = append( chunks, xmpChunk{ offset, chunk } )
+        total += uint(len(chunk))
+    }
+    if size == 0 || total < size {          // before allocating size bytes
+        return nil
+    }
+    sort.Slice( chunks, func( i, k int ) bool {
+        return chunks[i].offset < chunks[k].offset
+    } )
+    var covered uint                        // chunks may overlap, not leave gaps
+    for _, c := range chunks {
+        if c.offset > covered {
+            return nil
+        }
+        if end := c.offset + uint(len(c.data)); end > covered {
+            covered = end
+        }
+    }
+    if covered < size {
+        return nil
+    }
+    xmp := make( []byte, size )
+    for _, c := range chunks {
+        copy( xmp[c.offset:], c.data )
+    }
+    return xmp
+}
+
+const _XMP_EXIF_NAMESPACE = "http://ns.adobe.com/exif/1.0/"
+
+// xmpExifPrefixes returns the namespace prefixes bound to the EXIF namespace
+// in an XMP packet.
+func xmpExifPrefixes( packet []byte ) (prefixes []string) {
+    for rest := packet; ; {
+        i := bytes.Index( rest, []byte("xmlns:") )
+        if i == -1 {
+            return
+        }
+        rest = rest[i+len("xmlns:"):]
+        eq := bytes.IndexByte( rest, '=' )
+        if eq == -1 {
+            return
+        }
+        prefix := string(bytes.TrimSpace( rest[:eq] ))
+        value := bytes.TrimLeft( rest[eq+1:], " \t\r\n" )
+        if len(value) > 0 && (value[0] == '"' || value[0] == '\'') &&
+           bytes.HasPrefix( value[1:], []byte(_XMP_EXIF_NAMESPACE + string(value[0])) ) {
+            prefixes = append( prefixes, prefix )
+        }
+    }
+}
+
+// removeXMPProperty removes from packet the property starting at i, with a
+// prefix and a name ending at end, either as an attribute, with the white
+// space preceding it, or as an element. It returns the packet, and false if
+// the property could not be removed.
+func removeXMPProperty( packet []byte, i, end int ) ([]byte, bool) {
+    if i > 0 && packet[i-1] == '<' {                // element
+        gt := bytes.IndexByte( packet[end:], '>' )
+        if gt == -1 {
+            return packet, false
+        }
+        gt += end
+        if packet[gt-1] == '/' {                    // empty element
+            return append( packet[:i-1], packet[gt+1:]... ), true
+        }
+        closing := []byte( "</" + string(packet[i:end]) + ">" )
+        c := bytes.Index( packet[gt:], closing )
+        if c == -1 {
+            return packet, false
+        }
+        return append( packet[:i-1], packet[gt+c+len(closing):]... ), true
+    }
+    start := i                                      // attribute
+    for start > 0 && bytes.IndexByte( []byte(" \t\r\n"), packet[start-1] ) != -1 {
+        start --
+    }
+    if start == i {
+        return packet, false
+    }
+    value := bytes.TrimLeft( packet[end:], " \t\r\n" )
+    if len(value) < 2 || value[0] != '=' {
+        return packet, false
+    }
+    value = bytes.TrimLeft( value[1:], " \t\r\n" )
+    if len(value) == 0 || (value[0] != '"' && value[0] != '\'') {
+        return packet, false
+    }
+    q := bytes.IndexByte( value[1:], value[0] )
+    if q == -1 {
+        return packet, false
+    }
+    stop := len(packet) - len(value) + q + 2
+    return append( packet[:start], packet[stop:]... ), true
+}
+
+// stripXMPGPS returns a copy of an XMP packet without the GPS properties of
+// the EXIF namespace (exif:GPSLatitude, exif:GPSLongitude...), either given
+// as attributes or as elements, and true if any was removed.
+func stripXMPGPS( packet []byte ) ([]byte, bool) {
+    out := append( []byte{ }, packet... )
+    changed := false
+    for _, prefix := range xmpExifPrefixes( packet ) {
+        property := []byte( prefix + ":GPS" )
+        for pos := 0; ; {
+            i := bytes.Index( out[pos:], property )
+            if i == -1 {
+                break
+            }
+            i += pos
+            end := i + len(property)
+            for end < len(out) && bytes.IndexByte( []byte(" \t\r\n=/>"), out[end] ) == -1 {
+                end ++
+            }
+            var removed bool
+            if i == 0 || ! isXMPNameChar( out[i-1] ) {
+                out, removed = removeXMPProperty( out, i, end )
+            }
+            if removed {
+                changed = true
+                pos = 0
+            } else {
+                pos = end
+            }
+        }
+    }
+    return out, changed
+}
+
+// isXMPNameChar returns true if c can be part of an XML name, in which case
+// a prefix preceded by c is only the end of a longer name
+func isXMPNameChar( c byte ) bool {
+    return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+           c == '_' || c == '-' || c == '.' || c == ':'
+}
+
+// redactXMPGPS removes the GPS properties of the EXIF namespace from the
+// standard and the extended XMP packets. Extended XMP segments that cannot be
+// reassembled are removed, since they cannot be checked. It returns true if
+// any XMP segment was modified or removed.
+func (jpg *Desc)redactXMPGPS( ) (bool, error) {
+    std := jpg.GetXMP( )
+    if std == nil {
+        return false, nil
+    }
+    ext := jpg.GetExtendedXMP( )
+    newStd, changed := stripXMPGPS( std )
+    var chunks [][]byte
+    if ext != nil {
+        newExt, extChanged := stripXMPGPS( ext )
+        if extChanged {
+            var guid string
+            guid, chunks = extendedXMPChunks( newExt )
+            newStd = bytes.Replace( newStd, []byte( extendedXMPGuid( std ) ),
+                                    []byte( guid ), -1 )
+            changed = true
+        } else {
+            _, chunks = extendedXMPChunks( ext )
+        }
+    } else {
+        for _, s := range jpg.segments {
+            if isAppSignature( s, 1, _XMP_EXT_SIGNATURE ) {
+                changed = true              // orphan or incomplete chunks
+                break
+            }
+        }
+    }
+    if ! changed {
+        return false, nil
+    }
+    payloads := append( [][]byte{ append( []byte(_XMP_SIGNATURE), newStd... ) },
+                        chunks... )
+    index := jpg.removeAppSignatures( 1, _XMP_SIGNATURE, _XMP_EXT_SIGNATURE )
+    if err := jpg.insertAppChunks( 1, payloads, index, FirstApplication ); err != nil {
+        return true, err
+    }
+    return true, nil
+}
@@ -0,0 +1,164 @@
+// jpegbrowse is an interactive segment browser. It reads one JPEG file and
+// accepts commands to list its segments, expand any of them (tables, frame
+// and scan headers, application segments), view EXIF IFDs and hexdump any
+// payload, using only the public accessors of the jpeg package.
+//
+//  usage: jpegbrowse file
+package main
+
+import (
+    "fmt"
+    "bufio"
+    "io"
+    "os"
+    "strconv"
+    "strings"
+    "github.com/jrm-1535/exif"
+    "github.com/jrm-1535/jpeg"
+)
+
+const help = `commands:
+  ls                 list segments
+  show n             expand segment n
+  hex n [width]      hexdump segment n
+  info               image and frame information
+  jfif               JFIF metadata
+  exif [ifd...]      EXIF metadata, optionally only the given IFDs
+                     (primary, thumbnail, exif, gps, iop, maker, embedded)
+  markers            all markers with their file offset
+  help               this text
+  quit               leave
+`
+
+var ifdNames = map[string]exif.IfdId{
+    "primary": exif.PRIMARY, "thumbnail": exif.THUMBNAIL, "exif": exif.EXIF,
+    "gps": exif.GPS, "iop": exif.IOP, "maker": exif.MAKER,
+    "embedded": exif.EMBEDDED,
+}
+
+type browser struct {
+    jpg         *jpeg.Desc
+    segments    []jpeg.Segment
+    out         io.Writer
+}
+
+// segment returns the segment whose index is given by arg
+func (b *browser)segment( arg string ) (jpeg.Segment, error) {
+    n, err := strconv.Atoi( arg )
+    if err != nil || n < 0 || n >= len(b.segments) {
+        return jpeg.Segment{}, fmt.Errorf( "invalid segment index %s (0 to %d)\n",
+                                           arg, len(b.segments)-1 )
+    }
+    return b.segments[n], nil
+}
+
+func (b *browser)list( ) {
+    for i, s := range b.segments {
+        fmt.Fprintf( b.out, "%3d  %-6s %8d bytes  %s\n", i,
+                     fmt.Sprintf( "0x%04x", s.Marker ), len(s.Raw()), s.Name() )
+    }
+}
+
+func (b *browser)exif( args []string ) error {
+    var ids []int
+    for _, a := range args {
+        id, ok := ifdNames[strings.ToLower( a )]
+        if ! ok {
+            return fmt.Errorf( "unknown IFD %s\n", a )
+        }
+        ids = append( ids, int(id) )
+    }
+    n, err := b.jpg.FormatMetadata( b.out, 1, ids )
+    if err == nil && n == 0 {
+        fmt.Fprintf( b.out, "no EXIF metadata\n" )
+    }
+    return err
+}
+
+// execute runs one command line. It returns false when the browser must stop.
+func (b *browser)execute( line string ) bool {
+    fields := strings.Fields( line )
+    if len(fields) == 0 {
+        return true
+    }
+    var err error
+    cmd, args := fields[0], fields[1:]
+    switch cmd {
+    case "ls", "l":
+        b.list()
+    case "show", "s":
+        var s jpeg.Segment
+        if len(args) != 1 {
+            err = fmt.Errorf( "usage: show n\n" )
+        } else if s, err = b.segment( args[0] ); err == nil {
+            _, err = s.Format( b.out )
+        }
+    case "hex", "x":
+        var s jpeg.Segment
+        width := 16
+        if len(args) == 0 || len(args) > 2 {
+            err = fmt.Errorf( "usage: hex n [width]\n" )
+        } else if s, err = b.segment( args[0] ); err == nil {
+            if len(args) == 2 {
+                width, _ = strconv.Atoi( args[1] )
+            }
+            _, err = s.Hexdump( b.out, width )
+        }
+    case "info", "i":
+        b.jpg.FormatImageInfo( b.out )
+        for i := uint(0); i < b.jpg.GetNumberOfFrames(); i++ {
+            b.jpg.FormatFrameInfo( b.out, i )
+        }
+    case "jfif":
+        var n int
+        n, err = b.jpg.FormatMetadata( b.out, 0, nil )
+        if err == nil && n == 0 {
+            fmt.Fprintf( b.out, "no JFIF metadata\n" )
+        }
+    case "exif":
+        err = b.exif( args )
+    case "markers", "m":
+        for _, m := range b.jpg.MarkerMap() {
+            fmt.Fprintf( b.out, "0x%08x  %s (length %d)\n", m.Offset, m.Name,
+                         m.Length )
+        }
+    case "help", "h", "?":
+        fmt.Fprint( b.out, help )
+    case "quit", "q", "exit":
+        return false
+    default:
+        err = fmt.Errorf( "unknown command %s, try help\n", cmd )
+    }
+    if err != nil {
+        fmt.Fprintf( b.out, "error: %v", err )
+    }
+    return true
+}
+
+func main() {
+    if len(os.Args) != 2 {
+        fmt.Fprintf( os.Stderr, "usage: jpegbrowse file\n" )
+        os.Exit(2)
+    }
+    path := os.Args[1]
+    jpg, err := jpeg.Read( path, &jpeg.Control{ } )
+    if jpg == nil {
+        fmt.Fprintf( os.Stderr, "%s: %v", path, err )
+        os.Exit(1)
+    }
+    if err != nil {
+        fmt.Fprintf( os.Stderr, "%s: warning: %v", path, err )
+    }
+    b := browser{ jpg: jpg, segments: jpg.Segments(), out: os.Stdout }
+    fmt.Printf( "%s: %d segments, type help for commands\n", path,
+                len(b.segments) )
+
+    in := bufio.NewScanner( os.Stdin )
+    for {
+        fmt.Print( "jpeg> " )
+        if ! in.Scan() || ! b.execute( in.Text() ) {
+            break
+        }
+    }
+    fmt.Println()
+}
@@ -0,0 +1,83 @@
+// jpegcmp compares two JPEG files segment by segment and, optionally, sample
+// by sample. Like cmp, it exits with status 0 if the files are equivalent, 1
+// if they differ and 2 in case of error, which makes it suitable for checks
+// in image pipelines.
+//
+//  usage: jpegcmp [-pixels] [-tolerance n] [-q] file1 file2
+package main
+
+import (
+    "fmt"
+    "flag"
+    "os"
+    "bytes"
+    "github.com/jrm-1535/jpeg"
+)
+
+func read( path string ) *jpeg.Desc {
+    jpg, err := jpeg.Read( path, &jpeg.Control{ } )
+    if err != nil {
+        fmt.Fprintf( os.Stderr, "%s: %v", path, err )
+        os.Exit(2)
+    }
+    return jpg
+}
+
+func main() {
+    pixels := flag.Bool( "pixels", false, "also compare decoded samples" )
+    tolerance := flag.Int( "tolerance", 0,
+                           "largest sample difference ignored with -pixels" )
+    quiet := flag.Bool( "q", false, "do not print differences, only set exit status" )
+    flag.Usage = func() {
+        fmt.Fprintf( flag.CommandLine.Output(),
+            "usage: jpegcmp [-pixels] [-tolerance n] [-q] file1 file2\n" )
+        flag.PrintDefaults()
+    }
+    flag.Parse()
+    if flag.NArg() != 2 {
+        flag.Usage()
+        os.Exit(2)
+    }
+    pathA, pathB := flag.Arg(0), flag.Arg(1)
+    a, b := read( pathA ), read( pathB )
+
+    differ := false
+    report := func( format string, args ...interface{} ) {
+        differ = true
+        if ! *quiet {
+            fmt.Printf( format, args... )
+        }
+    }
+
+    for _, d := range jpeg.DiffSegments( a, b ) {
+        switch d.Kind {
+        case jpeg.SegmentRemoved:
+            report( "%s #%d (%d bytes) only in %s\n", d.Name, d.IndexA, d.SizeA, pathA )
+        case jpeg.SegmentAdded:
+            report( "%s #%d (%d bytes) only in %s\n", d.Name, d.IndexB, d.SizeB, pathB )
+        case jpeg.SegmentChanged:
+            report( "%s #%d/#%d differs (%d/%d bytes)\n", d.Name, d.IndexA,
+                    d.IndexB, d.SizeA, d.SizeB )
+        }
+    }
+    if ta, tb := a.GetTrailingData(), b.GetTrailingData(); ! bytes.Equal( ta, tb ) {
+        report( "trailing data differs (%d/%d bytes)\n", len(ta), len(tb) )
+    }
+
+    if *pixels {
+        pds, err := jpeg.DiffPixels( a, b )
+        if err != nil {
+            fmt.Fprintf( os.Stderr, "jpegcmp: %v", err )
+            os.Exit(2)
+        }
+        for _, pd := range pds {
+            if pd.MaxDelta > *tolerance {
+                report( "component %d: %d of %d samples differ, max delta %d\n",
+                        pd.Component, pd.Different, pd.Samples, pd.MaxDelta )
+            }
+        }
+    }
+    if differ {
+        os.Exit(1)
+    }
+}
@@ -0,0 +1,135 @@
+// jpegextract extracts embedded resources from JPEG files: EXIF and JFIF
+// thumbnails, ICC profiles, XMP packets and the data following EOI, such as
+// MPF secondary images or motion photo videos.
+//
+//  usage: jpegextract [-o dir] [-thumbnails] [-icc] [-xmp] [-trailer] [-j n]
+//                     file|dir|pattern...
+//
+// Directories are walked recursively and files are processed in parallel.
+// If no resource is selected, all are extracted. Output files are named after
+// the input file: name.thumb0.jpg, name.icc, name.xmp, name.trailer...
+package main
+
+import (
+    "fmt"
+    "flag"
+    "io"
+    "os"
+    "path/filepath"
+    "runtime"
+    "strings"
+    "github.com/jrm-1535/jpeg"
+)
+
+type options struct {
+    dir                             string
+    thumbnails, icc, xmp, trailer   bool
+}
+
+// outputPath returns the path for a resource extracted from input
+func outputPath( input, dir, suffix string ) string {
+    base := filepath.Base( input )
+    base = strings.TrimSuffix( base, filepath.Ext( base ) )
+    if dir == "" {
+        dir = filepath.Dir( input )
+    }
+    return filepath.Join( dir, base + suffix )
+}
+
+func save( w io.Writer, input, path, what string, data []byte ) bool {
+    if err := os.WriteFile( path, data, 0644 ); err != nil {
+        fmt.Fprintf( w, "%s: %v\n", input, err )
+        return false
+    }
+    fmt.Fprintf( w, "%s: %s -> %s (%d bytes)\n", input, what, path, len(data) )
+    return true
+}
+
+// extract saves the requested resources from one file and reports them in w.
+// It returns false in case of error.
+func extract( input string, opts *options, w io.Writer ) bool {
+    jpg, err := jpeg.Read( input, &jpeg.Control{ } )
+    if jpg == nil {
+        fmt.Fprintf( w, "%s: %v", input, err )
+        return false
+    }           // else try to extract whatever was parsed before an error
+    ok := true
+    if opts.thumbnails {
+        for i, t := range jpg.ThumbnailInfo() {
+            data, err := jpg.GetThumbnailData( i )
+            if err != nil {
+                fmt.Fprintf( w, "%s: %v", input, err )
+                ok = false
+                continue
+            }
+            ext := ".rgb"
+            if t.Compression == "JPEG" {
+                ext = ".jpg"
+            }
+            path := outputPath( input, opts.dir, fmt.Sprintf( ".thumb%d%s", i, ext ) )
+            ok = save( w, input, path, t.Source + " thumbnail", data ) && ok
+        }
+    }
+    if opts.icc {
+        if profile := jpg.GetICCProfile(); profile != nil {
+            path := outputPath( input, opts.dir, ".icc" )
+            ok = save( w, input, path, "ICC profile", profile ) && ok
+        }
+    }
+    if opts.xmp {
+        if xmp := jpg.GetXMP(); xmp != nil {
+            path := outputPath( input, opts.dir, ".xmp" )
+            ok = save( w, input, path, "XMP packet", xmp ) && ok
+        }
+    }
+    if opts.trailer {
+        if trailer := jpg.GetTrailingData(); trailer != nil {
+            path := outputPath( input, opts.dir, ".trailer" )
+            ok = save( w, input, path, "trailing data", trailer ) && ok
+        }
+    }
+    return ok
+}
+
+func main() {
+    var opts options
+    flag.StringVar( &opts.dir, "o", "", "output directory (default: input file directory)" )
+    flag.BoolVar( &opts.thumbnails, "thumbnails", false, "extract thumbnails" )
+    flag.BoolVar( &opts.icc, "icc", false, "extract ICC profile" )
+    flag.BoolVar( &opts.xmp, "xmp", false, "extract XMP packet" )
+    flag.BoolVar( &opts.trailer, "trailer", false,
+                  "extract data following EOI (MPF images, motion photo...)" )
+    workers := flag.Int( "j", runtime.NumCPU(), "number of files processed in parallel" )
+    flag.Usage = func() {
+        fmt.Fprintf( flag.CommandLine.Output(),
+            "usage: jpegextract [-o dir] [-thumbnails] [-icc] [-xmp] [-trailer] [-j n] file|dir|pattern...\n" )
+        flag.PrintDefaults()
+    }
+    flag.Parse()
+    if flag.NArg() == 0 {
+        flag.Usage()
+        os.Exit(2)
+    }
+    if ! (opts.thumbnails || opts.icc || opts.xmp || opts.trailer) {
+        opts.thumbnails, opts.icc, opts.xmp, opts.trailer = true, true, true, true
+    }
+
+    paths, err := jpeg.ExpandPaths( flag.Args() )
+    if err != nil {
+        fmt.Fprintf( os.Stderr, "jpegextract: %v", err )
+        os.Exit(1)
+    }
+    summary := jpeg.Batch( paths, *workers, os.Stdout,
+        func( i int, input string, w io.Writer ) jpeg.BatchStatus {
+            if ! extract( input, &opts, w ) {
+                return jpeg.BatchFailed
+            }
+            return jpeg.BatchOK
+        } )
+    if len(paths) > 1 {
+        fmt.Printf( "%v\n", summary )
+    }
+    if summary.Failed > 0 {
+        os.Exit(1)
+    }
+}
@@ -0,0 +1,168 @@
+// jpegfix repairs common JPEG problems (restart marker sequences, DNL folding,
+// line count, missing EOI, trailing data, fill bytes, segment lengths...) by
+// parsing files with TidyUp, and prints a summary of what was changed.
+//
+//  usage: jpegfix [-dry-run | -in-place | -o output] [options] file|dir|pattern...
+//
+// Directories are walked recursively and files are processed in parallel.
+package main
+
+import (
+    "fmt"
+    "flag"
+    "os"
+    "io"
+    "path/filepath"
+    "runtime"
+    "strings"
+    "github.com/jrm-1535/jpeg"
+)
+
+// fixes implements jpeg.Logger to collect the fix notices
+type fixes struct {
+    warnings    []string
+    changes     []string
+}
+
+func (f *fixes)Warn( msg string, args ...interface{} ) {
+    f.warnings = append( f.warnings, msg )
+}
+
+func (f *fixes)Info( msg string, args ...interface{} ) {
+    f.changes = append( f.changes, msg )
+}
+
+type options struct {
+    dryRun, inPlace, verbose bool
+    output                   string
+    control                  jpeg.Control
+}
+
+// writeAtomic writes the fixed data in a temporary file in the same directory
+// and renames it to path, so that path is never left partially written.
+func writeAtomic( jpg *jpeg.Desc, path string ) error {
+    data, err := jpg.Generate()
+    if err != nil {
+        return err
+    }
+    tmp, err := os.CreateTemp( filepath.Dir( path ), ".jpegfix-*" )
+    if err != nil {
+        return err
+    }
+    defer os.Remove( tmp.Name() )   // no-op after a successful rename
+    if _, err = tmp.Write( data ); err != nil {
+        tmp.Close()
+        return err
+    }
+    if err = tmp.Close(); err != nil {
+        return err
+    }
+    mode := os.FileMode( 0644 )
+    if fi, err := os.Stat( path ); err == nil {
+        mode = fi.Mode()
+    }
+    if err = os.Chmod( tmp.Name(), mode ); err != nil {
+        return err
+    }
+    return os.Rename( tmp.Name(), path )
+}
+
+// fix processes one file and writes its summary in w. It returns the batch
+// status of the file.
+func fix( path string, opts *options, w io.Writer ) jpeg.BatchStatus {
+    var f fixes
+    ctl := opts.control
+    ctl.Logger = &f
+    jpg, err := jpeg.Read( path, &ctl )
+    if err != nil {
+        fmt.Fprintf( w, "%s: error: %s\n", path, strings.TrimSpace( err.Error() ) )
+        return jpeg.BatchFailed
+    }
+    actual, original := jpg.GetActualLengths()
+    if len(f.changes) == 0 {
+        fmt.Fprintf( w, "%s: unchanged\n", path )
+    } else {
+        fmt.Fprintf( w, "%s: %d change(s), %d -> %d bytes\n", path,
+                     len(f.changes), original, actual )
+        for _, c := range f.changes {
+            fmt.Fprintf( w, "  %s\n", c )
+        }
+    }
+    if opts.verbose {
+        for _, warning := range f.warnings {
+            fmt.Fprintf( w, "  %s\n", warning )
+        }
+    }
+    status := jpeg.BatchChanged
+    if len(f.changes) == 0 {
+        status = jpeg.BatchOK
+    }
+    if opts.dryRun || status == jpeg.BatchOK && opts.inPlace {
+        return status
+    }
+    if ! jpg.IsComplete() {
+        fmt.Fprintf( w, "%s: error: not a complete JPEG, not written\n", path )
+        return jpeg.BatchFailed
+    }
+    dest := opts.output
+    if opts.inPlace {
+        dest = path
+    }
+    if err = writeAtomic( jpg, dest ); err != nil {
+        fmt.Fprintf( w, "%s: error: %s\n", path, strings.TrimSpace( err.Error() ) )
+        return jpeg.BatchFailed
+    }
+    return status
+}
+
+func main() {
+    var opts options
+    flag.BoolVar( &opts.dryRun, "dry-run", false, "report changes without writing" )
+    flag.BoolVar( &opts.inPlace, "in-place", false, "replace input files with fixed files" )
+    flag.StringVar( &opts.output, "o", "", "output file (single input only)" )
+    flag.BoolVar( &opts.verbose, "v", false, "also print warnings" )
+    workers := flag.Int( "j", runtime.NumCPU(), "number of files processed in parallel" )
+    flag.BoolVar( &opts.control.DedupApps, "dedup", false,
+                  "remove duplicate application segments" )
+    flag.BoolVar( &opts.control.StdHuffman, "std-huffman", false,
+                  "use standard Huffman tables when DHT is missing" )
+    flag.BoolVar( &opts.control.KeepDNL, "keep-dnl", false,
+                  "keep DNL instead of folding it into SOF" )
+    flag.Usage = func() {
+        fmt.Fprintf( flag.CommandLine.Output(),
+            "usage: jpegfix [-dry-run | -in-place | -o output] [options] file|dir|pattern...\n" )
+        flag.PrintDefaults()
+    }
+    flag.Parse()
+
+    modes := 0
+    if opts.dryRun { modes++ }
+    if opts.inPlace { modes++ }
+    if opts.output != "" { modes++ }
+    if flag.NArg() == 0 || modes != 1 {
+        flag.Usage()
+        os.Exit(2)
+    }
+    paths, err := jpeg.ExpandPaths( flag.Args() )
+    if err != nil {
+        fmt.Fprintf( os.Stderr, "jpegfix: %s\n", strings.TrimSpace( err.Error() ) )
+        os.Exit(1)
+    }
+    if opts.output != "" && len(paths) != 1 {
+        fmt.Fprintf( os.Stderr, "jpegfix: -o requires a single input file\n" )
+        os.Exit(2)
+    }
+    opts.control.TidyUp = true
+    opts.control.Warn = true
+
+    summary := jpeg.Batch( paths, *workers, os.Stdout,
+        func( i int, path string, w io.Writer ) jpeg.BatchStatus {
+            return fix( path, &opts, w )
+        } )
+    if len(paths) > 1 {
+        fmt.Printf( "%v\n", summary )
+    }
+    if summary.Failed > 0 {
+        os.Exit(1)
+    }
+}
@@ -0,0 +1,253 @@
+// jpeginfo prints the structure, metadata, estimated quality and validation
+// findings of one or more JPEG files, either as text, as JSON or as a SARIF
+// log of findings.
+//
+//  usage: jpeginfo [-format text|json|sarif] [-segments] [-metadata] [-j n]
+//                  file|dir|pattern...
+//
+// Directories are walked recursively and files are processed in parallel.
+// The exit status is suitable for CI checks: 0 if all files are clean, 1 if
+// warnings were found, 2 if errors were found and 3 if a file is unreadable.
+// Invalid arguments exit with 64 (EX_USAGE), distinct from those results.
+package main
+
+import (
+    "fmt"
+    "flag"
+    "os"
+    "encoding/json"
+    "io"
+    "runtime"
+    "strings"
+    "github.com/jrm-1535/jpeg"
+)
+
+// finding is a warning or a fix notice reported while parsing a file
+type finding struct {
+    Level   string          `json:"level"`
+    Message string          `json:"message"`
+    Offset  interface{}     `json:"offset,omitempty"`
+    Marker  interface{}     `json:"marker,omitempty"`
+}
+
+// findings implements jpeg.Logger to collect all warnings and fix notices
+type findings []finding
+
+func (f *findings)add( level, msg string, args []interface{} ) {
+    fd := finding{ Level: level, Message: msg }
+    for i := 0; i+1 < len(args); i += 2 {
+        switch args[i] {
+        case "offset":  fd.Offset = args[i+1]
+        case "marker":  fd.Marker = args[i+1]
+        }
+    }
+    *f = append( *f, fd )
+}
+
+func (f *findings)Warn( msg string, args ...interface{} ) {
+    f.add( "warning", msg, args )
+}
+
+func (f *findings)Info( msg string, args ...interface{} ) {
+    f.add( "fix", msg, args )
+}
+
+type segmentInfo struct {
+    Marker  string          `json:"marker"`
+    Offset  uint            `json:"offset"`
+    Length  uint            `json:"length"`
+}
+
+// exit status, from best to worst
+const (
+    clean = iota
+    warnings
+    errors
+    unreadable
+)
+
+var statusNames = [...]string{ "clean", "warnings", "errors", "unreadable" }
+
+const usageError = 64           // EX_USAGE, as in sysexits.h
+
+type fileInfo struct {
+    File        string                  `json:"file"`
+    Status      string                  `json:"status"`
+    status      int
+    Error       string                  `json:"error,omitempty"`
+    Complete    bool                    `json:"complete"`
+    Encoding    string                  `json:"encoding,omitempty"`
+    Entropy     string                  `json:"entropy,omitempty"`
+    Mode        string                  `json:"mode,omitempty"`
+    Width       uint                    `json:"width"`
+    Height      uint                    `json:"height"`
+    Components  uint                    `json:"components"`
+    Subsampling string                  `json:"subsampling,omitempty"`
+    Frames      uint                    `json:"frames"`
+    Scans       uint                    `json:"scans"`
+    Quality     int                     `json:"quality,omitempty"`
+    HasEXIF     bool                    `json:"exif"`
+    HasICC      bool                    `json:"icc"`
+    HasXMP      bool                    `json:"xmp"`
+    Comments    []string                `json:"comments,omitempty"`
+    Thumbnails  []jpeg.ThumbnailInfo    `json:"thumbnails,omitempty"`
+    Segments    []segmentInfo           `json:"segments,omitempty"`
+    Findings    findings                `json:"findings,omitempty"`
+}
+
+// analyse parses a file and collects information about it. The returned Desc
+// is nil if the file could not be read.
+func analyse( path string ) (*fileInfo, *jpeg.Desc) {
+    info := &fileInfo{ File: path }
+    jpg, err := jpeg.Read( path, &jpeg.Control{ Warn: true,
+                                                Logger: &info.Findings } )
+    if err != nil {
+        info.Error = strings.TrimSpace( err.Error() )
+    }
+    defer func() { info.Status = statusNames[info.status] }()
+    if jpg == nil || (err != nil && len(jpg.MarkerMap()) == 0) {
+        info.status = unreadable        // not even a JPEG start of image
+        return info, nil
+    }
+    if err != nil {
+        info.status = errors
+    } else {
+        for _, f := range info.Findings {
+            if f.Level == "warning" {
+                info.status = warnings
+                break
+            }
+        }
+    }
+    info.Complete = jpg.IsComplete()
+    if enc, err := jpg.Encoding( 0 ); err == nil {
+        info.Encoding = enc.String()
+    }
+    if is, err := jpg.GetImageSummary( ); err == nil {
+        info.Entropy = is.Entropy.String()
+        info.Mode = is.Mode.String()
+        info.Width, info.Height = is.Width, is.Height
+        info.Components = is.Components
+        info.Subsampling = is.Subsampling
+        info.Frames, info.Scans = is.Frames, is.Scans
+        info.Quality = is.Quality
+        info.HasEXIF, info.HasICC, info.HasXMP = is.HasEXIF, is.HasICC, is.HasXMP
+    }
+    info.Comments = jpg.GetComments()
+    info.Thumbnails = jpg.ThumbnailInfo()
+    for _, m := range jpg.MarkerMap() {
+        info.Segments = append( info.Segments,
+                                segmentInfo{ m.Name, m.Offset, m.Length } )
+    }
+    return info, jpg
+}
+
+func printText( w io.Writer, info *fileInfo, jpg *jpeg.Desc,
+                segments, metadata bool ) {
+    fmt.Fprintf( w, "== %s\n", info.File )
+    if info.Error != "" {
+        fmt.Fprintf( w, "Error: %s\n", info.Error )
+    }
+    if jpg != nil {
+        jpg.FormatImageInfo( w )
+        for i := uint(0); i < jpg.GetNumberOfFrames(); i++ {
+            jpg.FormatFrameInfo( w, i )
+        }
+        if info.Quality != 0 {
+            fmt.Fprintf( w, "Estimated quality: %d\n", info.Quality )
+        }
+        for _, c := range info.Comments {
+            fmt.Fprintf( w, "Comment: %s\n", c )
+        }
+        for i, t := range info.Thumbnails {
+            fmt.Fprintf( w, "Thumbnail #%d: %s %s %dx%d, %d bytes\n", i,
+                         t.Source, t.Compression, t.Width, t.Height, t.Size )
+        }
+        if metadata {
+            jpg.FormatMetadata( w, 0, nil )
+            jpg.FormatMetadata( w, 1, nil )
+        }
+        if segments {
+            for _, s := range info.Segments {
+                fmt.Fprintf( w, "  0x%08x %s (length %d)\n", s.Offset,
+                             s.Marker, s.Length )
+            }
+        }
+    }
+    for _, f := range info.Findings {
+        fmt.Fprintf( w, "%s: %s\n", f.Level, f.Message )
+    }
+}
+
+func main() {
+    flag.CommandLine.Init( os.Args[0], flag.ContinueOnError )
+    format := flag.String( "format", "text", "output format: text, json or sarif" )
+    jsonOut := flag.Bool( "json", false, "same as -format json" )
+    segments := flag.Bool( "segments", false, "list all markers with offsets" )
+    metadata := flag.Bool( "metadata", false, "print JFIF and EXIF metadata" )
+    workers := flag.Int( "j", runtime.NumCPU(), "number of files processed in parallel" )
+    flag.Usage = func() {
+        fmt.Fprintf( flag.CommandLine.Output(),
+            "usage: jpeginfo [-format text|json|sarif] [-segments] [-metadata] [-j n]\n" +
+            "                file|dir|pattern...\n" )
+        flag.PrintDefaults()
+    }
+    if err := flag.CommandLine.Parse( os.Args[1:] ); err == flag.ErrHelp {
+        os.Exit( clean )
+    } else if err != nil {          // flag only exits with 2 by default
+        os.Exit( usageError )
+    }
+    if *jsonOut {
+        *format = "json"
+    }
+    if flag.NArg() == 0 ||
+       (*format != "text" && *format != "json" && *format != "sarif") {
+        flag.Usage()
+        os.Exit( usageError )
+    }
+    paths, err := jpeg.ExpandPaths( flag.Args() )
+    if err != nil {
+        fmt.Fprintf( os.Stderr, "jpeginfo: %v", err )
+        os.Exit( unreadable )
+    }
+
+    infos := make( []*fileInfo, len(paths) )
+    summary := jpeg.Batch( paths, *workers, os.Stdout,
+        func( i int, path string, w io.Writer ) jpeg.BatchStatus {
+            info, jpg := analyse( path )
+            if ! *segments {
+                info.Segments = nil
+            }
+            infos[i] = info
+            if *format == "text" {
+                printText( w, info, jpg, *segments, *metadata )
+            }
+            if info.Error != "" {
+                return jpeg.BatchFailed
+            }
+            return jpeg.BatchOK
+        } )
+
+    status := clean
+    for _, info := range infos {
+        if info.status > status {
+            status = info.status
+        }
+    }
+    if *format != "text" {
+        var v interface{} = infos
+        if *format == "sarif" {
+            v = makeSarifLog( infos )
+        }
+        enc := json.NewEncoder( os.Stdout )
+        enc.SetIndent( "", "  " )
+        if err := enc.Encode( v ); err != nil {
+            fmt.Fprintf( os.Stderr, "jpeginfo: %v\n", err )
+            status = errors
+        }
+    }
+    if len(paths) > 1 {
+        fmt.Fprintf( os.Stderr, "jpeginfo: %v\n", summary )
+    }
+    os.Exit( status )
+}
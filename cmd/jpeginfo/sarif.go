@@ -0,0 +1,98 @@
+package main
+
+// SARIF 2.1.0 output of validation findings, for code scanning tools in CI
+
+type sarifMessage struct {
+    Text    string                  `json:"text"`
+}
+
+type sarifRegion struct {
+    ByteOffset  interface{}         `json:"byteOffset"`
+}
+
+type sarifArtifact struct {
+    URI     string                  `json:"uri"`
+}
+
+type sarifPhysicalLocation struct {
+    Artifact    sarifArtifact       `json:"artifactLocation"`
+    Region      *sarifRegion        `json:"region,omitempty"`
+}
+
+type sarifLocation struct {
+    Physical    sarifPhysicalLocation   `json:"physicalLocation"`
+}
+
+type sarifResult struct {
+    RuleId      string              `json:"ruleId"`
+    Level       string              `json:"level"`
+    Message     sarifMessage        `json:"message"`
+    Locations   []sarifLocation     `json:"locations"`
+}
+
+type sarifRule struct {
+    Id          string              `json:"id"`
+    Short       sarifMessage        `json:"shortDescription"`
+}
+
+type sarifDriver struct {
+    Name        string              `json:"name"`
+    Rules       []sarifRule         `json:"rules"`
+}
+
+type sarifTool struct {
+    Driver      sarifDriver         `json:"driver"`
+}
+
+type sarifRun struct {
+    Tool        sarifTool           `json:"tool"`
+    Results     []sarifResult       `json:"results"`
+}
+
+type sarifLog struct {
+    Version     string              `json:"version"`
+    Schema      string              `json:"$schema"`
+    Runs        []sarifRun          `json:"runs"`
+}
+
+var sarifRules = []sarifRule{
+    { "jpeg-unreadable", sarifMessage{ "File cannot be read as JPEG" } },
+    { "jpeg-error", sarifMessage{ "JPEG data cannot be entirely parsed" } },
+    { "jpeg-warning", sarifMessage{ "JPEG data is inconsistent" } },
+    { "jpeg-fix", sarifMessage{ "JPEG data would be fixed by jpegfix" } },
+}
+
+// makeSarifLog converts the errors and findings of all files in one SARIF run
+func makeSarifLog( infos []*fileInfo ) *sarifLog {
+    results := []sarifResult{ }
+    add := func( info *fileInfo, rule, level, msg string, offset interface{} ) {
+        loc := sarifLocation{ sarifPhysicalLocation{
+                                    Artifact: sarifArtifact{ info.File } } }
+        if offset != nil {
+            loc.Physical.Region = &sarifRegion{ offset }
+        }
+        results = append( results, sarifResult{ rule, level, sarifMessage{ msg },
+                                                []sarifLocation{ loc } } )
+    }
+    for _, info := range infos {
+        switch {
+        case info.status == unreadable:
+            add( info, "jpeg-unreadable", "error", info.Error, nil )
+        case info.Error != "":
+            add( info, "jpeg-error", "error", info.Error, nil )
+        }
+        for _, f := range info.Findings {
+            if f.Level == "warning" {
+                add( info, "jpeg-warning", "warning", f.Message, f.Offset )
+            } else {
+                add( info, "jpeg-fix", "note", f.Message, f.Offset )
+            }
+        }
+    }
+    return &sarifLog{
+        Version: "2.1.0",
+        Schema: "https://json.schemastore.org/sarif-2.1.0.json",
+        Runs: []sarifRun{ { sarifTool{ sarifDriver{ "jpeginfo", sarifRules } },
+                            results } },
+    }
+}
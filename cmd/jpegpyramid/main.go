@@ -0,0 +1,89 @@
+// jpegpyramid produces downscaled copies of JPEG files, at 1/2, 1/4 and 1/8
+// of the original size, for tile viewers and responsive image pipelines.
+// Output files are named after the input file: name.1-2.jpg, name.1-4.jpg
+// and name.1-8.jpg.
+//
+//  usage: jpegpyramid [-o dir] [-q quality] [-j n] file|dir|pattern...
+//
+// Directories are walked recursively and files are processed in parallel.
+package main
+
+import (
+    "fmt"
+    "flag"
+    "io"
+    "os"
+    "path/filepath"
+    "runtime"
+    "strings"
+    "github.com/jrm-1535/jpeg"
+)
+
+// outputPath returns the path for a level generated from input
+func outputPath( input, dir string, factor int ) string {
+    base := filepath.Base( input )
+    base = strings.TrimSuffix( base, filepath.Ext( base ) )
+    if dir == "" {
+        dir = filepath.Dir( input )
+    }
+    return filepath.Join( dir, fmt.Sprintf( "%s.1-%d.jpg", base, factor ) )
+}
+
+// pyramid generates all levels for one file and reports them in w. It
+// returns false in case of error.
+func pyramid( input, dir string, quality int, w io.Writer ) bool {
+    jpg, err := jpeg.Read( input, &jpeg.Control{ } )
+    if err != nil {
+        fmt.Fprintf( w, "%s: %v", input, err )
+        return false
+    }
+    levels, err := jpg.MakePyramid( quality )
+    if err != nil {
+        fmt.Fprintf( w, "%s: %v", input, err )
+        return false
+    }
+    for _, l := range levels {
+        path := outputPath( input, dir, l.Factor )
+        if err = os.WriteFile( path, l.Data, 0644 ); err != nil {
+            fmt.Fprintf( w, "%s: %v\n", input, err )
+            return false
+        }
+        fmt.Fprintf( w, "%s: 1/%d %dx%d -> %s (%d bytes)\n", input, l.Factor,
+                     l.Width, l.Height, path, len(l.Data) )
+    }
+    return true
+}
+
+func main() {
+    dir := flag.String( "o", "", "output directory (default: input file directory)" )
+    quality := flag.Int( "q", 85, "JPEG quality of generated images (1 to 100)" )
+    workers := flag.Int( "j", runtime.NumCPU(), "number of files processed in parallel" )
+    flag.Usage = func() {
+        fmt.Fprintf( flag.CommandLine.Output(),
+            "usage: jpegpyramid [-o dir] [-q quality] [-j n] file|dir|pattern...\n" )
+        flag.PrintDefaults()
+    }
+    flag.Parse()
+    if flag.NArg() == 0 || *quality < 1 || *quality > 100 {
+        flag.Usage()
+        os.Exit(2)
+    }
+    paths, err := jpeg.ExpandPaths( flag.Args() )
+    if err != nil {
+        fmt.Fprintf( os.Stderr, "jpegpyramid: %v", err )
+        os.Exit(1)
+    }
+    summary := jpeg.Batch( paths, *workers, os.Stdout,
+        func( i int, input string, w io.Writer ) jpeg.BatchStatus {
+            if ! pyramid( input, *dir, *quality, w ) {
+                return jpeg.BatchFailed
+            }
+            return jpeg.BatchOK
+        } )
+    if len(paths) > 1 {
+        fmt.Printf( "%v\n", summary )
+    }
+    if summary.Failed > 0 {
+        os.Exit(1)
+    }
+}
@@ -0,0 +1,160 @@
+// jpegstrip removes metadata from JPEG files, either everything that is not
+// needed to display the image (-all, the default) or only GPS information
+// (-gps), and reports the number of bytes removed per file. With -gps, the
+// GPS IFD of EXIF metadata and the GPS properties of XMP packets are removed,
+// as well as EXIF metadata that cannot be parsed (see jpeg.Desc.Redact).
+//
+//  usage: jpegstrip [-dry-run | -in-place | -o output] [-all | -gps]
+//                   [-keep-icc] [-keep-orientation] [-j n] file|dir|pattern...
+//
+// Directories are walked recursively and files are processed in parallel.
+package main
+
+import (
+    "fmt"
+    "flag"
+    "io"
+    "os"
+    "path/filepath"
+    "runtime"
+    "strings"
+    "github.com/jrm-1535/jpeg"
+)
+
+type options struct {
+    dryRun, inPlace bool
+    output          string
+    redaction       jpeg.Redaction
+}
+
+// writeAtomic writes data in a temporary file in the same directory and
+// renames it to path, so that path is never left partially written.
+func writeAtomic( data []byte, path string ) error {
+    tmp, err := os.CreateTemp( filepath.Dir( path ), ".jpegstrip-*" )
+    if err != nil {
+        return err
+    }
+    defer os.Remove( tmp.Name() )   // no-op after a successful rename
+    if _, err = tmp.Write( data ); err != nil {
+        tmp.Close()
+        return err
+    }
+    if err = tmp.Close(); err != nil {
+        return err
+    }
+    mode := os.FileMode( 0644 )
+    if fi, err := os.Stat( path ); err == nil {
+        mode = fi.Mode()
+    }
+    if err = os.Chmod( tmp.Name(), mode ); err != nil {
+        return err
+    }
+    return os.Rename( tmp.Name(), path )
+}
+
+// strip removes metadata from one file and writes its report in w. It
+// returns the batch status of the file.
+func strip( path string, opts *options, w io.Writer ) jpeg.BatchStatus {
+    fi, err := os.Stat( path )
+    if err != nil {
+        fmt.Fprintf( w, "%s: error: %s\n", path, strings.TrimSpace( err.Error() ) )
+        return jpeg.BatchFailed
+    }
+    jpg, err := jpeg.Read( path, &jpeg.Control{ } )
+    if err != nil {
+        fmt.Fprintf( w, "%s: error: %s\n", path, strings.TrimSpace( err.Error() ) )
+        return jpeg.BatchFailed
+    }
+    changed, err := jpg.Redact( opts.redaction )
+    if err != nil {
+        fmt.Fprintf( w, "%s: error: %s\n", path, strings.TrimSpace( err.Error() ) )
+        return jpeg.BatchFailed
+    }
+    data, err := jpg.Generate()
+    if err != nil {
+        fmt.Fprintf( w, "%s: error: %s\n", path, strings.TrimSpace( err.Error() ) )
+        return jpeg.BatchFailed
+    }
+    if ! changed {
+        fmt.Fprintf( w, "%s: no metadata to remove\n", path )
+        if ! opts.inPlace && ! opts.dryRun {
+            if err = writeAtomic( data, opts.output ); err != nil {
+                fmt.Fprintf( w, "%s: error: %s\n", path, strings.TrimSpace( err.Error() ) )
+                return jpeg.BatchFailed
+            }
+        }
+        return jpeg.BatchOK
+    }
+    fmt.Fprintf( w, "%s: %d bytes removed (%d -> %d bytes)\n", path,
+                 fi.Size() - int64(len(data)), fi.Size(), len(data) )
+    if opts.dryRun {
+        return jpeg.BatchChanged
+    }
+    dest := opts.output
+    if opts.inPlace {
+        dest = path
+    }
+    if err = writeAtomic( data, dest ); err != nil {
+        fmt.Fprintf( w, "%s: error: %s\n", path, strings.TrimSpace( err.Error() ) )
+        return jpeg.BatchFailed
+    }
+    return jpeg.BatchChanged
+}
+
+func main() {
+    var opts options
+    var all, gps, keepICC, keepOrientation bool
+    flag.BoolVar( &opts.dryRun, "dry-run", false, "report removals without writing" )
+    flag.BoolVar( &opts.inPlace, "in-place", false, "replace input files with stripped files" )
+    flag.StringVar( &opts.output, "o", "", "output file (single input only)" )
+    flag.BoolVar( &all, "all", false,
+                  "remove all metadata except JFIF and Adobe (default)" )
+    flag.BoolVar( &gps, "gps", false, "remove only GPS information" )
+    flag.BoolVar( &keepICC, "keep-icc", false, "with -all, keep the ICC profile" )
+    flag.BoolVar( &keepOrientation, "keep-orientation", false,
+                  "with -all, keep the EXIF orientation" )
+    workers := flag.Int( "j", runtime.NumCPU(), "number of files processed in parallel" )
+    flag.Usage = func() {
+        fmt.Fprintf( flag.CommandLine.Output(),
+            "usage: jpegstrip [-dry-run | -in-place | -o output] [-all | -gps]\n" +
+            "                 [-keep-icc] [-keep-orientation] [-j n] file|dir|pattern...\n" )
+        flag.PrintDefaults()
+    }
+    flag.Parse()
+
+    modes := 0
+    if opts.dryRun { modes++ }
+    if opts.inPlace { modes++ }
+    if opts.output != "" { modes++ }
+    if flag.NArg() == 0 || modes != 1 || (all && gps) {
+        flag.Usage()
+        os.Exit(2)
+    }
+    if gps {
+        opts.redaction = jpeg.RedactGPS
+    } else {
+        opts.redaction = jpeg.RedactAll
+        if keepICC { opts.redaction |= jpeg.KeepICC }
+        if keepOrientation { opts.redaction |= jpeg.KeepOrientation }
+    }
+    paths, err := jpeg.ExpandPaths( flag.Args() )
+    if err != nil {
+        fmt.Fprintf( os.Stderr, "jpegstrip: %s\n", strings.TrimSpace( err.Error() ) )
+        os.Exit(1)
+    }
+    if opts.output != "" && len(paths) != 1 {
+        fmt.Fprintf( os.Stderr, "jpegstrip: -o requires a single input file\n" )
+        os.Exit(2)
+    }
+
+    summary := jpeg.Batch( paths, *workers, os.Stdout,
+        func( i int, path string, w io.Writer ) jpeg.BatchStatus {
+            return strip( path, &opts, w )
+        } )
+    if len(paths) > 1 {
+        fmt.Printf( "%v\n", summary )
+    }
+    if summary.Failed > 0 {
+        os.Exit(1)
+    }
+}
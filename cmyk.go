@@ -0,0 +1,90 @@
+package jpeg
+
+// support for 4-component (CMYK and YCCK) pictures
+
+import (
+    "fmt"
+    "image"
+    "image/color"
+)
+
+// adobeTransform returns the color transform given by the first Adobe APP14
+// segment, or -1 if there is no Adobe segment.
+func (jpg *Desc) adobeTransform( ) int {
+    for _, s := range jpg.segments {
+        if isAdobeSegment( s ) {
+            return int(s.(*appSeg).payload[_ADOBE_TRANSFORM])
+        }
+    }
+    return -1
+}
+
+// CMYKImage decodes a 4-component first frame and returns it as an
+// image.CMYK, with all components upsampled to the frame resolution.
+//
+// If an Adobe APP14 segment indicates a YCCK transform, the first 3 components
+// are converted from YCbCr to CMY. Since Adobe stores CMYK values inverted
+// (255 means no ink), all components are inverted when an Adobe segment is
+// present, so that the returned image follows the image.CMYK convention (0
+// means no ink). Without Adobe segment, components are used as they are.
+//
+// The orientation given by metadata is not applied.
+func (jpg *Desc) CMYKImage( ) (*image.CMYK, error) {
+    if len(jpg.frames) == 0 {
+        return nil, fmt.Errorf( "CMYKImage: no frame\n" )
+    }
+    if len(jpg.frames[0].components) != 4 {
+        return nil, fmt.Errorf( "CMYKImage: not a 4-component picture\n" )
+    }
+    transform := jpg.adobeTransform( )
+    if transform != -1 && transform != _ADOBE_CMYK && transform != _ADOBE_YCCK {
+        return nil, fmt.Errorf( "CMYKImage: invalid Adobe transform %d\n",
+                                transform )
+    }
+    cols, rows, planes, err := jpg.upsampledPlanes( )
+    if err != nil {
+        return nil, jpgForwardError( "CMYKImage", err )
+    }
+
+    img := image.NewCMYK( image.Rect( 0, 0, cols, rows ) )
+    for i := 0; i < cols * rows; i++ {
+        p := img.Pix[i*4:i*4+4]
+        p[0], p[1], p[2], p[3] = planes[0][i], planes[1][i],
+                                 planes[2][i], planes[3][i]
+        switch transform {
+        case _ADOBE_YCCK:   // YCbCr gives inverted CMY, cancelling inversion
+            p[0], p[1], p[2] = color.YCbCrToRGB( p[0], p[1], p[2] )
+            p[3] = 255 - p[3]
+        case _ADOBE_CMYK:
+            p[0], p[1], p[2], p[3] = 255 - p[0], 255 - p[1],
+                                     255 - p[2], 255 - p[3]
+        }
+    }
+    return img, nil
+}
+
+// CMYKToRGB converts a CMYK color (0 means no ink) to RGB
+type CMYKToRGB func( c, m, y, k uint8 ) (r, g, b uint8)
+
+// CMYKImageToRGBA decodes a 4-component first frame as CMYKImage does and
+// converts it to an image.RGBA using the conversion function convert. This
+// function can be provided by a color management system using the ICC
+// profile returned by GetICCProfile, for accurate print colors. If convert is
+// nil, the naive conversion from image/color is used, which ignores any
+// profile.
+func (jpg *Desc) CMYKImageToRGBA( convert CMYKToRGB ) (*image.RGBA, error) {
+    cmyk, err := jpg.CMYKImage( )
+    if err != nil {
+        return nil, jpgForwardError( "CMYKImageToRGBA", err )
+    }
+    if convert == nil {
+        convert = color.CMYKToRGB
+    }
+    img := image.NewRGBA( cmyk.Rect )
+    for i := 0; i < len(cmyk.Pix); i += 4 {
+        p := cmyk.Pix[i:i+4]
+        img.Pix[i], img.Pix[i+1], img.Pix[i+2] = convert( p[0], p[1], p[2], p[3] )
+        img.Pix[i+3] = 255
+    }
+    return img, nil
+}
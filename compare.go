@@ -0,0 +1,173 @@
+package jpeg
+
+// support for PSNR and SSIM image comparisons
+
+import (
+    "fmt"
+    "image"
+    "image/color"
+    "math"
+)
+
+const (
+    _SSIM_WINDOW    = 8                         // SSIM window size
+    _SSIM_STEP      = 4                         // SSIM window step
+    _SSIM_C1        = (0.01 * 255) * (0.01 * 255)
+    _SSIM_C2        = (0.03 * 255) * (0.03 * 255)
+)
+
+// ComponentComparison gives the comparison results for one component
+type ComponentComparison struct {
+    Component   int     // component index (0=Y, 1=Cb, 2=Cr)
+    MSE         float64 // mean squared error
+    PSNR        float64 // peak signal to noise ratio in dB (+Inf if equal)
+    SSIM        float64 // mean structural similarity index in [-1, 1]
+}
+
+// ImageComparison is the result of CompareImages or CompareToImage
+type ImageComparison struct {
+    Width, Height   int     // compared area, in visual orientation
+    Components      []ComponentComparison
+    PSNR            float64 // over all compared components (+Inf if equal)
+}
+
+// orientedPlanes decodes the first frame and returns its full resolution
+// planes (Y or Y, Cb, Cr) in visual orientation.
+func (jpg *Desc) orientedPlanes( ) (cols, rows int, planes [][]uint8, err error) {
+    cols, rows, planes, err = jpg.fullPlanes( )
+    if err != nil {
+        return
+    }
+    effect := jpg.visualEffect( )
+    oCols, oRows := cols, rows
+    for i, p := range planes {
+        planes[i], oCols, oRows = orientPlane( p, cols, rows, effect )
+    }
+    return oCols, oRows, planes, nil
+}
+
+// ssim returns the mean SSIM of a and b (same stride), computed over square
+// windows of _SSIM_WINDOW samples moved by _SSIM_STEP samples, with uniform
+// weights.
+func ssim( a, b []uint8, aStride, bStride, cols, rows int ) float64 {
+    win := _SSIM_WINDOW
+    if cols < win || rows < win {       // tiny image: single window
+        if cols < rows { win = cols } else { win = rows }
+    }
+    if win == 0 {
+        return 1
+    }
+    var sum float64
+    var n int
+    for r := 0; r + win <= rows; r += _SSIM_STEP {
+        for c := 0; c + win <= cols; c += _SSIM_STEP {
+            var sa, sb, saa, sbb, sab float64
+            for y := r; y < r + win; y++ {
+                for x := c; x < c + win; x++ {
+                    va, vb := float64(a[y*aStride+x]), float64(b[y*bStride+x])
+                    sa += va; sb += vb
+                    saa += va * va; sbb += vb * vb; sab += va * vb
+                }
+            }
+            k := float64(win * win)
+            ma, mb := sa / k, sb / k
+            va, vb := saa / k - ma * ma, sbb / k - mb * mb
+            cov := sab / k - ma * mb
+            sum += ((2 * ma * mb + _SSIM_C1) * (2 * cov + _SSIM_C2)) /
+                   ((ma * ma + mb * mb + _SSIM_C1) * (va + vb + _SSIM_C2))
+            n ++
+        }
+    }
+    return sum / float64(n)
+}
+
+func psnr( mse float64 ) float64 {
+    if mse == 0 {
+        return math.Inf( 1 )
+    }
+    return 10 * math.Log10( 255 * 255 / mse )
+}
+
+// comparePlanes compares the common planes of a and b over their common area
+func comparePlanes( aCols, aRows int, a [][]uint8,
+                    bCols, bRows int, b [][]uint8 ) *ImageComparison {
+    cols, rows := aCols, aRows
+    if bCols < cols { cols = bCols }
+    if bRows < rows { rows = bRows }
+    nComp := len(a)
+    if len(b) < nComp { nComp = len(b) }
+
+    ic := &ImageComparison{ Width: cols, Height: rows,
+                            Components: make( []ComponentComparison, nComp ) }
+    var total float64
+    for ci := 0; ci < nComp; ci++ {
+        var se float64
+        for r := 0; r < rows; r++ {
+            ar, br := a[ci][r*aCols:], b[ci][r*bCols:]
+            for c := 0; c < cols; c++ {
+                d := float64(ar[c]) - float64(br[c])
+                se += d * d
+            }
+        }
+        mse := se / float64(cols * rows)
+        total += mse
+        ic.Components[ci] = ComponentComparison{ ci, mse, psnr( mse ),
+                                ssim( a[ci], b[ci], aCols, bCols, cols, rows ) }
+    }
+    ic.PSNR = psnr( total / float64(nComp) )
+    return ic
+}
+
+// CompareImages decodes the first frame of a and b and compares their
+// samples, returning PSNR and SSIM for each component (Y, Cb, Cr), with
+// chroma components upsampled to the full resolution. Both images are first
+// put in their visual orientation, as given by their metadata, so that a
+// rotated copy can be compared to its original. If the sizes still differ
+// (e.g. cropping), only the common top left area is compared and returned in
+// ImageComparison. If one image is in gray scale, only the Y component is
+// compared.
+func CompareImages( a, b *Desc ) (*ImageComparison, error) {
+    aCols, aRows, aPlanes, err := a.orientedPlanes( )
+    if err != nil {
+        return nil, jpgForwardError( "CompareImages", err )
+    }
+    bCols, bRows, bPlanes, err := b.orientedPlanes( )
+    if err != nil {
+        return nil, jpgForwardError( "CompareImages", err )
+    }
+    if aCols * aRows == 0 || bCols * bRows == 0 {
+        return nil, fmt.Errorf( "CompareImages: empty image\n" )
+    }
+    return comparePlanes( aCols, aRows, aPlanes, bCols, bRows, bPlanes ), nil
+}
+
+// CompareToImage compares the first frame of jpg with a reference image, as
+// CompareImages does. The reference image is converted to Y, Cb, Cr with the
+// JFIF conversion from image/color and is assumed to be in visual
+// orientation, whereas the orientation given by jpg metadata is applied.
+func (jpg *Desc) CompareToImage( ref image.Image ) (*ImageComparison, error) {
+    cols, rows, planes, err := jpg.orientedPlanes( )
+    if err != nil {
+        return nil, jpgForwardError( "CompareToImage", err )
+    }
+    b := ref.Bounds()
+    rCols, rRows := b.Dx(), b.Dy()
+    if cols * rows == 0 || rCols * rRows == 0 {
+        return nil, fmt.Errorf( "CompareToImage: empty image\n" )
+    }
+    rPlanes := make( [][]uint8, len(planes) )
+    for i := range rPlanes {
+        rPlanes[i] = make( []uint8, rCols * rRows )
+    }
+    for y := 0; y < rRows; y++ {
+        for x := 0; x < rCols; x++ {
+            i := y * rCols + x
+            c := color.YCbCrModel.Convert( ref.At( b.Min.X + x, b.Min.Y + y ) ).(color.YCbCr)
+            rPlanes[0][i] = c.Y
+            if len(rPlanes) == 3 {
+                rPlanes[1][i], rPlanes[2][i] = c.Cb, c.Cr
+            }
+        }
+    }
+    return comparePlanes( cols, rows, planes, rCols, rRows, rPlanes ), nil
+}
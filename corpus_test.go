@@ -0,0 +1,287 @@
+package jpeg
+
+// support for checking the test corpus in testdata: valid pictures are decoded
+// and compared with image/jpeg, and serialized back unchanged, while damaged
+// pictures must be parsed, with TidyUp if needed, and fixed. Gray and 4:2:0 pictures are encoded
+// by image/jpeg, other subsampling modes, progressive and CMYK pictures by
+// encodeTestPicture, as image/jpeg cannot encode them. Damaged pictures are
+// made from the 4:2:0 picture. 12-bit pictures, which image/jpeg does not
+// decode, are checked by TestExtendedPrecision. The corpus is made again with:
+//
+//  go test -run TestCorpus -update
+
+import (
+    "bytes"
+    "flag"
+    "image"
+    "image/color"
+    stdjpeg "image/jpeg"
+    "os"
+    "path/filepath"
+    "testing"
+)
+
+var update = flag.Bool( "update", false, "make the test corpus in testdata again" )
+
+const (
+    corpusWidth     = 45            // not a multiple of any MCU size
+    corpusHeight    = 29
+    corpusQuality   = 75
+)
+
+// stdCorpusImage returns the pattern of encodeTestPicture as an image, either
+// gray or YCbCr, to be encoded by image/jpeg.
+func stdCorpusImage( gray bool ) image.Image {
+    p := testPicture{ width: corpusWidth, height: corpusHeight, precision: 8,
+                      sampling: [][2]uint8{ {1, 1}, {1, 1}, {1, 1} } }
+    r := image.Rect( 0, 0, corpusWidth, corpusHeight )
+    if gray {
+        img := image.NewGray( r )
+        for y := 0; y < corpusHeight; y++ {
+            for x := 0; x < corpusWidth; x++ {
+                img.SetGray( x, y, color.Gray{ uint8(p.sample( 0, x, y )) } )
+            }
+        }
+        return img
+    }
+    img := image.NewYCbCr( r, image.YCbCrSubsampleRatio444 )
+    for y := 0; y < corpusHeight; y++ {
+        for x := 0; x < corpusWidth; x++ {
+            img.Y[img.YOffset( x, y )] = uint8(p.sample( 0, x, y ))
+            img.Cb[img.COffset( x, y )] = uint8(p.sample( 1, x, y ))
+            img.Cr[img.COffset( x, y )] = uint8(p.sample( 2, x, y ))
+        }
+    }
+    return img
+}
+
+func stdCorpusPicture( gray bool ) []byte {
+    var b bytes.Buffer
+    err := stdjpeg.Encode( &b, stdCorpusImage( gray ),
+                           &stdjpeg.Options{ Quality: corpusQuality } )
+    if err != nil {
+        panic( err )
+    }
+    return b.Bytes( )
+}
+
+func testCorpusPicture( sampling [][2]uint8, restart int, progressive bool ) []byte {
+    return encodeTestPicture( testPicture{
+                    width: corpusWidth, height: corpusHeight, precision: 8,
+                    sampling: sampling, restart: restart, progressive: progressive,
+                    adobe: len(sampling) == 4, quality: corpusQuality } )
+}
+
+// ecsMiddle returns the offset of the middle of the first entropy coded
+// segment in data.
+func ecsMiddle( data []byte ) int {
+    sos := bytes.Index( data, []byte{ 0xff, 0xda } )
+    return (sos + len(data)) / 2
+}
+
+var (
+    s111 = [2]uint8{ 1, 1 }
+    s211 = [2]uint8{ 2, 1 }
+    s121 = [2]uint8{ 1, 2 }
+    s221 = [2]uint8{ 2, 2 }
+    s411 = [2]uint8{ 4, 1 }
+    s421 = [2]uint8{ 4, 2 }
+)
+
+var corpus = []struct{
+    name        string
+    make        func( ) []byte
+    damaged     bool            // not expected to decode as image/jpeg does
+    parseErr    bool            // damaged picture not parsed unless TidyUp
+}{
+    { "gray.jpg", func( ) []byte { return stdCorpusPicture( true ) }, false, false },
+    { "ycc420.jpg", func( ) []byte { return stdCorpusPicture( false ) }, false, false },
+    { "ycc444.jpg", func( ) []byte {
+        return testCorpusPicture( [][2]uint8{ s111, s111, s111 }, 0, false )
+      }, false, false },
+    { "ycc422.jpg", func( ) []byte {
+        return testCorpusPicture( [][2]uint8{ s211, s111, s111 }, 0, false )
+      }, false, false },
+    { "ycc440.jpg", func( ) []byte {
+        return testCorpusPicture( [][2]uint8{ s121, s111, s111 }, 0, false )
+      }, false, false },
+    { "ycc411.jpg", func( ) []byte {
+        return testCorpusPicture( [][2]uint8{ s411, s111, s111 }, 0, false )
+      }, false, false },
+    { "ycc410.jpg", func( ) []byte {
+        return testCorpusPicture( [][2]uint8{ s421, s111, s111 }, 0, false )
+      }, false, false },
+    { "restart.jpg", func( ) []byte {
+        return testCorpusPicture( [][2]uint8{ s221, s111, s111 }, 2, false )
+      }, false, false },
+    // image/jpeg counts restart intervals in interleaved MCUs even in
+    // non-interleaved scans: no restart interval in progressive pictures
+    { "progressive.jpg", func( ) []byte {
+        return testCorpusPicture( [][2]uint8{ s221, s111, s111 }, 0, true )
+      }, false, false },
+    { "cmyk.jpg", func( ) []byte {
+        return testCorpusPicture( [][2]uint8{ s111, s111, s111, s111 }, 0, false )
+      }, false, false },
+    { "gray12.jpg", func( ) []byte {
+        return encodeTestPicture( extendedPictures[0].picture )
+      }, false, false },
+    { "ycc12.jpg", func( ) []byte {
+        return encodeTestPicture( extendedPictures[1].picture )
+      }, false, false },
+    { "truncated.jpg", func( ) []byte {
+        data := stdCorpusPicture( false )
+        return data[:ecsMiddle( data )]
+      }, true, false },
+    { "corrupted.jpg", func( ) []byte {
+        data := stdCorpusPicture( false )
+        m := ecsMiddle( data )
+        copy( data[m:m+16], bytes.Repeat( []byte{ 0x5a }, 16 ) )
+        return data
+      }, true, false },
+    { "badlength.jpg", func( ) []byte {
+        data := stdCorpusPicture( false )
+        dqt := bytes.Index( data, []byte{ 0xff, 0xdb } )
+        data[dqt+3] += 7                // DQT length beyond the segment end
+        return data
+      }, true, true },
+}
+
+// maxSampleDiff returns the largest difference between the samples of a and
+// b, which must have the same type and bounds, or -1 if they do not.
+func maxSampleDiff( a, b image.Image ) int {
+    if a.Bounds( ) != b.Bounds( ) {
+        return -1
+    }
+    var max int
+    diff := func( x, y uint8 ) {
+        d := int(x) - int(y)
+        if d < 0 { d = -d }
+        if d > max { max = d }
+    }
+    r := a.Bounds( )
+    for y := r.Min.Y; y < r.Max.Y; y++ {
+        for x := r.Min.X; x < r.Max.X; x++ {
+            switch a := a.(type) {
+            case *image.Gray:
+                g, ok := b.(*image.Gray)
+                if ! ok { return -1 }
+                diff( a.GrayAt( x, y ).Y, g.GrayAt( x, y ).Y )
+            case *image.YCbCr:
+                c, ok := b.(*image.YCbCr)
+                if ! ok || a.SubsampleRatio != c.SubsampleRatio { return -1 }
+                ca, cc := a.YCbCrAt( x, y ), c.YCbCrAt( x, y )
+                diff( ca.Y, cc.Y ); diff( ca.Cb, cc.Cb ); diff( ca.Cr, cc.Cr )
+            case *image.CMYK:
+                c, ok := b.(*image.CMYK)
+                if ! ok { return -1 }
+                ca, cc := a.CMYKAt( x, y ), c.CMYKAt( x, y )
+                diff( ca.C, cc.C ); diff( ca.M, cc.M ); diff( ca.Y, cc.Y ); diff( ca.K, cc.K )
+            default:
+                return -1
+            }
+        }
+    }
+    return max
+}
+
+// decodedImage returns the first frame of jpg, without color conversion, as
+// image/jpeg decodes it.
+func decodedImage( jpg *Desc ) (image.Image, error) {
+    switch len(jpg.frames[0].components) {
+    case 1:
+        samples, err := jpg.MakeFrameRawPicture( 0 )
+        if err != nil {
+            return nil, err
+        }
+        frm := &jpg.frames[0]
+        return &image.Gray{ Pix: *samples[0],
+                            Stride: int(frm.components[0].nUnitsRow << 3),
+                            Rect: image.Rect( 0, 0, int(frm.nSamplesLine( )),
+                                              int(frm.actualLines( )) ) }, nil
+    case 4:
+        return jpg.CMYKImage( )
+    }
+    return jpg.YCbCrImage( 0 )
+}
+
+// checkTidyUp checks that damaged data is parsed and decoded with TidyUp, and
+// that the fixed picture is parsed without TidyUp.
+func checkTidyUp( t *testing.T, data []byte ) {
+    jpg, err := Parse( data, &Control{ TidyUp: true, Logger: discardLogger{ } } )
+    if err != nil {
+        t.Fatalf( "Parse with TidyUp: %v", err )
+    }
+    if _, err = jpg.RGBA( ); err != nil {
+        t.Errorf( "RGBA: %v", err )
+    }
+    fixed, err := jpg.Generate( )
+    if err != nil {
+        t.Fatalf( "Generate: %v", err )
+    }
+    if _, err = Parse( fixed, &Control{ } ); err != nil {
+        t.Errorf( "Parse of fixed picture: %v", err )
+    }
+}
+
+// discardLogger silences the fix notices
+type discardLogger struct{ }
+
+func (discardLogger) Warn( msg string, args ...interface{} ) { }
+func (discardLogger) Info( msg string, args ...interface{} ) { }
+
+// checkGenerate checks that jpg, parsed from data, is serialized unchanged
+func checkGenerate( t *testing.T, jpg *Desc, data []byte ) {
+    if out, err := jpg.Generate( ); err != nil {
+        t.Errorf( "Generate: %v", err )
+    } else if ! bytes.Equal( out, data ) {
+        t.Errorf( "Generate: serialized picture differs from the original" )
+    }
+}
+
+// largest difference with image/jpeg, due to the different inverse DCTs
+const maxCorpusDiff = 2
+
+func TestCorpus( t *testing.T ) {
+    for _, c := range corpus {
+        path := filepath.Join( "testdata", c.name )
+        if *update {
+            if err := os.WriteFile( path, c.make( ), 0644 ); err != nil {
+                t.Fatal( err )
+            }
+        }
+        data, err := os.ReadFile( path )
+        if err != nil {
+            t.Fatal( err )
+        }
+        t.Run( c.name, func( t *testing.T ) {
+            jpg, err := Parse( data, &Control{ } )
+            if c.damaged {
+                if (err != nil) != c.parseErr {
+                    t.Fatalf( "Parse: unexpected result %v", err )
+                }
+                checkTidyUp( t, data )
+                return
+            }
+            if err != nil {
+                t.Fatalf( "Parse: %v", err )
+            }
+            if jpg.frames[0].resolution.samplePrecision == 12 {
+                checkGenerate( t, jpg, data )   // see TestExtendedPrecision
+                return
+            }
+            ref, err := stdjpeg.Decode( bytes.NewReader( data ) )
+            if err != nil {
+                t.Fatalf( "image/jpeg: %v", err )
+            }
+            img, err := decodedImage( jpg )
+            if err != nil {
+                t.Fatalf( "decoding: %v", err )
+            }
+            if d := maxSampleDiff( ref, img ); d < 0 || d > maxCorpusDiff {
+                t.Errorf( "samples differ from image/jpeg (%d, max %d)",
+                          d, maxCorpusDiff )
+            }
+            checkGenerate( t, jpg, data )
+        } )
+    }
+}
@@ -4,38 +4,70 @@ import (
     "fmt"
     "os"
     "bufio"
+    "runtime"
     "math"
+    "image"
 )
 
-// must be called after all scans have been processed for a single frame
+// must be called after all scans have been processed for a single frame.
+// Data units are dequantized in place, only once. It fails if they have been
+// released after being streamed (see Control.StreamRows).
 func (jpg *Desc) dequantize( f *frame ) error {
-
-    for _, cmp := range f.components {          // for each component in frame
-
-        if cmp.QS > 3 { return fmt.Errorf("dequantize: table out of range\n") }
-        qz := jpg.qdefs[cmp.QS]
-
+    if f.streamed {
+        return fmt.Errorf( "dequantize: frame %d samples have been streamed\n", f.id )
+    }
+    if f.dequantized {
+        return nil
+    }
+    qzs, err := jpg.quantizationTables( f )
+    if err != nil {
+        return err
+    }
+    for ci, cmp := range f.components {         // for each component in frame
         for _, duRow := range cmp.iDCTdata {    // for each DU row
             for k := 0; k < len(duRow); k++ {   // for each data unit
-                du := &duRow[k]                 // pointer to du (du is updated)
-                var uZZdu dataUnit              // temporary storage
-                i := 0
-                for r := 0; r < 8; r ++ {       // dequantize DCT coefficients
-                    for c := 0; c < 8; c ++ {
-                        j := zigZagRowCol[r][c]
-                        uZZdu[i] = du[j] * int16(qz.values[j])
-                        i ++
-                    }
-                }
-                for i := 0; i < 64; i++ {       // unZigZag Coefficients
-                    du[i] = uZZdu[i]
-                }
+                dequantizeUnit( &duRow[k], &qzs[ci] )   // du is updated
             }
         }
     }
+    f.dequantized = true
     return nil
 }
 
+// quantizationTables returns the quantization table of each frame component
+func (jpg *Desc) quantizationTables( f *frame ) ([]qdef, error) {
+    qzs := make( []qdef, len(f.components) )
+    for ci, cmp := range f.components {
+        if cmp.QS > 3 { return nil, fmt.Errorf("dequantize: table out of range\n") }
+        qzs[ci] = jpg.qdefs[cmp.QS]
+        if cmp.qt != nil {                      // table used by its scans
+            qzs[ci] = *cmp.qt
+        }
+    }
+    return qzs, nil
+}
+
+// dequantizeUnit dequantizes the zig-zag coefficients in du with the table qz
+// and stores them back in natural order.
+func dequantizeUnit( du *dataUnit, qz *qdef ) {
+    var uZZdu dataUnit                  // temporary storage
+    i := 0
+    for r := 0; r < 8; r ++ {           // dequantize DCT coefficients
+        for c := 0; c < 8; c ++ {
+            j := zigZagRowCol[r][c]
+            v := int32(du[j]) * int32(qz.values[j])
+            if v > math.MaxInt16 {      // 16-bit tables may overflow
+                v = math.MaxInt16
+            } else if v < math.MinInt16 {
+                v = math.MinInt16
+            }
+            uZZdu[i] = int16(v)
+            i ++
+        }
+    }
+    *du = uZZdu                         // unZigZag Coefficients
+}
+
 const(
     is0 = 2.828427124746190097603377448419
     is1 = 3.923141121612921796504728944537
@@ -260,12 +292,27 @@ func (jpg *Desc) GetImageOrientation( ) (*Orientation, error) {
 }
 
 func make8BitComponentArrays( cmps []component ) [](*[]uint8) {
+    return transformComponents( cmps, nil, nil )
+}
+
+// transformComponents returns the samples of each component, taken from buf
+// if it is large enough for all components, or allocated otherwise. If qzs is
+// not nil, each data unit is first dequantized in place with the table of its
+// component, just before its inverse DCT.
+func transformComponents( cmps []component, buf []uint8,
+                          qzs []qdef ) [](*[]uint8) {
 
     cArrays := make( [](*[]uint8), len( cmps ) ) // one flat []byte per component
 
     for cdi, cmp := range cmps {    // for each component
         rows := cmp.iDCTdata        // 1 slice of same length rows of dataUnits
-        cArray := make ( []uint8, uint(len(rows)) * cmp.nUnitsRow * 64 )
+        size := uint(len(rows)) * cmp.nUnitsRow * 64
+        var cArray []uint8
+        if uint(len(buf)) >= size { // inverseDCT8 sets all samples
+            cArray, buf = buf[:size:size], buf[size:]
+        } else {
+            cArray = make ( []uint8, size )
+        }
         cArrays[cdi] = &cArray
 
 //fmt.Printf( "Cmp %d, nRows %d nUnitsRow %d sample array size %d\n",
@@ -278,6 +325,9 @@ func make8BitComponentArrays( cmps []component ) [](*[]uint8) {
                 index := start + (uint(c) << 3)    // du origin in row samples
 //fmt.Printf("Accessing DU %d in row %d start index %d end @ %d stride %d\n",
 //            c, r, index, len(cArray), stride)
+                if qzs != nil {
+                    dequantizeUnit( &row[c], &qzs[cdi] )
+                }
                 inverseDCT8( &row[c], cArray[index:], stride )
             }
         }
@@ -293,22 +343,159 @@ func (jpg *Desc) MakeFrameRawPicture( frame int ) ([](*[]uint8), error) {
     if len( frm.scans ) < 1 {
         return nil, fmt.Errorf( "SaveRawPicture: no scan available for picture\n" )
     }
-    if err := jpg.dequantize( frm ); err != nil {
-        return nil, err
+    if frm.streamed {
+        return nil, fmt.Errorf( "MakeFrameRawPicture: frame %d samples have been streamed\n", frame )
+    }
+    var qzs []qdef      // dequantize in the same pass as the inverse DCT
+    if ! frm.dequantized {
+        var err error
+        if qzs, err = jpg.quantizationTables( frm ); err != nil {
+            return nil, err
+        }
     }
 
     cmps := frm.components
     var samples [](*[]uint8)
     switch frm.resolution.samplePrecision {
     case 8:
-        samples = make8BitComponentArrays( cmps )
+        samples = transformComponents( cmps, nil, qzs )
+        frm.dequantized = true
     default:
         return nil, fmt.Errorf( "MakeFrameRawPicture: extended precision is not supported\n" )
     }
     return samples, nil
 }
 
+// subsampleRatio returns the image subsample ratio corresponding to the
+// sampling factors of a 3 component frame, if any.
+func subsampleRatio( cmps []component ) (image.YCbCrSubsampleRatio, bool) {
+    y, cb, cr := &cmps[0], &cmps[1], &cmps[2]
+    if cb.HSF != cr.HSF || cb.VSF != cr.VSF ||
+       y.HSF % cb.HSF != 0 || y.VSF % cb.VSF != 0 {
+        return 0, false
+    }
+    switch [2]uint8{ y.HSF / cb.HSF, y.VSF / cb.VSF } {
+    case [2]uint8{ 1, 1 }:  return image.YCbCrSubsampleRatio444, true
+    case [2]uint8{ 2, 1 }:  return image.YCbCrSubsampleRatio422, true
+    case [2]uint8{ 2, 2 }:  return image.YCbCrSubsampleRatio420, true
+    case [2]uint8{ 1, 2 }:  return image.YCbCrSubsampleRatio440, true
+    case [2]uint8{ 4, 1 }:  return image.YCbCrSubsampleRatio411, true
+    case [2]uint8{ 4, 2 }:  return image.YCbCrSubsampleRatio410, true
+    }
+    return 0, false
+}
+
+// fitPlane returns the plane, extended with zero samples if shorter than n
+// (missing rows in scan).
+func fitPlane( plane []uint8, n int ) []uint8 {
+    if len(plane) >= n {
+        return plane
+    }
+    p := make( []uint8, n )
+    copy( p, plane )
+    return p
+}
+
+// YCbCrImage returns the decoded samples of a YCbCr frame wrapped in an
+// *image.YCbCr, without color conversion. The planes returned by
+// MakeFrameRawPicture are used as they are, with their padding to a whole
+// number of data units, and the image bounds are the frame dimensions. The
+// sampling factors must correspond to one of the subsample ratios defined by
+// the image package, with identical factors for Cb and Cr. Orientation
+// metadata is not applied.
+func (jpg *Desc) YCbCrImage( frame int ) (*image.YCbCr, error) {
+    if frame >= len(jpg.frames) || frame < 0 {
+        return nil, fmt.Errorf( "YCbCrImage: frame %d is absent\n", frame )
+    }
+    frm := &jpg.frames[frame]
+    if len(frm.components) != 3 {
+        return nil, fmt.Errorf( "YCbCrImage: not a YCbCr picture\n" )
+    }
+    ratio, ok := subsampleRatio( frm.components )
+    if ! ok {
+        return nil, fmt.Errorf( "YCbCrImage: unsupported sampling factors\n" )
+    }
+    samples, err := jpg.MakeFrameRawPicture( frame )
+    if err != nil {
+        return nil, jpgForwardError( "YCbCrImage", err )
+    }
+    cols, rows := int(frm.nSamplesLine()), int(frm.actualLines())
+    img := &image.YCbCr{ SubsampleRatio: ratio,
+                         YStride: int(frm.components[0].nUnitsRow << 3),
+                         CStride: int(frm.components[1].nUnitsRow << 3),
+                         Rect: image.Rect( 0, 0, cols, rows ) }
+    if cols == 0 || rows == 0 {
+        return img, nil
+    }
+    cCols, cRows := frm.componentSize( &frm.components[1] )
+    img.Y = fitPlane( *samples[0], (rows - 1) * img.YStride + cols )
+    img.Cb = fitPlane( *samples[1], (cRows - 1) * img.CStride + cCols )
+    img.Cr = fitPlane( *samples[2], (cRows - 1) * img.CStride + cCols )
+    return img, nil
+}
+
 const writeBufferSize = 1048576
+
+// fixed-point YCbCr to RGB conversion (JFIF), with 16 fractional bits:
+//  R = Y + 1.402 (Cr-128)
+//  G = Y - 0.34414 (Cb-128) - 0.71414 (Cr-128)
+//  B = Y + 1.772 (Cb-128)
+const (
+    _YCC_SCALE_BITS = 16
+    _YCC_ONE_HALF   = 1 << (_YCC_SCALE_BITS - 1)
+    _CLAMP_OFFSET   = 256       // clamp table index offset for negative values
+)
+
+func yccFix( x float64 ) int32 {
+    return int32( x * (1 << _YCC_SCALE_BITS) + 0.5 )
+}
+
+type yccTables struct {
+    crR, cbB        [256]int32  // Cr and Cb contributions to R and B
+    crG, cbG        [256]int32  // Cr and Cb contributions to G (scaled)
+    clamp           [3*256]uint8 // clamp[v + _CLAMP_OFFSET] = v in [0-255]
+}
+
+var ycc = makeYccTables( )
+
+func makeYccTables( ) *yccTables {
+    t := new( yccTables )
+    for i := int32(0); i < 256; i++ {
+        x := i - 128
+        t.crR[i] = (yccFix( 1.402 ) * x + _YCC_ONE_HALF) >> _YCC_SCALE_BITS
+        t.cbB[i] = (yccFix( 1.772 ) * x + _YCC_ONE_HALF) >> _YCC_SCALE_BITS
+        t.crG[i] = -yccFix( 0.71414 ) * x
+        t.cbG[i] = -yccFix( 0.34414 ) * x + _YCC_ONE_HALF
+    }
+    for i := range t.clamp {
+        v := i - _CLAMP_OFFSET
+        if v < 0 { v = 0 } else if v > 255 { v = 255 }
+        t.clamp[i] = uint8(v)
+    }
+    return t
+}
+
+// yccToRGB converts one YCbCr sample to RGB in fixed-point arithmetic
+func yccToRGB( y, cb, cr uint8 ) (uint8, uint8, uint8) {
+    yv := int32(y) + _CLAMP_OFFSET
+    return ycc.clamp[yv + ycc.crR[cr]],
+           ycc.clamp[yv + ((ycc.cbG[cb] + ycc.crG[cr]) >> _YCC_SCALE_BITS)],
+           ycc.clamp[yv + ycc.cbB[cb]]
+}
+
+// yccToRGBFloat converts one YCbCr sample to RGB in floating point arithmetic
+// (Control.FloatColor), for verification.
+func yccToRGBFloat( y, cb, cr uint8 ) (uint8, uint8, uint8) {
+    Ys, Cbs, Crs := float32(y), float32(cb), float32(cr)
+
+    rs := int( 0.5 + Ys + 1.402*(Crs-128.0) )
+    if rs < 0 { rs = 0 } else if rs > 255 { rs = 255 }
+    gs := int( 0.5 + Ys - 0.34414*(Cbs-128.0) - 0.71414*(Crs-128.0) )
+    if gs < 0 { gs = 0 } else if gs > 255 { gs = 255 }
+    bs := int( 0.5 + Ys + 1.772*(Cbs-128.0) )
+    if bs < 0 { bs = 0 } else if bs > 255 { bs = 255 }
+    return uint8(rs), uint8(gs), uint8(bs)
+}
 func (jpg *Desc) writeBW( f *os.File, frm *frame, samples [](*[]uint8),
                           o *Orientation ) (nc, nr uint, n int, err error) {
 
@@ -320,8 +507,10 @@ func (jpg *Desc) writeBW( f *os.File, frm *frame, samples [](*[]uint8),
 
     Y := samples[0]
     yStride := frm.components[0].nUnitsRow << 3
+    p := jpg.newProgress( len(*Y), int(yStride) )
 
     writePixel := func( r, c uint ) {
+        p.advance( 1 )
         if c < cols && r < rows {
             ys  := (*Y)[r*yStride+c]
             cbw.Write( []byte{ ys, ys, ys } )
@@ -413,21 +602,56 @@ func (jpg *Desc) writeBW( f *os.File, frm *frame, samples [](*[]uint8),
     return
 }
 
+// orientedSource returns the function giving the source row and column in a
+// picture of cols x rows samples, for the destination row and column in the
+// picture oriented according to o, as well as the number of destination
+// columns and rows.
+func orientedSource( o *Orientation, cols, rows uint ) (src func( dr, dc uint ) (uint, uint),
+                                                         nc, nr uint) {
+    nc, nr = cols, rows
+    if o != nil && (o.Row0 == Right || o.Row0 == Left) {
+        nc, nr = rows, cols
+    }
+    lc, lr := cols - 1, rows - 1    // last column, last row
+    switch {
+    case o == nil || (o.Row0 == Top && o.Col0 == Left):     // default orientation
+        src = func( dr, dc uint ) (uint, uint) { return dr, dc }
+    case o.Row0 == Top && o.Col0 == Right:
+        src = func( dr, dc uint ) (uint, uint) { return dr, lc - dc }
+    case o.Row0 == Right && o.Col0 == Top:                  // rotation +90
+        src = func( dr, dc uint ) (uint, uint) { return lr - dc, dr }
+    case o.Row0 == Right && o.Col0 == Bottom:
+        src = func( dr, dc uint ) (uint, uint) { return lr - dc, lc - dr }
+    case o.Row0 == Bottom && o.Col0 == Left:
+        src = func( dr, dc uint ) (uint, uint) { return lr - dr, dc }
+    case o.Row0 == Bottom && o.Col0 == Right:
+        src = func( dr, dc uint ) (uint, uint) { return lr - dr, lc - dc }
+    case o.Row0 == Left && o.Col0 == Top:
+        src = func( dr, dc uint ) (uint, uint) { return dc, dr }
+    case o.Row0 == Left && o.Col0 == Bottom:                // rotation -90
+        src = func( dr, dc uint ) (uint, uint) { return dc, lc - dr }
+    default:                        // inconsistent orientation: ignored
+        nc, nr = cols, rows
+        src = func( dr, dc uint ) (uint, uint) { return dr, dc }
+    }
+    return
+}
+
 func (jpg *Desc) writeYCbCr( f *os.File, frm *frame, samples [](*[]uint8),
                              o *Orientation ) (nc, nr uint, n int, err error) {
     if len(samples) != 3 {  // contract: writeYCbCr requires 3 components
         panic("writeYCbCr: incorrect number of components\n")
     }
 
-    bw := bufio.NewWriterSize( f, writeBufferSize )
-    cbw := newCumulativeWriter( bw )
-
     cols  := uint(frm.resolution.nSamplesLine)
     rows  := uint(frm.resolution.nLines)
+    if rows > uint(len(*samples[0])) / (frm.components[0].nUnitsRow << 3) {
+        rows = uint(len(*samples[0])) / (frm.components[0].nUnitsRow << 3)
+    }
 
-    Y := samples[0]
-    Cb := samples[1]
-    Cr := samples[2]
+    Y := *samples[0]
+    Cb := *samples[1]
+    Cr := *samples[2]
 
     cmps := frm.components
     yHSF := uint(cmps[0].HSF)
@@ -441,117 +665,50 @@ func (jpg *Desc) writeYCbCr( f *os.File, frm *frame, samples [](*[]uint8),
     CrHSF := uint(cmps[2].HSF)
     CrVSF := uint(cmps[2].VSF)
     CrStride := cmps[2].nUnitsRow << 3
-//fmt.Printf("yHSF %d, CbHSF %d, CrHSF %d, yVSF %d, CbVSF %d, CrVSF %d, CbStride %d, CrStride %d\n",
-//            yHSF, CbHSF, CrHSF, yVSF, CbVSF, CrVSF, CbStride, CrStride )
 
     // Assuming yHSF and yVSF are >= Cb/Cr H/V SF:
-    // Destination is an array of packed RGB values, indexed by i [0..len[Y]]
+    // Destination is an array of packed RGB values, nr rows of nc pixels.
     // Sources are Y, Cb and Cr arrays indexed such that given source row r and
     // col c, sample Ys is directly y[j] whereas samples Cbs and Crs are given
     // by C{b/r}s = Cb[((*rC{b/r}VSF)/yVSF)*CbStride + (c*C{b/r}HSF)/yHSF])
     // Depending on actual orientation (Row0 and Col0) the source row r and col
-    // c are calculated from the destination index i
+    // c are calculated from the destination row and column.
+    var src func( dr, dc uint ) (uint, uint)
+    src, nc, nr = orientedSource( o, cols, rows )
 
-    writePixel := func( r, c uint ) {
-        if c < cols && r < rows {
-            Ys  := float32((*Y)[r*yStride+c])
-            Cbs := float32((*Cb)[((r*CbVSF)/yVSF)*CbStride + (c*CbHSF)/yHSF])
-            Crs := float32((*Cr)[((r*CrVSF)/yVSF)*CrStride + (c*CrHSF)/yHSF])
-
-            rs := int( 0.5 + Ys + 1.402*(Crs-128.0) )
-            if rs < 0 { rs = 0 } else if rs > 255 { rs = 255 }
-            gs := int( 0.5 + Ys - 0.34414*(Cbs-128.0) - 0.71414*(Crs-128.0) )
-            if gs < 0 { gs = 0 } else if gs > 255 { gs = 255 }
-            bs := int( 0.5 + Ys + 1.772*(Cbs-128.0) )
-            if bs < 0 { bs = 0 } else if bs > 255 { bs = 255 }
-
-            cbw.Write( []byte{ byte(rs), byte(gs), byte(bs) } )
-        }
+    toRGB := yccToRGB
+    if jpg.FloatColor {
+        toRGB = yccToRGBFloat
     }
-
-    var writeOrientedRGB func()
-    nSamples  := uint(len(*Y))
-    sampleRows := nSamples / yStride
-
-    if o == nil || (o.Row0 == Top && o.Col0 == Left ) { // default orientation
-        nr = rows
-        nc = cols
-        writeOrientedRGB = func() {
-            for i := uint(0); i < nSamples; i++ {
-                writePixel( i / yStride, i % yStride )
-            }
-        }
-    } else if o.Row0 == Top && o.Col0 == Right {
-        nr = rows
-        nc = cols
-        cStart := yStride - 1
-        writeOrientedRGB = func () {
-            for i := uint(0);i < nSamples; i++ {
-                writePixel( i / yStride, cStart - (i % yStride) )
-            }
-        }
-    } else if o.Row0 == Right && o.Col0 == Top {        // rotation +90
-        nr = cols
-        nc = rows
-        rStart := sampleRows - 1
-        writeOrientedRGB = func () {
-            for i := uint(0);i < nSamples; i++ {
-                writePixel( rStart - (i % sampleRows), i / sampleRows )
-            }
-        }
-    } else if o.Row0 == Right && o.Col0 == Bottom {
-        nr = cols
-        nc = rows
-        rStart := sampleRows - 1
-        cStart := yStride - 1
-        writeOrientedRGB = func () {
-            for i := uint(0);i < nSamples; i++ {
-                writePixel( rStart - i % sampleRows, cStart - (i / sampleRows) )
-            }
-        }
-    } else if o.Row0 == Bottom && o.Col0 == Left {
-        nr = rows
-        nc = cols
-        rStart := sampleRows - 1
-        writeOrientedRGB = func () {
-            for i := uint(0);i < nSamples; i++ {
-                writePixel( rStart - (i / yStride), i % yStride )
-            }
-        }
-    } else if o.Row0 == Bottom && o.Col0 == Right {
-        nr = rows
-        nc = cols
-        rStart := sampleRows - 1
-        cStart := yStride - 1
-        writeOrientedRGB = func () {
-            for i := uint(0);i < nSamples; i++ {
-                writePixel( rStart - (i / yStride), cStart - (i % yStride) )
-            }
-        }
-    } else if o.Row0 == Left && o.Col0 == Top {
-        nr = cols
-        nc = rows
-        writeOrientedRGB = func() {
-            for i := uint(0); i < nSamples; i++ {
-                writePixel( i % sampleRows, i / sampleRows )
-            }
-        }
-    } else if o.Row0 == Left && o.Col0 == Bottom {      // rotation -90
-        nr = cols
-        nc = rows
-        cStart := yStride - 1
-        writeOrientedRGB = func() {
-            for i := uint(0); i < nSamples; i++ {
-                writePixel( i % sampleRows, cStart - (i / sampleRows) )
+    rgb := make( []byte, nr * nc * 3 )
+    convertRows := func( dr0, dr1 uint, done chan<- uint ) {
+        for dr := dr0; dr < dr1; dr++ {
+            pixel := rgb[dr * nc * 3:]
+            for dc := uint(0); dc < nc; dc++ {
+                r, c := src( dr, dc )
+                pixel[0], pixel[1], pixel[2] = toRGB( Y[r*yStride+c],
+                    Cb[((r*CbVSF)/yVSF)*CbStride + (c*CbHSF)/yHSF],
+                    Cr[((r*CrVSF)/yVSF)*CrStride + (c*CrHSF)/yHSF] )
+                pixel = pixel[3:]
             }
+            done <- nc
         }
     }
-//    start := time.Now()
-    writeOrientedRGB()
-//    stop := time.Now()
-//    fmt.Printf( "writeYCbCr: elapsed time %d\n", stop.Sub(start) )
-    n, err = cbw.result()
-    err = bw.Flush()
+
+    // destination rows are converted in bands, one goroutine per band
+    nBands := uint(runtime.GOMAXPROCS( 0 ))
+    if nBands > nr {
+        nBands = nr
+    }
+    done := make( chan uint, nr )
+    for b := uint(0); b < nBands; b++ {
+        go convertRows( (b * nr) / nBands, ((b + 1) * nr) / nBands, done )
+    }
+    p := jpg.newProgress( int(nr * nc), int(nc) )
+    for i := uint(0); i < nr; i++ {
+        p.advance( int(<-done) )
+    }
+    n, err = f.Write( rgb )
     return
 }
 
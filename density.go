@@ -0,0 +1,118 @@
+package jpeg
+
+// support for physical print size, from JFIF density or EXIF resolution
+
+import (
+    "fmt"
+    "math"
+    "github.com/jrm-1535/exif"
+)
+
+const (
+    _TIFF_X_RESOLUTION      = 0x11a     // in IFD0 (PRIMARY)
+    _TIFF_Y_RESOLUTION      = 0x11b
+    _TIFF_RESOLUTION_UNIT   = 0x128
+
+    _TIFF_UNIT_INCH         = 2         // default
+    _TIFF_UNIT_CM           = 3
+
+    _MM_PER_INCH            = 25.4
+)
+
+// dpi returns the JFIF density in dots per inch, or false if the density is
+// not given in absolute units
+func (a0 *app0) dpi( ) (x, y float64, ok bool) {
+    x, y = float64(a0.hDensity), float64(a0.vDensity)
+    switch a0.unit {
+    case _DOTS_PER_INCH:
+    case _DOTS_PER_CM:
+        x, y = x * 2.54, y * 2.54
+    default:
+        return 0, 0, false
+    }
+    return x, y, x != 0 && y != 0
+}
+
+// dpi returns the EXIF resolution in dots per inch, or false if it is not
+// available or not given in absolute units
+func (ed *exifData) dpi( ) (x, y float64, ok bool) {
+    xr := ed.ifdRational( exif.PRIMARY, _TIFF_X_RESOLUTION )
+    yr := ed.ifdRational( exif.PRIMARY, _TIFF_Y_RESOLUTION )
+    x, y = xr.Float64(), yr.Float64()
+    if x == 0 || y == 0 {
+        return 0, 0, false
+    }
+    switch ed.ifdUint( exif.PRIMARY, _TIFF_RESOLUTION_UNIT ) {
+    case 0, _TIFF_UNIT_INCH:            // missing unit defaults to inch
+    case _TIFF_UNIT_CM:
+        x, y = x * 2.54, y * 2.54
+    default:
+        return 0, 0, false
+    }
+    return x, y, true
+}
+
+// densities returns the JFIF and EXIF densities in dots per inch, if they
+// are available in absolute units
+func (jpg *Desc) densities( ) (jfifDpi, exifDpi [2]float64, hasJfif, hasExif bool) {
+    for _, seg := range jpg.segments {
+        switch s := seg.(type) {
+        case *app0:
+            if ! hasJfif && isJfifSegment( s ) {
+                jfifDpi[0], jfifDpi[1], hasJfif = s.dpi( )
+            }
+        case *exifData:
+            if ! hasExif && ! s.removed {
+                exifDpi[0], exifDpi[1], hasExif = s.dpi( )
+            }
+        }
+    }
+    return
+}
+
+// checkDensity warns if JFIF density and EXIF resolution are both given in
+// absolute units and do not match (rounded to the nearest dpi).
+func (jpg *Desc) checkDensity( ) {
+    jfifDpi, exifDpi, hasJfif, hasExif := jpg.densities( )
+    if ! hasJfif || ! hasExif {
+        return
+    }
+    if math.Round( jfifDpi[0] ) != math.Round( exifDpi[0] ) ||
+       math.Round( jfifDpi[1] ) != math.Round( exifDpi[1] ) {
+        jpg.warning( "  WARNING: JFIF density %.0fx%.0f dpi does not match " +
+                     "EXIF resolution %.0fx%.0f dpi\n",
+                     jfifDpi[0], jfifDpi[1], exifDpi[0], exifDpi[1] )
+    }
+}
+
+// PrintSize is the physical size of the image, as returned by PhysicalSize
+type PrintSize struct {
+    Width, Height   float64     // size in millimetres
+    XDPI, YDPI      float64     // effective resolution in dots per inch
+    Source          string      // "EXIF" or "JFIF"
+}
+
+// PhysicalSize returns the print size of the image in millimetres, from the
+// EXIF resolution if it is given in inches or centimetres, or from the JFIF
+// density otherwise. An error is returned if the image has no frame or if
+// neither gives an absolute density (e.g. JFIF aspect ratio only). When both
+// are present and disagree, Parse reports a warning.
+func (jpg *Desc) PhysicalSize( ) (*PrintSize, error) {
+    if len(jpg.frames) == 0 {
+        return nil, fmt.Errorf( "PhysicalSize: no frame in image\n" )
+    }
+    frm := &jpg.frames[0]
+    ps := new( PrintSize )
+    jfifDpi, exifDpi, hasJfif, hasExif := jpg.densities( )
+    switch {
+    case hasExif:
+        ps.XDPI, ps.YDPI, ps.Source = exifDpi[0], exifDpi[1], "EXIF"
+    case hasJfif:
+        ps.XDPI, ps.YDPI, ps.Source = jfifDpi[0], jfifDpi[1], "JFIF"
+    default:
+        return nil, fmt.Errorf( "PhysicalSize: no absolute density in metadata\n" )
+    }
+    ps.Width = float64(frm.nSamplesLine()) * _MM_PER_INCH / ps.XDPI
+    ps.Height = float64(frm.actualLines()) * _MM_PER_INCH / ps.YDPI
+    return ps, nil
+}
@@ -0,0 +1,163 @@
+package jpeg
+
+// support for structural and pixel comparisons
+
+import (
+    "fmt"
+    "bytes"
+)
+
+// DiffKind indicates how a segment differs between two JPEG descriptions
+type DiffKind int
+const (
+    SegmentRemoved DiffKind = iota  // segment only in the first description
+    SegmentAdded                    // segment only in the second description
+    SegmentChanged                  // same marker at the same place, other data
+)
+
+func (k DiffKind) String( ) string {
+    switch k {
+    case SegmentRemoved:    return "removed"
+    case SegmentAdded:      return "added"
+    case SegmentChanged:    return "changed"
+    }
+    return fmt.Sprintf( "DiffKind(%d)", int(k) )
+}
+
+// SegmentDiff describes one segment level difference between two JPEG
+// descriptions a and b.
+type SegmentDiff struct {
+    Kind            DiffKind
+    Marker          uint        // segment marker
+    Name            string      // segment marker name
+    IndexA, IndexB  int         // segment index in a and b, -1 if absent
+    SizeA, SizeB    int         // raw segment size in a and b, 0 if absent
+}
+
+// DiffSegments compares the segments of a and b, as returned by Segments,
+// and returns the list of differences in segment order. Segments are first
+// aligned on their markers (longest common subsequence), then aligned
+// segments are compared byte for byte, including entropy coded data for
+// scans. An empty list means that both descriptions serialize the same
+// segments, although trailing data or fill bytes may still differ.
+func DiffSegments( a, b *Desc ) []SegmentDiff {
+    sa, sb := a.Segments(), b.Segments()
+    na, nb := len(sa), len(sb)
+
+    // lcs[i][j] is the length of the longest common marker subsequence
+    // of sa[i:] and sb[j:]
+    lcs := make( [][]int, na+1 )
+    for i := range lcs {
+        lcs[i] = make( []int, nb+1 )
+    }
+    for i := na-1; i >= 0; i-- {
+        for j := nb-1; j >= 0; j-- {
+            if sa[i].Marker == sb[j].Marker {
+                lcs[i][j] = lcs[i+1][j+1] + 1
+            } else if lcs[i+1][j] >= lcs[i][j+1] {
+                lcs[i][j] = lcs[i+1][j]
+            } else {
+                lcs[i][j] = lcs[i][j+1]
+            }
+        }
+    }
+
+    var diffs []SegmentDiff
+    removed := func( i int ) {
+        diffs = append( diffs, SegmentDiff{ SegmentRemoved, sa[i].Marker,
+                                            sa[i].Name(), i, -1,
+                                            len(sa[i].Raw()), 0 } )
+    }
+    added := func( j int ) {
+        diffs = append( diffs, SegmentDiff{ SegmentAdded, sb[j].Marker,
+                                            sb[j].Name(), -1, j,
+                                            0, len(sb[j].Raw()) } )
+    }
+    i, j := 0, 0
+    for i < na && j < nb {
+        switch {
+        case sa[i].Marker == sb[j].Marker:
+            ra, rb := sa[i].Raw(), sb[j].Raw()
+            if ! bytes.Equal( ra, rb ) {
+                diffs = append( diffs, SegmentDiff{ SegmentChanged, sa[i].Marker,
+                                                    sa[i].Name(), i, j,
+                                                    len(ra), len(rb) } )
+            }
+            i++; j++
+        case lcs[i+1][j] >= lcs[i][j+1]:
+            removed( i ); i++
+        default:
+            added( j ); j++
+        }
+    }
+    for ; i < na; i++ {
+        removed( i )
+    }
+    for ; j < nb; j++ {
+        added( j )
+    }
+    return diffs
+}
+
+// PixelDiff summarizes the sample differences for one component
+type PixelDiff struct {
+    Component   int     // component index in frame
+    Samples     int     // number of samples compared
+    Different   int     // number of samples that differ
+    MaxDelta    int     // largest absolute sample difference
+}
+
+// DiffPixels decodes the first frame of a and b and compares their component
+// samples, without color conversion. Both images must have the same size,
+// number of components and sampling factors. Samples are compared over whole
+// data units, including the padding beyond the image edges.
+func DiffPixels( a, b *Desc ) ([]PixelDiff, error) {
+    if len(a.frames) == 0 || len(b.frames) == 0 {
+        return nil, fmt.Errorf( "DiffPixels: no frame to compare\n" )
+    }
+    fa, fb := &a.frames[0], &b.frames[0]
+    if fa.nSamplesLine() != fb.nSamplesLine() ||
+       fa.actualLines() != fb.actualLines() {
+        return nil, fmt.Errorf( "DiffPixels: different image sizes\n" )
+    }
+    if len(fa.components) != len(fb.components) {
+        return nil, fmt.Errorf( "DiffPixels: different number of components\n" )
+    }
+    for i, ca := range fa.components {
+        cb := fb.components[i]
+        if ca.HSF != cb.HSF || ca.VSF != cb.VSF {
+            return nil, fmt.Errorf( "DiffPixels: different sampling factors for component %d\n", i )
+        }
+    }
+    pa, err := a.MakeFrameRawPicture( 0 )
+    if err != nil {
+        return nil, jpgForwardError( "DiffPixels", err )
+    }
+    pb, err := b.MakeFrameRawPicture( 0 )
+    if err != nil {
+        return nil, jpgForwardError( "DiffPixels", err )
+    }
+
+    diffs := make( []PixelDiff, len(pa) )
+    for c := range pa {
+        sa, sb := *pa[c], *pb[c]
+        if len(sa) != len(sb) {
+            return nil, fmt.Errorf( "DiffPixels: different component %d sizes\n", c )
+        }
+        pd := &diffs[c]
+        pd.Component, pd.Samples = c, len(sa)
+        for k, v := range sa {
+            d := int(v) - int(sb[k])
+            if d < 0 {
+                d = -d
+            }
+            if d != 0 {
+                pd.Different ++
+                if d > pd.MaxDelta {
+                    pd.MaxDelta = d
+                }
+            }
+        }
+    }
+    return diffs, nil
+}
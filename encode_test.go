@@ -0,0 +1,344 @@
+package jpeg
+
+// support for encoding test pictures with any sampling factors, sample
+// precision, restart interval and progressive scans, since image/jpeg only
+// encodes 8-bit baseline gray and 4:2:0 YCbCr pictures
+
+import (
+    "bytes"
+    "encoding/binary"
+    "math"
+    "math/bits"
+)
+
+// testPicture describes a picture made by encodeTestPicture. Its samples
+// follow a smooth pattern, different for each component and never clipped.
+type testPicture struct {
+    width, height   int
+    precision       int         // 8 or 12 bits (16-bit DQT with 12 bits)
+    sampling        [][2]uint8  // HSF and VSF of each component
+    restart         int         // restart interval in MCUs, 0 if none
+    progressive     bool        // one DC scan then one AC scan per component
+    adobe           bool        // Adobe APP14 segment without transform
+    quality         int         // IJG quality [1-100]
+}
+
+func (p *testPicture) maxFactors( ) (hMax, vMax int) {
+    for _, s := range p.sampling {
+        if int(s[0]) > hMax { hMax = int(s[0]) }
+        if int(s[1]) > vMax { vMax = int(s[1]) }
+    }
+    return
+}
+
+// componentSize returns the number of samples per line and of lines of
+// component ci.
+func (p *testPicture) componentSize( ci int ) (cols, rows int) {
+    hMax, vMax := p.maxFactors( )
+    cols = (p.width * int(p.sampling[ci][0]) + hMax - 1) / hMax
+    rows = (p.height * int(p.sampling[ci][1]) + vMax - 1) / vMax
+    return
+}
+
+// sample returns the sample of component ci at (col, row), in component
+// resolution.
+func (p *testPicture) sample( ci, col, row int ) int {
+    hMax, vMax := p.maxFactors( )
+    x := float64(col * hMax / int(p.sampling[ci][0]))
+    y := float64(row * vMax / int(p.sampling[ci][1]))
+    max := float64(int(1) << p.precision - 1)
+    v := 0.5 + 0.4 * math.Sin( x / 6 + float64(ci) ) * math.Cos( y / 5 - float64(ci) )
+    return int( math.Round( max * v ) )
+}
+
+// quantization returns the IJG luminance table scaled for the picture
+// quality, in natural order.
+func (p *testPicture) quantization( ) (qt [64]int) {
+    scale := 200 - 2 * p.quality
+    if p.quality < 50 {
+        scale = 5000 / p.quality
+    }
+    maxQ := 255
+    if p.precision == 12 {
+        maxQ = 32767
+    }
+    for i, v := range stdLuminanceQt {
+        q := (int(v) * scale + 50) / 100
+        if q < 1 { q = 1 } else if q > maxQ { q = maxQ }
+        qt[i] = q
+    }
+    return
+}
+
+// Huffman tables covering all symbols allowed by the sample precision: DC
+// sizes with 5-bit codes, and AC EOB, ZRL and run/size symbols with 8-bit
+// codes. Codes are the symbol indexes in the tables.
+func (p *testPicture) huffmanSymbols( ) (dc, ac []uint8) {
+    maxDC, maxAC := uint8(11), uint8(10)
+    if p.precision == 12 {
+        maxDC, maxAC = 15, 14
+    }
+    for s := uint8(0); s <= maxDC; s++ {
+        dc = append( dc, s )
+    }
+    ac = append( ac, 0x00, 0xf0 )
+    for r := uint8(0); r < 16; r++ {
+        for s := uint8(1); s <= maxAC; s++ {
+            ac = append( ac, r << 4 | s )
+        }
+    }
+    return
+}
+
+type testBitWriter struct {
+    out             *bytes.Buffer
+    acc             byte
+    n               uint
+}
+
+func (w *testBitWriter) put( v uint32, n uint ) {
+    for i := int(n) - 1; i >= 0; i-- {
+        w.acc = w.acc << 1 | byte(v >> uint(i)) & 1
+        w.n ++
+        if w.n == 8 {
+            w.out.WriteByte( w.acc )
+            if w.acc == 0xff {
+                w.out.WriteByte( 0 )
+            }
+            w.acc, w.n = 0, 0
+        }
+    }
+}
+
+func (w *testBitWriter) flush( ) {
+    for w.n != 0 {
+        w.put( 1, 1 )
+    }
+}
+
+// magnitude returns the size and the bits encoding v
+func magnitude( v int ) (uint32, uint) {
+    a := v
+    if a < 0 {
+        a = -a
+    }
+    size := uint(bits.Len( uint(a) ))
+    if v < 0 {
+        v += 1 << size - 1
+    }
+    return uint32(v), size
+}
+
+func writeTestSegment( b *bytes.Buffer, marker uint16, payload []byte ) {
+    binary.Write( b, binary.BigEndian, marker )
+    binary.Write( b, binary.BigEndian, uint16(len(payload) + 2) )
+    b.Write( payload )
+}
+
+// mcuSize returns the number of MCUs per MCU row and of MCU rows in
+// interleaved scans.
+func (p *testPicture) mcuSize( ) (cols, rows int) {
+    hMax, vMax := p.maxFactors( )
+    cols = (p.width + 8 * hMax - 1) / (8 * hMax)
+    rows = (p.height + 8 * vMax - 1) / (8 * vMax)
+    return
+}
+
+// units returns for each component the quantized coefficients in zig-zag
+// order of all data units covered by interleaved MCUs, row after row, with
+// samples replicated beyond the component edges.
+func (p *testPicture) units( ) [][][64]int {
+    mcuCols, mcuRows := p.mcuSize( )
+    qt := p.quantization( )
+    units := make( [][][64]int, len(p.sampling) )
+    for ci, s := range p.sampling {
+        cols, rows := p.componentSize( ci )
+        uCols, uRows := mcuCols * int(s[0]), mcuRows * int(s[1])
+        units[ci] = make( [][64]int, uCols * uRows )
+        for u := range units[ci] {
+            var block [64]float64
+            for y := 0; y < 8; y++ {
+                for x := 0; x < 8; x++ {
+                    c, r := (u % uCols) * 8 + x, (u / uCols) * 8 + y
+                    if c >= cols { c = cols - 1 }
+                    if r >= rows { r = rows - 1 }
+                    block[y*8+x] = float64(p.sample( ci, c, r ) -
+                                           1 << (p.precision - 1))
+                }
+            }
+            for v := 0; v < 8; v++ {
+                for h := 0; h < 8; h++ {
+                    var f float64
+                    for y := 0; y < 8; y++ {
+                        for x := 0; x < 8; x++ {
+                            f += block[y*8+x] * fdctCos[h][x] * fdctCos[v][y]
+                        }
+                    }
+                    units[ci][u][zigZagRowCol[v][h]] =
+                                    int( math.Round( f / float64(qt[v*8+h]) ) )
+                }
+            }
+        }
+    }
+    return units
+}
+
+// encodeTestPicture returns the JPEG encoding of p
+func encodeTestPicture( p testPicture ) []byte {
+    mcuCols, mcuRows := p.mcuSize( )
+    qt := p.quantization( )
+    units := p.units( )
+
+    var b bytes.Buffer
+    b.Write( []byte{ 0xff, 0xd8 } )
+    if p.adobe {
+        writeTestSegment( &b, _APP14,
+                          []byte{ 'A', 'd', 'o', 'b', 'e', 0, 100, 0, 0, 0, 0, 0 } )
+    }
+
+    dqt := []byte{ 0 }
+    if p.precision == 12 {
+        dqt[0] = 0x10                           // 16-bit values
+    }
+    var zz [64]int
+    for r := 0; r < 8; r++ {
+        for c := 0; c < 8; c++ {
+            zz[zigZagRowCol[r][c]] = qt[r*8+c]
+        }
+    }
+    for _, q := range zz {
+        if p.precision == 12 {
+            dqt = append( dqt, byte(q >> 8) )
+        }
+        dqt = append( dqt, byte(q) )
+    }
+    writeTestSegment( &b, _DQT, dqt )
+
+    sof := uint16(_SOF0)
+    if p.progressive {
+        sof = _SOF2
+    } else if p.precision == 12 {
+        sof = _SOF1
+    }
+    frame := []byte{ byte(p.precision), byte(p.height >> 8), byte(p.height),
+                     byte(p.width >> 8), byte(p.width), byte(len(p.sampling)) }
+    for ci, s := range p.sampling {
+        frame = append( frame, byte(ci + 1), s[0] << 4 | s[1], 0 )
+    }
+    writeTestSegment( &b, sof, frame )
+
+    dcSymbols, acSymbols := p.huffmanSymbols( )
+    dht := make( []byte, 0, 2 * 17 + len(dcSymbols) + len(acSymbols) )
+    dht = append( dht, 0x00 )
+    dht = append( dht, 0, 0, 0, 0, byte(len(dcSymbols)) )
+    dht = append( dht, make( []byte, 11 )... )
+    dht = append( dht, dcSymbols... )
+    dht = append( dht, 0x10 )
+    dht = append( dht, 0, 0, 0, 0, 0, 0, 0, byte(len(acSymbols)) )
+    dht = append( dht, make( []byte, 8 )... )
+    dht = append( dht, acSymbols... )
+    writeTestSegment( &b, _DHT, dht )
+    var acCodes [256]uint32
+    for i, s := range acSymbols {
+        acCodes[s] = uint32(i)
+    }
+
+    if p.restart != 0 {
+        writeTestSegment( &b, _DRI, []byte{ byte(p.restart >> 8), byte(p.restart) } )
+    }
+
+    // encodeScan writes a scan of the components cis, for the coefficients
+    // from ss to se
+    encodeScan := func( cis []int, ss, se int ) {
+        sos := []byte{ byte(len(cis)) }
+        for _, ci := range cis {
+            sos = append( sos, byte(ci + 1), 0x00 )
+        }
+        sos = append( sos, byte(ss), byte(se), 0 )
+        writeTestSegment( &b, _SOS, sos )
+
+        w := testBitWriter{ out: &b }
+        predictors := make( []int, len(p.sampling) )
+        encodeUnit := func( ci int, u *[64]int ) {
+            if ss == 0 {
+                v, size := magnitude( u[0] - predictors[ci] )
+                predictors[ci] = u[0]
+                w.put( uint32(size), 5 )
+                w.put( v, size )
+            }
+            run := 0
+            for k := ss; k <= se; k++ {
+                if k == 0 {
+                    continue
+                }
+                if u[k] == 0 {
+                    run ++
+                    continue
+                }
+                for ; run > 15; run -= 16 {
+                    w.put( acCodes[0xf0], 8 )
+                }
+                v, size := magnitude( u[k] )
+                w.put( acCodes[run << 4 | int(size)], 8 )
+                w.put( v, size )
+                run = 0
+            }
+            if run > 0 {
+                w.put( acCodes[0x00], 8 )
+            }
+        }
+        nMCUs := 0
+        startMCU := func( ) {
+            if p.restart != 0 && nMCUs != 0 && nMCUs % p.restart == 0 {
+                w.flush( )
+                b.Write( []byte{ 0xff, byte(_RST0 + (nMCUs / p.restart - 1) % 8) } )
+                for i := range predictors {
+                    predictors[i] = 0
+                }
+            }
+            nMCUs ++
+        }
+
+        if len(cis) == 1 {                  // non-interleaved
+            ci := cis[0]
+            cols, rows := p.componentSize( ci )
+            uCols := mcuCols * int(p.sampling[ci][0])
+            for r := 0; r < (rows + 7) / 8; r++ {
+                for c := 0; c < (cols + 7) / 8; c++ {
+                    startMCU( )
+                    encodeUnit( ci, &units[ci][r * uCols + c] )
+                }
+            }
+        } else {
+            for mr := 0; mr < mcuRows; mr++ {
+                for mc := 0; mc < mcuCols; mc++ {
+                    startMCU( )
+                    for _, ci := range cis {
+                        h, v := int(p.sampling[ci][0]), int(p.sampling[ci][1])
+                        for r := mr * v; r < (mr + 1) * v; r++ {
+                            for c := mc * h; c < (mc + 1) * h; c++ {
+                                encodeUnit( ci, &units[ci][r * mcuCols * h + c] )
+                            }
+                        }
+                    }
+                }
+            }
+        }
+        w.flush( )
+    }
+
+    all := make( []int, len(p.sampling) )
+    for ci := range all {
+        all[ci] = ci
+    }
+    if p.progressive {
+        encodeScan( all, 0, 0 )
+        for ci := range all {
+            encodeScan( []int{ ci }, 1, 63 )
+        }
+    } else {
+        encodeScan( all, 0, 63 )
+    }
+    b.Write( []byte{ 0xff, 0xd9 } )
+    return b.Bytes( )
+}
@@ -0,0 +1,226 @@
+package jpeg
+
+// support for validating EXIF offsets and counts before parsing EXIF metadata
+
+import (
+    "encoding/binary"
+    "fmt"
+)
+
+const (
+    _EXIF_SIGNATURE_SIZE = 6        // "Exif\x00\x00" before TIFF data
+
+    _TIFF_GPS_IFD       = 0x8825    // pointers to sub-IFDs, besides EXIF
+    _TIFF_INTEROP_IFD   = 0xa005
+
+    _TIFF_THUMB_OFFSET  = 0x201     // JPEGInterchangeFormat in IFD1
+    _TIFF_THUMB_LENGTH  = 0x202     // JPEGInterchangeFormatLength
+
+    _TIFF_LONG          = 4         // type of thumbnail offset and length
+
+    _TIFF_HEADER_SIZE   = 8         // byte order, 42 and IFD0 offset
+    _IFD_ENTRY_SIZE     = 12
+    _MAX_IFDS           = 16        // more IFDs than that means a loop
+)
+
+// size in bytes of one value of each TIFF type (1 to 13, IFD), 0 if unknown
+var tiffTypeSizes = [...]uint64{ 0, 1, 1, 2, 4, 8, 1, 1, 2, 4, 8, 4, 8, 4 }
+
+// exifChecker walks the IFDs of TIFF data, checking that all offsets and
+// counts stay within the data. Entries that do not are removed from their IFD
+// and reported as issues, so that the rest of the metadata can still be used.
+// Entries of unknown type, whose size is not known, are only reported as notes.
+type exifChecker struct {
+    tiff        []byte
+    order       binary.ByteOrder
+    nIfds       int
+    issues      []string
+    notes       []string
+}
+
+func (ec *exifChecker) inside( offset, size uint64 ) bool {
+    return offset + size <= uint64(len(ec.tiff))
+}
+
+// removeEntry removes the entry i from the IFD at offset, moving the following
+// entries and the next IFD offset, if present, to fill the gap.
+func (ec *exifChecker) removeEntry( offset, i uint64 ) {
+    nEntries := uint64(ec.order.Uint16( ec.tiff[offset:] ))
+    entries := offset + 2
+    end := entries + nEntries * _IFD_ENTRY_SIZE
+    if ec.inside( end, 4 ) {
+        end += 4
+    }
+    copy( ec.tiff[entries + i * _IFD_ENTRY_SIZE:end - _IFD_ENTRY_SIZE],
+          ec.tiff[entries + (i+1) * _IFD_ENTRY_SIZE:end] )
+    ec.order.PutUint16( ec.tiff[offset:], uint16(nEntries - 1) )
+}
+
+// removeTag removes the entry with the given tag from the IFD at offset, and
+// returns true if it was found.
+func (ec *exifChecker) removeTag( offset uint64, tag uint16 ) bool {
+    nEntries := uint64(ec.order.Uint16( ec.tiff[offset:] ))
+    for i := uint64(0); i < nEntries; i++ {
+        if ec.order.Uint16( ec.tiff[offset + 2 + i * _IFD_ENTRY_SIZE:] ) == tag {
+            ec.removeEntry( offset, i )
+            return true
+        }
+    }
+    return false
+}
+
+func (ec *exifChecker) issue( format string, args ...interface{} ) {
+    ec.issues = append( ec.issues, fmt.Sprintf( format, args... ) )
+}
+
+func (ec *exifChecker) note( format string, args ...interface{} ) {
+    ec.notes = append( ec.notes, fmt.Sprintf( format, args... ) )
+}
+
+// checkIfd checks the IFD name at offset, its entries and their values, and
+// recursively the sub-IFDs it points to. Entries with values beyond the end
+// of data, and pointers to invalid sub-IFDs, are removed from the IFD, while
+// entries of unknown type are kept. It
+// returns the offset of the next IFD in the list, or 0 if there is none, or an
+// error if the IFD itself does not fit in the data.
+func (ec *exifChecker) checkIfd( name string, offset uint64 ) (uint64, error) {
+    ec.nIfds ++
+    if ec.nIfds > _MAX_IFDS {
+        return 0, fmt.Errorf( "too many IFDs (%s)", name )
+    }
+    if offset < _TIFF_HEADER_SIZE {
+        return 0, fmt.Errorf( "%s at offset 0x%x inside TIFF header", name, offset )
+    }
+    if ! ec.inside( offset, 2 ) {
+        return 0, fmt.Errorf( "%s at offset 0x%x beyond end of data (0x%x)",
+                              name, offset, len(ec.tiff) )
+    }
+    nEntries := uint64(ec.order.Uint16( ec.tiff[offset:] ))
+    entries := offset + 2
+    if ! ec.inside( entries, nEntries * _IFD_ENTRY_SIZE ) {
+        return 0, fmt.Errorf( "%s %d entries at offset 0x%x beyond end of data (0x%x)",
+                              name, nEntries, entries, len(ec.tiff) )
+    }
+    var thumbOffset, thumbLength uint64
+    var thumbTags int
+    thumbValid := true          // single LONG values, offset before length
+    for i := uint64(0); i < nEntries; {
+        entry := ec.tiff[entries + i * _IFD_ENTRY_SIZE:]
+        tag := ec.order.Uint16( entry )
+        typ := ec.order.Uint16( entry[2:] )
+        count := uint64(ec.order.Uint32( entry[4:] ))
+        value := uint64(ec.order.Uint32( entry[8:] ))
+
+        if typ == 0 || int(typ) >= len(tiffTypeSizes) {
+            ec.note( "%s entry %d (tag 0x%04x): unknown TIFF type %d",
+                     name, i, tag, typ )
+            i ++
+            continue
+        }
+        var err error
+        if size := count * tiffTypeSizes[typ]; size > 4 && ! ec.inside( value, size ) {
+            err = fmt.Errorf( "%d bytes at offset 0x%x beyond end of data (0x%x)",
+                              size, value, len(ec.tiff) )
+        }
+        if err == nil {
+            switch tag {
+            case _TIFF_EXIF_IFD:
+                _, err = ec.checkIfd( "Exif IFD", value )
+            case _TIFF_GPS_IFD:
+                _, err = ec.checkIfd( "GPS IFD", value )
+            case _TIFF_INTEROP_IFD:
+                _, err = ec.checkIfd( "Interoperability IFD", value )
+            case _TIFF_THUMB_OFFSET:
+                thumbTags ++
+                thumbOffset = value
+                thumbValid = thumbValid && typ == _TIFF_LONG && count == 1
+            case _TIFF_THUMB_LENGTH:
+                thumbTags ++
+                thumbLength = value
+                thumbValid = thumbValid && typ == _TIFF_LONG && count == 1 &&
+                             thumbOffset != 0
+            }
+        }
+        if err != nil {
+            ec.issue( "%s entry %d (tag 0x%04x): %v",
+                      name, i, tag, err )
+            ec.removeEntry( offset, i )
+            nEntries --
+            continue
+        }
+        i ++
+    }
+    if thumbTags != 0 {
+        var err error
+        if thumbTags != 2 || ! thumbValid {
+            err = fmt.Errorf( "offset and length are not single LONG values in order" )
+        } else if ! ec.inside( thumbOffset, thumbLength ) {
+            err = fmt.Errorf( "%d bytes at offset 0x%x beyond end of data (0x%x)",
+                              thumbLength, thumbOffset, len(ec.tiff) )
+        }
+        if err != nil {
+            ec.issue( "%s thumbnail: %v", name, err )
+            for _, tag := range []uint16{ _TIFF_THUMB_OFFSET, _TIFF_THUMB_LENGTH } {
+                for ec.removeTag( offset, tag ) {
+                    nEntries --
+                }
+            }
+        }
+    }
+    next := entries + nEntries * _IFD_ENTRY_SIZE
+    if ! ec.inside( next, 4 ) {     // often omitted at the end of the data
+        return 0, nil
+    }
+    return uint64(ec.order.Uint32( ec.tiff[next:] )), nil
+}
+
+// checkIfds checks IFD0 at offset, and IFD1 if there is one. An invalid IFD1
+// is removed from the list. It returns an error if IFD0 is invalid.
+func (ec *exifChecker) checkIfds( ifd0 uint64 ) error {
+    next, err := ec.checkIfd( "IFD0", ifd0 )
+    if err != nil {
+        return err
+    }
+    if next != 0 {
+        if _, err = ec.checkIfd( "IFD1", next ); err != nil {
+            ec.issue( "%v", err )
+            nEntries := uint64(ec.order.Uint16( ec.tiff[ifd0:] ))
+            ec.order.PutUint32( ec.tiff[ifd0 + 2 + nEntries * _IFD_ENTRY_SIZE:], 0 )
+        }
+    }
+    return nil
+}
+
+// checkExifBounds checks the TIFF header and the IFD structure of tiff, the
+// EXIF data following the Exif signature, before it is parsed. It removes in
+// place the entries whose offset or count does not fit in tiff, as well as an
+// invalid IFD1, and returns a description of each removal, and of each entry
+// of unknown type, which is kept. It returns an error if the TIFF header or
+// IFD0 does not fit in tiff.
+//
+// Since IFDs may overlap in invalid data, removing entries from an IFD may
+// change another one: checking is repeated until nothing is removed.
+func checkExifBounds( tiff []byte ) (issues, notes []string, err error) {
+    if len(tiff) < _TIFF_HEADER_SIZE {
+        return nil, nil, fmt.Errorf( "TIFF header truncated (%d bytes)\n", len(tiff) )
+    }
+    ec := exifChecker{ tiff: tiff }
+    switch string(tiff[0:2]) {
+    case "II":  ec.order = binary.LittleEndian
+    case "MM":  ec.order = binary.BigEndian
+    default:
+        return nil, nil, fmt.Errorf( "invalid TIFF byte order (%q)\n", tiff[0:2] )
+    }
+    ifd0 := uint64(ec.order.Uint32( tiff[4:] ))
+    for pass := 0; pass < _MAX_IFDS; pass++ {
+        ec.nIfds, ec.issues, ec.notes = 0, nil, nil
+        if err = ec.checkIfds( ifd0 ); err != nil {
+            return nil, nil, fmt.Errorf( "%v\n", err )
+        }
+        if len(ec.issues) == 0 {    // notes of the last pass only
+            return issues, ec.notes, nil
+        }
+        issues = append( issues, ec.issues... )
+    }
+    return nil, nil, fmt.Errorf( "overlapping IFDs\n" )
+}
@@ -0,0 +1,78 @@
+package jpeg
+
+// support for checking the handling of malformed EXIF metadata: entries that
+// fit in the segment are kept, even with an unknown TIFF type, and metadata
+// that makes the exif package panic is kept as a raw APP1 segment.
+
+import (
+    "bytes"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+)
+
+// withExif returns gray.jpg with an APP1 segment made of the Exif signature
+// followed by tiff, just after SOI.
+func withExif( t *testing.T, tiff []byte ) []byte {
+    gray, err := os.ReadFile( filepath.Join( "testdata", "gray.jpg" ) )
+    if err != nil {
+        t.Fatal( err )
+    }
+    payload := append( []byte( "Exif\x00\x00" ), tiff... )
+    data := []byte{ 0xff, 0xd8, 0xff, 0xe1,
+                    byte((len(payload) + 2) >> 8), byte(len(payload) + 2) }
+    data = append( data, payload... )
+    return append( data, gray[2:]... )
+}
+
+// appleMakerNote is big-endian TIFF data whose entries are all within bounds:
+// IFD0 points to an Exif IFD with a single 20-byte maker note starting with an
+// Apple signature, too short for the Apple maker note IFD.
+var appleMakerNote = append( []byte{
+    'M', 'M', 0, 42, 0, 0, 0, 8,
+    0, 1,                                   // IFD0 at 8, 1 entry
+    0x87, 0x69, 0, 4, 0, 0, 0, 1, 0, 0, 0, 26,  // Exif IFD at 26
+    0, 0, 0, 0,
+    0, 1,                                   // Exif IFD, 1 entry
+    0x92, 0x7c, 0, 7, 0, 0, 0, 20, 0, 0, 0, 44, // maker note at 44
+    0, 0, 0, 0 },
+    append( []byte( "Apple iOS\x00\x00\x01MM" ), 0, 0, 0, 0, 0, 0 )... )
+
+func TestExifMakerNotePanic( t *testing.T ) {
+    data := withExif( t, appleMakerNote )
+    jpg, err := Parse( data, &Control{ Logger: discardLogger{ } } )
+    if err != nil {
+        t.Fatalf( "Parse: %v", err )
+    }
+    if _, ok := jpg.segments[0].(*appSeg); ! ok {
+        t.Errorf( "EXIF segment not kept as raw data (%T)", jpg.segments[0] )
+    }
+    issues := jpg.GetExifIssues( )
+    if len(issues) != 1 || ! strings.Contains( issues[0], "raw data" ) {
+        t.Errorf( "unexpected EXIF issues %q", issues )
+    }
+    checkGenerate( t, jpg, data )
+}
+
+func TestExifUnknownType( t *testing.T ) {
+    tiff := []byte{ 'I', 'I', 42, 0, 8, 0, 0, 0,
+                    2, 0,                               // IFD0 at 8, 2 entries
+                    0x10, 0x01, 13, 0, 1, 0, 0, 0, 0, 0, 0, 0,  // type 13 (IFD)
+                    0x11, 0x01, 99, 0, 9, 0, 0, 0, 0, 0, 0, 0,  // unknown type
+                    0, 0, 0, 0 }
+    checked := append( []byte{ }, tiff... )
+    issues, notes, err := checkExifBounds( checked )
+    if err != nil {
+        t.Fatalf( "checkExifBounds: %v", err )
+    }
+    if len(issues) != 0 {
+        t.Errorf( "entries removed: %q", issues )
+    }
+    if len(notes) != 1 || ! strings.Contains( notes[0], "unknown TIFF type 99" ) {
+        t.Errorf( "unexpected notes %q", notes )
+    }
+    if ! bytes.Equal( checked, tiff ) {
+        t.Errorf( "TIFF data modified" )
+    }
+}
@@ -0,0 +1,242 @@
+package jpeg
+
+// support for exporting metadata with exiftool tag names
+
+import (
+    "encoding/json"
+    "fmt"
+    "io"
+    "math"
+    "strings"
+
+    "github.com/jrm-1535/exif"
+)
+
+// ExiftoolGroups selects the exiftool group family used to prefix tag names
+type ExiftoolGroups int
+const (
+    ExiftoolFamily0 ExiftoolGroups = iota   // general location: EXIF:Make,
+                                            // EXIF:GPSLatitude (exiftool -G)
+    ExiftoolFamily1                         // specific location: IFD0:Make,
+                                            // GPS:GPSLatitude (exiftool -G1)
+)
+
+type exiftoolConv int
+const (
+    etNumber    exiftoolConv = iota // numbers, rationals as floats
+    etString                        // ASCII or UNDEFINED bytes as string
+    etAperture                      // APEX aperture value: 2^(v/2)
+    etShutter                       // APEX shutter speed value: 2^(-v)
+    etDegrees                       // 3 rationals: degrees, minutes, seconds
+    etTime                          // 3 rationals: hours, minutes, seconds
+)
+
+type exiftoolTag struct {
+    tag     int
+    name    string
+    conv    exiftoolConv
+}
+
+var exiftoolIfds = []struct {
+    id      exif.IfdId
+    group1  string
+    tags    []exiftoolTag
+}{
+    { exif.PRIMARY, "IFD0", []exiftoolTag{
+        { 0x010e, "ImageDescription", etString },
+        { 0x010f, "Make", etString },
+        { 0x0110, "Model", etString },
+        { 0x0112, "Orientation", etNumber },
+        { 0x011a, "XResolution", etNumber },
+        { 0x011b, "YResolution", etNumber },
+        { 0x0128, "ResolutionUnit", etNumber },
+        { 0x0131, "Software", etString },
+        { 0x0132, "ModifyDate", etString },
+        { 0x013b, "Artist", etString },
+        { 0x0213, "YCbCrPositioning", etNumber },
+        { 0x8298, "Copyright", etString } } },
+    { exif.THUMBNAIL, "IFD1", []exiftoolTag{
+        { 0x0103, "Compression", etNumber },
+        { 0x011a, "XResolution", etNumber },
+        { 0x011b, "YResolution", etNumber },
+        { 0x0128, "ResolutionUnit", etNumber },
+        { 0x0201, "ThumbnailOffset", etNumber },
+        { 0x0202, "ThumbnailLength", etNumber } } },
+    { exif.EXIF, "ExifIFD", []exiftoolTag{
+        { 0x829a, "ExposureTime", etNumber },
+        { 0x829d, "FNumber", etNumber },
+        { 0x8822, "ExposureProgram", etNumber },
+        { 0x8827, "ISO", etNumber },
+        { 0x9000, "ExifVersion", etString },
+        { 0x9003, "DateTimeOriginal", etString },
+        { 0x9004, "CreateDate", etString },
+        { 0x9010, "OffsetTime", etString },
+        { 0x9011, "OffsetTimeOriginal", etString },
+        { 0x9012, "OffsetTimeDigitized", etString },
+        { 0x9101, "ComponentsConfiguration", etNumber },
+        { 0x9201, "ShutterSpeedValue", etShutter },
+        { 0x9202, "ApertureValue", etAperture },
+        { 0x9204, "ExposureCompensation", etNumber },
+        { 0x9205, "MaxApertureValue", etAperture },
+        { 0x9207, "MeteringMode", etNumber },
+        { 0x9208, "LightSource", etNumber },
+        { 0x9209, "Flash", etNumber },
+        { 0x920a, "FocalLength", etNumber },
+        { 0x9290, "SubSecTime", etString },
+        { 0x9291, "SubSecTimeOriginal", etString },
+        { 0x9292, "SubSecTimeDigitized", etString },
+        { 0xa000, "FlashpixVersion", etString },
+        { 0xa001, "ColorSpace", etNumber },
+        { 0xa002, "ExifImageWidth", etNumber },
+        { 0xa003, "ExifImageHeight", etNumber },
+        { 0xa402, "ExposureMode", etNumber },
+        { 0xa403, "WhiteBalance", etNumber },
+        { 0xa405, "FocalLengthIn35mmFormat", etNumber },
+        { 0xa406, "SceneCaptureType", etNumber },
+        { 0xa420, "ImageUniqueID", etString },
+        { 0xa430, "OwnerName", etString },
+        { 0xa431, "SerialNumber", etString },
+        { 0xa432, "LensInfo", etNumber },
+        { 0xa433, "LensMake", etString },
+        { 0xa434, "LensModel", etString } } },
+    { exif.GPS, "GPS", []exiftoolTag{
+        { 0x0000, "GPSVersionID", etNumber },
+        { 0x0001, "GPSLatitudeRef", etString },
+        { 0x0002, "GPSLatitude", etDegrees },
+        { 0x0003, "GPSLongitudeRef", etString },
+        { 0x0004, "GPSLongitude", etDegrees },
+        { 0x0005, "GPSAltitudeRef", etNumber },
+        { 0x0006, "GPSAltitude", etNumber },
+        { 0x0007, "GPSTimeStamp", etTime },
+        { 0x0010, "GPSImgDirectionRef", etString },
+        { 0x0011, "GPSImgDirection", etNumber },
+        { 0x0012, "GPSMapDatum", etString },
+        { 0x001d, "GPSDateStamp", etString } } },
+    { exif.IOP, "InteropIFD", []exiftoolTag{
+        { 0x0001, "InteropIndex", etString },
+        { 0x0002, "InteropVersion", etString } } },
+}
+
+// exiftoolNumbers returns the tag value as a slice of numbers, if it is not
+// a string.
+func exiftoolNumbers( st exif.SliceType, v interface{} ) (nums []float64) {
+    switch st {
+    case exif.U8Slice:
+        for _, n := range v.([]uint8) { nums = append( nums, float64(n) ) }
+    case exif.S8Slice:
+        for _, n := range v.([]int8) { nums = append( nums, float64(n) ) }
+    case exif.U16Slice:
+        for _, n := range v.([]uint16) { nums = append( nums, float64(n) ) }
+    case exif.S16Slice:
+        for _, n := range v.([]int16) { nums = append( nums, float64(n) ) }
+    case exif.U32Slice:
+        for _, n := range v.([]uint32) { nums = append( nums, float64(n) ) }
+    case exif.S32Slice:
+        for _, n := range v.([]int32) { nums = append( nums, float64(n) ) }
+    case exif.URationalSlice:
+        for _, r := range v.([]exif.UnsignedRational) {
+            nums = append( nums, Rational{ r.Numerator, r.Denominator }.Float64( ) )
+        }
+    case exif.SRationalSlice:
+        for _, r := range v.([]exif.SignedRational) {
+            nums = append( nums, SRational{ r.Numerator, r.Denominator }.Float64( ) )
+        }
+    }
+    return
+}
+
+// exiftoolValue returns the tag value converted as exiftool does with the
+// option -n (no print conversion), or nil if the value is not usable.
+func exiftoolValue( t *exiftoolTag, st exif.SliceType, v interface{} ) interface{} {
+    if st == exif.String || (t.conv == etString && st == exif.U8Slice) {
+        var s string
+        if st == exif.String {
+            s = v.(string)
+        } else {
+            s = string(v.([]uint8))
+        }
+        return strings.TrimRight( s, "\x00 " )
+    }
+    nums := exiftoolNumbers( st, v )
+    for _, n := range nums {
+        if math.IsNaN( n ) || math.IsInf( n, 0 ) {
+            return nil
+        }
+    }
+    switch {
+    case len(nums) == 0:
+        return nil
+    case t.conv == etAperture:
+        return math.Pow( 2, nums[0] / 2 )
+    case t.conv == etShutter:
+        return math.Pow( 2, -nums[0] )
+    case t.conv == etDegrees && len(nums) == 3:
+        return nums[0] + nums[1] / 60 + nums[2] / 3600
+    case t.conv == etTime && len(nums) == 3:
+        return fmt.Sprintf( "%02d:%02d:%s", int(nums[0]), int(nums[1]),
+                            strings.TrimRight( strings.TrimRight(
+                                fmt.Sprintf( "%09.6f", nums[2] ), "0" ), "." ) )
+    case len(nums) == 1:
+        return nums[0]
+    }
+    s := make( []string, len(nums) )    // list of values, space separated
+    for i, n := range nums {
+        s[i] = fmt.Sprintf( "%g", n )
+    }
+    return strings.Join( s, " " )
+}
+
+// ExiftoolTags returns the frame size and the common EXIF metadata (IFD0,
+// IFD1, Exif, GPS and Interoperability tags) with the names used by exiftool,
+// prefixed by their group in the given family, such as "EXIF:DateTimeOriginal"
+// or "ExifIFD:DateTimeOriginal". Values are given as exiftool does with the
+// option -n: numbers (rationals as floats), strings, lists of numbers as space
+// separated strings, GPS coordinates in decimal degrees (without sign, as
+// given by the Ref tags) and APEX values converted to f-number or seconds.
+// Only the first EXIF segment is used. Tags unknown to this table are not
+// exported.
+func (jpg *Desc) ExiftoolTags( groups ExiftoolGroups ) map[string]interface{} {
+    tags := make( map[string]interface{} )
+    if len(jpg.frames) > 0 {
+        frm := &jpg.frames[0]
+        tags["File:ImageWidth"] = frm.nSamplesLine()
+        tags["File:ImageHeight"] = frm.actualLines()
+    }
+    for _, seg := range jpg.segments {
+        ed, ok := seg.(*exifData)
+        if ! ok || ed.removed {
+            continue
+        }
+        for _, ifd := range exiftoolIfds {
+            group := "EXIF"
+            if groups == ExiftoolFamily1 {
+                group = ifd.group1
+            }
+            for i := range ifd.tags {
+                t := &ifd.tags[i]
+                st, v, err := ed.desc.GetIfdTagValue( ifd.id, t.tag )
+                if err != nil {
+                    continue
+                }
+                if val := exiftoolValue( t, st, v ); val != nil {
+                    tags[group + ":" + t.name] = val
+                }
+            }
+        }
+        break
+    }
+    return tags
+}
+
+// WriteExiftoolJSON writes the tags returned by ExiftoolTags in JSON, as an
+// array of one object as exiftool does with the options -j -n -G (family 0)
+// or -j -n -G1 (family 1), so that tools expecting exiftool output can use it
+// unchanged. Tag names are sorted.
+func (jpg *Desc) WriteExiftoolJSON( w io.Writer, groups ExiftoolGroups ) (int, error) {
+    b, err := json.MarshalIndent( []map[string]interface{}{
+                                    jpg.ExiftoolTags( groups ) }, "", "  " )
+    if err != nil {
+        return 0, jpgForwardError( "WriteExiftoolJSON", err )
+    }
+    return w.Write( append( b, '\n' ) )
+}
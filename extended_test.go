@@ -0,0 +1,88 @@
+package jpeg
+
+// support for checking 12-bit extended sequential pictures, which use 16-bit
+// quantization tables and larger coefficients than 8-bit pictures. Their DQT
+// tables, estimated quality, decoded coefficients and serialization are
+// checked against the parameters used to encode them.
+
+import (
+    "os"
+    "path/filepath"
+    "testing"
+)
+
+var extendedPictures = []struct{
+    name        string
+    picture     testPicture
+}{
+    // quality 90: DC and AC coefficients larger than allowed with 8 bits
+    { "gray12.jpg", testPicture{ width: corpusWidth, height: corpusHeight,
+                                 precision: 12, sampling: [][2]uint8{ s111 },
+                                 quality: 90 } },
+    // quality 10: quantization values larger than 255
+    { "ycc12.jpg", testPicture{ width: corpusWidth, height: corpusHeight,
+                                precision: 12,
+                                sampling: [][2]uint8{ s221, s111, s111 },
+                                restart: 2, quality: 10 } },
+}
+
+func TestExtendedPrecision( t *testing.T ) {
+    for _, e := range extendedPictures {
+        t.Run( e.name, func( t *testing.T ) {
+            data, err := os.ReadFile( filepath.Join( "testdata", e.name ) )
+            if err != nil {
+                t.Fatal( err )
+            }
+            jpg, err := Parse( data, &Control{ } )
+            if err != nil {
+                t.Fatalf( "Parse: %v", err )
+            }
+
+            qts := jpg.GetQuantizationTables( )
+            if len(qts) != 1 || qts[0].Precision != 16 {
+                t.Fatalf( "expected one 16-bit DQT table, got %+v", qts )
+            }
+            for i, q := range e.picture.quantization( ) {
+                if int(qts[0].Natural[i]) != q {
+                    t.Fatalf( "DQT value %d is %d, expected %d",
+                              i, qts[0].Natural[i], q )
+                }
+            }
+
+            summary, err := jpg.GetImageSummary( )
+            if err != nil {
+                t.Fatal( err )
+            }
+            if summary.Mode != ExtendedSequential {
+                t.Errorf( "mode %s, expected %s", summary.Mode, ExtendedSequential )
+            }
+            if summary.Quality != e.picture.quality {
+                t.Errorf( "estimated quality %d, expected %d",
+                          summary.Quality, e.picture.quality )
+            }
+
+            mcuCols, _ := e.picture.mcuSize( )
+            for ci, units := range e.picture.units( ) {
+                uCols := mcuCols * int(e.picture.sampling[ci][0])
+                rows := jpg.frames[0].components[ci].iDCTdata
+                if len(rows) * uCols != len(units) {
+                    t.Fatalf( "component %d: %d data unit rows, expected %d",
+                              ci, len(rows), len(units) / uCols )
+                }
+                for r, row := range rows {
+                    for c := range row {
+                        for k, v := range units[r * uCols + c] {
+                            if int(row[c][k]) != v {
+                                t.Fatalf( "component %d data unit %d,%d " +
+                                          "coefficient %d is %d, expected %d",
+                                          ci, r, c, k, row[c][k], v )
+                            }
+                        }
+                    }
+                }
+            }
+
+            checkGenerate( t, jpg, data )
+        } )
+    }
+}
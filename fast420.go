@@ -0,0 +1,241 @@
+package jpeg
+
+// support for a faster decoding of 8-bit 4:2:0 sequential scans
+
+// fast420 returns true if scan s in frame frm can be decoded by process420Ecs:
+// an interleaved sequential scan of an 8-bit frame, with 3 components sampled
+// as 4:2:0 (Y 2x2, Cb 1x1, Cr 1x1), and no MCU or data unit tracing.
+func (jpg *Desc) fast420( frm *frame, s *scan ) bool {
+    if frm.resolution.samplePrecision != 8 || len(s.sComps) != 3 ||
+       s.startSS != 0 || s.endSS != 63 || s.sABPh != 0 || s.sABPl != 0 ||
+       jpg.Mcu || jpg.Du {
+        return false
+    }
+    for i := range s.sComps {
+        sc := &s.sComps[i]
+        if sc.hDC == nil || sc.hAC == nil {
+            return false
+        }
+        if i == 0 && (sc.HSF != 2 || sc.VSF != 2) ||
+           i != 0 && (sc.HSF != 1 || sc.VSF != 1) {
+            return false
+        }
+    }
+    return true
+}
+
+// ecsReader loads the bits of an entropy coded segment in an accumulator,
+// removing stuffed bytes and stopping before the first marker.
+type ecsReader struct {
+    data        []byte
+    pos         uint        // offset of the next byte to load
+    acc         uint64      // loaded bits, first bit in msb
+    n           uint        // number of bits in acc
+    stopped     bool        // marker or end of data reached
+}
+
+// fill loads bytes until at least 57 bits are available, if possible
+func (r *ecsReader) fill( ) {
+    for r.n <= 56 && ! r.stopped {
+        if r.pos >= uint(len(r.data)) {
+            r.stopped = true
+            break
+        }
+        b := r.data[r.pos]
+        if b == 0xFF {      // same condition as processSequentialEcs
+            if r.pos + 2 >= uint(len(r.data)) || r.data[r.pos+1] != 0x00 {
+                r.stopped = true
+                break
+            }
+            r.pos += 2
+        } else {
+            r.pos ++
+        }
+        r.acc |= uint64(b) << (56 - r.n)
+        r.n += 8
+    }
+}
+
+// decode returns the symbol of the next code, decoded with table t, or false
+// if the code is invalid or longer than the bits available.
+func (r *ecsReader) decode( t *hcTable ) (uint8, bool) {
+    var l uint
+    var symbol uint8
+    if e := t.lookup[r.acc >> (64 - lookupBits)]; e != 0 {
+        l, symbol = uint(e >> 8), uint8(e)
+    } else {
+        for l = lookupBits + 1; ; l++ {
+            if l > 16 {
+                return 0, false
+            }
+            code := uint32(r.acc >> (64 - l))
+            if code >= t.limit[l] {
+                return 0, false
+            }
+            if d := code - t.minCode[l]; code >= t.minCode[l] && d < t.count[l] {
+                symbol = t.symbols[t.valPtr[l] + d]
+                break
+            }
+        }
+    }
+    if l > r.n {
+        return 0, false
+    }
+    r.acc <<= l
+    r.n -= l
+    return symbol, true
+}
+
+// receive returns the next size bits, or false if they are not available
+func (r *ecsReader) receive( size uint8 ) (uint, bool) {
+    if uint(size) > r.n {
+        return 0, false
+    }
+    v := uint(r.acc >> (64 - uint(size)))
+    r.acc <<= size
+    r.n -= uint(size)
+    return v, true
+}
+
+// position returns the offset of the byte holding the next bit and the number
+// of bits of that byte already decoded, given the offset pos of the next byte
+// to load and the number n of bits loaded but not decoded.
+func (r *ecsReader) position( pos, n uint ) (uint, uint8) {
+    for n > 0 {                 // walk back over the loaded bytes
+        pos --
+        if r.data[pos] == 0x00 && pos > 0 && r.data[pos-1] == 0xFF {
+            pos --              // stuffed byte
+        }
+        if n <= 8 {
+            return pos, uint8(8 - n)
+        }
+        n -= 8
+    }
+    return pos, 0
+}
+
+// ensureRows appends rows of data units to sc, VSF rows at a time as
+// processSequentialEcs does, until row is available.
+func (jpg *Desc) ensureRows( sc *scanComp, row uint ) {
+    for len(*sc.iDCTdata) <= int(row) {
+        for k := uint8(0); k < sc.VSF; k++ {
+            *sc.iDCTdata = append( *sc.iDCTdata,
+                                   jpg.scratch.newRow( sc.nUnitsRow ) )
+        }
+    }
+}
+
+// process420Ecs is processSequentialEcs for the scans accepted by fast420.
+// Whole MCUs are decoded from a bit accumulator, with a single table lookup
+// for most Huffman codes. The first MCU that cannot be decoded that way
+// (reaching a marker, the end of data or an invalid code) is left, with the
+// rest of the segment, to processSequentialEcs, which restarts from the
+// beginning of that MCU and handles padding, errors and warnings.
+func (jpg *Desc) process420Ecs( nMCUs uint, scan *scan ) (uint, error) {
+    jpg.startSequentialEcs( nMCUs, scan )
+    nMCUs, skip := jpg.decode420Mcus( nMCUs, scan )
+    return jpg.decodeSequentialEcs( nMCUs, scan, skip )
+}
+
+// decode420Mcus decodes as many complete MCUs as possible, starting at MCU
+// nMCUs. It returns the number of MCUs, with jpg.offset and the number of
+// bits already decoded in that byte giving the beginning of the next MCU.
+func (jpg *Desc) decode420Mcus( nMCUs uint, scan *scan ) (uint, uint8) {
+    maxDC, maxAC := jpg.getCurrentFrame().maxCoefSizes()
+    y, cb, cr := &scan.sComps[0], &scan.sComps[1], &scan.sComps[2]
+    cmps := [6]*scanComp{ y, y, y, y, cb, cr }
+
+    r := ecsReader{ data: jpg.data, pos: jpg.offset }
+    var start, startN uint      // restart point: r.pos and r.n at MCU start
+
+mcuLoop:
+    for {
+        start, startN = r.pos, r.n
+        dcs := [3]int16{ y.previousDC, cb.previousDC, cr.previousDC }
+
+        // coefficients are stored as they are decoded, in the same data units
+        // and in the same rows, allocated at the same time, as they would be
+        // by processSequentialEcs, which rewrites the same values if the MCU
+        // is incomplete.
+        for k, sc := range cmps {
+            ci, row, col := 0, sc.nRows, sc.dUAnchor
+            if k > 3 {
+                ci = k - 3
+            } else {
+                row += uint(k >> 1)
+                col += uint(k & 1)
+            }
+            jpg.ensureRows( sc, row )
+            du := &(*sc.iDCTdata)[row][col]
+            if r.n < 32 {
+                r.fill( )
+            }
+            size, ok := r.decode( sc.hDC )
+            if ! ok || size > maxDC {
+                break mcuLoop
+            }
+            code, ok := r.receive( size )
+            if ! ok {
+                break mcuLoop
+            }
+            dcs[ci] += rlCodes[size][code]
+            du[0] = dcs[ci]
+
+            for z := uint8(1); z < 64; {
+                if r.n < 32 {
+                    r.fill( )
+                }
+                runSize, ok := r.decode( sc.hAC )
+                if ! ok {
+                    break mcuLoop
+                }
+                runLen, size := runSize >> 4, runSize & 0x0f
+                if size == 0 {
+                    if runLen == 0 {        // EOB
+                        break
+                    }
+                    if runLen != 15 || z + 16 > 64 { // EOBn or invalid ZRL
+                        break mcuLoop
+                    }
+                    z += 16
+                    continue
+                }
+                if size > maxAC || z + runLen > 63 {
+                    break mcuLoop
+                }
+                if code, ok = r.receive( size ); ! ok {
+                    break mcuLoop
+                }
+                z += runLen
+                du[z] = rlCodes[size][code]
+                z ++
+            }
+        }
+
+        // complete MCU: move to the next one
+        y.previousDC, cb.previousDC, cr.previousDC = dcs[0], dcs[1], dcs[2]
+        y.dUAnchor += 2
+        cb.dUAnchor ++
+        cr.dUAnchor ++
+        nMCUs ++
+
+        if y.dUAnchor == y.nUnitsRow {  // end of MCU row
+            if scan.rstInterval != 0 &&
+               nMCUs % scan.rstInterval != 0 && jpg.Warn {
+                jpg.warning( "Warning: end of slice @MCU %d is "+
+                             "not synced with RST intervals (%d)\n",
+                             nMCUs, scan.rstInterval )
+            }
+            for sci := range scan.sComps {
+                sc := &scan.sComps[sci]
+                sc.nRows += uint(sc.VSF)
+                sc.dUAnchor = 0
+            }
+            jpg.reportMcuRow( scan, y.nRows / uint(y.VSF) )
+            jpg.streamRows( jpg.getCurrentFrame( ), scan )
+        }
+    }
+    offset, skip := r.position( start, startN )
+    jpg.offset = offset
+    return nMCUs, skip
+}
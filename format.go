@@ -3,13 +3,65 @@ package jpeg
 import (
     "fmt"
     "io"
+    "strings"
+    "time"
+    "github.com/jrm-1535/exif"
 )
 
 // FormatSegments prints out all segments that constitute the image.
 func (jpg *Desc) FormatSegments( w io.Writer ) (n int, err error) {
+    return jpg.FormatSegmentsFiltered( w, AllSegments, 1 )
+}
+
+type SegmentClass uint
+const (                         // segment classes, can be combined
+    AppSegments SegmentClass = 1 << iota    // APP0 to APP15
+    TableSegments               // DQT, DHT, DAC, DRI and DNL
+    FrameSegments               // SOFn
+    ScanSegments                // SOS, including entropy coded segments
+    CommentSegments             // COM
+
+    AllSegments = AppSegments | TableSegments | FrameSegments |
+                  ScanSegments | CommentSegments
+)
+
+func segmentClass( seg segmenter ) SegmentClass {
+    switch seg.(type) {
+    case *frame:    return FrameSegments
+    case *scan:     return ScanSegments
+    case *comSeg:   return CommentSegments
+    }
+    if isAppSegment( seg ) {
+        return AppSegments
+    }
+    return TableSegments
+}
+
+// FormatSegmentsFiltered prints out only the segments belonging to the
+// requested classes. If depth is 0, only one line giving the segment index
+// and marker name is printed for each segment, otherwise segments are fully
+// formatted.
+func (jpg *Desc) FormatSegmentsFiltered( w io.Writer, classes SegmentClass,
+                                         depth int ) (n int, err error) {
     var np int
-    for _, s := range jpg.segments {
-        np, err = s.format( w )
+    for i, s := range jpg.segments {
+        if segmentClass( s ) & classes == 0 {
+            continue
+        }
+        if depth == 0 {
+            np, err = fmt.Fprintf( w, "Segment #%d: %s\n", i,
+                                   getJPEGmarkerName( s.marker() ) )
+        } else {
+            np, err = s.format( w )
+            if sc, ok := s.(*scan); ok && err == nil {
+                n += np
+                header, ecs := sc.scanSize( )
+                bpm, share := jpg.scanRates( sc )
+                np, err = fmt.Fprintf( w, "    Size: header %d bytes, ECS %d bytes, " +
+                                       "%d MCUs, %.1f bits/MCU, %.1f%% of file\n",
+                                       header, ecs, sc.nMcus, bpm, share )
+            }
+        }
         if err != nil {
             return
         }
@@ -18,11 +70,354 @@ func (jpg *Desc) FormatSegments( w io.Writer ) (n int, err error) {
     return
 }
 
+// dumpData writes data as lines of width hexadecimal bytes, each line starting
+// with the offset of its first byte and ending with the printable ascii bytes.
+func dumpData( w io.Writer, data []byte, width int ) (n int, err error) {
+    if width < 1 {
+        width = 16
+    }
+    cw := newCumulativeWriter( w )
+    for offset := 0; offset < len(data); offset += width {
+        end := offset + width
+        if end > len(data) {
+            end = len(data)
+        }
+        cw.format( "%08x ", offset )
+        for i := offset; i < offset + width; i++ {
+            if i < end {
+                cw.format( " %02x", data[i] )
+            } else {
+                cw.format( "   " )
+            }
+        }
+        cw.format( "  |" )
+        for _, b := range data[offset:end] {
+            if b < 0x20 || b > 0x7e {
+                b = '.'
+            }
+            cw.format( "%c", b )
+        }
+        cw.format( "|\n" )
+    }
+    return cw.result()
+}
+
+// GetComments returns the text of all COM segments, in the order they occur.
+// Since the encoding is not specified by the standard, text that is not valid
+// UTF-8 is assumed to be ISO-8859-1 (latin 1).
+func (j *Desc)GetComments( ) []string {
+    var comments []string
+    for _, s := range j.segments {
+        if c, ok := s.(*comSeg); ok {
+            comments = append( comments, c.commentText() )
+        }
+    }
+    return comments
+}
+
+// AppAll can be given to GetAppSegments to request all APPn segments
+const AppAll = -1
+
+// GetAppSegments returns the raw payloads (the data following the segment
+// length) of all APPn segments with the argument n [0-15], or of all APPn
+// segments if n is AppAll, in the order they occur.
+func (j *Desc)GetAppSegments( n int ) [][]byte {
+    var payloads [][]byte
+    for _, s := range j.segments {
+        if ! isAppSegment( s ) {
+            continue
+        }
+        if n != AppAll && s.marker() != _APP0 + uint(n) {
+            continue
+        }
+        var aw appendWriter
+        if _, err := s.serialize( &aw ); err != nil || len(aw.buf) < 4 {
+            continue    // removed metadata is not serialized
+        }
+        payloads = append( payloads, aw.buf[4:] )
+    }
+    return payloads
+}
+
+// GetICCProfile returns the ICC profile embedded in APP2 segments, after
+// reassembling its chunks in sequence order, or nil if there is no profile.
+func (j *Desc)GetICCProfile( ) []byte {
+    const chunkHeader = len(_ICC_SIGNATURE) + 2     // + seq number & count
+    var chunks [][]byte
+    for _, s := range j.segments {
+        if ! isAppSignature( s, 2, _ICC_SIGNATURE ) {
+            continue
+        }
+        payload := s.(*appSeg).payload
+        if len(payload) < chunkHeader {
+            continue
+        }
+        seq := int(payload[len(_ICC_SIGNATURE)])    // 1 based
+        for len(chunks) < seq {
+            chunks = append( chunks, nil )
+        }
+        if seq > 0 {
+            chunks[seq-1] = payload[chunkHeader:]
+        }
+    }
+    var profile []byte
+    for _, c := range chunks {
+        profile = append( profile, c... )
+    }
+    return profile
+}
+
+// GetXMP returns the XMP packet embedded in the first XMP APP1 segment, or
+// nil if there is no XMP packet.
+func (j *Desc)GetXMP( ) []byte {
+    for _, s := range j.segments {
+        if isAppSignature( s, 1, _XMP_SIGNATURE ) {
+            payload := s.(*appSeg).payload[len(_XMP_SIGNATURE):]
+            xmp := make( []byte, len(payload) )
+            copy( xmp, payload )
+            return xmp
+        }
+    }
+    return nil
+}
+
 // GetImageInfo returns the framing information, whether it is a single frame
 // (sequential or progressive) or multiple frames (hierarchical)
 func (j *Desc)GetImageInfo( ) Framing {
     return j.process
 }
+// ImageSummary gathers in one place the information most applications need
+type ImageSummary struct {
+    Mode            EncodingMode    // baseline, sequential, progressive, lossless
+    Entropy         EntropyCoding   // Huffman or arithmetic coding
+    Frames          uint            // number of frames
+    Scans           uint            // total number of scans in all frames
+    Components      uint            // number of components in first frame
+    Subsampling     string          // chroma subsampling, e.g. "4:2:0" or ""
+    Width, Height   uint            // image size in pixels
+    ActualLines     uint            // lines actually found (see ActualLines)
+    HasEXIF         bool            // EXIF metadata is present
+    HasICC          bool            // ICC profile is present
+    HasXMP          bool            // XMP metadata is present
+    Quality         int             // estimated IJG quality [1-100], 0 if unknown
+}
+
+// GetImageSummary returns a summary of the image encoding and metadata. An
+// error is returned if the image has no frame.
+func (j *Desc)GetImageSummary( ) (*ImageSummary, error) {
+    frm := j.getFrameSegment( 0 )
+    if frm == nil {
+        return nil, fmt.Errorf( "GetImageSummary: no frame in image\n" )
+    }
+    is := new( ImageSummary )
+    is.Mode = frm.encodingMode( )
+    is.Entropy = frm.entropyCoding( )
+    is.Frames = uint(len(j.frames))
+    for _, f := range j.frames {
+        is.Scans += uint(len(f.scans))
+    }
+    is.Components = uint(len(frm.components))
+    _, is.Subsampling, _ = j.GetComponents( 0 )
+    is.Width = frm.nSamplesLine( )
+    is.Height = uint(frm.actualLines( ))
+    if lines, err := frm.actualScanLines( ); err == nil {
+        is.ActualLines = uint(lines)
+    }
+
+    for _, s := range j.segments {
+        switch s := s.(type) {
+        case *exifData:
+            if ! s.removed {
+                is.HasEXIF = true
+            }
+        case *appSeg:
+            if isAppSignature( s, 1, _XMP_SIGNATURE ) {
+                is.HasXMP = true
+            } else if isAppSignature( s, 2, _ICC_SIGNATURE ) {
+                is.HasICC = true
+            }
+        case *qtSeg:
+            if is.Quality != 0 {
+                break
+            }
+            for i := range s.data {
+                if s.data[i][0] & 0x0f == 0 {   // luminance table
+                    is.Quality = estimateQuality( &s.data[i] )
+                    break
+                }
+            }
+        }
+    }
+    return is, nil
+}
+
+// CaptureSummary is a digest of the capture information most often needed,
+// taken from EXIF metadata and from the image itself. Fields are left empty
+// or zero when the information is not available. Rational values are exact,
+// as stored in EXIF metadata.
+type CaptureSummary struct {
+    Make, Model     string          // camera maker and model
+    Lens            string          // lens model, or lens maker if no model
+    ExposureTime    Rational        // in seconds
+    FNumber         Rational        // aperture f-number
+    ISO             uint            // photographic sensitivity
+    FocalLength     Rational        // in millimeters
+    CaptureTime     time.Time       // DateTimeOriginal, or DateTime
+    HasGPS          bool            // GPS information is present
+    Width, Height   uint            // image size in pixels
+    Quality         int             // estimated IJG quality [1-100]
+}
+
+const (                             // EXIF tags used in CaptureSummary
+    _TIFF_MAKE              = 0x10f     // in IFD0 (PRIMARY)
+    _TIFF_MODEL             = 0x110
+    _TIFF_DATE_TIME         = 0x132
+    _EXIF_EXPOSURE_TIME     = 0x829a    // in EXIF IFD
+    _EXIF_FNUMBER           = 0x829d
+    _EXIF_ISO               = 0x8827
+    _EXIF_DATE_TIME_ORIG    = 0x9003
+    _EXIF_OFFSET_TIME_ORIG  = 0x9011
+    _EXIF_FOCAL_LENGTH      = 0x920a
+    _EXIF_LENS_MAKE         = 0xa433
+    _EXIF_LENS_MODEL        = 0xa434
+)
+
+// exifTime converts an EXIF date and time ("YYYY:MM:DD HH:MM:SS") to time.
+// EXIF times have no zone unless an offset ("+HH:MM") is given, in which case
+// the returned time is in UTC.
+func exifTime( dt, offset string ) time.Time {
+    const layout = "2006:01:02 15:04:05"
+    if offset != "" {
+        if t, err := time.Parse( layout + "-07:00", dt + offset ); err == nil {
+            return t.UTC()
+        }
+    }
+    t, _ := time.Parse( layout, dt )    // zero time in case of error
+    return t
+}
+
+// Summary returns a digest of the capture information: camera, lens, exposure
+// settings, capture time, GPS presence, image size and estimated quality.
+// The capture time is given in UTC if EXIF metadata indicates the time zone
+// offset; otherwise it is the camera local time, reported as UTC.
+func (j *Desc)Summary( ) *CaptureSummary {
+    cs := new( CaptureSummary )
+    if is, err := j.GetImageSummary( ); err == nil {
+        cs.Width, cs.Height, cs.Quality = is.Width, is.Height, is.Quality
+    }
+    for _, seg := range j.segments {
+        ed, ok := seg.(*exifData)
+        if ! ok || ed.removed {
+            continue
+        }
+        cs.Make = ed.ifdString( exif.PRIMARY, _TIFF_MAKE )
+        cs.Model = ed.ifdString( exif.PRIMARY, _TIFF_MODEL )
+        if cs.Lens = ed.ifdString( exif.EXIF, _EXIF_LENS_MODEL ); cs.Lens == "" {
+            cs.Lens = ed.ifdString( exif.EXIF, _EXIF_LENS_MAKE )
+        }
+        cs.ExposureTime = ed.ifdRational( exif.EXIF, _EXIF_EXPOSURE_TIME )
+        cs.FNumber = ed.ifdRational( exif.EXIF, _EXIF_FNUMBER )
+        cs.ISO = ed.ifdUint( exif.EXIF, _EXIF_ISO )
+        cs.FocalLength = ed.ifdRational( exif.EXIF, _EXIF_FOCAL_LENGTH )
+        if dt := ed.ifdString( exif.EXIF, _EXIF_DATE_TIME_ORIG ); dt != "" {
+            cs.CaptureTime = exifTime( dt,
+                                ed.ifdString( exif.EXIF, _EXIF_OFFSET_TIME_ORIG ) )
+        } else {
+            cs.CaptureTime = exifTime( ed.ifdString( exif.PRIMARY, _TIFF_DATE_TIME ), "" )
+        }
+        for tag := 0; tag <= 6 && ! cs.HasGPS; tag++ {  // version to altitude
+            _, _, err := ed.desc.GetIfdTagValue( exif.GPS, tag )
+            cs.HasGPS = err == nil
+        }
+        break
+    }
+    return cs
+}
+
+// String returns the summary as a single line, such as
+// "Canon EOS 5D, EF50mm f/1.8, 1/125s f/2.8 ISO 100 50mm, 2020-01-02 15:04:05,
+// 4000x3000, quality 92, GPS"
+func (cs *CaptureSummary) String( ) string {
+    var parts []string
+    add := func( s string ) {
+        if s = strings.TrimSpace( s ); s != "" {
+            parts = append( parts, s )
+        }
+    }
+    camera := cs.Model
+    if cs.Make != "" && ! strings.HasPrefix( cs.Model, cs.Make ) {
+        camera = cs.Make + " " + cs.Model
+    }
+    add( camera )
+    add( cs.Lens )
+    var exposure []string
+    if et := cs.ExposureTime.Simplify(); et.Num != 0 && et.Den != 0 {
+        if et.Num < et.Den {
+            exposure = append( exposure, et.String() + "s" )
+        } else {
+            exposure = append( exposure, fmt.Sprintf( "%gs", et.Float64() ) )
+        }
+    }
+    if cs.FNumber.Num != 0 && cs.FNumber.Den != 0 {
+        exposure = append( exposure, fmt.Sprintf( "f/%.1f", cs.FNumber.Float64() ) )
+    }
+    if cs.ISO > 0 {
+        exposure = append( exposure, fmt.Sprintf( "ISO %d", cs.ISO ) )
+    }
+    if cs.FocalLength.Num != 0 && cs.FocalLength.Den != 0 {
+        exposure = append( exposure,
+                           fmt.Sprintf( "%gmm", cs.FocalLength.Float64() ) )
+    }
+    add( strings.Join( exposure, " " ) )
+    if ! cs.CaptureTime.IsZero() {
+        add( cs.CaptureTime.Format( "2006-01-02 15:04:05" ) )
+    }
+    if cs.Width != 0 {
+        add( fmt.Sprintf( "%dx%d", cs.Width, cs.Height ) )
+    }
+    if cs.Quality != 0 {
+        add( fmt.Sprintf( "quality %d", cs.Quality ) )
+    }
+    if cs.HasGPS {
+        add( "GPS" )
+    }
+    return strings.Join( parts, ", " )
+}
+
+// IJG standard luminance quantization table, in natural order
+var stdLuminanceQt = [64]uint{
+    16,  11,  10,  16,  24,  40,  51,  61,
+    12,  12,  14,  19,  26,  58,  60,  55,
+    14,  13,  16,  24,  40,  57,  69,  56,
+    14,  17,  22,  29,  51,  87,  80,  62,
+    18,  22,  37,  56,  68, 109, 103,  77,
+    24,  35,  55,  64,  81, 104, 113,  92,
+    49,  64,  78,  87, 103, 121, 120, 101,
+    72,  92,  95,  98, 112, 100, 103,  99 }
+
+// estimateQuality returns the IJG quality factor that would give a table
+// closest to the argument luminance table, by averaging the scaling factors.
+func estimateQuality( qt *[65]uint16 ) int {
+    var sum uint
+    for r := 0; r < 8; r++ {
+        for c := 0; c < 8; c++ {
+            sum += (uint(qt[1+zigZagRowCol[r][c]]) * 100 * 64 +
+                    stdLuminanceQt[r*8+c] / 2) / stdLuminanceQt[r*8+c]
+        }
+    }
+    scale := (sum + 32*64) / (64*64)   // average scale in percent
+    var quality int
+    if scale == 0 {
+        quality = 100
+    } else if scale <= 100 {
+        quality = int((200 - scale + 1) / 2)
+    } else {
+        quality = int((5000 + scale/2) / scale)
+    }
+    if quality < 1 { quality = 1 } else if quality > 100 { quality = 100 }
+    return quality
+}
+
 // FormatImageInfo formats and writes the image framing information, whether
 // it is  a single frame (sequential or progressive) or multiple frames
 // (hierarchical)
@@ -43,6 +438,34 @@ func (j *Desc)getFrameSegment( fi uint ) *frame {
     return &j.frames[fi]
 }
 
+// Encoding returns the encoding process of the frame fi.
+func (j *Desc)Encoding( fi uint ) (Encoding, error) {
+    frm := j.getFrameSegment( fi )
+    if frm == nil {
+        return 0, fmt.Errorf( "Encoding: frame %d is absent\n", fi )
+    }
+    return frm.encoding, nil
+}
+
+// EntropyCoding returns the entropy coding (Huffman or arithmetic) of the
+// frame fi.
+func (j *Desc)EntropyCoding( fi uint ) (EntropyCoding, error) {
+    frm := j.getFrameSegment( fi )
+    if frm == nil {
+        return 0, fmt.Errorf( "EntropyCoding: frame %d is absent\n", fi )
+    }
+    return frm.entropyCoding( ), nil
+}
+
+// IsProgressive returns true if the frame fi is encoded in progressive mode.
+func (j *Desc)IsProgressive( fi uint ) (bool, error) {
+    frm := j.getFrameSegment( fi )
+    if frm == nil {
+        return false, fmt.Errorf( "IsProgressive: frame %d is absent\n", fi )
+    }
+    return frm.encodingMode( ) == ExtendedProgressive, nil
+}
+
 type Component struct {
     Id, HSF, VSF, QS uint8
 }
@@ -52,9 +475,30 @@ type FrameInfo struct {
     Entropy         EntropyCoding   // Huffman or arithmetic coding
     SampleSize      uint            // number of bits per pixel
     Width, Height   uint            // image size in pixels
+    ActualLines     uint            // lines actually found (see ActualLines)
     Components      []Component     // frame components
 }
 
+// ActualLines returns the true number of lines in the given frame, without
+// modifying the image. It is the number of lines given in the frame header or
+// in a DNL segment if it is consistent with the scans, or the number of lines
+// actually found in scans otherwise (e.g. for a frame header with 0 lines and
+// no DNL segment), which is rounded up to a multiple of 8.
+func (j *Desc)ActualLines( frame int ) (uint, error) {
+    if frame < 0 {
+        return 0, fmt.Errorf( "ActualLines: frame %d is absent\n", frame )
+    }
+    frm := j.getFrameSegment( uint(frame) )
+    if frm == nil {
+        return 0, fmt.Errorf( "ActualLines: frame %d is absent\n", frame )
+    }
+    lines, err := frm.actualScanLines( )
+    if err != nil {
+        return 0, jpgForwardError( "ActualLines", err )
+    }
+    return uint(lines), nil
+}
+
 // GetFrameInfo returns encoding information about a specific frame, indentified
 // by the argument frame. An error is returned if the requested frame does not
 // exist. For non-hierarchical modes, only one frame (0) is used.
@@ -70,17 +514,113 @@ func (j *Desc)GetFrameInfo( fi uint ) (*FrameInfo, error) {
     finfo.SampleSize = frm.samplePrecision( )
     finfo.Width = frm.nSamplesLine( )
     finfo.Height = uint(frm.actualLines( ))
+    if lines, err := frm.actualScanLines( ); err == nil {
+        finfo.ActualLines = uint(lines)
+    }
 
     finfo.Components = make( []Component, len(frm.components) )
     for i, cmp := range frm.components {
         finfo.Components[i].Id = cmp.Id
-        finfo.Components[i].Id = cmp.HSF
-        finfo.Components[i].Id = cmp.VSF
-        finfo.Components[i].Id = cmp.QS
+        finfo.Components[i].HSF = cmp.HSF
+        finfo.Components[i].VSF = cmp.VSF
+        finfo.Components[i].QS = cmp.QS
     }
     return finfo, nil
 }
 
+type ComponentInfo struct {
+    Id, HSF, VSF, QS uint8      // id, sampling factors & quantization selector
+    UnitsRow        uint        // number of data units per row
+}
+
+// GetComponents returns the description of all components in a specific
+// frame, indentified by the argument fi, as well as the chroma subsampling
+// formula (e.g. "4:2:0") if it can be expressed, or an empty string. An error
+// is returned if the requested frame does not exist. For non-hierarchical
+// modes, only one frame (0) is used.
+func (j *Desc)GetComponents( fi uint ) ([]ComponentInfo, string, error) {
+    frm := j.getFrameSegment( fi )
+    if frm == nil {
+        return nil, "", fmt.Errorf( "GetComponents: frame %d is absent\n", fi )
+    }
+
+    cInfos := make( []ComponentInfo, len(frm.components) )
+    hsf := make( []uint8, len(frm.components) )
+    vsf := make( []uint8, len(frm.components) )
+    for i, cmp := range frm.components {
+        cInfos[i] = ComponentInfo{ cmp.Id, cmp.HSF, cmp.VSF, cmp.QS, cmp.nUnitsRow }
+        hsf[i], vsf[i] = cmp.HSF, cmp.VSF
+    }
+    return cInfos, chromaSubsampling( hsf, vsf ), nil
+}
+
+type ScanComponent struct {
+    Selector        uint8       // component id, matching a frame component Id
+    DCTable         uint8       // DC entropy coding table id
+    ACTable         uint8       // AC entropy coding table id
+}
+
+type ScanInfo struct {
+    Components      []ScanComponent // scan components, in scan order
+    StartSS, EndSS  uint8       // start and end of spectral selection
+    Ah, Al          uint8       // successive approximation bit position high, low
+    MCUs            uint        // total number of MCUs in scan
+    RestartInterval uint        // number of MCUs between restarts (0 if none)
+    Restarts        uint        // number of restarts in scan
+    ECSLength       uint        // entropy coded data length in bytes
+    HeaderLength    uint        // SOS segment length in bytes, with marker
+    BitsPerMCU      float64     // average entropy coded bits per MCU
+    FileShare       float64     // share of the file size (header + ECS) in %
+}
+
+// scanSize returns the size in bytes of the SOS segment header, including
+// its marker, and of the following entropy coded data.
+func (s *scan)scanSize( ) (header, ecs uint) {
+    header = uint(2 + fixedScanHeaderSize +      // marker + Ls bytes
+                  len(s.sComps) * scanComponentSpecSize)
+    return header, uint(len(s.ECSs))
+}
+
+// scanRates returns the average number of entropy coded bits per MCU and the
+// percentage of the file size used by the scan (header and ECS).
+func (jpg *Desc)scanRates( s *scan ) (bitsPerMCU, fileShare float64) {
+    header, ecs := s.scanSize( )
+    if s.nMcus != 0 {
+        bitsPerMCU = float64(ecs * 8) / float64(s.nMcus)
+    }
+    if len(jpg.data) != 0 {
+        fileShare = float64(header + ecs) * 100 / float64(len(jpg.data))
+    }
+    return
+}
+
+// GetScans returns the description of all scans in a specific frame,
+// indentified by the argument fi. An error is returned if the requested frame
+// does not exist. For non-hierarchical modes, only one frame (0) is used.
+func (j *Desc)GetScans( fi uint ) ([]ScanInfo, error) {
+    frm := j.getFrameSegment( fi )
+    if frm == nil {
+        return nil, fmt.Errorf( "GetScans: frame %d is absent\n", fi )
+    }
+
+    sInfos := make( []ScanInfo, len(frm.scans) )
+    for i, sc := range frm.scans {
+        si := &sInfos[i]
+        si.Components = make( []ScanComponent, len(sc.sComps) )
+        for k, scmp := range sc.sComps {
+            si.Components[k] = ScanComponent{ scmp.cId, scmp.dcId, scmp.acId }
+        }
+        si.StartSS, si.EndSS = sc.startSS, sc.endSS
+        si.Ah, si.Al = sc.sABPh, sc.sABPl
+        si.MCUs = sc.nMcus
+        si.RestartInterval = sc.rstInterval
+        si.Restarts = sc.rstCount
+        si.HeaderLength, si.ECSLength = sc.scanSize( )
+        si.BitsPerMCU, si.FileShare = j.scanRates( &frm.scans[i] )
+    }
+    return sInfos, nil
+}
+
 // FormatFrameInfo writes a textual description of a specific frame encoding
 // information. An error is returned if the requested frame does not exist.
 // For non-hierarchical modes, only one frame (0) is used.
@@ -207,6 +747,41 @@ func (j *Desc)formatQuantizationSegment( w io.Writer, frame uint, d int,
     return j.formatQuantization( w, frame, d, m, false )
 }
 
+// QuantizationTable describes one quantization table, as defined in a DQT
+// segment. Values are given in both zig-zag (as encoded) and natural order.
+type QuantizationTable struct {
+    Destination     uint8       // destination id [0-3]
+    Precision       uint        // value precision in bits (8 or 16)
+    ZigZag          [64]uint16  // values in zig-zag order
+    Natural         [64]uint16  // values in natural (row, col) order
+}
+
+// GetQuantizationTables returns all quantization tables in the order they are
+// defined in the JPEG data. A destination can appear multiple times if it
+// is redefined.
+func (j *Desc)GetQuantizationTables( ) []QuantizationTable {
+    var qts []QuantizationTable
+    for _, s := range j.segments {
+        qs, ok := s.(*qtSeg)
+        if ! ok {
+            continue
+        }
+        for _, qt := range qs.data {
+            var t QuantizationTable
+            t.Destination = uint8(qt[0] & 0x0f)
+            t.Precision = 8 * uint((qt[0] >> 8) + 1)
+            copy( t.ZigZag[:], qt[1:] )
+            for r := 0; r < 8; r++ {
+                for c := 0; c < 8; c++ {
+                    t.Natural[r*8+c] = qt[1+zigZagRowCol[r][c]]
+                }
+            }
+            qts = append( qts, t )
+        }
+    }
+    return qts
+}
+
 func (j *Desc)getHuffmanSegmentsForFrame( n uint ) ([]*htSeg, error) {
     var first, beyond int
     if n > 0 {
@@ -232,6 +807,48 @@ func (j *Desc)getHuffmanSegmentsForFrame( n uint ) ([]*htSeg, error) {
     return hts, nil
 }
 
+// HuffmanTable describes one huffman table, as defined in a DHT segment.
+// Bits and Values are the BITS and HUFFVAL arrays from the specification.
+// Lengths and Codes are derived from them and give for each symbol in Values
+// the code length in bits and the code itself.
+type HuffmanTable struct {
+    Class           uint8       // 0 for DC, 1 for AC
+    Destination     uint8       // destination id [0-3]
+    Bits            [16]uint8   // number of codes for each length 1 to 16
+    Values          []uint8     // symbols in order of increasing code length
+    Lengths         []uint8     // code length for each symbol in Values
+    Codes           []uint16    // code for each symbol in Values
+}
+
+// GetHuffmanTables returns all huffman tables in the order they are defined
+// in the JPEG data. A class and destination can appear multiple times if the
+// table is redefined.
+func (j *Desc)GetHuffmanTables( ) []HuffmanTable {
+    var hts []HuffmanTable
+    for _, s := range j.segments {
+        hs, ok := s.(*htSeg)
+        if ! ok {
+            continue
+        }
+        for _, ht := range hs.htcds {
+            t := HuffmanTable{ Class: ht.hc, Destination: ht.hd }
+            code := uint16(0)   // canonical huffman codes (ISO 10918-1 C.2)
+            for l := 0; l < 16; l++ {
+                t.Bits[l] = uint8(len(ht.data[l]))
+                for _, v := range ht.data[l] {
+                    t.Values = append( t.Values, v )
+                    t.Lengths = append( t.Lengths, uint8(l+1) )
+                    t.Codes = append( t.Codes, code )
+                    code ++
+                }
+                code <<= 1
+            }
+            hts = append( hts, t )
+        }
+    }
+    return hts
+}
+
 func (j *Desc)formatHuffmanEntropy( w io.Writer, fr uint, dest int,
                                     m FormatMode, skip bool ) (n int, err error) {
     type htindex struct{ ht *htSeg; index int }
@@ -315,7 +932,7 @@ func (j *Desc)formatScanSegment( w io.Writer, frame uint, index int,
     }
     scs := frm.scans
     if index >= len(frm.scans) {
-        return 0, fmt.Errorf( "formatEntropySegment: scan %s does not exist for frame %d\n",
+        return 0, fmt.Errorf( "formatEntropySegment: scan %d does not exist for frame %d\n",
                               index, frame )
     }
     cw := newCumulativeWriter( w )
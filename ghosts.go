@@ -0,0 +1,185 @@
+package jpeg
+
+// support for recompression quality estimation (JPEG ghosts)
+
+import (
+    "fmt"
+    "math"
+    "sort"
+)
+
+const (
+    _MIN_GHOST_DEPTH = 0.05     // min relative error dip for a ghost
+)
+
+// Ghost is a local minimum of the requantization error, at the quality of a
+// likely compression generation.
+type Ghost struct {
+    Quality     int         // IJG quality factor [1-100]
+    Depth       float64     // relative dip of the error compared to the
+                            // neighbouring qualities, in ]0, 1]
+}
+
+// GhostAnalysis is the result of AnalyzeGhosts
+type GhostAnalysis struct {
+    Errors          [101]float64    // mean squared requantization error for
+                                    // each quality in [1-100] (index 0 unused)
+    CurrentQuality  int             // estimated from the current DQT tables
+    Ghosts          []Ghost         // local error minima, deepest first
+    PriorQuality    int             // deepest ghost below CurrentQuality, 0
+                                    // if there is no sign of a prior generation
+}
+
+// ijgLuminanceTable returns the IJG baseline luminance quantization table
+// for the given quality, in natural order.
+func ijgLuminanceTable( quality int ) (qt [64]float64) {
+    scale := 200 - 2 * quality
+    if quality < 50 {
+        scale = 5000 / quality
+    }
+    for i, v := range stdLuminanceQt {
+        q := (int(v) * scale + 50) / 100
+        if q < 1 { q = 1 } else if q > 255 { q = 255 }
+        qt[i] = float64(q)
+    }
+    return
+}
+
+var fdctCos [8][8]float64       // fdctCos[u][x] = C(u)/2 * cos((2x+1)uπ/16)
+
+func init( ) {
+    for u := 0; u < 8; u++ {
+        cu := 0.5
+        if u == 0 {
+            cu = 0.5 / math.Sqrt2
+        }
+        for x := 0; x < 8; x++ {
+            fdctCos[u][x] = cu * math.Cos( float64((2*x+1)*u) * math.Pi / 16 )
+        }
+    }
+}
+
+// forwardDCT8 returns the DCT coefficients of the 8x8 block of samples
+// starting at start, in natural order.
+func forwardDCT8( start []uint8, stride int ) (coefs [64]float64) {
+    var tmp [64]float64
+    for y := 0; y < 8; y++ {        // rows
+        row := start[y*stride:]
+        for u := 0; u < 8; u++ {
+            var s float64
+            for x := 0; x < 8; x++ {
+                s += (float64(row[x]) - 128) * fdctCos[u][x]
+            }
+            tmp[y*8+u] = s
+        }
+    }
+    for u := 0; u < 8; u++ {        // columns
+        for v := 0; v < 8; v++ {
+            var s float64
+            for y := 0; y < 8; y++ {
+                s += tmp[y*8+u] * fdctCos[v][y]
+            }
+            coefs[v*8+u] = s
+        }
+    }
+    return
+}
+
+// AnalyzeGhosts looks for traces of previous compressions of the first frame
+// (JPEG ghosts). The decoded luma samples are transformed back in DCT domain,
+// and the coefficients are requantized with the IJG luminance tables for all
+// qualities from 1 to 100. The mean squared requantization error generally
+// decreases with quality, except for dips at the qualities that were used
+// to compress the picture: the last compression quality, and, if the picture
+// was decoded and compressed again with a higher quality, the previous
+// generation quality. Dips also appear above the current quality, for tables
+// whose steps nearly divide the current ones, and a prior generation with a
+// higher quality than the current one leaves no trace: the prior generation
+// is therefore searched only below the current quality. Only complete 8x8
+// blocks inside the image are used.
+//
+// The analysis is reliable only for pictures compressed with IJG-like tables.
+func (jpg *Desc) AnalyzeGhosts( ) (*GhostAnalysis, error) {
+    if len(jpg.frames) == 0 {
+        return nil, fmt.Errorf( "AnalyzeGhosts: no frame\n" )
+    }
+    frm := &jpg.frames[0]
+    samples, err := jpg.MakeFrameRawPicture( 0 )
+    if err != nil {
+        return nil, jpgForwardError( "AnalyzeGhosts", err )
+    }
+    y := &frm.components[0]
+    plane := *samples[0]
+    stride := int(y.nUnitsRow << 3)
+    cols, rows := frm.componentSize( y )
+    if rows > len(plane) / stride {
+        rows = len(plane) / stride
+    }
+    if cols < 8 || rows < 8 {
+        return nil, fmt.Errorf( "AnalyzeGhosts: image is smaller than one block\n" )
+    }
+
+    var tables [101][64]float64
+    for q := 1; q <= 100; q++ {
+        tables[q] = ijgLuminanceTable( q )
+    }
+    ga := new( GhostAnalysis )
+    var nBlocks int
+    for r := 0; r + 8 <= rows; r += 8 {
+        for c := 0; c + 8 <= cols; c += 8 {
+            coefs := forwardDCT8( plane[r*stride+c:], stride )
+            for q := 1; q <= 100; q++ {
+                var e float64
+                for k, v := range coefs {
+                    d := v - tables[q][k] * math.Round( v / tables[q][k] )
+                    e += d * d
+                }
+                ga.Errors[q] += e
+            }
+            nBlocks ++
+        }
+    }
+    for q := 1; q <= 100; q++ {
+        ga.Errors[q] /= float64(nBlocks * 64)
+    }
+
+    // qualities giving the same table also give the same error: compare each
+    // plateau with the closest different errors on both sides.
+    for q := 2; q < 100; q++ {
+        if ga.Errors[q] == ga.Errors[q-1] {
+            continue                            // inside a plateau
+        }
+        end := q
+        for end < 100 && ga.Errors[end+1] == ga.Errors[q] {
+            end ++
+        }
+        if end == 100 {
+            break
+        }
+        before, after := ga.Errors[q-1], ga.Errors[end+1]
+        if ga.Errors[q] < before && ga.Errors[q] < after {
+            depth := 1 - ga.Errors[q] / ((before + after) / 2)
+            if depth >= _MIN_GHOST_DEPTH {
+                ga.Ghosts = append( ga.Ghosts, Ghost{ q, depth } )
+            }
+        }
+    }
+    sort.SliceStable( ga.Ghosts, func( i, j int ) bool {
+        return ga.Ghosts[i].Depth > ga.Ghosts[j].Depth
+    } )
+
+    qt := y.qt                          // luma table, in zigzag order
+    if qt == nil {
+        qt = &jpg.qdefs[y.QS]
+    }
+    var t [65]uint16
+    copy( t[1:], qt.values[:] )
+    ga.CurrentQuality = estimateQuality( &t )
+    for _, g := range ga.Ghosts {
+        if g.Quality < ga.CurrentQuality - 2 {
+            ga.PriorQuality = g.Quality
+            break
+        }
+    }
+    return ga, nil
+}
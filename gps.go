@@ -0,0 +1,57 @@
+package jpeg
+
+// support for EXIF GPS information
+
+import (
+    "fmt"
+    "strings"
+    "time"
+    "github.com/jrm-1535/exif"
+)
+
+const (                             // GPS IFD tags giving the GPS time
+    _GPS_TIME_STAMP     = 0x07      // 3 RATIONAL: hour, minute, second (UTC)
+    _GPS_DATE_STAMP     = 0x1d      // ASCII "YYYY:MM:DD"
+)
+
+// GPSTime combines the GPS IFD GPSDateStamp and GPSTimeStamp tags into a UTC
+// time, including fractions of seconds. A leap second (60) is folded into the
+// following minute. An error is returned if there is no GPS information or
+// if either tag is missing or invalid.
+func (jpg *Desc) GPSTime( ) (time.Time, error) {
+    for _, seg := range jpg.segments {
+        ed, ok := seg.(*exifData)
+        if ! ok || ed.removed {
+            continue
+        }
+        date := ed.ifdString( exif.GPS, _GPS_DATE_STAMP )
+        if date == "" {
+            return time.Time{}, fmt.Errorf( "GPSTime: no GPSDateStamp\n" )
+        }
+        var y, mo, d int
+        if n, _ := fmt.Sscanf( strings.ReplaceAll( date, "-", ":" ), "%d:%d:%d",
+                               &y, &mo, &d ); n != 3 {
+            return time.Time{}, fmt.Errorf( "GPSTime: invalid GPSDateStamp %q\n", date )
+        }
+        st, v, err := ed.desc.GetIfdTagValue( exif.GPS, _GPS_TIME_STAMP )
+        if err != nil || st != exif.URationalSlice {
+            return time.Time{}, fmt.Errorf( "GPSTime: no GPSTimeStamp\n" )
+        }
+        hms := v.([]exif.UnsignedRational)
+        if len(hms) != 3 {
+            return time.Time{}, fmt.Errorf( "GPSTime: invalid GPSTimeStamp\n" )
+        }
+        var parts [3]float64
+        for i, r := range hms {
+            if r.Denominator == 0 {
+                return time.Time{}, fmt.Errorf( "GPSTime: invalid GPSTimeStamp\n" )
+            }
+            parts[i] = float64(r.Numerator) / float64(r.Denominator)
+        }
+        seconds := parts[0] * 3600 + parts[1] * 60 + parts[2]
+        t := time.Date( y, time.Month(mo), d, 0, 0, 0, 0, time.UTC )
+        return t.Add( time.Duration( seconds * float64(time.Second) ).
+                      Round( time.Millisecond ) ), nil
+    }
+    return time.Time{}, fmt.Errorf( "GPSTime: no GPS information\n" )
+}
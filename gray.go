@@ -0,0 +1,73 @@
+package jpeg
+
+// support for detecting grayscale pictures stored as YCbCr
+
+import (
+    "fmt"
+)
+
+const (
+    _GRAY_MAX_DEVIATION = 2     // max chroma deviation from neutral for gray
+    _NEUTRAL_CHROMA     = 128   // Cb, Cr value for no color
+)
+
+// GrayscaleReport is the result of DetectGrayscale
+type GrayscaleReport struct {
+    Components      int         // number of components in frame
+    ChromaEnergy    float64     // mean squared deviation of Cb and Cr samples
+                                // from neutral (128)
+    MaxDeviation    int         // largest absolute deviation from neutral
+    Grayscale       bool        // effectively grayscale
+}
+
+// DetectGrayscale decodes the chroma components of the first frame and
+// measures their deviation from the neutral value. A picture is reported as
+// effectively grayscale if it has a single component, or if no visible
+// chroma sample deviates from neutral by more than the rounding errors of
+// the inverse DCT (2). Such a picture could be stored as a single component
+// without visible change, all its information being carried by luma.
+func (jpg *Desc) DetectGrayscale( ) (*GrayscaleReport, error) {
+    if len(jpg.frames) == 0 {
+        return nil, fmt.Errorf( "DetectGrayscale: no frame\n" )
+    }
+    frm := &jpg.frames[0]
+    gr := &GrayscaleReport{ Components: len(frm.components) }
+    switch len(frm.components) {
+    case 1:
+        gr.Grayscale = true
+        return gr, nil
+    case 3:
+    default:
+        return nil, fmt.Errorf( "DetectGrayscale: not YCbCr or Gray scale picture\n" )
+    }
+    samples, err := jpg.MakeFrameRawPicture( 0 )
+    if err != nil {
+        return nil, jpgForwardError( "DetectGrayscale", err )
+    }
+    var sum float64
+    var n int
+    for ci := 1; ci < 3; ci++ {
+        cmp := &frm.components[ci]
+        plane := *samples[ci]
+        stride := int(cmp.nUnitsRow << 3)
+        cols, rows := frm.componentSize( cmp )
+        if rows > len(plane) / stride {     // missing rows in scan
+            rows = len(plane) / stride
+        }
+        for r := 0; r < rows; r++ {
+            for _, v := range plane[r*stride:r*stride+cols] {
+                d := absDiff( v, _NEUTRAL_CHROMA )
+                if d > gr.MaxDeviation {
+                    gr.MaxDeviation = d
+                }
+                sum += float64(d * d)
+            }
+        }
+        n += rows * cols
+    }
+    if n > 0 {
+        gr.ChromaEnergy = sum / float64(n)
+    }
+    gr.Grayscale = gr.MaxDeviation <= _GRAY_MAX_DEVIATION
+    return gr, nil
+}
@@ -0,0 +1,155 @@
+package jpeg
+
+// support for detecting block grid misalignment (splicing)
+
+import (
+    "fmt"
+    "sort"
+)
+
+const (
+    _GRID_TILE          = 64    // size of square regions for local grid phase
+    _GRID_MIN_STRENGTH  = 0.1   // min peak strength for a meaningful phase
+)
+
+// GridRegion gives the local block grid phase in one region
+type GridRegion struct {
+    X, Y            int     // top left corner of region, in samples
+    Width, Height   int     // region size, in samples
+    PhaseX, PhaseY  int     // column and row of block boundaries, modulo 8
+    Strength        float64 // relative strength of the boundary discontinuity
+}
+
+// GridReport is the result of AnalyzeGrid
+type GridReport struct {
+    PhaseX, PhaseY  int             // dominant grid phase, over the whole image
+    Strength        float64         // dominant phase strength
+    Regions         []GridRegion    // all regions with a meaningful phase
+    Shifted         []GridRegion    // regions whose phase differs from the
+                                    // dominant one, strongest first
+}
+
+// gridPhase returns the phase at which the mean discontinuity is the
+// highest, and its strength: the difference between the highest and median
+// mean discontinuities, relative to the median.
+func gridPhase( sums *[8]float64 ) (phase int, strength float64) {
+    var sorted [8]float64
+    copy( sorted[:], sums[:] )
+    sort.Float64s( sorted[:] )
+    median := (sorted[3] + sorted[4]) / 2
+    for k := 1; k < 8; k++ {
+        if sums[k] > sums[phase] {
+            phase = k
+        }
+    }
+    if median > 0 {
+        strength = (sums[phase] - median) / median
+    }
+    return
+}
+
+// discontinuity returns the excess of the gradient between samples b and c
+// over the mean of the neighbouring gradients, a to b and c to d. It is zero
+// in smooth (linear) areas, and maximum for a step between b and c.
+func discontinuity( a, b, c, d uint8 ) float64 {
+    e := 3 * (int(c) - int(b)) + int(a) - int(d)
+    if e < 0 {
+        e = -e
+    }
+    return float64(e) / 2
+}
+
+// discontinuities accumulates, for each phase modulo 8, the discontinuities
+// between adjacent columns (h) and adjacent rows (v) in the given area, within
+// a plane of cols x rows samples.
+func discontinuities( plane []uint8, stride, cols, rows, x0, y0, x1, y1 int,
+                      h, v *[8]float64 ) {
+    for y := y0; y < y1; y++ {
+        for x := x0; x < x1; x++ {
+            i := y * stride + x
+            if x >= 2 && x + 1 < cols {
+                h[x & 7] += discontinuity( plane[i-2], plane[i-1],
+                                           plane[i], plane[i+1] )
+            }
+            if y >= 2 && y + 1 < rows {
+                v[y & 7] += discontinuity( plane[i-2*stride], plane[i-stride],
+                                           plane[i], plane[i+stride] )
+            }
+        }
+    }
+}
+
+// AnalyzeGrid measures the phase of the 8x8 block grid in the luma samples of
+// the first frame, over the whole image and locally in regions of 64x64
+// samples, in storage orientation. Block boundaries appear as a periodic
+// excess of gradient between adjacent samples compared with the neighbouring
+// gradients, and the phase is where this excess is maximum. A compressed picture has its dominant phase at
+// (0, 0), unless it was cropped after decoding and compressed again. Regions
+// whose phase differs from the dominant one are likely pasted from another
+// JPEG picture (splicing). Regions too smooth or too compressed to show a
+// clear phase (strength below 0.1) are ignored.
+func (jpg *Desc) AnalyzeGrid( ) (*GridReport, error) {
+    if len(jpg.frames) == 0 {
+        return nil, fmt.Errorf( "AnalyzeGrid: no frame\n" )
+    }
+    frm := &jpg.frames[0]
+    samples, err := jpg.MakeFrameRawPicture( 0 )
+    if err != nil {
+        return nil, jpgForwardError( "AnalyzeGrid", err )
+    }
+    y := &frm.components[0]
+    plane := *samples[0]
+    stride := int(y.nUnitsRow << 3)
+    cols, rows := frm.componentSize( y )
+    if rows > len(plane) / stride {
+        rows = len(plane) / stride
+    }
+    if cols < 16 || rows < 16 {
+        return nil, fmt.Errorf( "AnalyzeGrid: image is too small\n" )
+    }
+
+    gr := new( GridReport )
+    var hAll, vAll [8]float64
+    for ty := 0; ty < rows; ty += _GRID_TILE {
+        for tx := 0; tx < cols; tx += _GRID_TILE {
+            x1, y1 := tx + _GRID_TILE, ty + _GRID_TILE
+            if x1 > cols { x1 = cols }
+            if y1 > rows { y1 = rows }
+            var h, v [8]float64
+            discontinuities( plane, stride, cols, rows, tx, ty, x1, y1, &h, &v )
+            for k := 0; k < 8; k++ {
+                hAll[k] += h[k]
+                vAll[k] += v[k]
+            }
+            if x1 - tx < 16 || y1 - ty < 16 {   // too small for a local phase
+                continue
+            }
+            px, sx := gridPhase( &h )
+            py, sy := gridPhase( &v )
+            strength := sx
+            if sy < strength {
+                strength = sy
+            }
+            if strength >= _GRID_MIN_STRENGTH {
+                gr.Regions = append( gr.Regions, GridRegion{ tx, ty,
+                                        x1 - tx, y1 - ty, px, py, strength } )
+            }
+        }
+    }
+    var sx, sy float64
+    gr.PhaseX, sx = gridPhase( &hAll )
+    gr.PhaseY, sy = gridPhase( &vAll )
+    gr.Strength = sx
+    if sy < sx {
+        gr.Strength = sy
+    }
+    for _, r := range gr.Regions {
+        if r.PhaseX != gr.PhaseX || r.PhaseY != gr.PhaseY {
+            gr.Shifted = append( gr.Shifted, r )
+        }
+    }
+    sort.SliceStable( gr.Shifted, func( i, j int ) bool {
+        return gr.Shifted[i].Strength > gr.Shifted[j].Strength
+    } )
+    return gr, nil
+}
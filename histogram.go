@@ -0,0 +1,72 @@
+package jpeg
+
+// support for histograms and exposure statistics
+
+import (
+    "fmt"
+    "image/color"
+)
+
+// ChannelHistogram gives the sample distribution of one channel
+type ChannelHistogram struct {
+    Channel     string      // "Y" (luminance), "R", "G" or "B"
+    Counts      [256]uint   // number of samples for each value
+    Black       float64     // percentage of samples clipped to 0
+    White       float64     // percentage of samples clipped to 255
+    Mean        float64     // mean sample value
+    Median      uint8       // median sample value
+}
+
+func (ch *ChannelHistogram) setStatistics( total uint ) {
+    var sum, cumul uint
+    half := (total + 1) / 2
+    median := -1
+    for v, n := range ch.Counts {
+        sum += uint(v) * n
+        cumul += n
+        if median == -1 && cumul >= half {
+            median = v
+        }
+    }
+    ch.Black = float64(ch.Counts[0]) * 100 / float64(total)
+    ch.White = float64(ch.Counts[255]) * 100 / float64(total)
+    ch.Mean = float64(sum) / float64(total)
+    ch.Median = uint8(median)
+}
+
+// Histogram decodes the first frame and returns the histograms of its
+// channels, with their clipping percentages, mean and median values, all
+// computed in the same pass. The first channel is always the luminance (Y);
+// color pictures are followed by R, G and B channels after conversion, as
+// given by ScaledImage. Only the visible samples are counted.
+func (jpg *Desc) Histogram( ) ([]ChannelHistogram, error) {
+    cols, rows, planes, err := jpg.fullPlanes( )
+    if err != nil {
+        return nil, jpgForwardError( "Histogram", err )
+    }
+    total := uint(cols * rows)
+    if total == 0 {
+        return nil, fmt.Errorf( "Histogram: empty image\n" )
+    }
+    var hs []ChannelHistogram
+    if len(planes) == 1 {
+        hs = []ChannelHistogram{ { Channel: "Y" } }
+        for _, v := range planes[0] {
+            hs[0].Counts[v] ++
+        }
+    } else {
+        hs = []ChannelHistogram{ { Channel: "Y" }, { Channel: "R" },
+                                 { Channel: "G" }, { Channel: "B" } }
+        for i, y := range planes[0] {
+            r, g, b := color.YCbCrToRGB( y, planes[1][i], planes[2][i] )
+            hs[0].Counts[y] ++
+            hs[1].Counts[r] ++
+            hs[2].Counts[g] ++
+            hs[3].Counts[b] ++
+        }
+    }
+    for i := range hs {
+        hs[i].setStatistics( total )
+    }
+    return hs, nil
+}
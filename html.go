@@ -0,0 +1,142 @@
+package jpeg
+
+// support for HTML reports
+
+import (
+    "fmt"
+    "bytes"
+    "encoding/base64"
+    "github.com/jrm-1535/exif"
+    "html"
+    "io"
+)
+
+const htmlHeader = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>JPEG report</title>
+<style>
+body { font-family: sans-serif; margin: 1em 2em; }
+details { margin: 0.3em 0 0.3em 1em; }
+summary { cursor: pointer; font-weight: bold; }
+pre { background: #f4f4f4; padding: 0.5em; overflow-x: auto; }
+table { border-collapse: collapse; margin: 0.5em 0; }
+td, th { border: 1px solid #bbb; padding: 0.15em 0.5em; text-align: right;
+         font-family: monospace; }
+caption { font-weight: bold; text-align: left; }
+img { border: 1px solid #bbb; margin: 0.5em 0; }
+</style>
+</head>
+<body>
+`
+
+const htmlTrailer = `</body>
+</html>
+`
+
+// FormatHTML writes a self-contained HTML report describing the image: a
+// collapsible tree of segments, quantization matrices as tables, huffman code
+// listings, and thumbnails found in metadata embedded as data URIs.
+func (jpg *Desc) FormatHTML( w io.Writer ) (n int, err error) {
+    cw := newCumulativeWriter( w )
+    cw.format( "%s", htmlHeader )
+    cw.format( "<h1>JPEG report</h1>\n" )
+
+    var b bytes.Buffer
+    jpg.FormatImageInfo( &b )
+    for i := uint(0); i < jpg.GetNumberOfFrames(); i++ {
+        jpg.FormatFrameInfo( &b, i )
+    }
+    formatHTMLText( cw, b.Bytes() )
+
+    cw.format( "<details open>\n<summary>Segments (%d)</summary>\n",
+               len(jpg.segments) )
+    for i, s := range jpg.segments {
+        cw.format( "<details>\n<summary>#%d %s</summary>\n", i,
+                   html.EscapeString( getJPEGmarkerName( s.marker() ) ) )
+        switch s := s.(type) {
+        case *qtSeg:
+            formatHTMLQuantization( cw, s )
+        case *htSeg:
+            formatHTMLHuffman( cw, s )
+        default:
+            b.Reset()
+            s.format( &b )
+            formatHTMLText( cw, b.Bytes() )
+        }
+        if ed, ok := s.(*exifData); ok {
+            formatHTMLThumbnails( cw, ed )
+        }
+        cw.format( "</details>\n" )
+    }
+    cw.format( "</details>\n" )
+    cw.format( "%s", htmlTrailer )
+    n, err = cw.result()
+    if err != nil {
+        err = jpgForwardError( "FormatHTML", err )
+    }
+    return
+}
+
+func formatHTMLText( cw *cumulativeWriter, text []byte ) {
+    if len(text) > 0 {
+        cw.format( "<pre>%s</pre>\n", html.EscapeString( string(text) ) )
+    }
+}
+
+func formatHTMLQuantization( cw *cumulativeWriter, qs *qtSeg ) {
+    for _, qt := range qs.data {
+        cw.format( "<table>\n<caption>Quantization table %d, %d-bit</caption>\n",
+                   qt[0] & 0x0f, 8 * ((qt[0] >> 8) + 1) )
+        for r := 0; r < 8; r++ {
+            cw.format( "<tr>" )
+            for c := 0; c < 8; c++ {
+                cw.format( "<td>%d</td>", qt[1+zigZagRowCol[r][c]] )
+            }
+            cw.format( "</tr>\n" )
+        }
+        cw.format( "</table>\n" )
+    }
+}
+
+func formatHTMLHuffman( cw *cumulativeWriter, hs *htSeg ) {
+    for _, ht := range hs.htcds {
+        class := "DC"
+        if ht.hc != 0 {
+            class = "AC"
+        }
+        cw.format( "<details>\n<summary>Huffman table %s%d</summary>\n",
+                   class, ht.hd )
+        cw.format( "<table>\n<tr><th>length</th><th>code</th><th>symbol</th></tr>\n" )
+        code := uint(0)             // canonical huffman codes (ISO 10918-1 C.2)
+        for l := 0; l < 16; l++ {
+            for _, symbol := range ht.data[l] {
+                cw.format( "<tr><td>%d</td><td>%0*b</td><td>0x%02x</td></tr>\n",
+                           l+1, l+1, code, symbol )
+                code ++
+            }
+            code <<= 1
+        }
+        cw.format( "</table>\n</details>\n" )
+    }
+}
+
+func formatHTMLThumbnails( cw *cumulativeWriter, ed *exifData ) {
+    for i, thbn := range ed.desc.GetThumbnailInfo() {
+        cw.format( "<p>Thumbnail #%d: %s, %d bytes in %s IFD</p>\n", i,
+                   html.EscapeString( exif.GetCompressionName(thbn.Comp) ),
+                   thbn.Size, html.EscapeString( exif.GetIfdName(thbn.Origin) ) )
+        if thbn.Comp != exif.JPEG {
+            continue
+        }
+        data, err := ed.desc.GetThumbnailData( thbn.Origin )
+        if err != nil {
+            cw.format( "<p>%s</p>\n",
+                       html.EscapeString( fmt.Sprintf( "%v", err ) ) )
+            continue
+        }
+        cw.format( "<img alt=\"thumbnail #%d\" src=\"data:image/jpeg;base64,%s\">\n",
+                   i, base64.StdEncoding.EncodeToString( data ) )
+    }
+}
@@ -0,0 +1,132 @@
+package jpeg
+
+// support for indexing JPEG data through io.ReaderAt
+
+import (
+    "fmt"
+    "io"
+)
+
+const (
+    _INDEX_CHUNK    = 65536     // read size when looking for the end of ECS
+)
+
+type indexReader struct {
+    r       io.ReaderAt
+    size    int64
+}
+
+func (ir *indexReader)read( offset int64, n int ) ([]byte, error) {
+    if offset < 0 || offset + int64(n) > ir.size {
+        return nil, fmt.Errorf( "unexpected end of data at offset %d\n", offset )
+    }
+    b := make( []byte, n )
+    r, err := ir.r.ReadAt( b, offset )
+    if r == n {                 // io.EOF is allowed with a complete read
+        return b, nil
+    }
+    return nil, fmt.Errorf( "read error at offset %d: %v\n", offset, err )
+}
+
+// endOfEcs returns the offset of the marker that ends the entropy coded
+// segment starting at offset, skipping RSTn markers and stuffed bytes.
+func (ir *indexReader)endOfEcs( offset int64 ) (int64, error) {
+    for offset < ir.size - 1 {
+        n := int64(_INDEX_CHUNK)
+        if offset + n > ir.size {
+            n = ir.size - offset
+        }
+        chunk, err := ir.read( offset, int(n) )
+        if err != nil {
+            return 0, err
+        }
+        for i := 0; i < len(chunk) - 1; i++ {
+            if chunk[i] != 0xff {
+                continue
+            }
+            m := chunk[i+1]
+            if m != 0 && m != 0xff && (m < 0xd0 || m > 0xd7) {
+                return offset + int64(i), nil
+            }
+        }
+        offset += n - 1         // last byte may be the first of a marker
+    }
+    return 0, fmt.Errorf( "missing end of entropy coded segment\n" )
+}
+
+func isSOFn( marker uint ) bool {
+    return marker >= _SOF0 && marker <= _SOF15 &&
+           marker != _DHT && marker != _JPG && marker != _DAC
+}
+
+// IndexReaderAt lists the markers of the JPEG data given by r and its size,
+// without reading the data entirely. It returns the same entries as MarkerMap
+// does after parsing, except RSTn markers, which are not looked for.
+//
+// Segments are skipped according to their length, without being read. The
+// entropy coded segment following a scan is read in chunks, looking for the
+// next marker. It cannot be assumed to extend up to the EOI at the end of the
+// data, even for the only scan of a sequential frame, since other images may
+// follow the first one, as in MPO files or motion photos.
+//
+// Since nothing is decoded, the segments are not checked. Indexing stops at
+// EOI, and trailing data is ignored.
+func IndexReaderAt( r io.ReaderAt, size int64 ) ([]MarkerEntry, error) {
+    ir := &indexReader{ r: r, size: size }
+    mm, err := ir.index( )
+    if err != nil {
+        return mm, jpgForwardError( "IndexReaderAt", err )
+    }
+    return mm, nil
+}
+
+func (ir *indexReader)index( ) (mm []MarkerEntry, err error) {
+    b, err := ir.read( 0, 2 )
+    if err != nil {
+        return
+    }
+    if b[0] != 0xff || b[1] != 0xd8 {
+        return nil, fmt.Errorf( "Wrong signature 0x%x for a JPEG file\n", b )
+    }
+    mm = append( mm, MarkerEntry{ _SOI, getJPEGmarkerName( _SOI ), 0, 0 } )
+
+    for offset := int64(2); ; {
+        if b, err = ir.read( offset, 2 ); err != nil {
+            return
+        }
+        if b[0] != 0xff {
+            return mm, fmt.Errorf( "no marker at offset %d\n", offset )
+        }
+        if b[1] == 0xff {       // fill byte
+            offset ++
+            continue
+        }
+        marker := 0xff00 | uint(b[1])
+        if marker == _EOI || marker == _TEM || (marker >= _RST0 && marker <= _RST7) {
+            mm = append( mm, MarkerEntry{ marker, getJPEGmarkerName( marker ),
+                                          uint(offset), 0 } )
+            if marker == _EOI {
+                return
+            }
+            offset += 2
+            continue
+        }
+        if b, err = ir.read( offset + 2, 2 ); err != nil {
+            return
+        }
+        sLen := uint(b[0]) << 8 + uint(b[1])
+        if sLen < 2 {
+            return mm, fmt.Errorf( "invalid %s length %d\n",
+                                   getJPEGmarkerName( marker ), sLen )
+        }
+        mm = append( mm, MarkerEntry{ marker, getJPEGmarkerName( marker ),
+                                      uint(offset), sLen } )
+        next := offset + 2 + int64(sLen)
+        if marker == _SOS {
+            if next, err = ir.endOfEcs( next ); err != nil {
+                return
+            }
+        }
+        offset = next
+    }
+}
@@ -5,8 +5,11 @@ import (
     "fmt"
     "io"
     "io/ioutil"
+    "io/fs"
     "bytes"
     "os"
+    "strings"
+    "image"
 )
 
 /*  ISO/IEC 10918-1:1993 defines JPEG document structure:
@@ -155,7 +158,7 @@ func (jpg *Desc) getJPEGStateName( ) string {
 }
 
 type scanComp struct {
-    hDC, hAC        *hcnode     // huffman roots for DC and AC coefficients
+    hDC, hAC        *hcTable    // huffman tables for DC and AC coefficients
     iDCTdata        *[]iDCTRow  // reference to the frame component data units
 
     previousDC      int16       // previous DC value for this component
@@ -193,16 +196,27 @@ type scanComp struct {
 }
 
 type scan   struct {            // one for each scan
-    ECSs            []byte      // entropy coded segments constituting the scan
+    ECSs            []byte      // entropy coded segments constituting the scan,
+                                // referencing the parsed data unless a fix
+                                // requires a modified copy (fill removal)
     sComps          []scanComp  // one per scan component
     nMcus           uint        // total number of MCUs in scan
     rstInterval     uint        // nMCUs between restart intervals
     rstCount        uint        // total number of restart in the scan
+    rsts            []rstMark   // restart markers found in the scan
+    rstTail         uint        // n MCUs after the last restart marker
     startSS, endSS  uint8       // start, end spectral selection
     sABPh, sABPl    uint8       // sucessive approximation bit position high, low
 }
 
-type hcnode struct {
+type rstMark struct {           // one for each restart marker in a scan
+    offset          uint        // marker offset in data
+    number          uint8       // RSTn marker number n
+    expected        uint8       // expected n in RST sequence
+    nMcus           uint        // n MCUs decoded since previous RST or start
+}
+
+type hcnode struct {            // only used for printing codes
     left, right     *hcnode
     parent          *hcnode
     symbol          uint8
@@ -215,7 +229,8 @@ type qdef struct {
 
 type hdef struct {
     values          [16][]uint8
-    root            *hcnode
+    table           *hcTable    // flat decoding table
+    checked         bool        // symbols checked against the frame
 }
 
 type dataUnit       [64]int16
@@ -225,6 +240,9 @@ type component struct {
     Id, HSF, VSF, QS uint8
     nUnitsRow       uint        // n data units per row (see iDCTRow)
     iDCTdata        []iDCTRow   // component data units (in full frame)
+    qt              *qdef       // table latched at the first scan including
+                                // the component, nil before that scan
+    flushed         uint        // number of DU rows streamed and released
 }
 
 type Encoding  uint
@@ -269,6 +287,10 @@ func encodingString( c Encoding ) string {
     return "Invalid encoding"
 }
 
+func (c Encoding)String( ) string {
+    return encodingString( c )
+}
+
 type EntropyCoding uint
 const (
     HuffmanCoding EntropyCoding = iota
@@ -283,6 +305,10 @@ func entropyCodingString( e EntropyCoding ) string {
     return "Unknown Entropy Coding"
 }
 
+func (e EntropyCoding)String( ) string {
+    return entropyCodingString( e )
+}
+
 type EncodingMode uint
 const (
     BaselineSequential EncodingMode = iota // precision 8b 2+2 tables (DC+AC)
@@ -301,6 +327,10 @@ func encodingModeString( m EncodingMode ) string {
     return "Unknown Encoding Mode"
 }
 
+func (m EncodingMode)String( ) string {
+    return encodingModeString( m )
+}
+
 type Framing uint
 const (
     SingleFrame Framing = iota          // non hierarchical modes
@@ -311,6 +341,14 @@ func framing( c Encoding ) Framing {
     return Framing(( c % 8 ) / 4)
 }
 
+func (f Framing)String( ) string {
+    switch f {
+    case SingleFrame:           return "Single Frame"
+    case HierarchicalFrames:    return "Hierarchical Frames"
+    }
+    return "Unknown Framing"
+}
+
 type sampling  struct {
     nLines          uint16      // number of lines from frame
     nSamplesLine    uint16      // number of samples per line
@@ -322,12 +360,22 @@ type sampling  struct {
 
 type frame struct {             // one for each SOFn
     id              uint        // frame number [0..n] in appearance order
+    offset          uint        // offset of the SOFn marker
     encoding        Encoding    // how the frame is encoded
     resolution      sampling
     components      []component // from SOFn component definitions
                                 // note: component order is Y [, Cb, Cr] in SOFn
     scans           []scan      // for the scans following SOFn
     image           *Desc       // access to global image parameters
+    dequantized     bool        // data units have been dequantized in place
+    streamed        bool        // data units have been released after being
+                                // streamed (see Control.StreamRows)
+    coded           [][64]uint8 // progressive: 1 + Al of the last scan that
+                                // coded each component coefficient, or 0
+    remapIds        bool        // scan component ids are remapped to frame
+                                // components (see checkScanIds)
+    indexIds        bool        // remapped scan component ids are indexes in
+                                // frame components
 }
 
 type VisualSide int
@@ -363,6 +411,7 @@ type control struct {           // just to keep Desc opaque
 }
 
 type segmenter interface {      // segment interface
+    marker( ) uint
     serialize( io.Writer ) (int, error)
     format( io.Writer ) (int, error)
 }
@@ -403,6 +452,61 @@ func (cw *cumulativeWriter)result( ) (int, error) {
     return cw.count, cw.err
 }
 
+// progress reporting, at most every step units of work
+type progress struct {
+    report          func( done, total int )
+    done, total     int
+    step, next      int
+}
+
+func (jpg *Desc)newProgress( total, step int ) *progress {
+    if step < 1 { step = 1 }
+    return &progress{ report: jpg.Progress, total: total, step: step, next: step }
+}
+
+func (p *progress)advance( n int ) {
+    if p.report == nil {
+        return
+    }
+    p.done += n
+    if p.done >= p.next || p.done >= p.total {
+        p.report( p.done, p.total )
+        p.next = p.done + p.step
+    }
+}
+
+// progress reporting writer, counting bytes written in chunks of at most step
+// bytes, so that long entropy coded segments are reported while written
+type progressWriter struct {
+    w       io.Writer
+    p       *progress
+}
+func (pw *progressWriter)Write( v []byte ) (n int, err error) {
+    for n < len(v) {
+        end := n + pw.p.step
+        if end > len(v) {
+            end = len(v)
+        }
+        var nw int
+        nw, err = pw.w.Write( v[n:end] )
+        n += nw
+        pw.p.advance( nw )
+        if err != nil {
+            break
+        }
+    }
+    return
+}
+
+// slice appending writer
+type appendWriter struct {
+    buf     []byte
+}
+func (aw *appendWriter)Write( v []byte ) (n int, err error) {
+    aw.buf = append( aw.buf, v... )
+    return len(v), nil
+}
+
 // Desc is the internal structure describing the JPEG file
 type Desc struct {
     data            []byte      // raw data file
@@ -412,6 +516,17 @@ type Desc struct {
     app0Extension   bool        // APP0 followed by APP0 extension
     nMcuRST         uint        // number of MCUs expected between RSTn
     orientation    *Orientation // nil if unknown in metadata
+    marker          uint        // current marker being parsed
+    markerMap       []MarkerEntry // all markers in order, including RSTn
+    trailer         []byte      // data following EOI, if any
+    fillBytes       uint        // total number of 0xFF fill bytes found
+    pendingFill     uint        // fill bytes preceding the next segment
+    fills           map[segmenter]uint // fill bytes to write before segments
+    origins         map[segmenter][]byte // original data of the segments not
+                                // modified since parsing, written as is
+    eoiFill         uint        // fill bytes to write before EOI
+    trimmed         bool        // trailer is not serialized
+    exifIssues      []string    // invalid EXIF entries found while parsing
 
 // global data applying to frames as they occur
     segments        []segmenter // segments in order they have occured
@@ -422,6 +537,7 @@ type Desc struct {
 
 // frame slice with encoding, resolution and components & other private tables.
     frames          []frame
+    scratch         scratch     // temporary buffers reused across scans
 
                     control     // what to print/fix during parsing
 }
@@ -608,7 +724,92 @@ func (jpg *Desc) getCurrentScan() *scan {
 
 func (j *Desc)addSeg( seg segmenter ) {
     j.segments = append( j.segments, seg )
+    if j.pendingFill > 0 {
+        if j.fills == nil {
+            j.fills = make( map[segmenter]uint )
+        }
+        j.fills[seg] = j.pendingFill
+        j.pendingFill = 0
+    }
 }
+
+// keepOrigin records the original data of the segment at offset, from its
+// marker to the end of its sLen bytes, if parsing it has added exactly one
+// segment at index, so that the original data can be written instead of
+// serializing the segment again, as long as it is not modified (see modified).
+// This is limited to segments that are serialized independently of the frame
+// and scans, and it is not done with TidyUp, which may fix them. If no segment
+// was added, the previous segment may have been extended and its original
+// data is dropped.
+func (jpg *Desc)keepOrigin( index int, offset, sLen uint ) {
+    if len(jpg.segments) != index + 1 {
+        if index > 0 && len(jpg.segments) == index {
+            jpg.modified( jpg.segments[index-1] )
+        }
+        return
+    }
+    if jpg.TidyUp || offset + sLen + 2 > uint(len(jpg.data)) {
+        return
+    }
+    seg := jpg.segments[index]
+    switch seg.(type) {
+    case *app0, *exifData, *appSeg, *comSeg, *qtSeg, *htSeg, *riSeg:
+    default:
+        return
+    }
+    if jpg.origins == nil {
+        jpg.origins = make( map[segmenter][]byte )
+    }
+    jpg.origins[seg] = jpg.data[offset:offset+sLen+2]
+}
+
+// modified indicates that the segment seg has been modified since parsing, so
+// that it must be serialized again.
+func (jpg *Desc)modified( seg segmenter ) {
+    delete( jpg.origins, seg )
+}
+
+// fillBytesAt returns the number of 0xFF fill bytes found at offset before a
+// marker
+func (jpg *Desc)fillBytesAt( offset uint ) (fill uint) {
+    tLen := uint(len(jpg.data))
+    for offset+fill+1 < tLen && jpg.data[offset+fill] == 0xff &&
+        jpg.data[offset+fill+1] == 0xff {
+        fill ++
+    }
+    return
+}
+
+// addFillBytes accounts for fill bytes found before a marker. Unless TidyUp is
+// requested, they are kept before the next segment added.
+func (jpg *Desc)addFillBytes( fill uint, keep bool ) {
+    jpg.fillBytes += fill
+    if jpg.Warn {
+        jpg.warning( "  WARNING: %d fill byte(s) at offset 0x%x\n", fill, jpg.offset )
+    }
+    if jpg.TidyUp {
+        jpg.fixing( "  FIXING: Removing %d fill byte(s)\n", fill )
+    } else if keep {
+        jpg.pendingFill += fill
+    }
+}
+
+// GetFillBytes returns the number of 0xFF fill bytes found before markers in
+// the original data. Fill bytes are kept in the serialized data, unless TidyUp
+// was requested.
+func (jpg *Desc) GetFillBytes( ) uint {
+    return jpg.fillBytes
+}
+// setState changes the parsing state, showing the transition if requested
+func (jpg *Desc)setState( state int ) {
+    if jpg.States {
+        fmt.Printf( "State %s -> %s on %s at offset 0x%x\n",
+                    jpg.getJPEGStateName(), stateNames[state],
+                    getJPEGmarkerName(jpg.marker), jpg.offset )
+    }
+    jpg.state = state
+}
+
 func (jpg *Desc)printMarker( marker, sLen, offset uint ) {
     if jpg.Markers {
         fmt.Printf( "Marker 0x%x, len %d, offset 0x%x (%s)\n",
@@ -616,15 +817,223 @@ func (jpg *Desc)printMarker( marker, sLen, offset uint ) {
     }
 }
 
+// recordMarker adds a marker to the marker map and prints it if requested
+func (jpg *Desc)recordMarker( marker, sLen, offset uint ) {
+    jpg.markerMap = append( jpg.markerMap,
+                            MarkerEntry{ marker, getJPEGmarkerName(marker),
+                                         offset, sLen } )
+    jpg.printMarker( marker, sLen, offset )
+}
+
+// isMarkerAt returns true if data at offset starts with a segment marker
+func isMarkerAt( data []byte, offset uint ) bool {
+    if offset+1 >= uint(len(data)) || data[offset] != 0xff {
+        return false
+    }
+    m := data[offset+1]
+    return m >= 0xc0 && m != 0xff && (m < 0xd0 || m > 0xd7)    // not RSTn
+}
+
+// isMarkerAfterFill returns true if data at offset starts with a segment
+// marker, possibly preceded by 0xFF fill bytes
+func (jpg *Desc)isMarkerAfterFill( offset uint ) bool {
+    return isMarkerAt( jpg.data, offset + jpg.fillBytesAt( offset ) )
+}
+
+// checkSegmentLength verifies that the segment length is consistent with the
+// position of the next marker, after any fill bytes. If it is not and TidyUp
+// is requested, it returns the length matching the marker found in data
+// closest to the end of the segment given by its length, searching both before
+// and after that end. Searching from the start of the segment would stop at
+// the first marker-like bytes in its payload, such as those of an embedded
+// thumbnail.
+func (jpg *Desc)checkSegmentLength( marker, sLen, offset uint ) uint {
+    end := offset + sLen + 2
+    if jpg.isMarkerAfterFill( end ) {
+        return sLen
+    }
+    if jpg.Warn {
+        jpg.warning( "  WARNING: %s length %d inconsistent with next marker position\n",
+                     getJPEGmarkerName(marker), sLen )
+    }
+    if jpg.TidyUp {
+        tLen := uint(len(jpg.data))
+        first := offset + 4     // smallest segment: length only
+        for d := uint(1); end >= first + d || end + d + 1 < tLen; d++ {
+            next := end + d
+            if ! jpg.isMarkerAfterFill( next ) {
+                if end < first + d || ! jpg.isMarkerAfterFill( end - d ) {
+                    continue
+                }
+                next = end - d
+                for next > first && jpg.data[next-1] == 0xff {
+                    next --     // fill bytes do not belong to the segment
+                }
+            }
+            jpg.fixing( "  FIXING: correcting %s length from %d to %d\n",
+                        getJPEGmarkerName(marker), sLen, next - offset - 2 )
+            return next - offset - 2
+        }
+    }
+    return sLen
+}
+
+// MarkerEntry describes one marker found in the file.
+type MarkerEntry struct {
+    Marker  uint    // marker value, e.g. 0xffd8 for SOI
+    Name    string  // marker name
+    Offset  uint    // offset of the marker first byte (0xff) in the file
+    Length  uint    // segment length field, 0 for SOI, EOI and RSTn
+}
+
+// MarkerMap returns the ordered list of all markers encountered during
+// parsing, including the RSTn markers embedded in entropy coded segments.
+// The whole segment spans from Offset to Offset+Length+2. For SOS, Length
+// does not include the following entropy coded segment, which extends up to
+// the next marker in the list that is not a RSTn.
+func (jpg *Desc)MarkerMap( ) []MarkerEntry {
+    mm := make( []MarkerEntry, len(jpg.markerMap) )
+    copy( mm, jpg.markerMap )
+    return mm
+}
+
+// tracef prints MCU & DU traces, either on TraceOut or on the standard output
+func (jpg *Desc)tracef( format string, args ...interface{} ) {
+    if jpg.TraceOut == nil {
+        fmt.Printf( format, args... )
+    } else {
+        fmt.Fprintf( jpg.TraceOut, format, args... )
+    }
+}
+
+// Logger is the interface expected for Control.Logger. It is compatible with
+// *slog.Logger, from the standard package log/slog.
+type Logger interface {
+    Warn( msg string, args ...interface{} )
+    Info( msg string, args ...interface{} )
+}
+
+// structured fields attached to each logged record
+func (jpg *Desc)logFields( ) []interface{} {
+    fields := []interface{}{ "offset", jpg.offset,
+                             "marker", getJPEGmarkerName(jpg.marker) }
+    if frm := jpg.getCurrentFrame(); frm != nil && len(frm.scans) > 0 {
+        fields = append( fields, "scan", len(frm.scans)-1 )
+    }
+    return fields
+}
+
+// warning prints a warning, or sends it to the Logger if one is provided
+func (jpg *Desc)warning( format string, args ...interface{} ) {
+    if jpg.Logger == nil {
+        fmt.Printf( format, args... )
+        return
+    }
+    jpg.Logger.Warn( strings.TrimSpace( fmt.Sprintf( format, args... ) ),
+                     jpg.logFields()... )
+}
+
+// fixing prints a fix notice, or sends it to the Logger if one is provided
+func (jpg *Desc)fixing( format string, args ...interface{} ) {
+    if jpg.Logger == nil {
+        fmt.Printf( format, args... )
+        return
+    }
+    jpg.Logger.Info( strings.TrimSpace( fmt.Sprintf( format, args... ) ),
+                     jpg.logFields()... )
+}
+
+type Verbosity int
+const (                     // increasing levels of information during parsing
+    Silent Verbosity = iota // no information, only errors are returned
+    Summary                 // warnings about inconsistencies (Warn)
+    Segments                // Summary + JPEG markers as they are parsed (Markers)
+    Tables                  // Segments + extra information on tables (Verbose)
+    MCU                     // Tables + MCUs as they are parsed (Mcu)
+    Bits                    // MCU + each DU resulting from MCU parsing (Du)
+)
+
+// TraceArea defines a rectangular area of MCUs or data units, from Top to
+// Bottom rows and from Left to Right columns, included.
+type TraceArea struct {
+    Top, Left       uint
+    Bottom, Right   uint
+}
+
+// McuPosition gives the row and column of an MCU in a scan
+type McuPosition struct {
+    Row, Col        uint
+}
+
 type Control struct {       // control parsing
+    Verbosity       Verbosity // level of information, in addition to the
+                            // following individual flags that can be set to
+                            // request more information than the level gives.
     Verbose         bool    // print extra information: turn on in case of error
     Warn            bool    // Warn about inconsistencies as they are seen
     Recurse         bool    // Recurse and parse embedded JPEG pictures
     TidyUp          bool    // Fix and clean up JPEG segments
     Markers         bool    // show JPEG markers as they are parsed
+    States          bool    // show parser state transitions as they occur
     Mcu             bool    // display MCUs as they are parsed
     Du              bool    // display each DU resulting from MCU parsing
     Begin, End      uint    // control MCU &DU display (from begin to end, included)
+    From, To        *McuPosition // if not nil, restrict MCU & DU display to
+                            // MCUs from, to the given row & col (included)
+    Components      []uint8 // if not empty, restrict MCU & DU display to
+                            // those components (0 for Y, 1 for Cb, 2 for Cr)
+    McuArea         *TraceArea // if not nil, restrict MCU & DU display to
+                            // the MCUs within that area
+    DuArea          *TraceArea // if not nil, restrict MCU & DU display to
+                            // the data units within that area
+    TraceOut        io.Writer // if not nil, MCU & DU display is written to
+                            // TraceOut instead of the standard output
+    TraceJSON       bool    // MCU display as one JSON object per line
+                            // (JSON Lines) instead of formatted text
+    KeepDNL         bool    // keep 0 lines in SOFn and write DNL after first scan
+    KeepTrailing    bool    // write the data following EOI, if any, after EOI
+                            // when serializing, unless TidyUp is also set
+                            // (see TrimTrailing)
+    StdHuffman      bool    // use the standard Huffman tables (T.81 Annex K)
+                            // when a scan refers to an undefined table
+    DedupApps       bool    // with TidyUp, remove application segments
+                            // identical to a previous one
+    AppMarkers      AppPreference // with TidyUp, make JFIF and Adobe APP14
+                            // segments consistent (see NormalizeAppMarkers)
+    Progress        func( done, total int ) // optional progress report during
+                            // long operations (Write, Generate, SaveRawPicture...)
+    Logger          Logger  // optional structured logger for warnings and
+                            // fix notices, instead of printing them
+    PartialImage    func( img image.Image, frame, scan int ) // optional,
+                            // called during parsing with the image decoded so
+                            // far, after each scan (progressive display). It
+                            // is only called by Parse, which is given all the
+                            // data at once: there is no incremental parsing.
+                            // The image is valid only during the call.
+    PartialRows     uint    // with PartialImage, also call it every
+                            // PartialRows MCU rows in sequential scans (only
+                            // the data unit rows completed since the previous
+                            // call are decoded again)
+    FloatColor      bool    // convert YCbCr to RGB in floating point in
+                            // SaveRawPicture, instead of fixed-point (for
+                            // verification only)
+    StreamRows      func( rows *SampleRows ) // optional, called during
+                            // parsing of 8-bit sequential frames with the
+                            // samples of each completed MCU row, whose data
+                            // units are then released (see SampleRows)
+}
+
+// set the individual flags implied by the verbosity level. If the level
+// includes MCU display and End is 0, all MCUs are displayed.
+func (c *Control)applyVerbosity( ) {
+    if c.Verbosity >= Summary   { c.Warn = true }
+    if c.Verbosity >= Segments  { c.Markers = true }
+    if c.Verbosity >= Tables    { c.Verbose = true }
+    if c.Verbosity >= MCU {
+        c.Mcu = true
+        if c.End == 0 { c.End = ^uint(0) }
+    }
+    if c.Verbosity >= Bits      { c.Du = true }
 }
 
 // Parse analyses jpeg data and splits the data into well-known segments.
@@ -646,13 +1055,41 @@ type Control struct {       // control parsing
 //  the SOFn value, the SOFn value and metadata are updated (this is done
 //  after DNL processing).
 //
+//  - if a segment length is inconsistent with the position of the next
+//  marker, the length is corrected to match that marker.
+//
+//  - if DedupApps is set, application segments identical to a previous one
+//  are removed.
+//
+//  - if AppMarkers is set, JFIF and Adobe APP14 segments are made consistent
+//  according to that preference.
+//
+//  - if scan component ids do not match the frame component ids, they are
+//  replaced with the frame component ids in frame order.
+//
+//  - 0xFF fill bytes found before markers are removed.
+//
+//  - if EXIF image dimensions do not match the frame dimensions, they are
+//  rewritten to match the frame.
+//
+//  - if some data follows EOI, it is removed even if KeepTrailing is set (it
+//  is still available from GetTrailingData).
+//
+//  - if the data ends after a scan without EOI, the file is considered
+//  complete and EOI is added when the data is serialized.
+//
 // It returns a tuple: a pointer to a Desc containing segment definitions and
 // and an error. In all cases, nil error or not, the returned Desc is usable
 // (but wont be complete in case of error).
+//
+// The data is referenced, not copied: in particular, entropy coded segments
+// are kept as slices of data unless they are fixed, so data must not be
+// modified as long as the returned Desc is in use.
 func Parse( data []byte, toDo *Control ) ( *Desc, error ) {
 
     jpg := new( Desc )   // initially in INIT state (0)
     jpg.Control = *toDo
+    jpg.Control.applyVerbosity( )
     jpg.data = data
 
     if ! bytes.Equal( data[0:2],  []byte{ 0xff, 0xd8 } ) {
@@ -662,8 +1099,14 @@ func Parse( data []byte, toDo *Control ) ( *Desc, error ) {
     tLen := uint(len(data))
 makerLoop:
     for i := uint(0); i < tLen; {
+        if fill := jpg.fillBytesAt( i ); fill > 0 {
+            jpg.addFillBytes( fill, true )
+            i += fill
+            jpg.offset = i
+        }
         marker := uint(data[i]) << 8 + uint(data[i+1])
         sLen := uint(0)       // case of a segment without any data
+        jpg.marker = marker
 
         if marker < _TEM {
 		    return jpg, fmt.Errorf( "Parse: invalid marker 0x%x\n", data[i:i+1] )
@@ -672,36 +1115,48 @@ makerLoop:
         switch marker {
 
         case _SOI:            // no data, no length
-            jpg.printMarker( marker, sLen, i )
+            jpg.recordMarker( marker, sLen, i )
             if jpg.state != _INIT {
 		        return jpg, fmt.Errorf( "Parse: Wrong sequence %s in state %s\n",
                                         getJPEGmarkerName(marker), jpg.getJPEGStateName() )
             }
-            jpg.state = _APPLICATION
+            jpg.setState( _APPLICATION )
 
         case _RST0, _RST1, _RST2, _RST3, _RST4, _RST5, _RST6, _RST7:
                                 // empty segment, no following length
-            jpg.printMarker( marker, sLen, i )
+            jpg.recordMarker( marker, sLen, i )
             return jpg, fmt.Errorf ("Parse: Marker %s should not happen in top level segments\n",
                                      getJPEGmarkerName(marker) )
 
         case _EOI:
-            jpg.printMarker( marker, sLen, i )
+            jpg.recordMarker( marker, sLen, i )
+            jpg.eoiFill, jpg.pendingFill = jpg.pendingFill, 0
             if jpg.state != _SCAN1 && jpg.state != _SCANn {
 		        return jpg, fmt.Errorf( "Parse: Wrong sequence %s in state %s\n",
                             getJPEGmarkerName(marker), jpg.getJPEGStateName() )
             }
-            jpg.state = _FINAL
+            jpg.setState( _FINAL )
             jpg.offset = i + 2  // points after the last byte
+            if jpg.offset < tLen {
+                jpg.trailingData( )
+            }
+            if jpg.Warn {
+                jpg.checkQuantizationRefs( )
+                jpg.checkScriptCoverage( )
+            }
             if err := jpg.checkLines( ); nil != err {
-                return nil, err
+                return jpg, err
             }
             break makerLoop // exit even if there is junk at the end of the file
 
         default:        // all other cases have data following marker & length
             sLen = uint(data[i+2]) << 8 + uint(data[i+3])
-            jpg.printMarker( marker, sLen, i )
+            if marker != _SOS { // SOS is followed by ECS, not by a marker
+                sLen = jpg.checkSegmentLength( marker, sLen, i )
+            }
+            jpg.recordMarker( marker, sLen, i )
             transitionToFrame := true
+            nSegments := len(jpg.segments)
             var err error
 
             switch marker {    // second level marker switching within the first default
@@ -714,6 +1169,7 @@ makerLoop:
 
             case _APP2, _APP3, _APP4, _APP5, _APP6, _APP7, _APP8, _APP9,
                  _APP10, _APP11, _APP12, _APP13, _APP14, _APP15:
+                err = jpg.appn( marker, sLen )
                 transitionToFrame = false
 
             case _SOF0, _SOF1, _SOF2, _SOF3, _SOF5, _SOF6, _SOF7, _SOF9, _SOF10,
@@ -754,13 +1210,49 @@ makerLoop:
                                         getJPEGmarkerName(marker) )
             }
             if err != nil { return jpg, jpgForwardError( "Parse", err ) }
+            jpg.keepOrigin( nSegments, i, sLen )
             if jpg.state == _APPLICATION && transitionToFrame {
-                jpg.state = _FRAME
+                jpg.setState( _FRAME )
             }
         }
         i += sLen + 2
         jpg.offset = i          // always points at the mark
     }
+    if jpg.TidyUp && jpg.DedupApps {
+        if n, saved := jpg.removeDuplicateApps( ); n > 0 {
+            jpg.fixing( "  FIXING: removed %d duplicate application segment(s)" +
+                        " (%d bytes saved)\n", n, saved )
+        }
+    }
+    if jpg.TidyUp && jpg.AppMarkers != NoAppPreference {
+        changed, err := jpg.NormalizeAppMarkers( jpg.AppMarkers )
+        if err != nil {
+            return jpg, jpgForwardError( "Parse", err )
+        }
+        if changed {
+            jpg.fixing( "  FIXING: normalized application markers\n" )
+        }
+    }
+    if jpg.state == _SCANn {    // data ended after a scan, without EOI
+        if jpg.Warn {
+            jpg.warning( "  WARNING: missing EOI at the end of data\n" )
+        }
+        if jpg.TidyUp {
+            jpg.fixing( "  FIXING: Adding missing EOI\n" )
+            jpg.setState( _FINAL )  // EOI is always added on serialization
+            if err := jpg.checkLines( ); nil != err {
+                return jpg, err
+            }
+        }
+    }
+    if jpg.state == _FINAL {
+        if err := jpg.fixExifDimensions( ); err != nil {
+            return jpg, jpgForwardError( "Parse", err )
+        }
+        if jpg.Warn {
+            jpg.checkDensity( )
+        }
+    }
     return jpg, nil
 }
 
@@ -778,16 +1270,54 @@ func (jpg *Desc) GetNumberOfFrames( ) uint {
     return uint(len(jpg.frames))
 }
 
+// trailingData keeps the data following EOI. It is only serialized if
+// KeepTrailing is set and TidyUp is not.
+func (jpg *Desc)trailingData( ) {
+    jpg.trailer = jpg.data[jpg.offset:]
+    if jpg.Warn {
+        jpg.warning( "  WARNING: %d bytes of trailing data after EOI\n",
+                     len(jpg.trailer) )
+    }
+    if jpg.TidyUp {
+        jpg.fixing( "  FIXING: Removing trailing data after EOI\n" )
+    }
+    jpg.trimmed = jpg.TidyUp || ! jpg.KeepTrailing
+}
+
+// TrimTrailing removes the data following EOI from the serialized data, when
+// it was kept by setting KeepTrailing. The trailing data is still available
+// from GetTrailingData. It returns the number of bytes removed.
+func (jpg *Desc) TrimTrailing( ) int {
+    if jpg.trimmed {
+        return 0
+    }
+    jpg.trimmed = true
+    return len(jpg.trailer)
+}
+
+// GetTrailingData returns the data found after EOI in the original file,
+// whether it is removed from the serialized data or not. It returns nil if
+// there is no trailing data.
+func (jpg *Desc) GetTrailingData( ) []byte {
+    if len(jpg.trailer) == 0 {
+        return nil
+    }
+    trailer := make( []byte, len(jpg.trailer) )
+    copy( trailer, jpg.trailer )
+    return trailer
+}
+
 // GetActualLengths returns the number of bytes between SOI and EOI (both
-// included) in the possibly fixed jpeg data, and the original data length.
-// The actual data length may be different from the original length if the
-// analysis stopped in error, TidyUp has actually corrected some segment,
-// RemoveMetadata have been called or if there is some garbage at the end of
-// the original file that should be ignored.
+// included) in the possibly fixed jpeg data, followed by the trailing data
+// if it is kept (see KeepTrailing), and the original data length. The actual
+// data length may be different from the original length if the analysis
+// stopped in error, TidyUp has actually corrected some segment, RemoveMetadata
+// has been called, or if there is some trailing data after EOI that is not
+// kept.
 func (jpg *Desc) GetActualLengths( ) ( actual uint, original uint ) {
     dataSize := uint( len( jpg.data ) )
     if ! jpg.IsComplete() { return 0, dataSize }
-    size, err := jpg.serialize( ioutil.Discard )
+    size, err := jpg.serializeSegments( ioutil.Discard )
     if err != nil {
         return 0, dataSize
     }
@@ -804,6 +1334,7 @@ func (jpg *Desc) GetActualLengths( ) ( actual uint, original uint ) {
 func (jpg *Desc)RemoveMetadata( appId int, sIds []int ) (err error) {
     for _, seg := range jpg.segments {
         if s, ok := seg.(metadata); ok {
+            jpg.modified( seg )
             err = s.mRemove( appId, sIds )
             if err != nil {
                 break
@@ -813,6 +1344,188 @@ func (jpg *Desc)RemoveMetadata( appId int, sIds []int ) (err error) {
     return
 }
 
+type SegmentPosition int
+const (
+    FirstApplication SegmentPosition = iota // first app segment (after JFIF)
+    LastApplication                         // after all leading app segments
+    BeforeFrame                             // immediately before the first SOFn
+)
+
+func (j *Desc)insertSeg( index int, seg segmenter ) {
+    j.segments = append( j.segments, nil )
+    copy( j.segments[index+1:], j.segments[index:] )
+    j.segments[index] = seg
+}
+
+func (jpg *Desc)getInsertionIndex( position SegmentPosition ) (index int, err error) {
+    switch position {
+    case FirstApplication:          // skip JFIF and its possible extension
+        for index < len(jpg.segments) {
+            if _, ok := jpg.segments[index].(*app0); ! ok {
+                break
+            }
+            index++
+        }
+    case LastApplication:
+        for index < len(jpg.segments) {
+            if ! isAppSegment( jpg.segments[index] ) {
+                break
+            }
+            index++
+        }
+    case BeforeFrame:
+        index = jpg.getFrameSegmentIndex( 0 )
+        if index == -1 {
+            err = fmt.Errorf( "no frame\n" )
+        }
+    default:
+        err = fmt.Errorf( "invalid position %d\n", position )
+    }
+    return
+}
+
+// InsertAppSegment inserts a new application segment APPn, where n is given
+// by the argument appId in the range 0 to 15. The argument payload is the
+// segment data following the segment length, which must not exceed 65533
+// bytes. The argument position indicates where the new segment is inserted:
+// as the first application segment (after JFIF if present), after the last
+// application segment or immediately before the frame header.
+//
+// The new segment is kept as is when the JPEG data is written or generated.
+// Larger ICC profiles and XMP packets can be inserted with SetICCProfile and
+// SetXMP, which split them across multiple segments.
+func (jpg *Desc)InsertAppSegment( appId int, payload []byte,
+                                  position SegmentPosition ) error {
+    if appId < 0 {
+        return fmt.Errorf( "InsertAppSegment: invalid application segment %d\n",
+                           appId )
+    }
+    a, err := newAppSeg( uint(appId), payload )
+    if err != nil {
+        return jpgForwardError( "InsertAppSegment", err )
+    }
+    index, err := jpg.getInsertionIndex( position )
+    if err != nil {
+        return jpgForwardError( "InsertAppSegment", err )
+    }
+    jpg.insertSeg( index, a )
+    return nil
+}
+
+// Segment is a handle on one segment of the JPEG data, as returned by Segments
+type Segment struct {
+    Marker          uint        // segment marker (0xffxx)
+    seg             segmenter
+}
+
+// Name returns the segment marker name
+func (s Segment) Name( ) string {
+    return getJPEGmarkerName( s.Marker )
+}
+
+// Raw returns the segment as it would be serialized, starting with its marker
+// and length. In case of scan, it includes the following entropy coded data.
+func (s Segment) Raw( ) []byte {
+    var aw appendWriter
+    if s.seg != nil {
+        s.seg.serialize( &aw )
+    }
+    return aw.buf
+}
+
+// Format writes the segment fully formatted, as FormatSegments does for each
+// segment: tables, frame and scan headers, or application segment contents.
+func (s Segment) Format( w io.Writer ) (int, error) {
+    if s.seg == nil {
+        return 0, fmt.Errorf( "Format: invalid segment handle\n" )
+    }
+    return s.seg.format( w )
+}
+
+// Hexdump writes the raw segment as an hexadecimal dump, with width bytes per
+// line followed by their ascii representation. A width less than 1 is
+// replaced by 16.
+func (s Segment) Hexdump( w io.Writer, width int ) (int, error) {
+    return dumpData( w, s.Raw(), width )
+}
+
+// Segments returns a handle on each segment, in the order they occur in the
+// JPEG data (SOI and EOI excluded). A handle remains valid until its segment
+// is removed or replaced.
+func (jpg *Desc)Segments( ) []Segment {
+    handles := make( []Segment, len(jpg.segments) )
+    for i, seg := range jpg.segments {
+        handles[i] = Segment{ seg.marker(), seg }
+    }
+    return handles
+}
+
+func (jpg *Desc)getSegmentIndex( s Segment ) int {
+    for i, seg := range jpg.segments {
+        if seg == s.seg {
+            return i
+        }
+    }
+    return -1
+}
+
+// RemoveSegment removes the segment given by its handle. Frame and scan
+// segments cannot be removed.
+func (jpg *Desc)RemoveSegment( s Segment ) error {
+    index := jpg.getSegmentIndex( s )
+    if index == -1 {
+        return fmt.Errorf( "RemoveSegment: segment not found\n" )
+    }
+    switch s.seg.(type) {
+    case *frame, *scan:
+        return fmt.Errorf( "RemoveSegment: cannot remove %s\n", s.Name() )
+    }
+    jpg.segments = append( jpg.segments[:index], jpg.segments[index+1:]... )
+    return nil
+}
+
+// ReplaceSegment replaces the content of the segment given by its handle
+// with the argument payload, which is the new segment data following the
+// segment length. Only COM, APPn and DQT segments can be replaced. In case
+// of DQT, the payload must be a valid sequence of quantization tables. Note
+// that a new DQT segment does not change the way the image was decoded.
+//
+// It returns the handle on the new segment, which replaces the argument s.
+func (jpg *Desc)ReplaceSegment( s Segment, payload []byte ) (Segment, error) {
+    index := jpg.getSegmentIndex( s )
+    if index == -1 {
+        return s, fmt.Errorf( "ReplaceSegment: segment not found\n" )
+    }
+    var seg segmenter
+    var err error
+    switch s.seg.(type) {
+    case *comSeg:
+        if len(payload) > _MAX_APP_PAYLOAD {
+            err = fmt.Errorf( "payload too large (%d bytes)\n", len(payload) )
+            break
+        }
+        c := new(comSeg)
+        c.text = make( []byte, len(payload) )
+        copy( c.text, payload )
+        seg = c
+    case *app0, *exifData, *appSeg:
+        seg, err = newAppSeg( s.Marker - _APP0, payload )
+    case *qtSeg:
+        if len(payload) > _MAX_APP_PAYLOAD {
+            err = fmt.Errorf( "payload too large (%d bytes)\n", len(payload) )
+            break
+        }
+        seg, err = makeQtSeg( payload )
+    default:
+        err = fmt.Errorf( "cannot replace %s\n", s.Name() )
+    }
+    if err != nil {
+        return s, jpgForwardError( "ReplaceSegment", err )
+    }
+    jpg.segments[index] = seg
+    return Segment{ seg.marker(), seg }, nil
+}
+
 type ThumbSpec struct {         // argument to SaveThumbnail
     Path    string              // new thumbnail file path
     ThId    int                 // thumbnail id
@@ -854,29 +1567,187 @@ segLoop:
     return
 }
 
-func (jpg *Desc)serialize( w io.Writer ) (n int, err error) {
+// ThumbnailInfo describes an image embedded in a metadata segment.
+type ThumbnailInfo struct {
+    Source      string      // app segment providing the thumbnail
+    Id          int         // id to use with SaveThumbnail, -1 if not saveable
+    Width,
+    Height      uint        // pixel dimensions, 0 if unknown
+    Size        uint        // size in bytes
+    Compression string      // thumbnail coding
+}
+
+// ThumbnailInfo returns the list of all thumbnails embedded in metadata
+// segments, in the order they appear in the file, without extracting them.
+func (jpg *Desc)ThumbnailInfo( ) (ti []ThumbnailInfo) {
+    for _, seg := range jpg.segments {
+        if s, ok := seg.(metadata); ok {
+            ti = append( ti, s.mThumbnailInfo( )... )
+        }
+    }
+    return
+}
+
+// fixExifDimensions checks that EXIF dimensions match the first frame and, if
+// TidyUp is requested, rewrites them to match the frame.
+func (jpg *Desc)fixExifDimensions( ) error {
+    if len(jpg.frames) == 0 {
+        return nil
+    }
+    frm := &jpg.frames[0]
+    width, height := frm.nSamplesLine(), uint(frm.actualLines())
+    for _, seg := range jpg.segments {
+        ed, ok := seg.(*exifData)
+        if ! ok || ed.removed || ! jpg.checkDimensions( ed, width, height ) {
+            continue
+        }
+        if jpg.TidyUp {
+            jpg.fixing( "  FIXING: setting EXIF dimensions to %dx%d\n",
+                        width, height )
+            if err := ed.setDimensions( width, height ); err != nil {
+                return err
+            }
+            jpg.modified( ed )
+        }
+    }
+    return nil
+}
+
+// writeFill writes n 0xFF fill bytes
+func writeFill( w io.Writer, n uint ) (int, error) {
+    if n == 0 {
+        return 0, nil
+    }
+    return w.Write( bytes.Repeat( []byte{ 0xff }, int(n) ) )
+}
+
+// GetThumbnailData returns the data of the thumbnail n, as listed by
+// ThumbnailInfo: a complete JPEG file for JPEG thumbnails, or the raw pixel
+// data for other thumbnails (preceded by the palette for 8-bit palette).
+func (jpg *Desc)GetThumbnailData( n int ) ([]byte, error) {
+    for _, seg := range jpg.segments {
+        if s, ok := seg.(metadata); ok {
+            ns := len( s.mThumbnailInfo( ) )
+            if n < ns {
+                data, err := s.mThumbnailData( n )
+                if err != nil {
+                    err = jpgForwardError( "GetThumbnailData", err )
+                }
+                return data, err
+            }
+            n -= ns
+        }
+    }
+    return nil, fmt.Errorf( "GetThumbnailData: thumbnail does not exist\n" )
+}
+
+// Thumbnail returns in memory the thumbnail that SaveThumbnail would save for
+// the same id (0 for the main thumbnail, 1 for the second image), together
+// with its description. The data is a complete JPEG file for JPEG thumbnails,
+// or the raw pixel data for other thumbnails.
+func (jpg *Desc)Thumbnail( id int ) ([]byte, ThumbnailInfo, error) {
+    for i, t := range jpg.ThumbnailInfo( ) {
+        if t.Id == id {
+            data, err := jpg.GetThumbnailData( i )
+            if err != nil {
+                return nil, t, jpgForwardError( "Thumbnail", err )
+            }
+            return data, t, nil
+        }
+    }
+    return nil, ThumbnailInfo{ },
+           fmt.Errorf( "Thumbnail: thumbnail %d does not exist\n", id )
+}
+
+// serialize writes the jpeg data to w. If the Progress callback is given, the
+// total number of bytes is first obtained from a dry run, and the callback is
+// called every percent of the bytes written.
+func (jpg *Desc)serialize( w io.Writer ) (int, error) {
+    if jpg.Progress == nil {
+        return jpg.serializeSegments( w )
+    }
+    total, err := jpg.serializeSegments( ioutil.Discard )
+    if err != nil {
+        return 0, err
+    }
+    p := jpg.newProgress( total, total / 100 )
+    return jpg.serializeSegments( &progressWriter{ w: w, p: p } )
+}
+
+func (jpg *Desc)serializeSegments( w io.Writer ) (n int, err error) {
 
     if n, err = w.Write( []byte{ 0xFF, 0xD8 } ); err == nil {
         var ns int
-        for _, s := range jpg.segments {
-            ns, err = s.serialize( w ); if err != nil {
+        var dnlFrame *frame     // frame waiting for a DNL after its first scan
+        for i, s := range jpg.segments {
+            if ns, err = writeFill( w, jpg.fills[s] ); err != nil {
                 return
             }
             n += ns
-        }
-        if ns, err = w.Write( []byte{ 0xFF, 0xD9 } ); err == nil {
+            if raw, ok := jpg.origins[s]; ok {  // unmodified: copy as is
+                ns, err = w.Write( raw )
+            } else {
+                ns, err = s.serialize( w )
+            }
+            if err != nil {
+                return
+            }
             n += ns
+
+            switch s := s.(type) {
+            case *frame:
+                if s.keepDNL() {
+                    dnlFrame = s
+                }
+            case *scan:
+                if dnlFrame == nil {
+                    break
+                }
+                if i+1 >= len(jpg.segments) || ! isDnlSegment( jpg.segments[i+1] ) {
+                    dnl := dnlSeg{ nLines: dnlFrame.actualLines() }
+                    ns, err = dnl.serialize( w ); if err != nil {
+                        return
+                    }
+                    n += ns
+                }
+                dnlFrame = nil
+            }
+        }
+        if ns, err = writeFill( w, jpg.eoiFill ); err != nil {
+            return
+        }
+        n += ns
+        if ns, err = w.Write( []byte{ 0xFF, 0xD9 } ); err != nil {
+            return
+        }
+        n += ns
+        if len(jpg.trailer) > 0 && ! jpg.trimmed {
+            if ns, err = w.Write( jpg.trailer ); err == nil {
+                n += ns
+            }
         }
     }
     return
 }
 
 // Generate returns a copy in memory of the possibly fixed jpeg file after analysis.
+// Tables, comments and application segments that have not been modified since
+// parsing (without TidyUp) are copied from the original data.
 func (jpg *Desc) Generate( ) ( []byte, error ) {
-    var b bytes.Buffer
-    _, err := jpg.serialize( &b )
-    if  err != nil { return nil, fmt.Errorf( "Generate: ", err ) }
-    return b.Bytes(), nil
+    var aw appendWriter
+    _, err := jpg.serialize( &aw )
+    if  err != nil { return nil, jpgForwardError( "Generate", err ) }
+    return aw.buf, nil
+}
+
+// AppendTo appends the possibly fixed jpeg file after analysis to the
+// argument buf, growing it as needed, and returns the extended slice. In
+// case of error, the original slice is returned unmodified.
+func (jpg *Desc) AppendTo( buf []byte ) ( []byte, error ) {
+    aw := appendWriter{ buf }
+    _, err := jpg.serialize( &aw )
+    if  err != nil { return buf, jpgForwardError( "AppendTo", err ) }
+    return aw.buf, nil
 }
 
 // Write stores the possibly fixed JEPG data into a file.
@@ -919,3 +1790,21 @@ func Read( path string, toDo *Control ) ( *Desc, error ) {
     return Parse( data, toDo )
 }
 
+/*
+    ReadFS reads a JPEG file from the file system fsys, and parses its content
+    as Read does. The argument path is the file path in fsys, following the
+    io/fs naming rules. This allows reading from an embed.FS, a zip archive
+    or any other file system implementation.
+
+    It returns a tuple: a pointer to a Desc containing the segment
+    definitions and an error. If the file cannot be read the returned Desc
+    is nil.
+*/
+func ReadFS( fsys fs.FS, path string, toDo *Control ) ( *Desc, error ) {
+    data, err := fs.ReadFile( fsys, path )
+    if err != nil {
+        return nil, fmt.Errorf( "ReadFS: Unable to read file %s: %v\n", path, err )
+    }
+    return Parse( data, toDo )
+}
+
@@ -0,0 +1,44 @@
+package jpeg
+
+// support for luma only decoding
+
+import (
+    "fmt"
+    "image"
+)
+
+// LumaImage returns the luma (Y) component of the first frame as an
+// image.Gray, for applications that only need grayscale data (thumbnailing,
+// focus analysis, etc.). Chroma components are entropy decoded with the
+// image, since they are interleaved with luma data in scans, but they are
+// neither transformed (inverse DCT) nor upsampled, which makes it much
+// faster than decoding a full colour image. It is identical to the first
+// component returned by MakeFrameRawPicture, cropped to the frame size. The
+// orientation given by metadata is not applied.
+func (jpg *Desc) LumaImage( ) (*image.Gray, error) {
+    if len(jpg.frames) == 0 {
+        return nil, fmt.Errorf( "LumaImage: no frame\n" )
+    }
+    frm := &jpg.frames[0]
+    if len(frm.scans) < 1 {
+        return nil, fmt.Errorf( "LumaImage: no scan available for picture\n" )
+    }
+    if len(frm.components) != 1 && len(frm.components) != 3 {
+        return nil, fmt.Errorf( "LumaImage: not YCbCr or Gray scale picture\n" )
+    }
+    if frm.resolution.samplePrecision != 8 {
+        return nil, fmt.Errorf( "LumaImage: extended precision is not supported\n" )
+    }
+    if err := jpg.dequantize( frm ); err != nil {
+        return nil, jpgForwardError( "LumaImage", err )
+    }
+    y := frm.components[0]
+    samples := make8BitComponentArrays( []component{ y } )
+    cols, rows := int(frm.nSamplesLine()), int(frm.actualLines())
+    stride := int(y.nUnitsRow << 3)
+    if rows > len(*samples[0]) / stride {   // missing rows in scan
+        rows = len(*samples[0]) / stride
+    }
+    return &image.Gray{ Pix: *samples[0], Stride: stride,
+                        Rect: image.Rect( 0, 0, cols, rows ) }, nil
+}
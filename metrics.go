@@ -0,0 +1,172 @@
+package jpeg
+
+// support for no-reference quality metrics
+
+import (
+    "fmt"
+)
+
+const (
+    _EDGE_THRESHOLD = 32        // min step between samples to detect an edge
+)
+
+// ComponentQuality gives the no-reference quality metrics for one component,
+// as returned by QualityMetrics. Higher values indicate more visible
+// degradation due to quantization. They are heuristic estimates, meant to be
+// compared between encodings of the same picture rather than across pictures.
+type ComponentQuality struct {
+    Component   int     // component index in frame
+    Blockiness  float64 // mean step across 8x8 block boundaries divided by
+                        // the mean step inside blocks (about 1 if no block
+                        // artefact)
+    Ringing     float64 // mean oscillation amplitude (absolute second
+                        // difference) of flat samples in blocks including an
+                        // edge, in sample values
+}
+
+// componentSize returns the number of visible samples per line and the number
+// of lines for a component, given its sampling factors.
+func (frm *frame) componentSize( cmp *component ) (cols, rows int) {
+    cols = int( (frm.nSamplesLine() * uint(cmp.HSF) + uint(frm.resolution.mhSF) - 1) /
+                uint(frm.resolution.mhSF) )
+    rows = int( (uint(frm.actualLines()) * uint(cmp.VSF) + uint(frm.resolution.mvSF) - 1) /
+                uint(frm.resolution.mvSF) )
+    return
+}
+
+func absDiff( a, b uint8 ) int {
+    if a > b {
+        return int(a - b)
+    }
+    return int(b - a)
+}
+
+// blockiness returns the ratio between the mean absolute step across block
+// boundaries and the mean absolute step between other adjacent samples, in
+// both directions.
+func blockiness( plane []uint8, stride, cols, rows int ) float64 {
+    var edge, inner float64
+    var nEdge, nInner int
+    for r := 0; r < rows; r++ {
+        line := plane[r*stride:]
+        for c := 1; c < cols; c++ {
+            d := float64(absDiff( line[c], line[c-1] ))
+            if c & 7 == 0 {
+                edge += d; nEdge ++
+            } else {
+                inner += d; nInner ++
+            }
+        }
+        if r == 0 {
+            continue
+        }
+        prev := plane[(r-1)*stride:]
+        for c := 0; c < cols; c++ {
+            d := float64(absDiff( line[c], prev[c] ))
+            if r & 7 == 0 {
+                edge += d; nEdge ++
+            } else {
+                inner += d; nInner ++
+            }
+        }
+    }
+    if nEdge == 0 || nInner == 0 {
+        return 1                    // single block, no boundary
+    }
+    inner /= float64(nInner)
+    if inner == 0 {
+        inner = 1                   // flat blocks, count raw boundary steps
+    }
+    return (edge / float64(nEdge)) / inner
+}
+
+// ringing returns the mean absolute second difference of flat samples, i.e.
+// samples whose steps with their horizontal or vertical neighbours are small,
+// in the blocks that include at least one edge, possibly on their left or top
+// boundary. It returns 0 if there is no such block.
+func ringing( plane []uint8, stride, cols, rows int ) float64 {
+    var sum float64
+    var n int
+    for br := 0; br < rows; br += 8 {
+        for bc := 0; bc < cols; bc += 8 {
+            er, ec := br + 8, bc + 8
+            if er > rows { er = rows }
+            if ec > cols { ec = cols }
+
+            hasEdge := false
+        edgeLoop:
+            for r := br; r < er; r++ {
+                for c := bc; c < ec; c++ {
+                    s := plane[r*stride+c]
+                    if ( c > 0 && absDiff( s, plane[r*stride+c-1] ) >= _EDGE_THRESHOLD ) ||
+                       ( r > 0 && absDiff( s, plane[(r-1)*stride+c] ) >= _EDGE_THRESHOLD ) {
+                        hasEdge = true
+                        break edgeLoop
+                    }
+                }
+            }
+            if ! hasEdge {
+                continue
+            }
+            for r := br; r < er; r++ {
+                for c := bc+1; c < ec-1; c++ {      // horizontal oscillations
+                    s, p, f := plane[r*stride+c], plane[r*stride+c-1], plane[r*stride+c+1]
+                    if absDiff( s, p ) < _EDGE_THRESHOLD/2 &&
+                       absDiff( s, f ) < _EDGE_THRESHOLD/2 {
+                        d := 2 * int(s) - int(p) - int(f)
+                        if d < 0 { d = -d }
+                        sum += float64(d); n ++
+                    }
+                }
+            }
+            for r := br+1; r < er-1; r++ {
+                for c := bc; c < ec; c++ {          // vertical oscillations
+                    s, p, f := plane[r*stride+c], plane[(r-1)*stride+c],
+                               plane[(r+1)*stride+c]
+                    if absDiff( s, p ) < _EDGE_THRESHOLD/2 &&
+                       absDiff( s, f ) < _EDGE_THRESHOLD/2 {
+                        d := 2 * int(s) - int(p) - int(f)
+                        if d < 0 { d = -d }
+                        sum += float64(d); n ++
+                    }
+                }
+            }
+        }
+    }
+    if n == 0 {
+        return 0
+    }
+    return sum / float64(n)
+}
+
+// QualityMetrics decodes the first frame and returns for each component the
+// no-reference blockiness and ringing estimates (see ComponentQuality). They
+// are computed on the component samples at their own resolution, without
+// upsampling nor color conversion, so that the block grid is preserved, and
+// only over the visible samples (excluding the padding beyond image edges).
+func (jpg *Desc) QualityMetrics( ) ([]ComponentQuality, error) {
+    if len(jpg.frames) == 0 {
+        return nil, fmt.Errorf( "QualityMetrics: no frame\n" )
+    }
+    frm := &jpg.frames[0]
+    samples, err := jpg.MakeFrameRawPicture( 0 )
+    if err != nil {
+        return nil, jpgForwardError( "QualityMetrics", err )
+    }
+    metrics := make( []ComponentQuality, len(frm.components) )
+    for ci := range frm.components {
+        cmp := &frm.components[ci]
+        plane := *samples[ci]
+        stride := int(cmp.nUnitsRow << 3)
+        cols, rows := frm.componentSize( cmp )
+        if cols > stride {
+            cols = stride
+        }
+        if rows > len(plane) / stride {     // missing rows in scan
+            rows = len(plane) / stride
+        }
+        metrics[ci] = ComponentQuality{ ci, blockiness( plane, stride, cols, rows ),
+                                        ringing( plane, stride, cols, rows ) }
+    }
+    return metrics, nil
+}
@@ -0,0 +1,54 @@
+package jpeg
+
+// support for applying the image orientation to decoded samples
+
+// orientedPosition returns the position in the oriented plane of the sample
+// at col, row in the stored plane of size cols x rows, for the given effect.
+func orientedPosition( effect VisualEffect,
+                       col, row, cols, rows int ) (oCol, oRow int) {
+    switch effect {
+    case VerticalMirror:            return cols-1-col, row
+    case Rotate180:                 return cols-1-col, rows-1-row
+    case HorizontalMirror:          return col, rows-1-row
+    case HorizontalMirrorRotate90:  return row, col             // transpose
+    case Rotate90:                  return rows-1-row, col
+    case VerticalMirrorRotate90:    return rows-1-row, cols-1-col
+    case Rotate270:                 return row, cols-1-col
+    }
+    return col, row
+}
+
+// swapsSides returns true if the effect exchanges the image width and height
+func swapsSides( effect VisualEffect ) bool {
+    return effect == HorizontalMirrorRotate90 || effect == Rotate90 ||
+           effect == VerticalMirrorRotate90 || effect == Rotate270
+}
+
+// orientPlane returns a copy of plane (cols x rows samples, no padding) with
+// the orientation effect applied, and its new size.
+func orientPlane( plane []uint8, cols, rows int,
+                  effect VisualEffect ) (oPlane []uint8, oCols, oRows int) {
+    if effect == None {
+        return plane, cols, rows
+    }
+    oCols, oRows = cols, rows
+    if swapsSides( effect ) {
+        oCols, oRows = rows, cols
+    }
+    oPlane = make( []uint8, len(plane) )
+    for r := 0; r < rows; r++ {
+        for c := 0; c < cols; c++ {
+            oc, or := orientedPosition( effect, c, r, cols, rows )
+            oPlane[or*oCols+oc] = plane[r*cols+c]
+        }
+    }
+    return
+}
+
+// visualEffect returns the orientation effect given by metadata, or None
+func (jpg *Desc) visualEffect( ) VisualEffect {
+    if jpg.orientation == nil {
+        return None
+    }
+    return jpg.orientation.Effect
+}
@@ -0,0 +1,144 @@
+package jpeg
+
+// support for partial images during parsing (progressive display)
+
+import (
+    "image"
+)
+
+// partialState is the partial image of a frame, kept across the calls to the
+// PartialImage callback: only the data unit rows modified since the previous
+// call are decoded and upsampled again.
+type partialState struct {
+    id          uint        // frame id
+    cols, rows  int         // frame size
+    samples     [][]uint8   // samples of each component, as transformComponents
+    planes      [][]uint8   // samples upsampled to the frame size
+    scan        int         // current scan index
+    done        []uint      // data unit rows of each component decoded in scan
+}
+
+// partialImage returns the image decoded from the coefficients received so
+// far in frame frm, without modifying them: each data unit is copied before
+// being dequantized. Data units not yet received are decoded as mid-gray
+// samples and missing rows as black samples. If sc is nil, all data unit rows
+// are decoded, otherwise only the rows completed in scan sc since the previous
+// call. The image shares the planes kept for the next call. It returns nil if
+// the frame has not 1 or 3 components or if its size is not known yet.
+func (jpg *Desc) partialImage( frm *frame, sc *scan ) image.Image {
+    if len(frm.components) != 1 && len(frm.components) != 3 {
+        return nil
+    }
+    cols, rows := int(frm.nSamplesLine()), int(frm.actualLines())
+    if cols == 0 || rows == 0 {
+        return nil
+    }
+    qzs, err := jpg.quantizationTables( frm )
+    if err != nil {
+        return nil
+    }
+    p := &jpg.scratch.partial
+    if p.planes == nil || p.id != frm.id || p.cols != cols || p.rows != rows {
+        p.id, p.cols, p.rows = frm.id, cols, rows
+        p.samples = make( [][]uint8, len(frm.components) )
+        p.planes = make( [][]uint8, len(frm.components) )
+        for ci := range p.planes {
+            p.planes[ci] = make( []uint8, cols * rows )
+        }
+        p.done = make( []uint, len(frm.components) )
+        sc = nil                                // decode all rows once
+    }
+    if si := len(frm.scans) - 1; si != p.scan {
+        p.scan = si
+        for ci := range p.done {
+            p.done[ci] = 0
+        }
+    }
+
+    if sc == nil {
+        for ci := range frm.components {
+            p.decodeRows( frm, ci, &qzs[ci], 0,
+                          uint(len(frm.components[ci].iDCTdata)) )
+        }
+    } else {
+        for i := range sc.sComps {
+            ci := int(sc.sComps[i].cType)
+            end := sc.sComps[i].nRows
+            if n := uint(len(frm.components[ci].iDCTdata)); end > n {
+                end = n
+            }
+            if p.done[ci] < end {
+                p.decodeRows( frm, ci, &qzs[ci], p.done[ci], end )
+                p.done[ci] = end
+            }
+        }
+    }
+    return makeImage( p.planes, cols, rows )
+}
+
+// decodeRows decodes the data unit rows r0 to r1 (excluded) of component ci
+// in frame frm with the quantization table qz, and upsamples the lines they
+// cover to the frame size. If r1 is the last row, the lines below are missing
+// and left with zero samples.
+func (p *partialState) decodeRows( frm *frame, ci int, qz *qdef, r0, r1 uint ) {
+    cmp := &frm.components[ci]
+    stride := cmp.nUnitsRow << 3
+    yHSF, yVSF := uint(frm.resolution.mhSF), uint(frm.resolution.mvSF)
+    hsf, vsf := uint(cmp.HSF), uint(cmp.VSF)
+
+    p.samples[ci] = fitPlane( p.samples[ci], int(r1 * stride * 8) )
+    samples := p.samples[ci]
+    for r := r0; r < r1; r++ {
+        start := (r * cmp.nUnitsRow) << 6
+        for c := range cmp.iDCTdata[r] {
+            du := cmp.iDCTdata[r][c]            // dequantize a copy
+            dequantizeUnit( &du, qz )
+            inverseDCT8( &du, samples[start + uint(c << 3):], stride )
+        }
+    }
+
+    plane := p.planes[ci]
+    r := (r0 * 8 * yVSF + vsf - 1) / vsf
+    for ; r < uint(p.rows); r++ {
+        sr := (r * vsf) / yVSF
+        if sr >= r1 * 8 {
+            break
+        }
+        srow := samples[sr*stride:]
+        drow := plane[int(r)*p.cols:]
+        for c := uint(0); c < uint(p.cols); c++ {
+            drow[c] = srow[(c*hsf)/yHSF]
+        }
+    }
+    if r1 == uint(len(cmp.iDCTdata)) && r < uint(p.rows) {
+        missing := plane[int(r)*p.cols:]
+        for i := range missing {
+            missing[i] = 0
+        }
+    }
+}
+
+// reportScan calls the PartialImage callback, if any, at the end of scan sc
+// in frame frm.
+func (jpg *Desc) reportScan( frm *frame, sc int ) {
+    if jpg.PartialImage == nil {
+        return
+    }
+    if img := jpg.partialImage( frm, nil ); img != nil {
+        jpg.PartialImage( img, int(frm.id), sc )
+    }
+}
+
+// reportMcuRow calls the PartialImage callback, if any, every PartialRows
+// MCU rows during the sequential scan sc. The argument nRows is the number of
+// MCU rows completed in sc.
+func (jpg *Desc) reportMcuRow( sc *scan, nRows uint ) {
+    if jpg.PartialImage == nil || jpg.PartialRows == 0 ||
+       nRows % jpg.PartialRows != 0 {
+        return
+    }
+    frm := jpg.getCurrentFrame( )
+    if img := jpg.partialImage( frm, sc ); img != nil {
+        jpg.PartialImage( img, int(frm.id), len(frm.scans) - 1 )
+    }
+}
@@ -0,0 +1,60 @@
+package jpeg
+
+// support for checking the partial images given to the PartialImage callback:
+// in sequential scans, the image updated every MCU row must be the image
+// decoded entirely at the end of the scan.
+
+import (
+    "bytes"
+    "image"
+    "os"
+    "path/filepath"
+    "testing"
+)
+
+// imagePlanes returns copies of the planes of an image.Gray or image.YCbCr
+func imagePlanes( img image.Image ) [][]uint8 {
+    switch img := img.(type) {
+    case *image.Gray:
+        return [][]uint8{ append( []uint8{ }, img.Pix... ) }
+    case *image.YCbCr:
+        return [][]uint8{ append( []uint8{ }, img.Y... ),
+                          append( []uint8{ }, img.Cb... ),
+                          append( []uint8{ }, img.Cr... ) }
+    }
+    return nil
+}
+
+func TestPartialImage( t *testing.T ) {
+    for _, name := range []string{ "gray.jpg", "ycc420.jpg", "ycc422.jpg",
+                                   "ycc411.jpg", "restart.jpg" } {
+        t.Run( name, func( t *testing.T ) {
+            data, err := os.ReadFile( filepath.Join( "testdata", name ) )
+            if err != nil {
+                t.Fatal( err )
+            }
+            var images [][][]uint8
+            c := &Control{ PartialRows: 1 }
+            c.PartialImage = func( img image.Image, frame, scan int ) {
+                images = append( images, imagePlanes( img ) )
+            }
+            jpg, err := Parse( data, c )
+            if err != nil {
+                t.Fatalf( "Parse: %v", err )
+            }
+            // one update per MCU row, then one at the end of the scan
+            frm := &jpg.frames[0]
+            mcuLines := 8 * int(frm.resolution.mvSF)
+            mcuRows := (int(frm.actualLines( )) + mcuLines - 1) / mcuLines
+            if len(images) != mcuRows + 1 {
+                t.Fatalf( "%d partial images, expected %d", len(images), mcuRows + 1 )
+            }
+            last, end := images[len(images)-2], images[len(images)-1]
+            for i := range end {
+                if ! bytes.Equal( last[i], end[i] ) {
+                    t.Errorf( "plane %d differs from the last MCU row update", i )
+                }
+            }
+        } )
+    }
+}
@@ -0,0 +1,80 @@
+package jpeg
+
+// support for probing the frame header without reading the whole data
+
+import (
+    "fmt"
+    "io"
+)
+
+// ProbeInfo is the result of Probe
+type ProbeInfo struct {
+    Width, Height   uint        // frame size in samples (Height may be 0 if
+                                // the number of lines is given later by DNL)
+    Components      uint8       // number of components in frame
+    Precision       uint8       // number of bits per sample
+    Encoding        Encoding    // as given by the SOFn marker
+    Progressive     bool        // progressive DCT encoding
+}
+
+// Probe reads JPEG data from r up to the first frame header (SOFn) and
+// returns the frame characteristics, without reading further. Segments
+// before the frame header are skipped according to their length, without
+// being checked. It is a cheap way of validating and laying out a picture
+// before deciding to read it entirely.
+func Probe( r io.Reader ) (*ProbeInfo, error) {
+    var b [8]byte
+    if _, err := io.ReadFull( r, b[:2] ); err != nil {
+        return nil, fmt.Errorf( "Probe: %v\n", err )
+    }
+    if b[0] != 0xff || b[1] != 0xd8 {
+        return nil, fmt.Errorf( "Probe: Wrong signature 0x%x for a JPEG file\n", b[:2] )
+    }
+    b[1] = 0xff
+    for {
+        for b[1] == 0xff {      // skip possible fill bytes
+            if _, err := io.ReadFull( r, b[1:2] ); err != nil {
+                return nil, fmt.Errorf( "Probe: %v\n", err )
+            }
+        }
+        marker := 0xff00 | uint(b[1])
+        if marker == _EOI || marker == _SOS || marker < _TEM {
+            return nil, fmt.Errorf( "Probe: %s before frame header\n",
+                                    getJPEGmarkerName( marker ) )
+        }
+        if _, err := io.ReadFull( r, b[:2] ); err != nil {
+            return nil, fmt.Errorf( "Probe: %v\n", err )
+        }
+        sLen := int64(b[0]) << 8 + int64(b[1])
+        if sLen < 2 {
+            return nil, fmt.Errorf( "Probe: invalid %s length %d\n",
+                                    getJPEGmarkerName( marker ), sLen )
+        }
+        if isSOFn( marker ) {   // P, Y, X, Nf
+            if sLen < 8 {
+                return nil, fmt.Errorf( "Probe: Wrong %s header (len %d)\n",
+                                        getJPEGmarkerName( marker ), sLen )
+            }
+            if _, err := io.ReadFull( r, b[:6] ); err != nil {
+                return nil, fmt.Errorf( "Probe: %v\n", err )
+            }
+            pi := &ProbeInfo{ Precision: b[0],
+                              Height: uint(b[1]) << 8 + uint(b[2]),
+                              Width: uint(b[3]) << 8 + uint(b[4]),
+                              Components: b[5],
+                              Encoding: Encoding(marker & 0x0f) }
+            pi.Progressive = pi.Encoding % 4 == Encoding(ExtendedProgressive)
+            return pi, nil
+        }
+        if _, err := io.CopyN( io.Discard, r, sLen - 2 ); err != nil {
+            return nil, fmt.Errorf( "Probe: %v\n", err )
+        }
+        if _, err := io.ReadFull( r, b[:2] ); err != nil {
+            return nil, fmt.Errorf( "Probe: %v\n", err )
+        }
+        if b[0] != 0xff {
+            return nil, fmt.Errorf( "Probe: missing marker after %s\n",
+                                    getJPEGmarkerName( marker ) )
+        }
+    }
+}
@@ -0,0 +1,36 @@
+package jpeg
+
+// support for checking the progress reported while serializing: it counts
+// bytes, including those of the entropy coded segments as they are written.
+
+import (
+    "os"
+    "path/filepath"
+    "testing"
+)
+
+func TestSerializeProgress( t *testing.T ) {
+    data, err := os.ReadFile( filepath.Join( "testdata", "ycc420.jpg" ) )
+    if err != nil {
+        t.Fatal( err )
+    }
+    var reports, last int
+    c := &Control{ Progress: func( done, total int ) {
+        if done <= last || done > total || total != len(data) {
+            t.Errorf( "progress %d/%d after %d, expected total %d",
+                      done, total, last, len(data) )
+        }
+        reports++
+        last = done
+    } }
+    jpg, err := Parse( data, c )
+    if err != nil {
+        t.Fatal( err )
+    }
+    reports, last = 0, 0
+    checkGenerate( t, jpg, data )
+    if last != len(data) || reports < 50 {
+        t.Errorf( "%d bytes reported in %d calls, expected %d in about 100",
+                  last, reports, len(data) )
+    }
+}
@@ -0,0 +1,119 @@
+package jpeg
+
+// support for progressive scan script validation
+
+const (
+    _MAX_APPROXIMATION  = 13    // max Ah and Al in progressive scans
+)
+
+// script violations for a coefficient in a progressive scan
+const (
+    _SCRIPT_OK = iota
+    _SCRIPT_OVERLAP             // first pass for an already coded coefficient
+    _SCRIPT_NO_FIRST_PASS       // refinement before any first pass
+    _SCRIPT_BAD_REFINEMENT      // refinement Ah does not match previous Al
+    _SCRIPT_REPEATED            // refinement of an already coded bit
+)
+
+func scriptViolationString( v int ) string {
+    switch v {
+    case _SCRIPT_OVERLAP:           return "already coded by a previous first pass"
+    case _SCRIPT_NO_FIRST_PASS:     return "refined before their first pass"
+    case _SCRIPT_BAD_REFINEMENT:    return "refined with Ah not matching the previous Al"
+    case _SCRIPT_REPEATED:          return "coded twice at the same approximation level"
+    }
+    return "ok"
+}
+
+// checkScript warns about the violations of the progressive scan script by
+// the current scan, given all previous scans in the frame. It checks that the
+// spectral selection and successive approximation parameters are valid, that
+// the first DC scan of a component precedes its AC scans, that spectral bands
+// do not overlap in first passes and that each refinement follows the first
+// pass or the previous refinement of the same coefficients (Ah equal to the
+// previous Al, and Al equal to Ah-1). Violations are only reported, the scan
+// is decoded as it is.
+func (jpg *Desc) checkScript( frm *frame, sc *scan ) {
+    n := len(frm.scans) - 1
+    if sc.startSS > sc.endSS || sc.endSS > 63 {
+        jpg.warning( "  WARNING: progressive scan #%d: invalid spectral selection %d-%d\n",
+                     n, sc.startSS, sc.endSS )
+        return
+    }
+    if sc.sABPh > _MAX_APPROXIMATION || sc.sABPl > _MAX_APPROXIMATION {
+        jpg.warning( "  WARNING: progressive scan #%d: successive approximation Ah %d, Al %d out of range\n",
+                     n, sc.sABPh, sc.sABPl )
+        return
+    }
+    if sc.sABPh != 0 && sc.sABPl != sc.sABPh - 1 {
+        jpg.warning( "  WARNING: progressive scan #%d: refinement Al %d is not Ah %d - 1\n",
+                     n, sc.sABPl, sc.sABPh )
+    }
+    if frm.coded == nil {
+        frm.coded = make( [][64]uint8, len(frm.components) )
+    }
+    for _, sComp := range sc.sComps {
+        coded := &frm.coded[sComp.cType]
+        if sc.startSS > 0 && coded[0] == 0 {
+            jpg.warning( "  WARNING: progressive scan #%d: AC scan for component %d before its first DC scan\n",
+                         n, sComp.cId )
+        }
+        start, violation := int(sc.startSS), _SCRIPT_OK
+        for k := start; k <= int(sc.endSS) + 1; k++ {
+            v := _SCRIPT_OK
+            if k <= int(sc.endSS) {
+                switch {
+                case sc.sABPh == 0 && coded[k] != 0:
+                    v = _SCRIPT_OVERLAP
+                case sc.sABPh != 0 && coded[k] == 0:
+                    v = _SCRIPT_NO_FIRST_PASS
+                case sc.sABPh != 0 && sc.sABPl + 1 >= coded[k]:
+                    v = _SCRIPT_REPEATED
+                case sc.sABPh != 0 && coded[k] != sc.sABPh + 1:
+                    v = _SCRIPT_BAD_REFINEMENT
+                }
+                coded[k] = sc.sABPl + 1
+            }
+            if v == violation && k <= int(sc.endSS) {
+                continue
+            }
+            if violation != _SCRIPT_OK {            // end of a violation run
+                jpg.warning( "  WARNING: progressive scan #%d: component %d coefficients %d-%d %s\n",
+                             n, sComp.cId, start, k-1,
+                             scriptViolationString( violation ) )
+            }
+            start, violation = k, v
+        }
+    }
+}
+
+// checkScriptCoverage warns, once all scans are parsed, about the coefficients
+// of each component never coded by the progressive scans of each frame.
+func (jpg *Desc) checkScriptCoverage( ) {
+    for f := range jpg.frames {
+        frm := &jpg.frames[f]
+        if frm.encodingMode() != ExtendedProgressive || frm.coded == nil {
+            continue
+        }
+        for c, coded := range frm.coded {
+            cId := frm.components[c].Id
+            start := -1
+            for k := 0; k <= 64; k++ {
+                if k < 64 && coded[k] == 0 {
+                    if start == -1 {
+                        start = k
+                    }
+                    continue
+                }
+                if start == 0 && k == 64 {
+                    jpg.warning( "  WARNING: progressive frame #%d: component %d never coded\n",
+                                 f, cId )
+                } else if start != -1 {
+                    jpg.warning( "  WARNING: progressive frame #%d: component %d coefficients %d-%d never coded\n",
+                                 f, cId, start, k-1 )
+                }
+                start = -1
+            }
+        }
+    }
+}
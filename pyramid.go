@@ -0,0 +1,167 @@
+package jpeg
+
+// support for downscaled images and multi-resolution pyramids
+
+import (
+    "fmt"
+    "bytes"
+    "image"
+    stdjpeg "image/jpeg"
+)
+
+// fullPlanes returns the samples of the first frame, one plane per component,
+// with chroma components upsampled to the luma resolution.
+func (jpg *Desc) fullPlanes( ) (cols, rows int, planes [][]uint8, err error) {
+    if len(jpg.frames) == 0 {
+        return 0, 0, nil, fmt.Errorf( "fullPlanes: no frame\n" )
+    }
+    cmps := jpg.frames[0].components
+    if len(cmps) != 1 && len(cmps) != 3 {
+        return 0, 0, nil, fmt.Errorf( "fullPlanes: not YCbCr or Gray scale picture\n" )
+    }
+    return jpg.upsampledPlanes( )
+}
+
+// upsampledPlanes returns the samples of the first frame, one plane per
+// component, with all components upsampled to the frame resolution,
+// regardless of the number of components.
+func (jpg *Desc) upsampledPlanes( ) (cols, rows int, planes [][]uint8, err error) {
+    if len(jpg.frames) == 0 {
+        return 0, 0, nil, fmt.Errorf( "upsampledPlanes: no frame\n" )
+    }
+    frm := &jpg.frames[0]
+    samples, err := jpg.MakeFrameRawPicture( 0 )
+    if err != nil {
+        return 0, 0, nil, err
+    }
+    cols, rows, planes = upsample( frm, samples )
+    return
+}
+
+// upsample returns the component samples upsampled to the frame resolution.
+// Missing rows in scan are left with zero samples.
+func upsample( frm *frame, samples [](*[]uint8) ) (cols, rows int, planes [][]uint8) {
+    cols, rows = int(frm.nSamplesLine()), int(frm.actualLines())
+    yHSF, yVSF := uint(frm.resolution.mhSF), uint(frm.resolution.mvSF)
+
+    planes = make( [][]uint8, len(frm.components) )
+    for ci, cmp := range frm.components {
+        stride := cmp.nUnitsRow << 3
+        hsf, vsf := uint(cmp.HSF), uint(cmp.VSF)
+        src := fitPlane( *samples[ci],
+                         int(((uint(rows) * vsf + yVSF - 1) / yVSF) * stride) )
+        plane := make( []uint8, cols * rows )
+        for r := uint(0); r < uint(rows); r++ {
+            srow := src[((r*vsf)/yVSF)*stride:]
+            drow := plane[int(r)*cols:]
+            for c := uint(0); c < uint(cols); c++ {
+                drow[c] = srow[(c*hsf)/yHSF]
+            }
+        }
+        planes[ci] = plane
+    }
+    return
+}
+
+// boxScale reduces a plane by factor, averaging each factor x factor block
+// (clipped to the plane edges).
+func boxScale( plane []uint8, cols, rows, factor int ) (dst []uint8, dCols, dRows int) {
+    dCols, dRows = (cols + factor - 1) / factor, (rows + factor - 1) / factor
+    dst = make( []uint8, dCols * dRows )
+    for dr := 0; dr < dRows; dr++ {
+        r0, r1 := dr * factor, dr * factor + factor
+        if r1 > rows { r1 = rows }
+        for dc := 0; dc < dCols; dc++ {
+            c0, c1 := dc * factor, dc * factor + factor
+            if c1 > cols { c1 = cols }
+            sum := 0
+            for r := r0; r < r1; r++ {
+                for _, v := range plane[r*cols+c0:r*cols+c1] {
+                    sum += int(v)
+                }
+            }
+            n := (r1 - r0) * (c1 - c0)
+            dst[dr*dCols+dc] = uint8((sum + n/2) / n)
+        }
+    }
+    return
+}
+
+// makeImage wraps planes of the same size in an image.Gray or image.YCbCr
+func makeImage( planes [][]uint8, cols, rows int ) image.Image {
+    rect := image.Rect( 0, 0, cols, rows )
+    if len(planes) == 1 {
+        return &image.Gray{ Pix: planes[0], Stride: cols, Rect: rect }
+    }
+    return &image.YCbCr{ Y: planes[0], Cb: planes[1], Cr: planes[2],
+                         YStride: cols, CStride: cols,
+                         SubsampleRatio: image.YCbCrSubsampleRatio444,
+                         Rect: rect }
+}
+
+// ScaledImage decodes the first frame and returns it reduced by factor, which
+// must be 1, 2, 4 or 8, as an image.Gray for one component or as a 4:4:4
+// image.YCbCr for 3 components. Each output sample is the average of a block
+// of factor x factor decoded samples. The orientation given by metadata is
+// not applied.
+func (jpg *Desc) ScaledImage( factor int ) (image.Image, error) {
+    switch factor {
+    case 1, 2, 4, 8:
+    default:
+        return nil, fmt.Errorf( "ScaledImage: invalid factor %d\n", factor )
+    }
+    cols, rows, planes, err := jpg.fullPlanes( )
+    if err != nil {
+        return nil, jpgForwardError( "ScaledImage", err )
+    }
+    if factor > 1 {
+        var dCols, dRows int
+        for i, p := range planes {
+            planes[i], dCols, dRows = boxScale( p, cols, rows, factor )
+        }
+        cols, rows = dCols, dRows
+    }
+    return makeImage( planes, cols, rows ), nil
+}
+
+// PyramidLevel is one downscaled image generated by MakePyramid
+type PyramidLevel struct {
+    Factor          int         // reduction factor (2, 4 or 8)
+    Width, Height   int         // image size
+    Data            []byte      // encoded JPEG image
+}
+
+// MakePyramid decodes the first frame once and produces the images reduced
+// by 2, 4 and 8, each encoded as a baseline JPEG with the given quality (1 to
+// 100, 0 for the default quality 75). Each level is computed from the previous
+// one, so that the image is decoded only once. Metadata are not copied and
+// the orientation is not applied.
+func (jpg *Desc) MakePyramid( quality int ) ([]PyramidLevel, error) {
+    if quality < 0 || quality > 100 {
+        return nil, fmt.Errorf( "MakePyramid: invalid quality %d\n", quality )
+    }
+    if quality == 0 {
+        quality = stdjpeg.DefaultQuality
+    }
+    cols, rows, planes, err := jpg.fullPlanes( )
+    if err != nil {
+        return nil, jpgForwardError( "MakePyramid", err )
+    }
+    var levels []PyramidLevel
+    for factor := 2; factor <= 8; factor *= 2 {
+        var dCols, dRows int
+        for i, p := range planes {
+            planes[i], dCols, dRows = boxScale( p, cols, rows, 2 )
+        }
+        cols, rows = dCols, dRows
+
+        var b bytes.Buffer
+        err = stdjpeg.Encode( &b, makeImage( planes, cols, rows ),
+                              &stdjpeg.Options{ Quality: quality } )
+        if err != nil {
+            return nil, fmt.Errorf( "MakePyramid: %v\n", err )
+        }
+        levels = append( levels, PyramidLevel{ factor, cols, rows, b.Bytes() } )
+    }
+    return levels, nil
+}
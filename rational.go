@@ -0,0 +1,144 @@
+package jpeg
+
+// support for exact EXIF rational values
+
+import (
+    "fmt"
+    "github.com/jrm-1535/exif"
+)
+
+// Rational is an unsigned fraction, as stored in EXIF RATIONAL values. A zero
+// denominator indicates an unknown value.
+type Rational struct {
+    Num, Den    uint32
+}
+
+// SRational is a signed fraction, as stored in EXIF SRATIONAL values. A zero
+// denominator indicates an unknown value.
+type SRational struct {
+    Num, Den    int32
+}
+
+func gcd( a, b uint64 ) uint64 {
+    for b != 0 {
+        a, b = b, a % b
+    }
+    return a
+}
+
+// IsValid returns true if the denominator is not 0
+func (r Rational) IsValid( ) bool {
+    return r.Den != 0
+}
+
+// Float64 returns the value of r, or 0 if r is not valid
+func (r Rational) Float64( ) float64 {
+    if r.Den == 0 {
+        return 0
+    }
+    return float64(r.Num) / float64(r.Den)
+}
+
+// Simplify returns the irreducible fraction equal to r
+func (r Rational) Simplify( ) Rational {
+    if g := gcd( uint64(r.Num), uint64(r.Den) ); g > 1 {
+        return Rational{ r.Num / uint32(g), r.Den / uint32(g) }
+    }
+    return r
+}
+
+// Cmp compares r and s exactly and returns -1 if r < s, 0 if r == s and +1
+// if r > s. Invalid values compare as 0.
+func (r Rational) Cmp( s Rational ) int {
+    if r.Den == 0 || s.Den == 0 {
+        return 0
+    }
+    a, b := uint64(r.Num) * uint64(s.Den), uint64(s.Num) * uint64(r.Den)
+    switch {
+    case a < b: return -1
+    case a > b: return 1
+    }
+    return 0
+}
+
+// String returns r as "num/den" after simplification, or as an integer if
+// the simplified denominator is 1, or "?" if r is not valid.
+func (r Rational) String( ) string {
+    if r.Den == 0 {
+        return "?"
+    }
+    r = r.Simplify()
+    if r.Den == 1 {
+        return fmt.Sprintf( "%d", r.Num )
+    }
+    return fmt.Sprintf( "%d/%d", r.Num, r.Den )
+}
+
+// IsValid returns true if the denominator is not 0
+func (r SRational) IsValid( ) bool {
+    return r.Den != 0
+}
+
+// Float64 returns the value of r, or 0 if r is not valid
+func (r SRational) Float64( ) float64 {
+    if r.Den == 0 {
+        return 0
+    }
+    return float64(r.Num) / float64(r.Den)
+}
+
+// Simplify returns the irreducible fraction equal to r, with a positive
+// denominator
+func (r SRational) Simplify( ) SRational {
+    if r.Den < 0 {
+        r.Num, r.Den = -r.Num, -r.Den
+    }
+    abs := int64(r.Num)
+    if abs < 0 {
+        abs = -abs
+    }
+    if g := int32(gcd( uint64(abs), uint64(r.Den) )); g > 1 {
+        return SRational{ r.Num / g, r.Den / g }
+    }
+    return r
+}
+
+// Cmp compares r and s exactly and returns -1 if r < s, 0 if r == s and +1
+// if r > s. Invalid values compare as 0.
+func (r SRational) Cmp( s SRational ) int {
+    if r.Den == 0 || s.Den == 0 {
+        return 0
+    }
+    r, s = r.Simplify(), s.Simplify()   // positive denominators
+    a, b := int64(r.Num) * int64(s.Den), int64(s.Num) * int64(r.Den)
+    switch {
+    case a < b: return -1
+    case a > b: return 1
+    }
+    return 0
+}
+
+// String returns r as "num/den" after simplification, or as an integer if
+// the simplified denominator is 1, or "?" if r is not valid.
+func (r SRational) String( ) string {
+    if r.Den == 0 {
+        return "?"
+    }
+    r = r.Simplify()
+    if r.Den == 1 {
+        return fmt.Sprintf( "%d", r.Num )
+    }
+    return fmt.Sprintf( "%d/%d", r.Num, r.Den )
+}
+
+// ifdRational returns the value of a single RATIONAL tag in the given IFD,
+// or an invalid Rational if the tag is not available.
+func (ed *exifData) ifdRational( id exif.IfdId, tag int ) Rational {
+    st, v, err := ed.desc.GetIfdTagValue( id, tag )
+    if err == nil && st == exif.URationalSlice {
+        if sl := v.([]exif.UnsignedRational); len(sl) == 1 {
+            return Rational{ sl[0].Numerator, sl[0].Denominator }
+        }
+    }
+    return Rational{ }
+}
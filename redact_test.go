@@ -0,0 +1,101 @@
+package jpeg
+
+// support for checking that RedactGPS removes GPS information from EXIF and
+// XMP metadata, including EXIF metadata kept as raw data and extended XMP.
+
+import (
+    "bytes"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+)
+
+const gpsXMP = `<?xpacket begin="" id="W5M0MpCehiHzreSzNTczkc9d"?>` +
+    `<x:xmpmeta xmlns:x="adobe:ns:meta/">` +
+    `<rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">` +
+    `<rdf:Description rdf:about="" xmlns:e="http://ns.adobe.com/exif/1.0/"` +
+    ` xmlns:tiff="http://ns.adobe.com/tiff/1.0/"` +
+    ` e:GPSLatitude="48,51.5N" tiff:Make="Maker" e:GPSLongitude='2,17.6E'>` +
+    `<e:GPSAltitude>35/1</e:GPSAltitude><e:GPSVersionID/>` +
+    `<e:ExposureTime>1/60</e:ExposureTime>` +
+    `</rdf:Description></rdf:RDF></x:xmpmeta><?xpacket end="w"?>`
+
+func checkNoGPS( t *testing.T, what string, packet []byte ) {
+    if bytes.Contains( packet, []byte( "GPS" ) ) {
+        t.Errorf( "%s: GPS properties kept: %s", what, packet )
+    }
+    for _, kept := range []string{ `tiff:Make="Maker"`,
+                                   `<e:ExposureTime>1/60</e:ExposureTime>` } {
+        if ! bytes.Contains( packet, []byte( kept ) ) {
+            t.Errorf( "%s: %s removed", what, kept )
+        }
+    }
+}
+
+func redactGPS( t *testing.T, jpg *Desc ) *Desc {
+    changed, err := jpg.Redact( RedactGPS )
+    if err != nil || ! changed {
+        t.Fatalf( "Redact: changed %v, error %v", changed, err )
+    }
+    data, err := jpg.Generate( )
+    if err != nil {
+        t.Fatalf( "Generate: %v", err )
+    }
+    jpg, err = Parse( data, &Control{ } )
+    if err != nil {
+        t.Fatalf( "Parse of redacted picture: %v", err )
+    }
+    return jpg
+}
+
+func TestRedactGPS( t *testing.T ) {
+    gray, err := os.ReadFile( filepath.Join( "testdata", "gray.jpg" ) )
+    if err != nil {
+        t.Fatal( err )
+    }
+
+    t.Run( "XMP", func( t *testing.T ) {
+        jpg, err := Parse( gray, &Control{ } )
+        if err != nil {
+            t.Fatal( err )
+        }
+        if err = jpg.SetXMP( []byte( gpsXMP ), FirstApplication ); err != nil {
+            t.Fatal( err )
+        }
+        jpg = redactGPS( t, jpg )
+        checkNoGPS( t, "XMP", jpg.GetXMP( ) )
+    } )
+
+    t.Run( "extended XMP", func( t *testing.T ) {
+        jpg, err := Parse( gray, &Control{ } )
+        if err != nil {
+            t.Fatal( err )
+        }
+        padding := strings.Repeat( " ", _MAX_APP_PAYLOAD )
+        packet := strings.Replace( gpsXMP, "</rdf:RDF>", padding + "</rdf:RDF>", 1 )
+        if err = jpg.SetXMP( []byte( packet ), FirstApplication ); err != nil {
+            t.Fatal( err )
+        }
+        jpg = redactGPS( t, jpg )
+        ext := jpg.GetExtendedXMP( )
+        if ext == nil {
+            t.Fatalf( "extended XMP lost" )
+        }
+        checkNoGPS( t, "extended XMP", ext )
+    } )
+
+    t.Run( "raw EXIF", func( t *testing.T ) {
+        jpg, err := Parse( withExif( t, appleMakerNote ),
+                           &Control{ Logger: discardLogger{ } } )
+        if err != nil {
+            t.Fatal( err )
+        }
+        jpg = redactGPS( t, jpg )
+        for _, s := range jpg.segments {
+            if isAppSignature( s, 1, _EXIF_SIGNATURE ) {
+                t.Errorf( "raw EXIF segment kept" )
+            }
+        }
+    } )
+}
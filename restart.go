@@ -0,0 +1,59 @@
+package jpeg
+
+// support for restart marker integrity reports
+
+import (
+    "fmt"
+)
+
+// RestartMarker describes one restart marker found in a scan
+type RestartMarker struct {
+    Offset          uint        // marker offset in the original data
+    Number          uint8       // n in RSTn
+    Expected        uint8       // expected n in the RST sequence
+    MCUs            uint        // MCUs decoded since the previous RSTn or
+                                // the start of scan
+}
+
+// RestartReport summarizes the restart marker usage in a scan
+type RestartReport struct {
+    Scan            int         // scan index in frame
+    Interval        uint        // declared restart interval (0 if none)
+    Markers         []RestartMarker
+    SequenceErrors  int         // markers with an unexpected number
+    BadIntervals    int         // intervals with an unexpected MCU count
+    LastMCUs        uint        // MCUs after the last marker (or in scan if
+                                // there is no marker)
+}
+
+// GetRestartReports returns a restart marker report for all scans in the
+// frame fi. An interval is counted as bad if the number of MCUs decoded
+// before a marker is not the declared interval, or if a marker is found
+// without declared interval, or if the MCUs following the last marker exceed
+// the interval (the last interval may be shorter). An error is returned if
+// the requested frame does not exist.
+func (j *Desc)GetRestartReports( fi uint ) ([]RestartReport, error) {
+    frm := j.getFrameSegment( fi )
+    if frm == nil {
+        return nil, fmt.Errorf( "GetRestartReports: frame %d is absent\n", fi )
+    }
+    reports := make( []RestartReport, len(frm.scans) )
+    for i, sc := range frm.scans {
+        r := &reports[i]
+        r.Scan, r.Interval, r.LastMCUs = i, sc.rstInterval, sc.rstTail
+        r.Markers = make( []RestartMarker, len(sc.rsts) )
+        for k, m := range sc.rsts {
+            r.Markers[k] = RestartMarker{ m.offset, m.number, m.expected, m.nMcus }
+            if m.number != m.expected {
+                r.SequenceErrors ++
+            }
+            if m.nMcus != sc.rstInterval {
+                r.BadIntervals ++
+            }
+        }
+        if sc.rstInterval != 0 && sc.rstTail > sc.rstInterval {
+            r.BadIntervals ++
+        }
+    }
+    return reports, nil
+}
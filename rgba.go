@@ -0,0 +1,67 @@
+package jpeg
+
+// support for RGBA output, sized and oriented
+
+import (
+    "fmt"
+    "image"
+    "image/color"
+)
+
+// orientRGBA returns a copy of img with the orientation effect applied
+func orientRGBA( img *image.RGBA, effect VisualEffect ) *image.RGBA {
+    if effect == None {
+        return img
+    }
+    cols, rows := img.Rect.Dx(), img.Rect.Dy()
+    oCols, oRows := cols, rows
+    if swapsSides( effect ) {
+        oCols, oRows = rows, cols
+    }
+    oImg := image.NewRGBA( image.Rect( 0, 0, oCols, oRows ) )
+    for r := 0; r < rows; r++ {
+        for c := 0; c < cols; c++ {
+            oc, or := orientedPosition( effect, c, r, cols, rows )
+            copy( oImg.Pix[or*oImg.Stride+oc*4:or*oImg.Stride+oc*4+4],
+                  img.Pix[r*img.Stride+c*4:r*img.Stride+c*4+4] )
+        }
+    }
+    return oImg
+}
+
+// RGBA decodes the first frame and returns it as an image.RGBA, with all
+// components upsampled to the frame resolution and the orientation given by
+// metadata applied, so that it can be displayed as it is. Alpha is always
+// 255 (opaque), so that the samples are the same premultiplied or not.
+//
+// Gray scale pictures are replicated in R, G and B, YCbCr pictures are
+// converted with the JFIF conversion from image/color, and 4-component
+// pictures are converted as CMYKImageToRGBA does without conversion function.
+func (jpg *Desc) RGBA( ) (*image.RGBA, error) {
+    if len(jpg.frames) == 0 {
+        return nil, fmt.Errorf( "RGBA: no frame\n" )
+    }
+    var img *image.RGBA
+    if len(jpg.frames[0].components) == 4 {
+        var err error
+        if img, err = jpg.CMYKImageToRGBA( nil ); err != nil {
+            return nil, jpgForwardError( "RGBA", err )
+        }
+    } else {
+        cols, rows, planes, err := jpg.fullPlanes( )
+        if err != nil {
+            return nil, jpgForwardError( "RGBA", err )
+        }
+        img = image.NewRGBA( image.Rect( 0, 0, cols, rows ) )
+        for i, y := range planes[0] {
+            p := img.Pix[i*4:i*4+4]
+            if len(planes) == 1 {
+                p[0], p[1], p[2] = y, y, y
+            } else {
+                p[0], p[1], p[2] = color.YCbCrToRGB( y, planes[1][i], planes[2][i] )
+            }
+            p[3] = 255
+        }
+    }
+    return orientRGBA( img, jpg.visualEffect( ) ), nil
+}
@@ -0,0 +1,101 @@
+package jpeg
+
+// support for checking the decoding of all legal combinations of sampling
+// factors, with and without restart intervals, in sequential and progressive
+// pictures. Restart intervals check the position of the data units after
+// each restart marker, progressive pictures the number of data units per row
+// in non-interleaved scans.
+
+import (
+    "bytes"
+    "fmt"
+    "testing"
+)
+
+// legalSamplings returns all the sampling factors of gray pictures, and of
+// YCbCr pictures with identical Cb and Cr factors and no more than 10 data
+// units per MCU (T.81 B.2.3), as required in interleaved scans.
+func legalSamplings( ) (samplings [][][2]uint8) {
+    for h := uint8(1); h <= 4; h++ {
+        for v := uint8(1); v <= 4; v++ {
+            samplings = append( samplings, [][2]uint8{ { h, v } } )
+        }
+    }
+    for yh := uint8(1); yh <= 4; yh++ {
+        for yv := uint8(1); yv <= 4; yv++ {
+            for ch := uint8(1); ch <= 4; ch++ {
+                for cv := uint8(1); cv <= 4; cv++ {
+                    if yh * yv + 2 * ch * cv <= 10 {
+                        samplings = append( samplings,
+                                    [][2]uint8{ { yh, yv }, { ch, cv }, { ch, cv } } )
+                    }
+                }
+            }
+        }
+    }
+    return
+}
+
+// largest difference between decoded and original samples at quality 100
+const maxSamplingDiff = 2
+
+// picture sizes: the second one gives a different number of data units per
+// row if it is calculated from nSamplesLine * 8 / HSF rounded down, instead of
+// the number of component samples per line, with HSF 3 and maximum HSF 4
+var samplingSizes = [][2]int{ { corpusWidth, corpusHeight }, { 121, 17 } }
+
+func TestSamplingFactors( t *testing.T ) {
+    for _, size := range samplingSizes {
+        for _, sampling := range legalSamplings( ) {
+            for _, restart := range []int{ 0, 1, 5 } {
+                for _, progressive := range []bool{ false, true } {
+                    p := testPicture{ width: size[0], height: size[1],
+                                      precision: 8, sampling: sampling,
+                                      restart: restart, progressive: progressive,
+                                      quality: 100 }
+                    name := fmt.Sprintf( "%dx%d/%v/restart=%d/progressive=%v",
+                                         size[0], size[1], sampling,
+                                         restart, progressive )
+                    t.Run( name, func( t *testing.T ) {
+                        checkSamplingFactors( t, p )
+                    } )
+                }
+            }
+        }
+    }
+}
+
+func checkSamplingFactors( t *testing.T, p testPicture ) {
+    data := encodeTestPicture( p )
+    jpg, err := Parse( data, &Control{ } )
+    if err != nil {
+        t.Fatalf( "Parse: %v", err )
+    }
+    samples, err := jpg.MakeFrameRawPicture( 0 )
+    if err != nil {
+        t.Fatalf( "MakeFrameRawPicture: %v", err )
+    }
+    for ci := range p.sampling {
+        cols, rows := p.componentSize( ci )
+        stride := int(jpg.frames[0].components[ci].nUnitsRow << 3)
+        plane := *samples[ci]
+        if len(plane) < (rows - 1) * stride + cols {
+            t.Fatalf( "component %d: %d samples, expected at least %d",
+                      ci, len(plane), (rows - 1) * stride + cols )
+        }
+        for r := 0; r < rows; r++ {
+            for c := 0; c < cols; c++ {
+                d := int(plane[r * stride + c]) - p.sample( ci, c, r )
+                if d < -maxSamplingDiff || d > maxSamplingDiff {
+                    t.Fatalf( "component %d sample %d,%d is %d, expected %d",
+                              ci, r, c, plane[r * stride + c], p.sample( ci, c, r ) )
+                }
+            }
+        }
+    }
+    if out, err := jpg.Generate( ); err != nil {
+        t.Errorf( "Generate: %v", err )
+    } else if ! bytes.Equal( out, data ) {
+        t.Errorf( "Generate: serialized picture differs from the original" )
+    }
+}
@@ -523,18 +523,123 @@ var rlCodes = [][]int16{
       2040,  2041,  2042,  2043,  2044,  2045,  2046,  2047 },
   }
 
-func printDataUnit( dU *dataUnit ) {
+// sizes 12 to 15 are only used in 12-bit frames (see maxCoefSizes): instead of
+// being listed, they are computed as the smaller sizes would be.
+func init( ) {
+    for size := len(rlCodes); size <= 15; size++ {
+        n := 1 << size
+        codes := make( []int16, n )
+        for code := range codes {
+            if code < n / 2 {           // negative values
+                codes[code] = int16(code - (n - 1))
+            } else {
+                codes[code] = int16(code)
+            }
+        }
+        rlCodes = append( rlCodes, codes )
+    }
+}
+
+func (jpg *Desc) printDataUnit( dU *dataUnit ) {
+    if jpg.TraceJSON {              // values in natural (row, col) order
+        var buf bytes.Buffer
+        buf.WriteString( "{\"event\":\"du\",\"values\":[" )
+        for r := 0; r < 8; r++ {
+            for c := 0; c < 8; c++ {
+                if r != 0 || c != 0 {
+                    buf.WriteByte( ',' )
+                }
+                fmt.Fprintf( &buf, "%d", (*dU)[zigZagRowCol[r][c]] )
+            }
+        }
+        buf.WriteString( "]}\n" )
+        jpg.tracef( "%s", buf.String() )
+        return
+    }
     for r := 0; r < 8; r++ {
         if r == 0 {
-            fmt.Printf( "Data Unit:" )
+            jpg.tracef( "Data Unit:" )
         } else {
-            fmt.Printf( "\n          " )
+            jpg.tracef( "\n          " )
         }
         for c := 0; c < 8; c++ {
-            fmt.Printf(" %04d", (*dU)[zigZagRowCol[r][c]] )
+            jpg.tracef(" %04d", (*dU)[zigZagRowCol[r][c]] )
         }
     }
-    fmt.Printf( "\n" )
+    jpg.tracef( "\n" )
+}
+
+// traceJSON prints one MCU trace record as a JSON object on a single line.
+// The common fields are followed by the optional name, value pairs in kv.
+func (jpg *Desc) traceJSON( event string, nMCUs uint, comp int, duRow, duCol uint,
+                            coef uint8, offset uint, bit uint8, kv ...interface{} ) {
+    var buf bytes.Buffer
+    fmt.Fprintf( &buf, "{\"event\":%q,\"mcu\":%d,\"comp\":%d,\"duRow\":%d," +
+                       "\"duCol\":%d,\"coef\":%d,\"offset\":%d,\"bit\":%d",
+                 event, nMCUs, comp, duRow, duCol, coef, offset, bit )
+    for i := 0; i+1 < len(kv); i += 2 {
+        fmt.Fprintf( &buf, ",%q:%d", kv[i], kv[i+1] )
+    }
+    buf.WriteString( "}\n" )
+    jpg.tracef( "%s", buf.String() )
+}
+
+// contains returns true if the given row and col are within the area
+func (a *TraceArea)contains( row, col uint ) bool {
+    return row >= a.Top && row <= a.Bottom && col >= a.Left && col <= a.Right
+}
+
+// number of MCUs per row in the scan component sComp
+func mcusPerRow( sComp *scanComp ) uint {
+    return sComp.nUnitsRow / uint(sComp.HSF)    // HSF is 1 in non-interleaved scans
+}
+
+// mcuString returns the MCU index followed by its row and column in the scan
+func (jpg *Desc) mcuString( nMCUs uint, sComp *scanComp ) string {
+    nMcusRow := mcusPerRow( sComp )
+    if nMcusRow == 0 {
+        return fmt.Sprintf( "%d", nMCUs )
+    }
+    return fmt.Sprintf( "%d(%d,%d)", nMCUs, nMCUs / nMcusRow, nMCUs % nMcusRow )
+}
+
+// traceOn returns true if the MCU/DU trace is requested for the current MCU
+// and data unit in the scan component sComp
+func (jpg *Desc) traceOn( nMCUs uint, sComp *scanComp ) bool {
+    if jpg.Begin > nMCUs || jpg.End < nMCUs {
+        return false
+    }
+    nMcusRow := mcusPerRow( sComp )
+    if jpg.From != nil && nMCUs < jpg.From.Row * nMcusRow + jpg.From.Col {
+        return false
+    }
+    if jpg.To != nil && nMCUs > jpg.To.Row * nMcusRow + jpg.To.Col {
+        return false
+    }
+    if len(jpg.Components) > 0 {
+        var found bool
+        for _, c := range jpg.Components {
+            if c == sComp.cType {
+                found = true
+                break
+            }
+        }
+        if ! found {
+            return false
+        }
+    }
+    if jpg.McuArea != nil {
+        if nMcusRow == 0 ||
+           ! jpg.McuArea.contains( nMCUs / nMcusRow, nMCUs % nMcusRow ) {
+            return false
+        }
+    }
+    if jpg.DuArea != nil &&
+       ! jpg.DuArea.contains( sComp.nRows + sComp.dURow,
+                              sComp.dUAnchor + sComp.dUCol ) {
+        return false
+    }
+    return true
 }
 
 func (jpg *Desc) getBitString( startByte uint, startBit uint8, nBits uint ) string {
@@ -604,12 +709,43 @@ func (jpg *Desc) getBitString( startByte uint, startBit uint8, nBits uint ) stri
     return buf.String()
 }
 
+// incompleteAt returns true if an entropy coded segment ending after nMCUs
+// leaves the scan component k in an unexpected state: in the middle of a MCU,
+// or in the middle of a data unit row without a restart interval boundary.
+// A component whose last data unit is complete has a count of 64.
+func (s *scan)incompleteAt( k int, nMCUs uint ) bool {
+    sc := &s.sComps[k]
+    if sc.dURow != 0 || sc.dUCol != 0 || sc.count % 64 != 0 {
+        return true
+    }
+    return sc.dUAnchor != 0 && (s.rstInterval == 0 || nMCUs % s.rstInterval != 0)
+}
+
+// rowsMissing returns true if the restart position of some scan component
+// is beyond the rows of data units allocated by the first DC scan, which may
+// happen after a broken RST sequence.
+func (s *scan)rowsMissing( ) bool {
+    for i := range s.sComps {
+        if int(s.sComps[i].nRows) >= len(*s.sComps[i].iDCTdata) {
+            return true
+        }
+    }
+    return false
+}
+
 // called for sequential DCT scans or initial progressive scan for DC only
 // coefficient (scan.startSS == 0, scan.endSS == 0 and scan.sABPh == 0).
 // In the latter case, the point transform (<< scan.sABPl) is applied before
 // storing the DC coefficient. Since sABPl is 0 for sequential DCT scans, this
 // has no effect on sequential scans.
 func (jpg *Desc) processSequentialEcs( nMCUs uint, scan *scan ) (uint, error) {
+    jpg.startSequentialEcs( nMCUs, scan )
+    return jpg.decodeSequentialEcs( nMCUs, scan, 0 )
+}
+
+// startSequentialEcs prepares the scan components for a new entropy coded
+// segment starting at MCU nMCUs.
+func (jpg *Desc) startSequentialEcs( nMCUs uint, scan *scan ) {
 
     if ( scan.startSS != 0 || scan.sABPh != 0 ) {
         panic( "processSequentialEcs called for wrong scan" )  // internal error
@@ -632,12 +768,18 @@ func (jpg *Desc) processSequentialEcs( nMCUs uint, scan *scan ) (uint, error) {
         // the following is only necessary in case of missing data
         scan.sComps[i].dUAnchor = (nMCUs * uint(scan.sComps[i].HSF)) %
                                             scan.sComps[i].nUnitsRow
-        scan.sComps[i].nRows = (nMCUs * uint(scan.sComps[i].HSF)) *
-                                            uint(scan.sComps[i].VSF) /
-                                                scan.sComps[i].nUnitsRow
+        scan.sComps[i].nRows = (nMCUs * uint(scan.sComps[i].HSF)) /
+                                    scan.sComps[i].nUnitsRow *
+                                        uint(scan.sComps[i].VSF)
         scan.sComps[i].count = 0       // always start at DC
     }
+}
 
+// decodeSequentialEcs decodes the entropy coded segment starting at MCU nMCUs,
+// at bit skip of the byte at jpg.offset (the first bits of that byte may have
+// been decoded already by process420Ecs).
+func (jpg *Desc) decodeSequentialEcs( nMCUs uint, scan *scan,
+                                      skip uint8 ) (uint, error) {
 /*
     Each scan component (sComp) gives the number of dataUnits that the
     component can use (hSF *vSF). This is a small rectangular area whose
@@ -654,11 +796,12 @@ func (jpg *Desc) processSequentialEcs( nMCUs uint, scan *scan ) (uint, error) {
     sCompIndex := 0                     // first component in MCU
     sComp := &scan.sComps[0]            // first component definition
 
-    // restart where we stopped
-    if len(*sComp.iDCTdata) <= int(sComp.nRows+sComp.dURow) {
+    // restart where we stopped (possibly after missing rows, if the RST
+    // sequence was broken)
+    for len(*sComp.iDCTdata) <= int(sComp.nRows+sComp.dURow) {
         for k := uint8(0); k < sComp.VSF; k++ {
             *sComp.iDCTdata = append(*sComp.iDCTdata,
-                                       make([]dataUnit, sComp.nUnitsRow) )
+                                       jpg.scratch.newRow( sComp.nUnitsRow ) )
         }
     }
     dUnit := &((*sComp.iDCTdata)[sComp.nRows][sComp.dUAnchor])
@@ -682,19 +825,21 @@ func (jpg *Desc) processSequentialEcs( nMCUs uint, scan *scan ) (uint, error) {
     - ZRL = 0xf0, indicates a series of 16 zero samples. ZRL applies only to AC
       samples.
 
-    Note that in case of progressive scans, 13 additional special values are
-    defined. They all apply only to AC samples (not relevant here):
+    Note that in case of progressive scans, 14 additional special values are
+    defined. They all apply only to AC samples (rejected here, see
+    processInitialAcEcs and processRefiningAcEcs):
     - EOBn followed by n bits => EOB + (2^n) following data units of AC samples
                                  are zero (DC samples are in 1 separate scan)
     Where EOBn is [0x10..0xe0]
 */
     huffman := true                     // always start with huffman code
-    var curHcnode *hcnode
-    curHcnode = sComp.hDC               // always start with encoded DC
+    var curTable *hcTable
+    curTable = sComp.hDC                // always start with encoded DC
     var curByte, nBits uint8            // hold current encoded bits
     var runLen, size uint8              // current decoded runlength & size
     var codeBit uint8                   // n bits in current code
     var code uint                       // current code data
+    maxDC, maxAC := jpg.getCurrentFrame().maxCoefSizes()
 
     // encoded loop 1 byte at a time: start at 1st byte following header or RST
     tLen := uint(len( jpg.data ))
@@ -710,7 +855,8 @@ func (jpg *Desc) processSequentialEcs( nMCUs uint, scan *scan ) (uint, error) {
     var padding = false                 // indicates stuffing at end of ECS
 
 encodedLoop:
-    for ; i < tLen-1; i ++ {            // byte loop
+    for ; i < tLen; i ++ {              // byte loop, up to the last byte if
+                                        // data is truncated before any marker
         curByte = jpg.data[i]           // load next byte
         nBits = 8                       // 8 bits now available in curByte
 
@@ -718,32 +864,34 @@ encodedLoop:
             i++         // skip expected following 0x00
             if i >= tLen-1 || jpg.data[i] != 0x00 {
                 i--     // backup for next marker and stop
-                if jpg.Mcu && jpg.Begin <= nMCUs && jpg.End >= nMCUs {
-                    fmt.Printf( "MCU=%d comp=%d du=%d,%d coef=%d offset=%#x [%#02x] " +
-                                "End of scan segment (found marker or RST)\n",
-                                nMCUs, sCompIndex, sComp.dURow, sComp.dUCol,
-                                sComp.count, i, curByte )
+                if jpg.Mcu && jpg.traceOn( nMCUs, sComp ) {
+                    if jpg.TraceJSON {
+                        jpg.traceJSON( "end", nMCUs, sCompIndex, sComp.dURow, sComp.dUCol,
+                                       sComp.count, i, 0 )
+                    } else {
+                        jpg.tracef( "MCU=%s comp=%d du=%d,%d coef=%d offset=%#x [%#02x] " +
+                                    "End of scan segment (found marker or RST)\n",
+                                    jpg.mcuString( nMCUs, sComp ), sCompIndex, sComp.dURow, sComp.dUCol,
+                                    sComp.count, i, curByte )
+                    }
                 }
 
                 warning := false
                 for k := len(scan.sComps)-1; k >= 0; k-- {
-                    if scan.sComps[k].dUAnchor != 0 ||
-                       scan.sComps[k].dURow != 0 ||
-                       scan.sComps[k].dUCol != 0 ||
-                       scan.sComps[k].count != 0 {
+                    if jpg.Warn && scan.incompleteAt( k, nMCUs ) {
                         warning = true
-                        fmt.Printf( "Warning: incomplete component %d (%d rows):"+
-                                    " anchor %d (max %d) row %d col %d count %d\n",
-                                k, scan.sComps[k].nRows,
-                                scan.sComps[k].dUAnchor,
-                                scan.sComps[k].nUnitsRow,
-                                scan.sComps[k].dURow,
-                                scan.sComps[k].dUCol,
-                                scan.sComps[k].count )
+                        jpg.warning( "Warning: incomplete component %d (%d rows):"+
+                                     " anchor %d (max %d) row %d col %d count %d\n",
+                                 k, scan.sComps[k].nRows,
+                                 scan.sComps[k].dUAnchor,
+                                 scan.sComps[k].nUnitsRow,
+                                 scan.sComps[k].dURow,
+                                 scan.sComps[k].dUCol,
+                                 scan.sComps[k].count )
                     }
                 }
                 if warning {
-                    fmt.Printf( "MCU=%d comp=%d du=%d,%d coef=%d offset=%#x [%#02x] " +
+                    jpg.warning( "MCU=%d comp=%d du=%d,%d coef=%d offset=%#x [%#02x] " +
                                 "Unexpected end of scan segment\n",
                                 nMCUs, sCompIndex, sComp.dURow, sComp.dUCol,
                                 sComp.count, i, curByte )
@@ -759,54 +907,59 @@ encodedLoop:
                      "Padding bits not at the end of entropy coded segment\n" )
             }
         }
+        if skip != 0 {                  // bits already decoded
+            curByte <<= skip
+            nBits -= skip
+            skip = 0
+        }
         for {                           // curbyte bit loop
             if huffman {
                 for {                       // huffman bit loop (both DC & AC)
                     if nBits == 0 { continue encodedLoop } // need more bits
                         
-                    if (curByte & 0x80) == 0x80 {
-                        curHcnode = curHcnode.left
-                        if curHcnode == nil {
-                            padding = true;     // maybe byte stuffing at the end
-                            if jpg.Verbose {
-                                fmt.Printf("possible padding curByte=0x%02x nBits=%d\n", curByte, nBits );
-                            }
-                            for {
-                                nBits --
-                                if nBits == 0 {
-                                    continue encodedLoop    // end of ECS
-                                }
-                                curByte <<= 1
-                                if (curByte & 0x80) != 0x80 {
-                                    return nMCUs, fmt.Errorf(
-                                           "Invalid code/huffman tree (left)\n")
-                                }
-                            }
-                        }
-                        huffval <<= 1
-                        huffval ++
-                    } else {
-                        if curHcnode.right == nil {
+                    bit := uint(curByte >> 7)
+                    if ! curTable.prefix( huffval << 1 | bit, huffbits + 1 ) {
+                        if bit == 0 {
                             return nMCUs, fmt.Errorf(
                                           "Invalid code/huffman tree (right)\n")
                         }
-                        curHcnode = curHcnode.right
-                        huffval <<= 1
+                        padding = true;     // maybe byte stuffing at the end
+                        if jpg.Verbose {
+                            fmt.Printf("possible padding curByte=0x%02x nBits=%d\n", curByte, nBits );
+                        }
+                        for {
+                            nBits --
+                            if nBits == 0 {
+                                continue encodedLoop    // end of ECS
+                            }
+                            curByte <<= 1
+                            if (curByte & 0x80) != 0x80 {
+                                return nMCUs, fmt.Errorf(
+                                       "Invalid code/huffman tree (left)\n")
+                            }
+                        }
                     }
+                    huffval = huffval << 1 | bit
                     curByte <<= 1
                     nBits --
                     huffbits ++
 
-                    if curHcnode.left == nil && curHcnode.right == nil {
-                        runSize := curHcnode.symbol // if AC first 4 bits are
-                        runLen = runSize >> 4      // runlength, remaining 4
-                        size = runSize & 0x0f      // are size in all cases
-                        if jpg.Mcu && jpg.Begin <= nMCUs && jpg.End >= nMCUs {
-                            fmt.Printf( "MCU=%d comp=%d du=%d,%d coef=%d %s Huffman: " +
-                                        "size %d (0-runlength %d)\n",
-                                        nMCUs, sCompIndex, sComp.dURow, sComp.dUCol, sComp.count,
-                                        jpg.getBitString( startByte,startBit, uint(huffbits) ),
-                                        size, runLen )
+                    if runSize, ok := curTable.symbol( huffval, huffbits ); ok {
+                        runLen = runSize >> 4      // if AC first 4 bits are
+                        size = runSize & 0x0f      // runlength, remaining 4
+                                                   // are size in all cases
+                        if jpg.Mcu && jpg.traceOn( nMCUs, sComp ) {
+                            if jpg.TraceJSON {
+                                jpg.traceJSON( "huffman", nMCUs, sCompIndex, sComp.dURow, sComp.dUCol,
+                                               sComp.count, startByte, startBit,
+                                               "nBits", huffbits, "size", size, "runLength", runLen )
+                            } else {
+                                jpg.tracef( "MCU=%s comp=%d du=%d,%d coef=%d %s Huffman: " +
+                                            "size %d (0-runlength %d)\n",
+                                            jpg.mcuString( nMCUs, sComp ), sCompIndex, sComp.dURow, sComp.dUCol, sComp.count,
+                                            jpg.getBitString( startByte,startBit, uint(huffbits) ),
+                                            size, runLen )
+                            }
                         }
                         huffval, huffbits, huffman = 0, 0, false
                         codeBit, code = 0, 0
@@ -815,9 +968,10 @@ encodedLoop:
                 }
             } else {                        // extract size bits of code
                 if ( sComp.count == 0 ) {   // first code is for DC
-                    if size > 11 {      // code bits to extract from curByte
+                    if size > maxDC {   // code bits to extract from curByte
                         return nMCUs, fmt.Errorf(
-                            "processSequentialEcs: DC coef size (%d) > 11 bits\n", size)
+                            "processSequentialEcs: DC coef size (%d) > %d bits\n",
+                            size, maxDC )
                     }
 
                     for ; codeBit < size; codeBit++ {   // extract code bits
@@ -833,12 +987,18 @@ encodedLoop:
                     decodedDC := rlCodes[size][code]
                     sComp.previousDC += decodedDC
 
-                    if jpg.Mcu && jpg.Begin <= nMCUs && jpg.End >= nMCUs {
-                        fmt.Printf(
-                    "MCU=%d comp=%d du=%d,%d coef=0 %s DC: decoded=%d cumulative=%d\n",
-                    nMCUs, sCompIndex, sComp.dURow, sComp.dUCol,
-                    jpg.getBitString( startByte, startBit, uint(size) ),
-                    decodedDC, sComp.previousDC )
+                    if jpg.Mcu && jpg.traceOn( nMCUs, sComp ) {
+                        if jpg.TraceJSON {
+                            jpg.traceJSON( "dc", nMCUs, sCompIndex, sComp.dURow, sComp.dUCol,
+                                           0, startByte, startBit,
+                                           "nBits", size, "value", decodedDC, "dc", sComp.previousDC )
+                        } else {
+                            jpg.tracef(
+                        "MCU=%s comp=%d du=%d,%d coef=0 %s DC: decoded=%d cumulative=%d\n",
+                        jpg.mcuString( nMCUs, sComp ), sCompIndex, sComp.dURow, sComp.dUCol,
+                        jpg.getBitString( startByte, startBit, uint(size) ),
+                        decodedDC, sComp.previousDC )
+                        }
                     }
 
                     // store in first data unit slot after point transform
@@ -855,21 +1015,31 @@ encodedLoop:
 
                 } else {                   // AC values
                     if runLen == 0 && size == 0 { // EOB => following AC coefs are 0
-                        if jpg.Mcu && jpg.Begin <= nMCUs && jpg.End >= nMCUs {
-                            fmt.Printf(
-                            "MCU=%d comp=%d du=%d,%d coef=%d %s AC: EOB for this data unit\n",
-                            nMCUs, sCompIndex, sComp.dURow, sComp.dUCol, sComp.count,
-                            jpg.getBitString( startByte, startBit, uint(size) ) )
+                        if jpg.Mcu && jpg.traceOn( nMCUs, sComp ) {
+                            if jpg.TraceJSON {
+                                jpg.traceJSON( "eob", nMCUs, sCompIndex, sComp.dURow, sComp.dUCol,
+                                               sComp.count, startByte, startBit )
+                            } else {
+                                jpg.tracef(
+                                "MCU=%s comp=%d du=%d,%d coef=%d %s AC: EOB for this data unit\n",
+                                jpg.mcuString( nMCUs, sComp ), sCompIndex, sComp.dURow, sComp.dUCol, sComp.count,
+                                jpg.getBitString( startByte, startBit, uint(size) ) )
+                            }
                         }
                         // just skip (not modified in any way)
                         sComp.count = 64     // ready for next data unit
 
                     } else if runLen == 15 && size == 0 {   // ZRL => 16 0s
-                        if jpg.Mcu && jpg.Begin <= nMCUs && jpg.End >= nMCUs {
-                            fmt.Printf(
-                            "MCU=%d comp=%d du=%d,%d  coef=%d %s AC: ZRL => 16 bytes = 0\n",
-                            nMCUs, sCompIndex, sComp.dURow, sComp.dUCol, sComp.count,
-                            jpg.getBitString( startByte, startBit, uint(size) ) )
+                        if jpg.Mcu && jpg.traceOn( nMCUs, sComp ) {
+                            if jpg.TraceJSON {
+                                jpg.traceJSON( "zrl", nMCUs, sCompIndex, sComp.dURow, sComp.dUCol,
+                                               sComp.count, startByte, startBit )
+                            } else {
+                                jpg.tracef(
+                                "MCU=%s comp=%d du=%d,%d  coef=%d %s AC: ZRL => 16 bytes = 0\n",
+                                jpg.mcuString( nMCUs, sComp ), sCompIndex, sComp.dURow, sComp.dUCol, sComp.count,
+                                jpg.getBitString( startByte, startBit, uint(size) ) )
+                            }
                         }
                         if sComp.count+16 > 64 {
                             return nMCUs, fmt.Errorf(
@@ -879,10 +1049,15 @@ encodedLoop:
                         sComp.count += 16
 
                     } else {                // not a special case, size is not 0
-                        if size < 1 || size > 10 {
+                        if size == 0 {      // EOBn is only valid in progressive scans
+                            return nMCUs, fmt.Errorf(
+                             "processSequentialEcs: EOB run (EOB%d) in sequential scan\n",
+                              runLen )
+                        }
+                        if size > maxAC {
                             return nMCUs, fmt.Errorf(
-                             "processSequentialEcs: AC coef size (%d) not in [1-10] bits\n",
-                              size)
+                             "processSequentialEcs: AC coef size (%d) not in [1-%d] bits\n",
+                              size, maxAC )
                         }
                         for ; codeBit < size; codeBit++ {
                             if nBits == 0 { continue encodedLoop }  // need more bits
@@ -896,12 +1071,18 @@ encodedLoop:
 
                         }
                         decodedAC := rlCodes[size][code]
-                        if jpg.Mcu && jpg.Begin <= nMCUs && jpg.End >= nMCUs {
-                            fmt.Printf(
-                            "MCU=%d comp=%d du=%d,%d coef=%d %s AC: runlength %d decoded=%d\n",
-                            nMCUs, sCompIndex, sComp.dURow, sComp.dUCol, sComp.count,
-                            jpg.getBitString( startByte, startBit, uint(size) ),
-                            runLen, decodedAC )
+                        if jpg.Mcu && jpg.traceOn( nMCUs, sComp ) {
+                            if jpg.TraceJSON {
+                                jpg.traceJSON( "ac", nMCUs, sCompIndex, sComp.dURow, sComp.dUCol,
+                                               sComp.count, startByte, startBit,
+                                               "nBits", size, "runLength", runLen, "value", decodedAC )
+                            } else {
+                                jpg.tracef(
+                                "MCU=%s comp=%d du=%d,%d coef=%d %s AC: runlength %d decoded=%d\n",
+                                jpg.mcuString( nMCUs, sComp ), sCompIndex, sComp.dURow, sComp.dUCol, sComp.count,
+                                jpg.getBitString( startByte, startBit, uint(size) ),
+                                runLen, decodedAC )
+                            }
                         }
                         if sComp.count+runLen > 63 {    // + 1 byte after runLen 0s
                             return nMCUs, fmt.Errorf(
@@ -916,8 +1097,8 @@ encodedLoop:
                     }
                 }
                 if sComp.count == 64 {  // end of data unit
-                    if jpg.Control.Du && jpg.Begin <= nMCUs && jpg.End >= nMCUs {
-                        printDataUnit( dUnit )
+                    if jpg.Control.Du && jpg.traceOn( nMCUs, sComp ) {
+                        jpg.printDataUnit( dUnit )
                     }
                     sComp.dUCol++
                     if sComp.dUCol >= uint(sComp.HSF) {
@@ -934,12 +1115,12 @@ encodedLoop:
 
                             sComp = &scan.sComps[sCompIndex]
                             if sComp.dUAnchor == sComp.nUnitsRow { // end of DU row
-                                if jpg.nMcuRST != 0 &&
-                                   nMCUs % jpg.nMcuRST != 0 && jpg.Warn {
-                                    fmt.Printf(
+                                if scan.rstInterval != 0 &&
+                                   nMCUs % scan.rstInterval != 0 && jpg.Warn {
+                                    jpg.warning(
                                         "Warning: end of slice @MCU %d is "+
                                         "not synced with RST intervals (%d)\n",
-                                        nMCUs, jpg.nMcuRST )
+                                        nMCUs, scan.rstInterval )
                                 }
                                 for sci := 0; sci < len(scan.sComps); sci++ {
                                     // new row for each component
@@ -950,22 +1131,24 @@ encodedLoop:
                                     sc.dUCol = 0
                                     sc.count = 0
                                 }
+                                jpg.reportMcuRow( scan, sComp.nRows / uint(sComp.VSF) )
+                                jpg.streamRows( jpg.getCurrentFrame( ), scan )
                             }
                         }
                     }
-                    if len(*sComp.iDCTdata) <= int(sComp.nRows+sComp.dURow) {
+                    for len(*sComp.iDCTdata) <= int(sComp.nRows+sComp.dURow) {
                         for k := uint8(0); k < sComp.VSF; k++ {
                             *sComp.iDCTdata = append(*sComp.iDCTdata,
-                                               make([]dataUnit, sComp.nUnitsRow) )
+                                               jpg.scratch.newRow( sComp.nUnitsRow ) )
                         }
                     }
                     //fmt.Printf("Ready for next data unit: component %d anchor %d row %d col %d\n",
                     //           sCompIndex, sComp.dUAnchor, sComp.dURow, sComp.dUCol)
                     dUnit = &((*sComp.iDCTdata)[sComp.nRows+sComp.dURow][sComp.dUAnchor+sComp.dUCol])
                     sComp.count = 0
-                    curHcnode = sComp.hDC   // new data unit starts with DC coefficient
+                    curTable = sComp.hDC    // new data unit starts with DC coefficient
                 } else {                    // same data unit, keep working on AC
-                    curHcnode = sComp.hAC   // but need to restart from the Huffman root
+                    curTable = sComp.hAC    // but need to restart from the Huffman root
                 }
                 huffman = true
             }
@@ -980,7 +1163,11 @@ encodedLoop:
         }   // end curbyte bit loop
     }   // end encodedLoop
 
-    jpg.offset = i  // stopped at 0xFF followed by non-zero byte or at tLen-1
+    if i >= tLen && sComp.dUAnchor == 0 {   // end of data without marker
+        (*sComp.iDCTdata) =                 // remove rows just added, as
+            (*sComp.iDCTdata)[:len(*sComp.iDCTdata)-int(sComp.VSF)] // above
+    }
+    jpg.offset = i  // stopped at 0xFF followed by non-zero byte or at tLen
     return nMCUs, nil
 }
 
@@ -1002,9 +1189,9 @@ func (jpg *Desc) processRefiningDcEcs( nMCUs uint, scan *scan ) (uint, error) {
         scan.sComps[i].dURow = 0
         scan.sComps[i].dUAnchor = (nMCUs * uint(scan.sComps[i].HSF)) %
                                     scan.sComps[i].nUnitsRow
-        scan.sComps[i].nRows = (nMCUs * uint(scan.sComps[i].HSF)) *
-                                            uint(scan.sComps[i].VSF) /
-                                                scan.sComps[i].nUnitsRow
+        scan.sComps[i].nRows = (nMCUs * uint(scan.sComps[i].HSF)) /
+                                    scan.sComps[i].nUnitsRow *
+                                        uint(scan.sComps[i].VSF)
         scan.sComps[i].count = 0       // only DC coefficient
     }
 
@@ -1012,6 +1199,9 @@ func (jpg *Desc) processRefiningDcEcs( nMCUs uint, scan *scan ) (uint, error) {
     sComp := &scan.sComps[0]            // first component definition
 
     // restart where we stopped
+    if scan.rowsMissing( ) {
+        return nMCUs, fmt.Errorf( "processRefiningDcEcs: restart beyond the end of scan\n" )
+    }
     dUnit := &((*sComp.iDCTdata)[sComp.nRows][sComp.dUAnchor])
     var curByte, nBits uint8            // hold current encoded bits
 
@@ -1030,31 +1220,33 @@ encodedLoop:
             i++         // skip expected following 0x00
             if i >= tLen-1 || jpg.data[i] != 0x00 {
                 i--     // backup for next marker and stop
-                if jpg.Mcu && jpg.Begin <= nMCUs && jpg.End >= nMCUs {
-                    fmt.Printf( "MCU=%d comp=%d du=%d,%d coef=0 offset=%#x [%#02x] " +
-                                "End of scan segment (found marker or RST)\n",
-                                nMCUs, sCompIndex, sComp.dURow, sComp.dUCol, i, curByte )
+                if jpg.Mcu && jpg.traceOn( nMCUs, sComp ) {
+                    if jpg.TraceJSON {
+                        jpg.traceJSON( "end", nMCUs, sCompIndex, sComp.dURow, sComp.dUCol,
+                                       0, i, 0 )
+                    } else {
+                        jpg.tracef( "MCU=%s comp=%d du=%d,%d coef=0 offset=%#x [%#02x] " +
+                                    "End of scan segment (found marker or RST)\n",
+                                    jpg.mcuString( nMCUs, sComp ), sCompIndex, sComp.dURow, sComp.dUCol, i, curByte )
+                    }
                 }
 
                 warning := false
                 for k := len(scan.sComps)-1; k >= 0; k-- {
-                    if scan.sComps[k].dUAnchor != 0 ||
-                       scan.sComps[k].dURow != 0 ||
-                       scan.sComps[k].dUCol != 0 ||
-                       scan.sComps[k].count != 0 {
+                    if jpg.Warn && scan.incompleteAt( k, nMCUs ) {
                         warning = true
-                        fmt.Printf( "Warning: incomplete component %d (%d rows):"+
-                                    " anchor %d (max %d) row %d col %d count %d\n",
-                                k, scan.sComps[k].nRows,
-                                scan.sComps[k].dUAnchor,
-                                scan.sComps[k].nUnitsRow,
-                                scan.sComps[k].dURow,
-                                scan.sComps[k].dUCol,
-                                scan.sComps[k].count )
+                        jpg.warning( "Warning: incomplete component %d (%d rows):"+
+                                     " anchor %d (max %d) row %d col %d count %d\n",
+                                 k, scan.sComps[k].nRows,
+                                 scan.sComps[k].dUAnchor,
+                                 scan.sComps[k].nUnitsRow,
+                                 scan.sComps[k].dURow,
+                                 scan.sComps[k].dUCol,
+                                 scan.sComps[k].count )
                     }
                 }
                 if warning {
-                    fmt.Printf( "MCU=%d comp=%d du=%d,%d coef=0 offset=%#x [%#02x] " +
+                    jpg.warning( "MCU=%d comp=%d du=%d,%d coef=0 offset=%#x [%#02x] " +
                                 "Unexpected end of scan segment\n",
                                 nMCUs, sCompIndex, sComp.dURow, sComp.dUCol, i, curByte )
                 }
@@ -1074,12 +1266,19 @@ encodedLoop:
                 decodedDC = 1 << scan.sABPl
                 (*dUnit)[0] |= decodedDC
             }
-            if jpg.Mcu && jpg.Begin <= nMCUs && jpg.End >= nMCUs {
-                fmt.Printf(
-                    "MCU=%d comp=%d du=%d,%d coef=0 %s DC: previous=%d decoded=%d updated=%d\n",
-                    nMCUs, sCompIndex, sComp.dURow, sComp.dUCol,
-                    jpg.getBitString( i, 8 - nBits, 1 ),
-                    previousVal, decodedDC, (*dUnit)[0] )
+            if jpg.Mcu && jpg.traceOn( nMCUs, sComp ) {
+                if jpg.TraceJSON {
+                    jpg.traceJSON( "dc", nMCUs, sCompIndex, sComp.dURow, sComp.dUCol,
+                                   0, i, 8 - nBits,
+                                   "nBits", 1, "previous", previousVal, "value", decodedDC,
+                                   "dc", (*dUnit)[0] )
+                } else {
+                    jpg.tracef(
+                        "MCU=%s comp=%d du=%d,%d coef=0 %s DC: previous=%d decoded=%d updated=%d\n",
+                        jpg.mcuString( nMCUs, sComp ), sCompIndex, sComp.dURow, sComp.dUCol,
+                        jpg.getBitString( i, 8 - nBits, 1 ),
+                        previousVal, decodedDC, (*dUnit)[0] )
+                }
             }
 
             curByte <<= 1
@@ -1100,12 +1299,12 @@ encodedLoop:
 
                     sComp = &scan.sComps[sCompIndex]
                     if sComp.dUAnchor == sComp.nUnitsRow { // end of DU row
-                        if jpg.nMcuRST != 0 &&
-                           nMCUs % jpg.nMcuRST != 0 && jpg.Warn {
-                            fmt.Printf(
+                        if scan.rstInterval != 0 &&
+                           nMCUs % scan.rstInterval != 0 && jpg.Warn {
+                            jpg.warning(
                                 "Warning: end of slice @MCU %d is "+
                                 "not synced with RST intervals (%d)\n",
-                                nMCUs, jpg.nMcuRST )
+                                nMCUs, scan.rstInterval )
                         }
                         for sci := 0; sci < len(scan.sComps); sci++ {
                             // new row for each component
@@ -1152,16 +1351,20 @@ func (jpg *Desc) processInitialAcEcs( nMCUs uint, scan *scan ) (uint, error) {
     sComp.count = scan.startSS                  // start at specific AC band
 
     // restart where we stopped
+    if scan.rowsMissing( ) {
+        return nMCUs, fmt.Errorf( "processInitialAcEcs: restart beyond the end of scan\n" )
+    }
     dUnit := &((*sComp.iDCTdata)[sComp.nRows][sComp.dUAnchor])
 
     huffman := true                     // always start with huffman code
-    var curHcnode = sComp.hAC           // always start with encoded AC
+    var curTable = sComp.hAC            // always start with encoded AC
 
     var curByte, nBits uint8            // hold current encoded bits
     var runLen, size uint8              // current decoded runlength & size
     var codeBit uint8                   // n bits in current code
     var code uint                       // current code data
     var nBlocks uint                    // number of block to skip
+    _, maxAC := jpg.getCurrentFrame().maxCoefSizes()
 
     // encoded loop 1 byte at a time: start at 1st byte following header or RST
     tLen := uint(len( jpg.data ))
@@ -1185,15 +1388,22 @@ encodedLoop:
             i++         // skip expected following 0x00
             if i >= tLen-1 || jpg.data[i] != 0x00 {
                 i--     // backup for next marker and stop
-                if jpg.Mcu && jpg.Begin <= nMCUs && jpg.End >= nMCUs {
-                    fmt.Printf( "MCU=%d comp=%d du=%d,%d coef=%d offset=%#x [%#02x] " +
-                                "End of scan segment (found marker or RST)\n",
-                                nMCUs, 0, sComp.nRows, sComp.dUAnchor,
-                                sComp.count, i, curByte )
+                if jpg.Mcu && jpg.traceOn( nMCUs, sComp ) {
+                    if jpg.TraceJSON {
+                        jpg.traceJSON( "end", nMCUs, 0, sComp.nRows, sComp.dUAnchor,
+                                       sComp.count, i, 0 )
+                    } else {
+                        jpg.tracef( "MCU=%s comp=%d du=%d,%d coef=%d offset=%#x [%#02x] " +
+                                    "End of scan segment (found marker or RST)\n",
+                                    jpg.mcuString( nMCUs, sComp ), 0, sComp.nRows, sComp.dUAnchor,
+                                    sComp.count, i, curByte )
+                    }
                 }
 
-                if sComp.dUAnchor != 0 || sComp.count != scan.startSS {
-                    fmt.Printf( "MCU=%d comp=%d du=%d,%d coef=%d offset=%#x [%#02x] " +
+                if jpg.Warn && ( sComp.count != scan.startSS ||
+                                 ( sComp.dUAnchor != 0 && ( scan.rstInterval == 0 ||
+                                           nMCUs % scan.rstInterval != 0 ) ) ) {
+                    jpg.warning( "MCU=%d comp=%d du=%d,%d coef=%d offset=%#x [%#02x] " +
                                 "Unexpected end of scan segment\n",
                                 nMCUs, 0, sComp.nRows, sComp.dUAnchor,
                                 sComp.count, i, curByte )
@@ -1210,50 +1420,50 @@ encodedLoop:
                     if nBits == 0 {
                         continue encodedLoop    // need more bits
                     }
-                    if (curByte & 0x80) == 0x80 {
-                        curHcnode = curHcnode.left
-                        if curHcnode == nil {
-                            padding = true;     // maybe byte stuffing at the end
-                            if jpg.Verbose {
-                                fmt.Printf("possible padding curByte=0x%02x nBits=%d\n",
-                                            curByte, nBits );
-                            }
-                            for {
-                                nBits --
-                                if nBits == 0 {
-                                    continue encodedLoop    // end of ECS
-                                }
-                                curByte <<= 1
-                                if (curByte & 0x80) != 0x80 {
-                                    return nMCUs, fmt.Errorf(
-                                           "Invalid code/huffman tree (left)\n")
-                                }
-                            }
-                        }
-                        huffval <<= 1
-                        huffval ++
-                    } else {
-                        curHcnode = curHcnode.right
-                        if curHcnode == nil {
+                    bit := uint(curByte >> 7)
+                    if ! curTable.prefix( huffval << 1 | bit, huffbits + 1 ) {
+                        if bit == 0 {
                             return nMCUs, fmt.Errorf(
                                           "Invalid code/huffman tree (right)\n")
+                        }
+                        padding = true;     // maybe byte stuffing at the end
+                        if jpg.Verbose {
+                            fmt.Printf("possible padding curByte=0x%02x nBits=%d\n",
+                                        curByte, nBits );
+                        }
+                        for {
+                            nBits --
+                            if nBits == 0 {
+                                continue encodedLoop    // end of ECS
+                            }
+                            curByte <<= 1
+                            if (curByte & 0x80) != 0x80 {
+                                return nMCUs, fmt.Errorf(
+                                       "Invalid code/huffman tree (left)\n")
                             }
-                        huffval <<= 1
+                        }
                     }
+                    huffval = huffval << 1 | bit
                     curByte <<= 1
                     nBits --
                     huffbits ++
 
-                    if curHcnode.left == nil && curHcnode.right == nil {
-                        runSize := curHcnode.symbol // if AC first 4 bits are
-                        runLen = runSize >> 4      // runlength, remaining 4
-                        size = runSize & 0x0f      // are size in all cases
-                        if jpg.Mcu && jpg.Begin <= nMCUs && jpg.End >= nMCUs {
-                            fmt.Printf( "MCU=%d comp=%d du=%d,%d coef=%d %s Huffman: " +
-                                        "size %d (0-runlength %d)\n",
-                                        nMCUs, 0, sComp.nRows, sComp.dUAnchor, sComp.count,
-                                        jpg.getBitString( startByte, startBit, uint(huffbits) ),
-                                        size, runLen )
+                    if runSize, ok := curTable.symbol( huffval, huffbits ); ok {
+                        runLen = runSize >> 4      // if AC first 4 bits are
+                        size = runSize & 0x0f      // runlength, remaining 4
+                                                   // are size in all cases
+                        if jpg.Mcu && jpg.traceOn( nMCUs, sComp ) {
+                            if jpg.TraceJSON {
+                                jpg.traceJSON( "huffman", nMCUs, 0, sComp.nRows, sComp.dUAnchor,
+                                               sComp.count, startByte, startBit,
+                                               "nBits", huffbits, "size", size, "runLength", runLen )
+                            } else {
+                                jpg.tracef( "MCU=%s comp=%d du=%d,%d coef=%d %s Huffman: " +
+                                            "size %d (0-runlength %d)\n",
+                                            jpg.mcuString( nMCUs, sComp ), 0, sComp.nRows, sComp.dUAnchor, sComp.count,
+                                            jpg.getBitString( startByte, startBit, uint(huffbits) ),
+                                            size, runLen )
+                            }
                         }
                         huffval, huffbits, huffman = 0, 0, false
                         codeBit, code = 0, 0
@@ -1264,11 +1474,16 @@ encodedLoop:
             } else {                    // only AC coefficients
                 if size == 0 {          // EOBn or ZRL
                    if runLen == 15 {    // ZRL => 16 0s
-                        if jpg.Mcu && jpg.Begin <= nMCUs && jpg.End >= nMCUs {
-                            fmt.Printf(
-                            "MCU=%d comp=%d du=%d,%d coef=%d %s AC: ZRL => 16 bytes = 0\n",
-                            nMCUs, 0, sComp.nRows, sComp.dUAnchor, sComp.count,
-                            jpg.getBitString( startByte, startBit, 0 ) )
+                        if jpg.Mcu && jpg.traceOn( nMCUs, sComp ) {
+                            if jpg.TraceJSON {
+                                jpg.traceJSON( "zrl", nMCUs, 0, sComp.nRows, sComp.dUAnchor,
+                                               sComp.count, startByte, startBit )
+                            } else {
+                                jpg.tracef(
+                                "MCU=%s comp=%d du=%d,%d coef=%d %s AC: ZRL => 16 bytes = 0\n",
+                                jpg.mcuString( nMCUs, sComp ), 0, sComp.nRows, sComp.dUAnchor, sComp.count,
+                                jpg.getBitString( startByte, startBit, 0 ) )
+                            }
                         }
                         if sComp.count+15 > scan.endSS {
                             return nMCUs, fmt.Errorf(
@@ -1288,18 +1503,24 @@ encodedLoop:
                         }
                         // do not change sComp.count, will be processed with blocks
                         nBlocks = (1 << runLen) + code
-                        if jpg.Mcu && jpg.Begin <= nMCUs && jpg.End >= nMCUs {
-                            fmt.Printf(
-                            "MCU=%d comp=%d du=%d,%d coef=%d %s AC: EOB%d for this data unit\n",
-                            nMCUs, 0, sComp.nRows, sComp.dUAnchor, sComp.count,
-                            jpg.getBitString( startByte, startBit, uint(runLen) ), runLen )
+                        if jpg.Mcu && jpg.traceOn( nMCUs, sComp ) {
+                            if jpg.TraceJSON {
+                                jpg.traceJSON( "eob", nMCUs, 0, sComp.nRows, sComp.dUAnchor,
+                                               sComp.count, startByte, startBit,
+                                               "nBits", runLen, "runLength", runLen, "blocks", nBlocks )
+                            } else {
+                                jpg.tracef(
+                                "MCU=%s comp=%d du=%d,%d coef=%d %s AC: EOB%d => %d data units\n",
+                                jpg.mcuString( nMCUs, sComp ), 0, sComp.nRows, sComp.dUAnchor, sComp.count,
+                                jpg.getBitString( startByte, startBit, uint(runLen) ), runLen, nBlocks )
+                            }
                         }
                     }
                 } else {                // not a special case, size is not 0
-                    if size > 10 {
+                    if size > maxAC {
                         return nMCUs, fmt.Errorf(
-                        "processInitialAcEcs: AC coef size (%d) not in [1-10] bits\n",
-                              size)
+                        "processInitialAcEcs: AC coef size (%d) not in [1-%d] bits\n",
+                              size, maxAC )
                     }
                     for ; codeBit < size; codeBit++ {
                         if nBits == 0 { continue encodedLoop }  // need more bits
@@ -1313,12 +1534,18 @@ encodedLoop:
                     }
                     decodedAC := rlCodes[size][code]
 
-                    if jpg.Mcu && jpg.Begin <= nMCUs && jpg.End >= nMCUs {
-                        fmt.Printf(
-                        "MCU=%d comp=%d du=%d,%d coef=%d %s AC: runlength %d decoded=%d\n",
-                        nMCUs, 0, sComp.nRows, sComp.dUAnchor, sComp.count,
-                        jpg.getBitString( startByte, startBit, uint(size) ),
-                        runLen, decodedAC )
+                    if jpg.Mcu && jpg.traceOn( nMCUs, sComp ) {
+                        if jpg.TraceJSON {
+                            jpg.traceJSON( "ac", nMCUs, 0, sComp.nRows, sComp.dUAnchor,
+                                           sComp.count, startByte, startBit,
+                                           "nBits", size, "runLength", runLen, "value", decodedAC )
+                        } else {
+                            jpg.tracef(
+                            "MCU=%s comp=%d du=%d,%d coef=%d %s AC: runlength %d decoded=%d\n",
+                            jpg.mcuString( nMCUs, sComp ), 0, sComp.nRows, sComp.dUAnchor, sComp.count,
+                            jpg.getBitString( startByte, startBit, uint(size) ),
+                            runLen, decodedAC )
+                        }
                     }
 
                     if sComp.count+runLen > scan.endSS {  // need room for 1 + runLen
@@ -1339,8 +1566,8 @@ encodedLoop:
                 if nBlocks > 0 {    // just skip (not modified in any way)
 
                     for n := uint(0); n < nBlocks; n++ {
-                        if jpg.Control.Du && jpg.Begin <= nMCUs && jpg.End >= nMCUs {
-                            printDataUnit( dUnit )
+                        if jpg.Control.Du && jpg.traceOn( nMCUs, sComp ) {
+                            jpg.printDataUnit( dUnit )
                         }
                         nMCUs ++        // new MCU
                         sComp.dUAnchor ++
@@ -1348,10 +1575,10 @@ encodedLoop:
                             sComp.dUAnchor = 0
                             sComp.nRows++
 
-                            if jpg.nMcuRST != 0 && nMCUs % jpg.nMcuRST != 0 && jpg.Warn {
-                                fmt.Printf( "Warning: end of slice @MCU %d is "+
-                                            "not synced with RST intervals (%d)\n",
-                                            nMCUs, jpg.nMcuRST )
+                            if scan.rstInterval != 0 && nMCUs % scan.rstInterval != 0 && jpg.Warn {
+                                jpg.warning( "Warning: end of slice @MCU %d is "+
+                                             "not synced with RST intervals (%d)\n",
+                                             nMCUs, scan.rstInterval )
                             }
                         }
                         if len(*sComp.iDCTdata) > int(sComp.nRows) {
@@ -1363,7 +1590,7 @@ encodedLoop:
                     }
                 }
                 huffman = true          // next huffman encoded value
-                curHcnode = sComp.hAC   // reset huffman root
+                curTable = sComp.hAC    // reset huffman table
             }
 
             startBit = 8 - nBits    // remaining in curByte
@@ -1396,10 +1623,13 @@ func (jpg *Desc) processRefiningAcEcs( nMCUs uint, scan *scan ) (uint, error) {
     sComp.count = scan.startSS                  // start at specific AC band
 
     // restart where we stopped
+    if scan.rowsMissing( ) {
+        return nMCUs, fmt.Errorf( "processRefiningAcEcs: restart beyond the end of scan\n" )
+    }
     dUnit := &((*sComp.iDCTdata)[sComp.nRows][sComp.dUAnchor])
 
     huffman := true                     // always start with huffman code
-    var curHcnode = sComp.hAC           // always start with encoded AC
+    var curTable = sComp.hAC            // always start with encoded AC
 
     var curByte, nBits uint8            // hold current encoded bits
     var runLen, size uint8              // current decoded runlength & size
@@ -1438,15 +1668,22 @@ encodedLoop:
             i++         // skip expected following 0x00
             if i >= tLen-1 || jpg.data[i] != 0x00 {
                 i--     // backup for next marker and stop
-                if jpg.Mcu && jpg.Begin <= nMCUs && jpg.End >= nMCUs {
-                    fmt.Printf( "MCU=%d comp=%d du=%d,%d coef=%d offset=%#x [%#02x] " +
-                                "End of scan segment (found marker or RST)\n",
-                                nMCUs, 0, sComp.nRows, sComp.dUAnchor,
-                                sComp.count, i, curByte )
+                if jpg.Mcu && jpg.traceOn( nMCUs, sComp ) {
+                    if jpg.TraceJSON {
+                        jpg.traceJSON( "end", nMCUs, 0, sComp.nRows, sComp.dUAnchor,
+                                       sComp.count, i, 0 )
+                    } else {
+                        jpg.tracef( "MCU=%s comp=%d du=%d,%d coef=%d offset=%#x [%#02x] " +
+                                    "End of scan segment (found marker or RST)\n",
+                                    jpg.mcuString( nMCUs, sComp ), 0, sComp.nRows, sComp.dUAnchor,
+                                    sComp.count, i, curByte )
+                    }
                 }
 
-                if sComp.dUAnchor != 0 || sComp.count != scan.startSS {
-                    fmt.Printf( "MCU=%d comp=%d du=%d,%d coef=%d offset=%#x [%#02x] " +
+                if jpg.Warn && ( sComp.count != scan.startSS ||
+                                 ( sComp.dUAnchor != 0 && ( scan.rstInterval == 0 ||
+                                           nMCUs % scan.rstInterval != 0 ) ) ) {
+                    jpg.warning( "MCU=%d comp=%d du=%d,%d coef=%d offset=%#x [%#02x] " +
                                 "Unexpected end of scan segment\n",
                                 nMCUs, 0, sComp.nRows, sComp.dUAnchor,
                                 sComp.count, i, curByte )
@@ -1463,47 +1700,49 @@ encodedLoop:
                     if nBits == 0 {
                         continue encodedLoop    // need more bits
                     }
-                    if (curByte & 0x80) == 0x80 {
-                        curHcnode = curHcnode.left
-                        if curHcnode == nil {
-                            padding = true;     // maybe byte stuffing at the end
-                            fmt.Printf("possible padding curByte=0x%02x nBits=%d\n", curByte, nBits );
-                            for {
-                                nBits --
-                                if nBits == 0 {
-                                    continue encodedLoop    // end of ECS
-                                }
-                                curByte <<= 1
-                                if (curByte & 0x80) != 0x80 {
-                                    return nMCUs, fmt.Errorf(
-                                        "processRefiningAcEcs: Invalid code/huffman tree (left)\n")
-                                }
-                            }
-                        }
-                        huffval <<= 1
-                        huffval ++
-                    } else {
-                        curHcnode = curHcnode.right
-                        if curHcnode == nil {
+                    bit := uint(curByte >> 7)
+                    if ! curTable.prefix( huffval << 1 | bit, huffbits + 1 ) {
+                        if bit == 0 {
                             return nMCUs, fmt.Errorf(
                                 "processRefiningAcEcs: Invalid code/huffman tree (right)\n")
                         }
-                        huffval <<= 1
+                        padding = true;     // maybe byte stuffing at the end
+                        if jpg.Verbose {
+                            fmt.Printf("possible padding curByte=0x%02x nBits=%d\n", curByte, nBits );
+                        }
+                        for {
+                            nBits --
+                            if nBits == 0 {
+                                continue encodedLoop    // end of ECS
+                            }
+                            curByte <<= 1
+                            if (curByte & 0x80) != 0x80 {
+                                return nMCUs, fmt.Errorf(
+                                    "processRefiningAcEcs: Invalid code/huffman tree (left)\n")
+                            }
+                        }
                     }
+                    huffval = huffval << 1 | bit
                     curByte <<= 1
                     nBits --
                     huffbits ++
 
-                    if curHcnode.left == nil && curHcnode.right == nil {
-                        runSize := curHcnode.symbol // if AC first 4 bits are
-                        runLen = runSize >> 4      // runlength, remaining 4
-                        size = runSize & 0x0f      // are size in all cases
-                        if jpg.Mcu && jpg.Begin <= nMCUs && jpg.End >= nMCUs {
-                            fmt.Printf( "MCU=%d comp=%d du=%d,%d coef=%d %s Huffman: " +
-                                        "size %d (0-runlength %d)\n",
-                                        nMCUs, 0, sComp.nRows, sComp.dUAnchor, sComp.count,
-                                        jpg.getBitString( startByte, startBit, uint(huffbits) ),
-                                        size, runLen )
+                    if runSize, ok := curTable.symbol( huffval, huffbits ); ok {
+                        runLen = runSize >> 4      // if AC first 4 bits are
+                        size = runSize & 0x0f      // runlength, remaining 4
+                                                   // are size in all cases
+                        if jpg.Mcu && jpg.traceOn( nMCUs, sComp ) {
+                            if jpg.TraceJSON {
+                                jpg.traceJSON( "huffman", nMCUs, 0, sComp.nRows, sComp.dUAnchor,
+                                               sComp.count, startByte, startBit,
+                                               "nBits", huffbits, "size", size, "runLength", runLen )
+                            } else {
+                                jpg.tracef( "MCU=%s comp=%d du=%d,%d coef=%d %s Huffman: " +
+                                            "size %d (0-runlength %d)\n",
+                                            jpg.mcuString( nMCUs, sComp ), 0, sComp.nRows, sComp.dUAnchor, sComp.count,
+                                            jpg.getBitString( startByte, startBit, uint(huffbits) ),
+                                            size, runLen )
+                            }
                         }
                         huffval, huffbits, huffman = 0, 0, false
 
@@ -1543,12 +1782,18 @@ encodedLoop:
                                 }
                             }
 
-                            if jpg.Mcu && jpg.Begin <= nMCUs && jpg.End >= nMCUs {
-                                fmt.Printf(
-                                "MCU=%d comp=%d du=%d,%d coef=%d %s AC: ZRL => skipped/refined %d coefs\n",
-                                nMCUs, 0, sComp.nRows, sComp.dUAnchor, sComp.count,
-                                jpg.getBitString( startByte, startBit, uint(checked - skipped) ),
-                                checked )
+                            if jpg.Mcu && jpg.traceOn( nMCUs, sComp ) {
+                                if jpg.TraceJSON {
+                                    jpg.traceJSON( "zrl", nMCUs, 0, sComp.nRows, sComp.dUAnchor,
+                                                   sComp.count, startByte, startBit,
+                                                   "nBits", checked - skipped, "checked", checked )
+                                } else {
+                                    jpg.tracef(
+                                    "MCU=%s comp=%d du=%d,%d coef=%d %s AC: ZRL => skipped/refined %d coefs\n",
+                                    jpg.mcuString( nMCUs, sComp ), 0, sComp.nRows, sComp.dUAnchor, sComp.count,
+                                    jpg.getBitString( startByte, startBit, uint(checked - skipped) ),
+                                    checked )
+                                }
                             }
                             sComp.count += checked
 
@@ -1628,12 +1873,19 @@ encodedLoop:
                             }
                         }
 
-                        if jpg.Mcu && jpg.Begin <= nMCUs && jpg.End >= nMCUs {
-                            fmt.Printf(
-                            "MCU=%d comp=%d du=%d,%d coef=%d %s AC: runlength %d updated %d coefs, decoded=%d\n",
-                            nMCUs, 0, sComp.nRows, sComp.dUAnchor, sComp.count,
-                            jpg.getBitString( startByte, startBit, uint(checked-skipped) + 1 ),
-                            runLen, checked-skipped, decodedAc )
+                        if jpg.Mcu && jpg.traceOn( nMCUs, sComp ) {
+                            if jpg.TraceJSON {
+                                jpg.traceJSON( "ac", nMCUs, 0, sComp.nRows, sComp.dUAnchor,
+                                               sComp.count, startByte, startBit,
+                                               "nBits", checked - skipped + 1, "runLength", runLen,
+                                               "updated", checked - skipped, "value", decodedAc )
+                            } else {
+                                jpg.tracef(
+                                "MCU=%s comp=%d du=%d,%d coef=%d %s AC: runlength %d updated %d coefs, decoded=%d\n",
+                                jpg.mcuString( nMCUs, sComp ), 0, sComp.nRows, sComp.dUAnchor, sComp.count,
+                                jpg.getBitString( startByte, startBit, uint(checked-skipped) + 1 ),
+                                runLen, checked-skipped, decodedAc )
+                            }
                         }
                         sComp.count += checked
                         // store decoded AC in next slot of current data unit
@@ -1665,8 +1917,8 @@ encodedLoop:
                             }
                         }   // end coef loop
 
-                        if jpg.Control.Du && jpg.Begin <= nMCUs && jpg.End >= nMCUs {
-                            printDataUnit( dUnit )
+                        if jpg.Control.Du && jpg.traceOn( nMCUs, sComp ) {
+                            jpg.printDataUnit( dUnit )
                         }
 
                         nMCUs ++            // next MCU (MCU == DU)
@@ -1676,10 +1928,10 @@ encodedLoop:
                             sComp.nRows++
                         }
 
-                        if jpg.nMcuRST != 0 && nMCUs % jpg.nMcuRST != 0 && jpg.Warn {
-                            fmt.Printf( "Warning: end of slice @MCU %d is "+
-                                        "not synced with RST intervals (%d)\n",
-                                        nMCUs, jpg.nMcuRST )
+                        if scan.rstInterval != 0 && nMCUs % scan.rstInterval != 0 && jpg.Warn {
+                            jpg.warning( "Warning: end of slice @MCU %d is "+
+                                         "not synced with RST intervals (%d)\n",
+                                         nMCUs, scan.rstInterval )
                         }
 
                         if len(*sComp.iDCTdata) > int(sComp.nRows) {
@@ -1689,16 +1941,23 @@ encodedLoop:
                         }
                         sComp.count = scan.startSS  // new data unit
                     }
-                    if jpg.Mcu && jpg.Begin <= nMCUs && jpg.End >= nMCUs {
-                        fmt.Printf(
-                        "MCU=%d comp=%d du=%d,%d coef=%d %s AC: EOB%d updated %d\n",
-                        nMCUs-1, 0, eobRow, eobCol, eobCoef,
-                        jpg.getBitString( startByte, startBit, uint(runLen) + updated ),
-                        runLen, updated )
+                    if jpg.Mcu && jpg.traceOn( nMCUs, sComp ) {
+                        if jpg.TraceJSON {
+                            jpg.traceJSON( "eob", nMCUs-1, 0, eobRow, eobCol,
+                                           eobCoef, startByte, startBit,
+                                           "nBits", uint(runLen) + updated, "runLength", runLen,
+                                           "updated", updated )
+                        } else {
+                            jpg.tracef(
+                            "MCU=%s comp=%d du=%d,%d coef=%d %s AC: EOB%d updated %d\n",
+                            jpg.mcuString( nMCUs-1, sComp ), 0, eobRow, eobCol, eobCoef,
+                            jpg.getBitString( startByte, startBit, uint(runLen) + updated ),
+                            runLen, updated )
+                        }
                     }
                 }
                 huffman = true          // next huffman encoded value
-                curHcnode = sComp.hAC   // reset huffman root
+                curTable = sComp.hAC    // reset huffman table
             }
 
             startBit = 8 - nBits    // remaining in curByte
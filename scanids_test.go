@@ -0,0 +1,93 @@
+package jpeg
+
+// support for checking the remapping of scan component selectors that do not
+// match the frame component ids, with TidyUp.
+
+import (
+    "bytes"
+    "os"
+    "path/filepath"
+    "testing"
+)
+
+// scanSelectors returns the offsets of the component selectors of each scan
+// header in data, which must not have any 0xffda sequence in its entropy
+// coded segments.
+func scanSelectors( data []byte ) (scans [][]int) {
+    for i := 0; i + 4 < len(data); i++ {
+        if data[i] != 0xff || data[i+1] != 0xda {
+            continue
+        }
+        var sels []int
+        for c := 0; c < int(data[i+4]); c++ {
+            sels = append( sels, i + 5 + c * scanComponentSpecSize )
+        }
+        scans = append( scans, sels )
+    }
+    return
+}
+
+func TestScanIdRemap( t *testing.T ) {
+    orig, err := os.ReadFile( filepath.Join( "testdata", "progressive.jpg" ) )
+    if err != nil {
+        t.Fatal( err )
+    }
+    ref, err := Parse( orig, &Control{ } )
+    if err != nil {
+        t.Fatal( err )
+    }
+    refImg, err := ref.YCbCrImage( 0 )
+    if err != nil {
+        t.Fatal( err )
+    }
+
+    for _, c := range []struct{
+        name    string
+        modify  func( data []byte, scans [][]int )
+    }{
+        { "last AC scan", func( data []byte, scans [][]int ) {
+            data[scans[len(scans)-1][0]] = 9
+          } },
+        { "0-based selectors", func( data []byte, scans [][]int ) {
+            for _, sels := range scans {
+                for _, o := range sels {
+                    data[o] --
+                }
+            }
+          } },
+    }{
+        t.Run( c.name, func( t *testing.T ) {
+            data := append( []byte{ }, orig... )
+            scans := scanSelectors( data )
+            if len(scans) != 4 {
+                t.Fatalf( "%d scans, expected 4", len(scans) )
+            }
+            c.modify( data, scans )
+            if _, err := Parse( data, &Control{ } ); err == nil {
+                t.Errorf( "Parse without TidyUp: no error" )
+            }
+            jpg, err := Parse( data, &Control{ TidyUp: true,
+                                               Logger: discardLogger{ } } )
+            if err != nil {
+                t.Fatalf( "Parse with TidyUp: %v", err )
+            }
+            for si, sc := range jpg.frames[0].scans {
+                for i, sComp := range sc.sComps {
+                    if si == 0 && int(sComp.cType) != i ||
+                       si > 0 && int(sComp.cType) != si - 1 {
+                        t.Errorf( "scan %d component %d remapped to %d",
+                                  si, i, sComp.cType )
+                    }
+                }
+            }
+            img, err := jpg.YCbCrImage( 0 )
+            if err != nil {
+                t.Fatal( err )
+            }
+            if ! bytes.Equal( img.Y, refImg.Y ) || ! bytes.Equal( img.Cb, refImg.Cb ) ||
+               ! bytes.Equal( img.Cr, refImg.Cr ) {
+                t.Errorf( "remapped picture differs from the original" )
+            }
+        } )
+    }
+}
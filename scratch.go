@@ -0,0 +1,47 @@
+package jpeg
+
+// support for reusing temporary buffers across frames and scans
+
+// scratch holds the temporary buffers used while decoding, reused by
+// successive scans and frames of the same Desc and sized to the largest
+// requirement met so far.
+type scratch struct {
+    samples     []uint8         // component samples (streaming)
+    freeRows    []iDCTRow       // data unit rows released after streaming
+    partial     partialState    // partial image (PartialImage callback)
+}
+
+// sampleBuffer returns a buffer of n samples, with undefined content
+func (s *scratch) sampleBuffer( n int ) []uint8 {
+    if cap(s.samples) < n {
+        s.samples = make( []uint8, n )
+    }
+    return s.samples[:n]
+}
+
+// newRow returns a row of n zero data units, reusing a released row if any is
+// large enough.
+func (s *scratch) newRow( n uint ) iDCTRow {
+    for i := len(s.freeRows) - 1; i >= 0; i-- {
+        row := s.freeRows[i]
+        if uint(cap(row)) < n {
+            continue
+        }
+        last := len(s.freeRows) - 1
+        s.freeRows[i] = s.freeRows[last]
+        s.freeRows = s.freeRows[:last]
+        row = row[:n]
+        for j := range row {
+            row[j] = dataUnit{}
+        }
+        return row
+    }
+    return make( iDCTRow, n )
+}
+
+// releaseRow makes row available for newRow
+func (s *scratch) releaseRow( row iDCTRow ) {
+    if row != nil {
+        s.freeRows = append( s.freeRows, row )
+    }
+}
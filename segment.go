@@ -5,6 +5,7 @@ import (
     "bytes"
     "io"
     "encoding/binary"
+    "unicode/utf8"
 )
 
 /*
@@ -104,6 +105,153 @@ func getPointTransform( h, l uint8 ) (pt uint8) {
 }
 
 var componentNames = [...]string{ "Y", "Cb", "Cr" }
+
+// componentName returns the name of the frame component at index j, or its id
+// if it is not one of the usual Y, Cb, Cr components
+func componentName( frm *frame, j int ) string {
+    if j < len(componentNames) && len(frm.components) <= len(componentNames) {
+        return componentNames[j]
+    }
+    return fmt.Sprintf( "id %d", frm.components[j].Id )
+}
+
+// scanRefError returns the error for a scan component reference that cannot
+// be resolved, given by the format and args. It identifies the scan, the
+// component and the offset of the scan header.
+func (jpg *Desc) scanRefError( frm *frame, component string,
+                               format string, args ...interface{} ) error {
+    return fmt.Errorf( "scan %d component %s references %s at offset 0x%x\n",
+                       len(frm.scans)-1, component,
+                       fmt.Sprintf( format, args... ), jpg.offset )
+}
+
+// hasComponentId returns true if id matches the id of a frame component
+func (frm *frame) hasComponentId( id uint8 ) bool {
+    for _, cmp := range frm.components {
+        if id == cmp.Id {
+            return true
+        }
+    }
+    return false
+}
+
+// frameScanIdMismatch returns mismatch true if any scan header of the current
+// frame, from the scan header at offset up to the next frame or EOI, uses a
+// component selector that does not match any frame component id, and indexes
+// true if all selectors are valid 0-based indexes in the frame components.
+// Segments are skipped according to their length and entropy coded segments
+// up to the next marker.
+func (jpg *Desc) frameScanIdMismatch( frm *frame,
+                                      offset uint ) (mismatch, indexes bool) {
+    indexes = true
+    data := jpg.data
+    tLen := uint(len(data))
+    for offset + 4 <= tLen && data[offset] == 0xff {
+        marker := 0xff00 | uint(data[offset+1])
+        if marker == 0xffff {                   // fill byte
+            offset ++
+            continue
+        }
+        if marker == _EOI || isSOFn( marker ) {
+            break
+        }
+        next := offset + 2 + (uint(data[offset+2]) << 8 + uint(data[offset+3]))
+        if marker != _SOS {
+            offset = next
+            continue
+        }
+        nComponents := uint(data[offset+4])
+        for i := uint(0); i < nComponents; i++ {
+            p := offset + 5 + i * scanComponentSpecSize
+            if p >= next || p >= tLen {
+                break
+            }
+            if ! frm.hasComponentId( data[p] ) {
+                mismatch = true
+            }
+            if int(data[p]) >= len(frm.components) {
+                indexes = false
+            }
+        }
+        for ; next + 1 < tLen; next++ {         // skip ECS, stuffing and RSTn
+            if data[next] == 0xff && data[next+1] != 0 &&
+               (data[next+1] < 0xd0 || data[next+1] > 0xd7) {
+                break
+            }
+        }
+        offset = next
+    }
+    return
+}
+
+// checkScanIds returns true if the scan component ids must be remapped to
+// frame components. This is decided once per frame, at its first scan: if any
+// scan of the frame uses a component id that does not match any frame
+// component id and TidyUp is requested, the scans of the frame are remapped
+// (see remapScanId). If all selectors of the frame are valid 0-based indexes
+// in the frame components, they are all used as indexes, even those matching
+// a frame component id, so that two scans cannot end up on the same component.
+func (jpg *Desc) checkScanIds( frm *frame, sComp []scanCompRef ) bool {
+    for _, sc := range sComp {
+        if ! frm.hasComponentId( sc.cmId ) && jpg.Warn {
+            jpg.warning( "  WARNING: scan component id %d does not match any frame component\n",
+                         sc.cmId )
+        }
+    }
+    if len(frm.scans) == 1 && jpg.TidyUp {
+        frm.remapIds, frm.indexIds = jpg.frameScanIdMismatch( frm, jpg.offset )
+    }
+    return frm.remapIds
+}
+
+// remapScanId returns the index of the frame component for the selector i of
+// scan s, or -1 if it cannot be found. A selector matching a frame component
+// id is kept, unless selectors are used as indexes in the frame components.
+// Other selectors are replaced by their position in full interleaved scans,
+// or, in other scans, by the only frame component not already coded by a
+// previous scan with the same spectral selection and successive approximation.
+func remapScanId( frm *frame, s *scan, sComp []scanCompRef, i int ) int {
+    id := sComp[i].cmId
+    if frm.indexIds {
+        if int(id) < len(frm.components) {
+            return int(id)
+        }
+        return -1
+    }
+    for j := range frm.components {
+        if frm.components[j].Id == id {
+            return j
+        }
+    }
+    if len(sComp) == len(frm.components) {
+        return i
+    }
+    if len(sComp) != 1 {
+        return -1
+    }
+    coded := make( []bool, len(frm.components) )
+    for k := 0; k < len(frm.scans) - 1; k++ {   // the last one is s
+        ps := &frm.scans[k]
+        if ps.startSS != s.startSS || ps.endSS != s.endSS ||
+           ps.sABPh != s.sABPh || ps.sABPl != s.sABPl {
+            continue
+        }
+        for _, sc := range ps.sComps {
+            coded[sc.cType] = true
+        }
+    }
+    j := -1
+    for k, done := range coded {
+        if ! done {
+            if j != -1 {
+                return -1               // ambiguous
+            }
+            j = k
+        }
+    }
+    return j
+}
+
 func (jpg *Desc) setScan( s *scan, sComp *[]scanCompRef ) error {
 
     frm := jpg.getCurrentFrame()
@@ -119,31 +267,56 @@ func (jpg *Desc) setScan( s *scan, sComp *[]scanCompRef ) error {
         fmt.Printf( "  Sucessive Approximation Ah: %d, Al: %d point transform *%d\n",
                     s.sABPh, s.sABPl, getPointTransform( s.sABPh, s.sABPl ) )
     }
+    remap := jpg.checkScanIds( frm, *sComp )
     s.sComps = make( []scanComp, nComp )
     for i, sc := range( *sComp ) {
         var cmp *component = nil;
-        for j, _ := range( frm.components ) {   // in fixed order Y, Cb, Cr
-            if sc.cmId == frm.components[j].Id {
+        if remap {
+            if j := remapScanId( frm, s, *sComp, i ); j != -1 {
                 cmp = &frm.components[j]
                 s.sComps[i].cType = uint8(j)
-                if jpg.Verbose {
-                    fmt.Printf( "  Component #%d id %d [%s]\n",
-                                    i, sc.cmId, componentNames[j] )
+                if cmp.Id != sc.cmId {
+                    jpg.fixing( "  FIXING: replacing scan component id %d with %d\n",
+                                sc.cmId, cmp.Id )
+                }
+            }
+        } else {
+            for j, _ := range( frm.components ) {   // in fixed order Y, Cb, Cr
+                if sc.cmId == frm.components[j].Id {
+                    cmp = &frm.components[j]
+                    s.sComps[i].cType = uint8(j)
+                    if jpg.Verbose {
+                        fmt.Printf( "  Component #%d id %d [%s]\n",
+                                        i, sc.cmId, componentName( frm, j ) )
+                    }
                 }
             }
         }
         if cmp == nil {
-            return fmt.Errorf( "Unknown component id %d for scan\n", sc.cmId );
+            return jpg.scanRefError( frm, fmt.Sprintf( "selector %d", sc.cmId ),
+                                     "undefined frame component" )
         }
+        name := componentName( frm, int(s.sComps[i].cType) )
         s.sComps[i].iDCTdata = &cmp.iDCTdata
         s.sComps[i].cId = cmp.Id
 
-        qsz := uint8(jpg.qdefs[cmp.QS].size)
+        if cmp.QS > 3 {
+            return jpg.scanRefError( frm, name,
+                                     "invalid quantization table %d", cmp.QS )
+        }
+        if cmp.qt == nil {  // latch the current table: a DQT segment after
+                            // this scan only applies to other components
+            qt := jpg.qdefs[cmp.QS]
+            cmp.qt = &qt
+        }
+        qsz := uint8(cmp.qt.size)
         if qsz == 0 {
-            return fmt.Errorf( "Missing Quantization table %d for scan\n",
-                               cmp.QS )
+            return jpg.scanRefError( frm, name,
+                                     "undefined quantization table %d", cmp.QS )
         }
-        if qsz != frm.resolution.samplePrecision {
+        // 16-bit tables are only allowed with 12-bit samples, which can
+        // also use 8-bit tables
+        if qsz == 16 && frm.resolution.samplePrecision != 12 {
             return fmt.Errorf( "Quantization size %d does not match frame sample size (%d)\n",
                                qsz, frm.resolution.samplePrecision )
         }
@@ -152,10 +325,23 @@ func (jpg *Desc) setScan( s *scan, sComp *[]scanCompRef ) error {
             if jpg.Verbose {
                 fmt.Printf( "    Huffman DC Id: %d\n", sc.dcId )
             }
-            s.sComps[i].hDC = jpg.hdefs[2*sc.dcId].root   // AC follows DC
+            if sc.dcId > 3 {
+                return jpg.scanRefError( frm, name,
+                                         "invalid DC table %d", sc.dcId )
+            }
+            s.sComps[i].hDC = jpg.hdefs[2*sc.dcId].table  // AC follows DC
+            if s.sComps[i].hDC == nil && jpg.StdHuffman {
+                if err := jpg.useStandardHuffmanTable( 0, sc.dcId ); err != nil {
+                    return err
+                }
+                s.sComps[i].hDC = jpg.hdefs[2*sc.dcId].table
+            }
             if s.sComps[i].hDC == nil {
-                return fmt.Errorf( "Missing Huffman table %d for DC scan (component %d)\n",
-                                   sc.dcId, i )
+                return jpg.scanRefError( frm, name,
+                                         "undefined DC table %d", sc.dcId )
+            }
+            if jpg.Warn {
+                jpg.checkHuffmanSymbols( frm, 0, sc.dcId )
             }
         }
         s.sComps[i].dcId = sc.dcId
@@ -164,10 +350,23 @@ func (jpg *Desc) setScan( s *scan, sComp *[]scanCompRef ) error {
             if jpg.Verbose {
                 fmt.Printf( "    Huffman AC Id: %d\n", sc.acId )
             }
-            s.sComps[i].hAC = jpg.hdefs[2*sc.acId+1].root // (2 tables per dest)
+            if sc.acId > 3 {
+                return jpg.scanRefError( frm, name,
+                                         "invalid AC table %d", sc.acId )
+            }
+            s.sComps[i].hAC = jpg.hdefs[2*sc.acId+1].table // (2 tables per dest)
+            if s.sComps[i].hAC == nil && jpg.StdHuffman {
+                if err := jpg.useStandardHuffmanTable( 1, sc.acId ); err != nil {
+                    return err
+                }
+                s.sComps[i].hAC = jpg.hdefs[2*sc.acId+1].table
+            }
             if s.sComps[i].hAC == nil {
-                return fmt.Errorf( "Missing Huffman table %d for AC scan (component %d)\n",
-                                   sc.acId, i )
+                return jpg.scanRefError( frm, name,
+                                         "undefined AC table %d", sc.acId )
+            }
+            if jpg.Warn {
+                jpg.checkHuffmanSymbols( frm, 1, sc.acId )
             }
         }
         s.sComps[i].acId = sc.acId
@@ -179,11 +378,13 @@ func (jpg *Desc) setScan( s *scan, sComp *[]scanCompRef ) error {
                     cmp.HSF,         cmp.VSF,         cmp.nUnitsRow
         } else {
             s.sComps[i].HSF, s.sComps[i].VSF = 1, 1
-            // calculate the number of data Units per line
-            roundingFactor := (uint16(frm.resolution.mhSF) * 8) / uint16(cmp.HSF)
-            s.sComps[i].nUnitsRow = uint((frm.resolution.nSamplesLine +
-                                                        roundingFactor - 1) /
-                                                                roundingFactor)
+            // calculate the number of data Units per line from the number of
+            // component samples per line: ceiling(nSamplesLine * HSF / mhSF)
+            // (mhSF is not always a multiple of HSF, e.g. 4 and 3)
+            mhSF := uint(frm.resolution.mhSF)
+            nSamples := (uint(frm.resolution.nSamplesLine) * uint(cmp.HSF) +
+                                                        mhSF - 1) / mhSF
+            s.sComps[i].nUnitsRow = (nSamples + 7) / 8
         }
         if jpg.Verbose {
             fmt.Printf( "    HSF %d, VSF %d, nUnitsRow %d\n",
@@ -226,17 +427,27 @@ func subsamplingFormat( sc *scan ) string {
     // Those formulae could work for any nluma and nlumaLines above 4 and 3, but
     // the calculation would have to be done in float, before being turned back
     // to integers.
-    if len( sc.sComps ) < 2 {
+    hsf := make( []uint8, len(sc.sComps) )
+    vsf := make( []uint8, len(sc.sComps) )
+    for i, scmp := range sc.sComps {
+        hsf[i], vsf[i] = scmp.HSF, scmp.VSF
+    }
+    return chromaSubsampling( hsf, vsf )
+}
+
+// chromaSubsampling returns the subsampling formula for the given component
+// horizontal and vertical sampling factors (see subsamplingFormat)
+func chromaSubsampling( hsf, vsf []uint8 ) string {
+    if len( hsf ) < 2 {
         return ""   // no chroma
     }
-    lumaS := sc.sComps[0].HSF
-    lumaL := sc.sComps[0].VSF
-    chromaS := sc.sComps[1].HSF
-    chromaL := sc.sComps[1].VSF
+    lumaS := hsf[0]
+    lumaL := vsf[0]
+    chromaS := hsf[1]
+    chromaL := vsf[1]
 
-    if len( sc.sComps ) == 3 &&
-        chromaS !=  sc.sComps[2].HSF &&
-        chromaL !=  sc.sComps[2].VSF {
+    if len( hsf ) == 3 &&
+        ( chromaS != hsf[2] || chromaL != vsf[2] ) {
         return ""   // not representable
     }
     a := (chromaS * 4) / lumaS
@@ -305,6 +516,15 @@ func (f *frame)samplePrecision( ) uint {
     return uint(f.resolution.samplePrecision)
 }
 
+// maxCoefSizes returns the maximum number of bits of DC differences and AC
+// coefficients for the frame sample precision (8 or 12 bits)
+func (f *frame)maxCoefSizes( ) (dc, ac uint8) {
+    if f.resolution.samplePrecision == 12 {
+        return 15, 14
+    }
+    return 11, 10
+}
+
 func (f *frame)nSamplesLine( ) uint {
     return uint(f.resolution.nSamplesLine)
 }
@@ -324,6 +544,15 @@ func (f *frame)actualLines( ) (nLines uint16) {
     return
 }
 
+// true if nLines must be kept at 0 in SOFn, with a following DNL segment
+func (f *frame)keepDNL( ) bool {
+    return f.image != nil && f.image.KeepDNL && f.resolution.nLines == 0
+}
+
+func (f *frame)marker( ) uint {
+    return _SOF0 + uint(f.encoding)
+}
+
 func (f *frame)serialize( w io.Writer ) (int, error) {
 
     lf := uint16((len(f.components) * frameComponentSpecSize) + fixedFrameHeaderSize)
@@ -332,7 +561,9 @@ func (f *frame)serialize( w io.Writer ) (int, error) {
     binary.BigEndian.PutUint16( seg[2:], lf )
     seg[4] = byte(f.resolution.samplePrecision)
 
-    binary.BigEndian.PutUint16( seg[5:], f.actualLines() )
+    if ! f.keepDNL() {
+        binary.BigEndian.PutUint16( seg[5:], f.actualLines() )
+    }
     binary.BigEndian.PutUint16( seg[7:], f.resolution.nSamplesLine )
     seg[9] = byte(len(f.components))
 
@@ -396,6 +627,7 @@ func (jpg *Desc) startOfFrame( marker uint, sLen uint ) error {
     jpg.frames = append( jpg.frames,
                          frame {
                            id: uint(len(jpg.frames)),
+                           offset: jpg.offset,
                            encoding: Encoding(marker & 0x0f),
                            resolution: sampling{
                                 samplePrecision: jpg.data[offset],
@@ -448,7 +680,7 @@ func (jpg *Desc) startOfFrame( marker uint, sLen uint ) error {
     maxSamplesMCU = uint16(maxVSF * 8) // changed maxSamplesMCU meaning
     nMcusCol := (nLines + maxSamplesMCU - 1) / maxSamplesMCU
     if nMcusCol == 0 && jpg.Warn {
-        fmt.Printf("  WARNING: Unknown number of lines\n")
+        jpg.warning("  WARNING: Unknown number of lines\n")
     }
     if jpg.Verbose {
         fmt.Printf( "  Frame: %d lines, max vertical SF %d, nMCUs/col %d\n",
@@ -468,6 +700,9 @@ func (jpg *Desc) startOfFrame( marker uint, sLen uint ) error {
             fmt.Printf( "      vertical sampling factor %d nUnitsCol: %d (%d lines)\n",
                         cmp.VSF, nUnitsCol, nUnitsCol * 8 )
         }
+        if jpg.streams( frm ) {     // rows are added and released as decoded
+            continue
+        }
         cmp.iDCTdata = make( []iDCTRow, nUnitsCol )
         for j := uint(0); j < nUnitsCol; j++ {
             cmp.iDCTdata[j] = make( []dataUnit, nUnitsRow )
@@ -475,13 +710,17 @@ func (jpg *Desc) startOfFrame( marker uint, sLen uint ) error {
     }
 
     jpg.addSeg( frm )
-    jpg.state = _SCAN1  // expecting DHT, DAC, DQT, DRI, COM, or SOS
+    jpg.setState( _SCAN1 ) // expecting DHT, DAC, DQT, DRI, COM, or SOS
 
     return nil
 }
 
 // ----------- Scans
 
+func (s *scan)marker( ) uint {
+    return _SOS
+}
+
 func (s *scan)serialize( w io.Writer ) (int, error) {
 
     ls := uint16((len(s.sComps) * scanComponentSpecSize) + fixedScanHeaderSize)
@@ -571,6 +810,10 @@ func (s *scan)format( w io.Writer ) (n int, err error) {
 func (jpg *Desc) processScanHeader( sLen uint, sc *scan ) (err error) {
 
     offset := jpg.offset + markerLengthSize
+    if offset + sLen - 2 > uint(len(jpg.data)) {
+        return fmt.Errorf( "processScanHeader: SOS length %d beyond end of data\n",
+                           sLen )
+    }
     nComponents := uint(jpg.data[offset])
 
     offset += 1
@@ -595,7 +838,13 @@ func (jpg *Desc) processScanHeader( sLen uint, sc *scan ) (err error) {
     sABP := jpg.data[offset+2]
     sc.sABPh = sABP >> 4
     sc.sABPl = sABP & 0x0f
-    err = jpg.setScan( sc, &sCs );
+    if err = jpg.setScan( sc, &sCs ); err != nil {
+        return
+    }
+    if frm := jpg.getCurrentFrame(); jpg.Warn &&
+                                frm.encodingMode() == ExtendedProgressive {
+        jpg.checkScript( frm, sc )
+    }
     return
 }
 
@@ -604,13 +853,21 @@ func (jpg *Desc)getEcsFct( frm *frame,
                                                                 err error) {
 
     mode := frm.encodingMode()
+    if frm.entropyCoding() != HuffmanCoding {
+        return nil, fmt.Errorf( "processScan: unsupported %s\n",
+                                entropyCodingString(frm.entropyCoding()) )
+    }
 
     switch mode  {
     default:
         err = fmt.Errorf( "processScan: unsupported scanning mode %s in\n",
                           encodingModeString(mode) )
-    case BaselineSequential:
-        f = jpg.processSequentialEcs
+    case BaselineSequential, ExtendedSequential:
+        if jpg.fast420( frm, s ) {
+            f = jpg.process420Ecs
+        } else {
+            f = jpg.processSequentialEcs
+        }
     case ExtendedProgressive:
         if s.startSS == 0 {     // include DC coefficient
             if s.endSS != 0 {
@@ -660,9 +917,9 @@ func (jpg *Desc) processScan( marker, sLen uint ) error {
         return err
     }
     if jpg.state == _SCAN1 {
-        jpg.state = _SCAN1_ECS
+        jpg.setState( _SCAN1_ECS )
     } else {
-        jpg.state = _SCANn_ECS
+        jpg.setState( _SCANn_ECS )
     }
 
     jpg.offset += sLen + 2
@@ -679,46 +936,59 @@ func (jpg *Desc) processScan( marker, sLen uint ) error {
     var lastRST uint = 7
     tLen := uint(len( jpg.data ))   // start hunting for 0xFFxx with xx != 0x00
 
+    var ecsFill bool
     var nMCUs uint
     for ; ; {   // processECS return upon error, reached EOF or 0xFF followed by non-zero
         if nMCUs, err = processECS( nMCUs, sc ); err != nil {
             return jpgForwardError( "processScan", err )
         }
         nIx = jpg.offset
-        if nIx+1 >= tLen || jpg.data[nIx+1] < 0xd0 || jpg.data[nIx+1] > 0xd7 {
+        fill := jpg.fillBytesAt( nIx )  // 0xFF fill bytes before marker
+        if nIx+fill+1 >= tLen ||
+           jpg.data[nIx+fill+1] < 0xd0 || jpg.data[nIx+fill+1] > 0xd7 {
             break
         }       // else one of RST0-7 embedded in scan data, keep going
+        if fill > 0 {
+            jpg.addFillBytes( fill, false )     // kept in ECS if not TidyUp
+            ecsFill = true
+            nIx += fill
+            jpg.offset = nIx
+        }
 
         if jpg.Warn {
-            if jpg.nMcuRST == 0 {
-                fmt.Printf( "  WARNING: Restart Marker found without Restart Interval definition\n" )
+            if sc.rstInterval == 0 {
+                jpg.warning( "  WARNING: Restart Marker found without Restart Interval definition\n" )
             } else {
-                if nMCUs % jpg.nMcuRST != 0 {
-                fmt.Printf( "  WARNING: Restart Marker found before the Restart Interval\n" )
+                if nMCUs % sc.rstInterval != 0 {
+                jpg.warning( "  WARNING: Restart Marker found before the Restart Interval\n" )
                 }
             }
         }
 
         RST := uint( jpg.data[nIx+1] - 0xd0 )
+        jpg.recordMarker( _RST0 + RST, 0, nIx )
+        sc.rsts = append( sc.rsts, rstMark{ nIx, uint8(RST),
+                                            uint8((lastRST + 1) % 8),
+                                            nMCUs - lastMcuCount } )
         if (lastRST + 1) % 8 != RST { // don't try to fix it, as it may indicate
                                       // a corrupted file with missing samples.
             if jpg.Warn {
-                fmt.Printf( "  WARNING: invalid RST sequence (%d, expected %d)\n",
-                            RST, (lastRST + 1) % 8 )
+                jpg.warning( "  WARNING: invalid RST sequence (%d, expected %d)\n",
+                             RST, (lastRST + 1) % 8 )
             }
             // Altough this is highly unlikely, it indicates a gap in encoded
             // samples. Based on the new RST value, calculate how many MCUs
             // have been lost. This is not a fool proof solution since the RST
             // numbers wrap up after 8 and there is no way to know if wrapping
             // occured multiple times. Assuming it did not occur, or only once:
-            if jpg.nMcuRST != 0 {                           // fix nMCUs
+            if sc.rstInterval != 0 {                        // fix nMCUs
                 var lostIntervals uint
                 if RST > lastRST {
                     lostIntervals = RST - lastRST
                 } else {
                     lostIntervals = 8 - lastRST + RST
                 }
-                nMCUs = lastMcuCount + jpg.nMcuRST * lostIntervals
+                nMCUs = lastMcuCount + sc.rstInterval * lostIntervals
             }
         }
         lastMcuCount = nMCUs
@@ -728,33 +998,62 @@ func (jpg *Desc) processScan( marker, sLen uint ) error {
 
         jpg.offset += 2;    // skip RST
     }
+    if nIx+1 >= tLen {          // end of data reached without any marker
+        if nIx < tLen && jpg.data[nIx] != 0xff {
+            nIx = tLen          // last byte belongs to the ECS
+        }                       // else it is likely the start of a truncated EOI
+        jpg.offset = tLen
+    }
 
     if lastRSTIndex == nIx - 2 {
         if jpg.Warn {
-            fmt.Printf( "  WARNING: ending RST is useless\n" )
+            jpg.warning( "  WARNING: ending RST is useless\n" )
         }
         if jpg.TidyUp {
             nIx -= 2
-            fmt.Printf( "  FIXING: Removing ending RST (useless)\n" )
+            jpg.fixing( "  FIXING: Removing ending RST (useless)\n" )
         }
     }
 
     sc.ECSs = jpg.data[firstECS:nIx]
+    if ecsFill && jpg.TidyUp {
+        sc.ECSs = removeEcsFill( sc.ECSs )
+    }
     sc.nMcus = nMCUs
     sc.rstCount = rstCount
+    sc.rstTail = nMCUs - lastMcuCount
 
     jpg.addSeg( sc )
-    jpg.state = _SCANn  // accept folloring scans (if progressive mode)
+    jpg.setState( _SCANn ) // accept folloring scans (if progressive mode)
+    jpg.reportScan( frm, len(frm.scans) - 1 )
 
     return nil
 }
 
+// removeEcsFill returns a copy of ecs without fill bytes. In entropy coded
+// data, 0xFF is always followed by 0x00 or by a RSTn marker code, therefore
+// 0xFF followed by 0xFF, or at the end of ecs, is a fill byte.
+func removeEcsFill( ecs []byte ) []byte {
+    compact := make( []byte, 0, len(ecs) )
+    for k, b := range ecs {
+        if b == 0xff && (k+1 == len(ecs) || ecs[k+1] == 0xff) {
+            continue
+        }
+        compact = append( compact, b )
+    }
+    return compact
+}
+
 // ----------------- Restart Intervals
 
 type riSeg struct {
     interval    uint16
 }
 
+func (rs *riSeg)marker( ) uint {
+    return _DRI
+}
+
 func (rs *riSeg)serialize( w io.Writer ) (int, error) {
     seg := make( []byte, restartIntervalSize + 2 )
     binary.BigEndian.PutUint16( seg, _DRI )
@@ -776,19 +1075,21 @@ func (jpg *Desc)defineRestartInterval( marker, sLen uint ) error {
 
     rs := new( riSeg )
     rs.interval = restartInterval
+    // the new interval (0 disables restart) applies only to following scans,
+    // each scan keeping the interval in effect at its start (rstInterval)
     jpg.nMcuRST = uint(restartInterval)
 
     frm := jpg.getCurrentFrame( )
-    if frm != nil && jpg.Warn {
+    if frm != nil && jpg.Warn && restartInterval != 0 {
         if frm.resolution.nSamplesLine % restartInterval != 0 {
-            fmt.Printf( "  Warning: number of samples per line (%d) is not a" +
-                        " multiple of the restart interval\n",
-                        frm.resolution.nSamplesLine )
+            jpg.warning( "  Warning: number of samples per line (%d) is not a" +
+                         " multiple of the restart interval\n",
+                         frm.resolution.nSamplesLine )
         }
         for _, cmp := range frm.components {
             if cmp.nUnitsRow / uint(cmp.HSF) < jpg.nMcuRST {
-                fmt.Printf( "  Warning: restart interval %d is larger than the number of MCUs per row\n",
-                            jpg.nMcuRST, cmp.nUnitsRow / uint(cmp.HSF) )
+                jpg.warning( "  Warning: restart interval %d is larger than the number of MCUs per row (%d)\n",
+                             jpg.nMcuRST, cmp.nUnitsRow / uint(cmp.HSF) )
                 break;
             }
         }
@@ -821,6 +1122,10 @@ func (qt *qtSeg)matchDestination( start int, d uint ) int {
     return -1
 }
 
+func (qs *qtSeg)marker( ) uint {
+    return _DQT
+}
+
 func (qs *qtSeg)serialize( w io.Writer ) (int, error) {
     n := len(qs.data)
     lq := uint16(2)
@@ -869,7 +1174,7 @@ func formatQuantizationDest( cw *cumulativeWriter,
                              qt *[65]uint16, m FormatMode ) {
 
     d := qt[0]
-    p := ((d >> 4) + 1) << 3
+    p := ((d >> 8) + 1) << 3
     d &= 0x0f
 
     cw.format( "  Quantization table: %d\n", d )
@@ -918,57 +1223,123 @@ func (qs *qtSeg)format( w io.Writer ) (n int, err error) {
     return
 }
 
-func (jpg *Desc)defineQuantizationTable( marker, sLen uint ) ( err error ) {
-
-    end := jpg.offset + 2 + sLen
-    offset := jpg.offset + 4
-    qtn := int(0)
+// makeQtSeg builds a quantization segment from the DQT data following the
+// segment length. Multiple tables can be combined in a single DQT segment.
+func makeQtSeg( data []byte ) (*qtSeg, error) {
     qts := new( qtSeg )
-
-    for ; ; { // Mutiple QTs can be combined in a single DQT segment
-        pq := uint(jpg.data[offset]) >> 4 // Quantization table element precision
+    offset := 0
+    for offset < len(data) {
+        pq := uint(data[offset]) >> 4 // Quantization table element precision
 // 0 => 8-bit values; 1 => 16-bit values. Shall be 0 for 8-bit sample precision.
-        tq := uint(jpg.data[offset]) & 0x0f // Quantization table destination id
+        tq := uint(data[offset]) & 0x0f // Quantization table destination id
 // destination id [0-3] into which the quantization table shall be installed.
         if pq > 1 {
-            return fmt.Errorf( "defineQuantizationTable: Wrong precision (%d)\n", pq )
+            return nil, fmt.Errorf( "Wrong precision (%d)\n", pq )
         }
         if tq > 3 {
-            return fmt.Errorf( "defineQuantizationTable: Wrong destination (%d)\n", pq )
+            return nil, fmt.Errorf( "Wrong destination (%d)\n", tq )
         }
-
-        qts.data = append( qts.data, [65]uint16{} )
-        qts.data[qtn][0] = (uint16(pq) << 8) | uint16(tq)
-
         offset ++
-        jpg.qdefs[tq].size = 8 * (pq+1)
-        for i := 0; i < 64; i++ {
-            jpg.qdefs[tq].values[i] = uint16(jpg.data[offset])
+        if offset + (64 << pq) > len(data) {
+            return nil, fmt.Errorf( "Invalid DQT length: %d, table %d needs %d\n",
+                                    len(data) + 2, len(qts.data),
+                                    offset + (64 << pq) + 2 )
+        }
+
+        var qt [65]uint16
+        qt[0] = (uint16(pq) << 8) | uint16(tq)
+        for i := 1; i < 65; i++ {
+            qt[i] = uint16(data[offset])
             offset ++
             if pq != 0 {
-                jpg.qdefs[tq].values[i] <<= 8
-                jpg.qdefs[tq].values[i] += uint16(jpg.data[offset])
+                qt[i] <<= 8
+                qt[i] += uint16(data[offset])
                 offset++
             }
-            qts.data[qtn][i+1] = jpg.qdefs[tq].values[i]
         }
-        if jpg.Verbose {
-            fmt.Printf("Quantization table dest %d defined\n", tq )
+        qts.data = append( qts.data, qt )
+    }
+    return qts, nil
+}
+
+// largest sensible quantization value: 8 times the largest 12-bit sample
+// value, which is the largest DCT coefficient magnitude. A greater value
+// quantizes any coefficient to 0.
+const maxQuantizationValue = 8 * 2048
+
+// checkQuantizationValues warns about zero values in table qt, which are not
+// allowed and cannot be used to requantize coefficients, and about values
+// larger than maxQuantizationValue.
+func (jpg *Desc)checkQuantizationValues( qt *[65]uint16 ) {
+    var zeros, large uint
+    for _, v := range qt[1:] {
+        if v == 0 {
+            zeros ++
+        } else if v > maxQuantizationValue {
+            large ++
         }
+    }
+    tq := qt[0] & 0x0f
+    if zeros > 0 {
+        jpg.warning( "  WARNING: Quantization table %d has %d zero value(s)\n",
+                     tq, zeros )
+    }
+    if large > 0 {
+        jpg.warning( "  WARNING: Quantization table %d has %d value(s) above %d\n",
+                     tq, large, maxQuantizationValue )
+    }
+}
 
-        qtn++
-        if offset >= end {
-            break
+// checkQuantizationRefs warns about the quantization tables referenced by the
+// frame components but never defined, for components that were not decoded
+// (a scan using an undefined table is an error). The warning is reported at
+// the frame header offset.
+func (jpg *Desc)checkQuantizationRefs( ) {
+    offset, marker := jpg.offset, jpg.marker
+    for f := range jpg.frames {
+        frm := &jpg.frames[f]
+        jpg.offset, jpg.marker = frm.offset, frm.marker()
+        for _, cmp := range frm.components {
+            if cmp.qt == nil && (cmp.QS > 3 || jpg.qdefs[cmp.QS].size == 0) {
+                jpg.warning( "  WARNING: Quantization table %d of component %d "+
+                             "is never defined\n", cmp.QS, cmp.Id )
+            }
         }
     }
-    if offset != end {
-        return fmt.Errorf( "defineQuantizationTable: Invalid DQT length: %d actual: %d\n",
-                           sLen, offset - jpg.offset -2 )
+    jpg.offset, jpg.marker = offset, marker
+}
+
+func (jpg *Desc)defineQuantizationTable( marker, sLen uint ) ( err error ) {
+
+    if sLen < 2 {
+        return fmt.Errorf( "defineQuantizationTable: Invalid DQT length: %d\n", sLen )
+    }
+    offset := jpg.offset + 4
+    if offset + sLen - 2 > uint(len(jpg.data)) {
+        return fmt.Errorf( "defineQuantizationTable: DQT length %d beyond end of data\n",
+                           sLen )
+    }
+    qts, err := makeQtSeg( jpg.data[offset:offset+sLen-2] )
+    if err != nil {
+        return fmt.Errorf( "defineQuantizationTable: %v", err )
+    }
+
+    for _, qt := range qts.data {
+        pq := uint(qt[0] >> 8)
+        tq := qt[0] & 0x0f
+        jpg.qdefs[tq].size = 8 * (pq+1)
+        copy( jpg.qdefs[tq].values[:], qt[1:] )
+        if jpg.Warn {
+            jpg.checkQuantizationValues( &qt )
+        }
+        if jpg.Verbose {
+            fmt.Printf("Quantization table dest %d defined\n", tq )
+        }
     }
-    if qtn > 0 {
+    if len(qts.data) > 0 {
         jpg.addSeg( qts )
     } else if jpg.Warn {
-        fmt.Printf("defineQuantizationTable: Warning: empty segment (ignoring)\n")
+        jpg.warning("defineQuantizationTable: Warning: empty segment (ignoring)\n")
     }
     return nil
 }
@@ -999,6 +1370,9 @@ func printTree( cw *cumulativeWriter, root *hcnode, indent string ) {
     printNodes( root )
 }
 
+// buildTree returns the tree of the Huffman codes defined by values. It is
+// only used to print the codes (formatHuffmanDest in Extra or Both mode):
+// parsing and decoding use only the flat hcTable, made by makeHcTable.
 func buildTree( values [16][]uint8 ) (root *hcnode, err error) {
 
     root = new( hcnode )
@@ -1049,6 +1423,143 @@ func buildTree( values [16][]uint8 ) (root *hcnode, err error) {
     return
 }
 
+// hcTable holds the canonical Huffman codes of a table in flat arrays, for
+// decoding (T.81 Annex F.2.2.3): codes of the same length are consecutive
+// numbers starting at minCode, and their symbols are consecutive in symbols,
+// starting at valPtr. Codes of up to lookupBits bits are also given directly
+// by lookup, indexed by the next lookupBits bits.
+type hcTable struct {
+    minCode         [17]uint32  // first code of each length [1-16]
+    count           [17]uint32  // number of codes of each length
+    valPtr          [17]uint32  // index in symbols of first code of each length
+    limit           [17]uint32  // end (excluded) of code prefixes of each length
+    symbols         []uint8     // symbols in code order
+    lookup          [1 << lookupBits]uint16 // length << 8 | symbol, 0 if longer
+}
+
+const lookupBits = 9            // longest code in hcTable lookup
+
+func makeHcTable( values [16][]uint8 ) (t *hcTable, err error) {
+    t = new( hcTable )
+    var code, last uint32
+    var maxLen uint
+    for l := uint(1); l <= 16; l++ {
+        n := uint32(len(values[l-1]))
+        t.minCode[l], t.count[l], t.valPtr[l] = code, n, uint32(len(t.symbols))
+        t.symbols = append( t.symbols, values[l-1]... )
+        code += n
+        if code > 1 << l {
+            return nil, fmt.Errorf( "Huffman table building: too many codes"+
+                                    " of length %d or less\n", l )
+        }
+        if n > 0 {
+            last, maxLen = code - 1, l
+        }
+        code <<= 1
+    }
+    for l := uint(1); l <= maxLen; l++ {  // longest codes have the last prefixes
+        t.limit[l] = (last >> (maxLen - l)) + 1
+    }
+    for l := uint(1); l <= lookupBits; l++ { // all bits following short codes
+        for d := uint32(0); d < t.count[l]; d++ {
+            entry := uint16(l) << 8 | uint16(t.symbols[t.valPtr[l] + d])
+            first := (t.minCode[l] + d) << (lookupBits - l)
+            for k := uint32(0); k < 1 << (lookupBits - l); k++ {
+                t.lookup[first + k] = entry
+            }
+        }
+    }
+    return
+}
+
+func huffmanClass( tc uint8 ) string {
+    if tc == 0 {
+        return "DC"
+    }
+    return "AC"
+}
+
+// checkHuffmanCodes warns about a table without any code and about a table
+// using the all-ones code of its maximal length, which is reserved (T.81
+// Annex C) since it could not be distinguished from fill bits.
+func (jpg *Desc)checkHuffmanCodes( tc, th uint8 ) {
+    values := &jpg.hdefs[2*th+tc].values
+    var code, next uint32       // next: first code following the last one
+    var maxLen, n uint
+    for l := uint(1); l <= 16; l++ {
+        c := uint32(len(values[l-1]))
+        code += c
+        if c > 0 {
+            next, maxLen = code, l
+            n += uint(c)
+        }
+        code <<= 1
+    }
+    if n == 0 {
+        jpg.warning( "  WARNING: Huffman table %s%d has no code\n",
+                     huffmanClass(tc), th )
+        return
+    }
+    if next == 1 << maxLen {    // last code was all ones
+        jpg.warning( "  WARNING: Huffman table %s%d uses the "+
+                     "reserved all-ones code of length %d\n",
+                     huffmanClass(tc), th, maxLen )
+    }
+}
+
+// checkHuffmanSymbols warns, once per table definition, about symbols that
+// cannot be used in frame frm: DC sizes or AC coefficient sizes beyond the
+// sample precision, and EOBn runs outside of progressive frames. Such symbols
+// are rejected when decoding, where they would only appear as corrupted data.
+func (jpg *Desc)checkHuffmanSymbols( frm *frame, tc, th uint8 ) {
+    hd := &jpg.hdefs[2*th+tc]
+    if hd.checked {
+        return
+    }
+    hd.checked = true
+    if frm.encodingMode() == Lossless {     // DC tables code differences
+        return
+    }
+    maxDC, maxAC := frm.maxCoefSizes()
+    progressive := frm.encodingMode() == ExtendedProgressive
+    for l := 0; l < 16; l++ {
+        for _, symbol := range hd.values[l] {
+            var invalid bool
+            if tc == 0 {
+                invalid = symbol > maxDC
+            } else if size := symbol & 0x0f; size != 0 {
+                invalid = size > maxAC
+            } else {
+                run := symbol >> 4
+                invalid = run != 0 && run != 15 && ! progressive
+            }
+            if invalid {
+                jpg.warning( "  WARNING: Huffman table %s%d symbol 0x%02x "+
+                             "(length %d) is not valid in this frame\n",
+                             huffmanClass(tc), th, symbol, l+1 )
+            }
+        }
+    }
+}
+
+// prefix returns true if code, made of length bits, is a code or the prefix of
+// a code in table t
+func (t *hcTable) prefix( code uint, length uint8 ) bool {
+    return length <= 16 && code < uint(t.limit[length])
+}
+
+// symbol returns the symbol corresponding to code, made of length bits, and
+// true if code is a complete code in table t
+func (t *hcTable) symbol( code uint, length uint8 ) (uint8, bool) {
+    if length > 16 || code < uint(t.minCode[length]) {
+        return 0, false
+    }
+    if d := uint32(code) - t.minCode[length]; d < t.count[length] {
+        return t.symbols[t.valPtr[length] + d], true
+    }
+    return 0, false
+}
+
 type htcd struct {
     data    [16][]uint8 // table data
     hc      byte        // class [0-1]
@@ -1059,6 +1570,10 @@ type htSeg struct {
     htcds   []htcd
 }
 
+func (hs *htSeg)marker( ) uint {
+    return _DHT
+}
+
 func (hs *htSeg)serialize( w io.Writer ) (int, error) {
     lh := uint16(2)
     for i := 0; i < len(hs.htcds); i++ {
@@ -1183,14 +1698,125 @@ func (hs *htSeg)format( w io.Writer ) (n int, err error) {
     return
 }
 
+// Standard Huffman tables given in ISO 10918-1 Annex K.3, indexed as hdefs
+// (2*destination+class). They are used by some encoders without any DHT.
+var stdHuffmanTables = [4]struct{
+    counts  [16]uint8   // number of codes for each length 1 to 16
+    values  []uint8     // symbols in order of increasing code length
+}{
+    {   // DC luminance (class 0, destination 0)
+        [16]uint8{ 0, 1, 5, 1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0, 0, 0 },
+        []uint8{
+            0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07,
+            0x08, 0x09, 0x0a, 0x0b,
+        },
+    },
+    {   // AC luminance (class 1, destination 0)
+        [16]uint8{ 0, 2, 1, 3, 3, 2, 4, 3, 5, 5, 4, 4, 0, 0, 1, 125 },
+        []uint8{
+            0x01, 0x02, 0x03, 0x00, 0x04, 0x11, 0x05, 0x12,
+            0x21, 0x31, 0x41, 0x06, 0x13, 0x51, 0x61, 0x07,
+            0x22, 0x71, 0x14, 0x32, 0x81, 0x91, 0xa1, 0x08,
+            0x23, 0x42, 0xb1, 0xc1, 0x15, 0x52, 0xd1, 0xf0,
+            0x24, 0x33, 0x62, 0x72, 0x82, 0x09, 0x0a, 0x16,
+            0x17, 0x18, 0x19, 0x1a, 0x25, 0x26, 0x27, 0x28,
+            0x29, 0x2a, 0x34, 0x35, 0x36, 0x37, 0x38, 0x39,
+            0x3a, 0x43, 0x44, 0x45, 0x46, 0x47, 0x48, 0x49,
+            0x4a, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58, 0x59,
+            0x5a, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68, 0x69,
+            0x6a, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78, 0x79,
+            0x7a, 0x83, 0x84, 0x85, 0x86, 0x87, 0x88, 0x89,
+            0x8a, 0x92, 0x93, 0x94, 0x95, 0x96, 0x97, 0x98,
+            0x99, 0x9a, 0xa2, 0xa3, 0xa4, 0xa5, 0xa6, 0xa7,
+            0xa8, 0xa9, 0xaa, 0xb2, 0xb3, 0xb4, 0xb5, 0xb6,
+            0xb7, 0xb8, 0xb9, 0xba, 0xc2, 0xc3, 0xc4, 0xc5,
+            0xc6, 0xc7, 0xc8, 0xc9, 0xca, 0xd2, 0xd3, 0xd4,
+            0xd5, 0xd6, 0xd7, 0xd8, 0xd9, 0xda, 0xe1, 0xe2,
+            0xe3, 0xe4, 0xe5, 0xe6, 0xe7, 0xe8, 0xe9, 0xea,
+            0xf1, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8,
+            0xf9, 0xfa,
+        },
+    },
+    {   // DC chrominance (class 0, destination 1)
+        [16]uint8{ 0, 3, 1, 1, 1, 1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0 },
+        []uint8{
+            0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07,
+            0x08, 0x09, 0x0a, 0x0b,
+        },
+    },
+    {   // AC chrominance (class 1, destination 1)
+        [16]uint8{ 0, 2, 1, 2, 4, 4, 3, 4, 7, 5, 4, 4, 0, 1, 2, 119 },
+        []uint8{
+            0x00, 0x01, 0x02, 0x03, 0x11, 0x04, 0x05, 0x21,
+            0x31, 0x06, 0x12, 0x41, 0x51, 0x07, 0x61, 0x71,
+            0x13, 0x22, 0x32, 0x81, 0x08, 0x14, 0x42, 0x91,
+            0xa1, 0xb1, 0xc1, 0x09, 0x23, 0x33, 0x52, 0xf0,
+            0x15, 0x62, 0x72, 0xd1, 0x0a, 0x16, 0x24, 0x34,
+            0xe1, 0x25, 0xf1, 0x17, 0x18, 0x19, 0x1a, 0x26,
+            0x27, 0x28, 0x29, 0x2a, 0x35, 0x36, 0x37, 0x38,
+            0x39, 0x3a, 0x43, 0x44, 0x45, 0x46, 0x47, 0x48,
+            0x49, 0x4a, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58,
+            0x59, 0x5a, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68,
+            0x69, 0x6a, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78,
+            0x79, 0x7a, 0x82, 0x83, 0x84, 0x85, 0x86, 0x87,
+            0x88, 0x89, 0x8a, 0x92, 0x93, 0x94, 0x95, 0x96,
+            0x97, 0x98, 0x99, 0x9a, 0xa2, 0xa3, 0xa4, 0xa5,
+            0xa6, 0xa7, 0xa8, 0xa9, 0xaa, 0xb2, 0xb3, 0xb4,
+            0xb5, 0xb6, 0xb7, 0xb8, 0xb9, 0xba, 0xc2, 0xc3,
+            0xc4, 0xc5, 0xc6, 0xc7, 0xc8, 0xc9, 0xca, 0xd2,
+            0xd3, 0xd4, 0xd5, 0xd6, 0xd7, 0xd8, 0xd9, 0xda,
+            0xe2, 0xe3, 0xe4, 0xe5, 0xe6, 0xe7, 0xe8, 0xe9,
+            0xea, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8,
+            0xf9, 0xfa,
+        },
+    },
+}
+
+// useStandardHuffmanTable defines the standard Huffman table for the given
+// class and destination, and adds it as a new DHT segment so that it is
+// included when the data is serialized.
+func (jpg *Desc)useStandardHuffmanTable( tc, th uint8 ) (err error) {
+    if th > 1 {
+        return fmt.Errorf( "No standard Huffman table for destination %d\n", th )
+    }
+    td := 2*th+tc
+    std := &stdHuffmanTables[td]
+    hts := &htSeg{ htcds: []htcd{ htcd{ hc: tc, hd: th } } }
+    values := std.values
+    for hcli := 0; hcli < 16; hcli++ {
+        li := std.counts[hcli]
+        jpg.hdefs[td].values[hcli] = append( []uint8(nil), values[:li]... )
+        hts.htcds[0].data[hcli] = append( []uint8(nil), values[:li]... )
+        values = values[li:]
+    }
+    jpg.hdefs[td].table, err = makeHcTable( jpg.hdefs[td].values )
+    if err != nil {
+        return
+    }
+    jpg.hdefs[td].checked = false
+    jpg.addSeg( hts )
+    if jpg.Warn {
+        jpg.warning( "  WARNING: Missing Huffman table class %d dest %d, using standard table\n",
+                     tc, th )
+    }
+    return
+}
+
 func (jpg *Desc)defineHuffmanTable( marker, sLen uint ) ( err error ) {
 
     end := jpg.offset + 2 + sLen
     offset := jpg.offset + 4
+    if end > uint(len(jpg.data)) {
+        return fmt.Errorf( "defineHuffmanTable: DHT length %d beyond end of data\n",
+                           sLen )
+    }
 
     hts := new( htSeg )
     ht := 0
-    for ; ; {
+    for ; offset < end; {
+        if offset + 17 > end {
+            return fmt.Errorf( "defineHuffmanTable: Truncated table definition\n" )
+        }
         tc := uint(jpg.data[offset]) >> 4
         th := uint(jpg.data[offset]) & 0x0f
         offset++
@@ -1207,8 +1833,14 @@ func (jpg *Desc)defineHuffmanTable( marker, sLen uint ) ( err error ) {
         td := 2*th+tc // use 8 tables, (1 for DC + 1 for AC per destination) * 4
         voffset := offset+16
 
+        var total uint
         for hcli := uint(0); hcli < 16; hcli++ {
             jpg.hdefs[td].values[hcli] = nil    // ready to replace table (append)
+            total += uint(jpg.data[offset+hcli])
+        }
+        if voffset + total > end {
+            return fmt.Errorf( "defineHuffmanTable: %d symbols do not fit in DHT length %d\n",
+                               total, sLen )
         }
         for hcli := uint(0); hcli < 16; hcli++ {
             li := uint(jpg.data[offset+hcli])
@@ -1220,18 +1852,19 @@ func (jpg *Desc)defineHuffmanTable( marker, sLen uint ) ( err error ) {
             copy( hts.htcds[ht].data[hcli], jpg.hdefs[td].values[hcli] )
             voffset += li
         }
-        jpg.hdefs[td].root, err = buildTree( jpg.hdefs[td].values )
+        jpg.hdefs[td].table, err = makeHcTable( jpg.hdefs[td].values )
         if err != nil {
             return
         }
+        jpg.hdefs[td].checked = false
+        if jpg.Warn {
+            jpg.checkHuffmanCodes( uint8(tc), uint8(th) )
+        }
         if jpg.Verbose {
             fmt.Printf("Huffman table class %d dest %d defined\n", tc, th )
         }
         ht++
         offset = voffset;
-        if offset >= end {
-            break
-        }
     }
     if offset != end {
         return fmt.Errorf( "defineHuffmanTable: Invalid DHT length: %d actual: %d\n",
@@ -1240,7 +1873,7 @@ func (jpg *Desc)defineHuffmanTable( marker, sLen uint ) ( err error ) {
     if ht > 0 {
         jpg.addSeg( hts )
     } else if jpg.Warn {
-        fmt.Printf("defineHuffmanTable: Warning: empty segment (ignoring)\n")
+        jpg.warning("defineHuffmanTable: Warning: empty segment (ignoring)\n")
     }
     return
 }
@@ -1251,6 +1884,10 @@ type comSeg struct {
     text    []byte
 }
 
+func (c *comSeg)marker( ) uint {
+    return _COM
+}
+
 func (c *comSeg)serialize( w io.Writer ) (int, error) {
     size  := fixedCommentHeaderSize + uint16( len(c.text) )
     seg := make( []byte, size + 2 )
@@ -1267,10 +1904,28 @@ func (c *comSeg)format( w io.Writer ) (n int, err error) {
     return
 }
 
+// commentText returns the comment as a string. The encoding is not specified
+// by the standard: if the comment is not valid UTF-8, it is assumed to be
+// ISO-8859-1 (latin 1). Terminating null characters are removed.
+func (c *comSeg)commentText( ) string {
+    text := bytes.TrimRight( c.text, "\x00" )
+    if utf8.Valid( text ) {
+        return string(text)
+    }
+    runes := make( []rune, len(text) )
+    for i, b := range text {
+        runes[i] = rune(b)
+    }
+    return string(runes)
+}
+
 func (jpg *Desc)commentSegment( marker, sLen uint ) error {
-    offset := jpg.offset
+    if sLen < 2 {
+        return fmt.Errorf( "commentSegment: Invalid COM length: %d\n", sLen )
+    }
+    offset := jpg.offset + 4    // skip marker and length
     var b bytes.Buffer
-    s := jpg.data[offset:offset+sLen]
+    s := jpg.data[offset:offset+sLen-2]
     b.Write( s )
     c := new(comSeg)
     c.text = b.Bytes()
@@ -1285,6 +1940,10 @@ type dnlSeg struct {
     toRemove bool
 }
 
+func (d *dnlSeg)marker( ) uint {
+    return _DNL
+}
+
 func (d *dnlSeg)serialize( w io.Writer ) (int, error) {
     if d.toRemove {
         return 0, nil
@@ -1296,6 +1955,11 @@ func (d *dnlSeg)serialize( w io.Writer ) (int, error) {
     return w.Write( seg )
 }
 
+func isDnlSegment( seg segmenter ) bool {
+    d, ok := seg.(*dnlSeg)
+    return ok && ! d.toRemove
+}
+
 func (d *dnlSeg)format( w io.Writer ) (n int, err error) {
     n, err = fmt.Fprintf( w, "Define Number Of Lines:\n  number of lines %d\n",
                           d.nLines )
@@ -1324,8 +1988,8 @@ func (jpg *Desc)defineNumberOfLines( marker, sLen uint ) ( err error ) {
     var toRemove bool
     if ( cf.resolution.nLines != 0 ) {
         if jpg.Warn {
-            fmt.Printf( "  Warning: DNL table found with non 0 SOF number" +
-                        "of lines (%d)\n", cf.resolution.nLines )
+            jpg.warning( "  Warning: DNL table found with non 0 SOF number " +
+                         "of lines (%d)\n", cf.resolution.nLines )
         }
         if jpg.TidyUp {
             toRemove = true
@@ -1341,6 +2005,48 @@ func (jpg *Desc)defineNumberOfLines( marker, sLen uint ) ( err error ) {
     return
 }
 
+// linesFromScans returns the number of lines actually decoded in scans, as a
+// multiple of 8, using the number of unit rows of the Y component.
+func (frm *frame)linesFromScans( ) (uint16, error) {
+    nLines := len(frm.components[0].iDCTdata)   // nUnits Y Col
+    yVSF := int(frm.components[0].VSF)          // nUnits per MCU col
+
+    for _, cmp := range frm.components {
+        if (len(cmp.iDCTdata) * yVSF) / int(cmp.VSF) != nLines {
+            return 0, fmt.Errorf("Inconsistent frame component number of lines\n" )
+        }
+    }
+    return uint16(nLines * 8), nil              // 8 pixel lines per unit
+}
+
+// matchScanLines returns true if nLines fits in the last MCU row of scanLines
+func (frm *frame)matchScanLines( nLines, scanLines uint16 ) bool {
+    return scanLines >= nLines &&
+           scanLines < nLines + (uint16(frm.resolution.mvSF) * 8)
+}
+
+// actualScanLines returns the number of lines given by the frame header or by
+// a DNL segment, unless it does not match the number of lines found in scans,
+// in which case the scan lines are returned. Contrary to checkLines, frame
+// lines are not modified. Non sequential Huffman frames are not checked.
+func (frm *frame)actualScanLines( ) (uint16, error) {
+    if frm.resolution.scanLines != 0 || frm.encoding > HuffmanProgressive {
+        return frm.actualLines( ), nil
+    }
+    scanLines, err := frm.linesFromScans( )
+    if err != nil {
+        return 0, err
+    }
+    nLines := frm.resolution.nLines
+    if nLines == 0 {
+        nLines = frm.resolution.dnlLines
+    }
+    if frm.matchScanLines( nLines, scanLines ) {
+        return nLines, nil
+    }
+    return scanLines, nil
+}
+
 func (jpg *Desc)checkLines( ) error {
     // lines are updated to dnlLines or scanLines when the frame is serialized
     frm := jpg.getCurrentFrame( )
@@ -1353,23 +2059,16 @@ func (jpg *Desc)checkLines( ) error {
 
     if frm.encoding > HuffmanProgressive {
         if jpg.Warn {
-            fmt.Printf("  WARNING: Non Sequential Huffman coded frame(s): lines are left untouched\n")
+            jpg.warning("  WARNING: Non Sequential Huffman coded frame(s): lines are left untouched\n")
         }
         return nil
     }
-    // use actual number of unit rows from Y component
-    nLines := len(frm.components[0].iDCTdata)   // nUnits Y Col
-    yVSF := int(frm.components[0].VSF)          // nUnits per MCU col
-
-    for _, cmp := range frm.components {
-        if (len(cmp.iDCTdata) * yVSF) / int(cmp.VSF) != nLines {
-            return fmt.Errorf("Inconsistent frame component number of lines\n" )
-        }
+    scanLines, err := frm.linesFromScans( )
+    if err != nil {
+        return err
     }
-    scanLines := uint16(nLines * 8)             // 8 pixel lines per unit
-    if scanLines < frm.resolution.nLines ||
-        scanLines > (frm.resolution.nLines - (uint16(frm.resolution.mvSF) * 8)) {
-        fmt.Printf( "  FIXING: replacing number of lines in Start Of Frame " +
+    if ! frm.matchScanLines( frm.resolution.nLines, scanLines ) {
+        jpg.fixing( "  FIXING: replacing number of lines in Start Of Frame " +
                     "with actual scan results (from %d to %d)\n",
                     frm.resolution.nLines, scanLines )
         frm.resolution.scanLines = scanLines
@@ -0,0 +1,267 @@
+package jpeg
+
+// support for steganalysis heuristics on DCT coefficients
+
+import (
+    "fmt"
+    "math"
+)
+
+const (
+    _CHI_MIN_EXPECTED       = 5     // min expected count for a chi-square pair
+    _CALIBRATION_SHIFT      = 4     // crop offset for calibration, in samples
+    _MIN_ASYMMETRY_COUNT    = 100   // min number of 1 and -1 for asymmetry
+    _JSTEG_ASYMMETRY        = 0.2   // typical asymmetry after a full embedding
+)
+
+// F5 estimation modes (0,1), (1,0) and (1,1), as natural and zigzag indexes
+var f5Modes = [3][2]int{ { 1, 1 }, { 8, 2 }, { 9, 4 } }
+
+// StegoReport gives the steganalysis results for one component. All scores
+// are in [0, 1], 0 meaning no sign of embedding.
+type StegoReport struct {
+    Component       int         // component index in frame
+    Coefficients    int         // number of AC coefficients examined
+    LSBProbability  float64     // chi-square probability that pairs of values
+                                // (2k, 2k+1) were equalized by LSB embedding
+    Asymmetry       float64     // relative difference between the counts of
+                                // 1 and -1 (Jsteg skips 0 and 1, but not -1)
+    F5Rate          float64     // estimated ratio of modified coefficients
+                                // from (0,1), (1,0) and (1,1) histograms
+    Suspicion       float64     // max of the above scores, with asymmetry
+                                // relative to a full Jsteg embedding
+}
+
+// quantizedAc returns the histogram of the quantized AC coefficients of a
+// dequantized component, and the histograms of the absolute values in the
+// modes used for F5 estimation.
+func quantizedAc( cmp *component, qz *qdef ) (hist map[int]int,
+                                               modes [3][]int, n int) {
+    hist = make( map[int]int )
+    var natural [64]uint16                  // table in natural order
+    for r := 0; r < 8; r ++ {
+        for c := 0; c < 8; c ++ {
+            natural[r*8+c] = qz.values[zigZagRowCol[r][c]]
+        }
+    }
+    for _, row := range cmp.iDCTdata {
+        for k := range row {
+            du := &row[k]
+            for i := 1; i < 64; i++ {
+                if natural[i] == 0 {
+                    continue
+                }
+                v := int(du[i]) / int(natural[i])
+                hist[v] ++
+                n ++
+            }
+            for m, mode := range f5Modes {
+                modes[m] = addAbsCount( modes[m], int(du[mode[0]]) /
+                                                  int(natural[mode[0]]) )
+            }
+        }
+    }
+    return
+}
+
+func addAbsCount( h []int, v int ) []int {
+    if v < 0 {
+        v = -v
+    }
+    for len(h) <= v {
+        h = append( h, 0 )
+    }
+    h[v] ++
+    return h
+}
+
+// calibratedModes returns the histograms of the absolute values in the modes
+// used for F5 estimation, after decoding, cropping by 4 samples in both
+// directions and quantizing again with the same table. The block grid being
+// shifted, the result is an estimate of the histograms before embedding.
+func calibratedModes( plane []uint8, stride, cols, rows int,
+                      qz *qdef ) (modes [3][]int) {
+    for r := _CALIBRATION_SHIFT; r + 8 <= rows; r += 8 {
+        for c := _CALIBRATION_SHIFT; c + 8 <= cols; c += 8 {
+            coefs := forwardDCT8( plane[r*stride+c:], stride )
+            for m, mode := range f5Modes {
+                q := float64(qz.values[mode[1]])
+                modes[m] = addAbsCount( modes[m],
+                                        int(math.Round( coefs[mode[0]] / q )) )
+            }
+        }
+    }
+    return
+}
+
+func histogramValue( h []int, i int, scale float64 ) float64 {
+    if i < len(h) {
+        return float64(h[i]) * scale
+    }
+    return 0
+}
+
+// f5Rate returns the least square estimate of the ratio of modified
+// coefficients for F5 shrinkage, from the observed histogram h and the
+// calibrated one H, as given by Fridrich, Goljan and Hogea (2002):
+// h(0) = H(0) + βH(1), and h(1) = (1-β)H(1) + βH(2)
+func f5Rate( h, H []int ) (beta float64, ok bool) {
+    var nh, nH int
+    for _, v := range h { nh += v }
+    for _, v := range H { nH += v }
+    if nH == 0 || nh == 0 {
+        return
+    }
+    s := float64(nh) / float64(nH)  // calibrated image has fewer blocks
+    h0, h1 := histogramValue( h, 0, 1 ), histogramValue( h, 1, 1 )
+    H0, H1, H2 := histogramValue( H, 0, s ), histogramValue( H, 1, s ),
+                  histogramValue( H, 2, s )
+    d := H1 * H1 + (H2 - H1) * (H2 - H1)
+    if d == 0 {
+        return
+    }
+    return (H1 * (h0 - H0) + (h1 - H1) * (H2 - H1)) / d, true
+}
+
+// chiSquareProbability returns the probability that a chi-square variable
+// with dof degrees of freedom exceeds chi2, i.e. the regularized upper
+// incomplete gamma function Q(dof/2, chi2/2).
+func chiSquareProbability( chi2 float64, dof int ) float64 {
+    a, x := float64(dof) / 2, chi2 / 2
+    if x <= 0 {
+        return 1
+    }
+    lg, _ := math.Lgamma( a )
+    if x < a + 1 {                      // series for P(a, x)
+        sum, del := 1 / a, 1 / a
+        for n := 1.0; n < 1000; n++ {
+            del *= x / (a + n)
+            sum += del
+            if math.Abs( del ) < math.Abs( sum ) * 1e-14 {
+                break
+            }
+        }
+        return 1 - sum * math.Exp( -x + a * math.Log( x ) - lg )
+    }
+    b := x + 1 - a                      // continued fraction for Q(a, x)
+    c, d := 1 / 1e-300, 1 / b
+    h := d
+    for i := 1.0; i < 1000; i++ {
+        an := -i * (i - a)
+        b += 2
+        d = an * d + b
+        if math.Abs( d ) < 1e-300 { d = 1e-300 }
+        c = b + an / c
+        if math.Abs( c ) < 1e-300 { c = 1e-300 }
+        d = 1 / d
+        del := d * c
+        h *= del
+        if math.Abs( del - 1 ) < 1e-14 {
+            break
+        }
+    }
+    return math.Exp( -x + a * math.Log( x ) - lg ) * h
+}
+
+// lsbProbability applies the chi-square attack of Westfeld and Pfitzmann to
+// the histogram of quantized coefficients: LSB embedding of random bits tends
+// to equalize the counts of values 2k and 2k+1. Pairs (0, 1) are not used by
+// Jsteg, and pairs with too few coefficients are ignored.
+func lsbProbability( hist map[int]int ) float64 {
+    var chi2 float64
+    var nPairs int
+    for v, n := range hist {
+        if v & 1 != 0 || v == 0 {       // even values, except 0
+            continue
+        }
+        expected := float64(n + hist[v+1]) / 2
+        if expected < _CHI_MIN_EXPECTED {
+            continue
+        }
+        d := float64(n) - expected
+        chi2 += d * d / expected
+        nPairs ++
+    }
+    if nPairs < 2 {
+        return 0
+    }
+    return chiSquareProbability( chi2, nPairs - 1 )
+}
+
+// StegoAnalysis looks for signatures of common DCT domain steganography in
+// the quantized coefficients of each component of the first frame:
+//
+// - LSB replacement (Jsteg, OutGuess without correction) equalizes the counts
+//   of values 2k and 2k+1, detected with a chi-square test over all pairs.
+//
+// - Jsteg leaves 0 and 1 alone but not -1, which breaks the symmetry of the
+//   histogram around 0. The asymmetry score is the relative difference
+//   between the counts of 1 and -1, which is about 0.2 after embedding in
+//   all usable coefficients, and close to 0 in natural pictures. It is not
+//   evaluated with less than 100 coefficients equal to 1 or -1.
+//
+// - F5 decrements the absolute value of coefficients, which moves counts from
+//   1 to 0 in low frequency histograms. The F5 rate compares the histograms
+//   of modes (0,1), (1,0) and (1,1) with calibrated ones, obtained by
+//   decoding the picture, cropping it by 4 samples and quantizing it again
+//   with the same table, and is the mean of the ratios of modified
+//   coefficients estimated for each mode.
+//
+// Those heuristics are meant for screening: natural pictures may show some
+// asymmetry, and calibration is less accurate for small or double compressed
+// pictures.
+func (jpg *Desc) StegoAnalysis( ) ([]StegoReport, error) {
+    if len(jpg.frames) == 0 {
+        return nil, fmt.Errorf( "StegoAnalysis: no frame\n" )
+    }
+    frm := &jpg.frames[0]
+    samples, err := jpg.MakeFrameRawPicture( 0 )   // also dequantizes
+    if err != nil {
+        return nil, jpgForwardError( "StegoAnalysis", err )
+    }
+
+    reports := make( []StegoReport, len(frm.components) )
+    for ci := range frm.components {
+        cmp := &frm.components[ci]
+        if cmp.QS > 3 {
+            return nil, fmt.Errorf( "StegoAnalysis: table out of range\n" )
+        }
+        qz := &jpg.qdefs[cmp.QS]
+        if cmp.qt != nil {
+            qz = cmp.qt
+        }
+        sr := &reports[ci]
+        sr.Component = ci
+
+        hist, modes, n := quantizedAc( cmp, qz )
+        sr.Coefficients = n
+        sr.LSBProbability = lsbProbability( hist )
+
+        if p, m := hist[1], hist[-1]; p + m >= _MIN_ASYMMETRY_COUNT {
+            sr.Asymmetry = math.Abs( float64(p - m) ) / float64(p + m)
+        }
+
+        plane := *samples[ci]
+        stride := int(cmp.nUnitsRow << 3)
+        cols, rows := frm.componentSize( cmp )
+        if rows > len(plane) / stride {
+            rows = len(plane) / stride
+        }
+        calibrated := calibratedModes( plane, stride, cols, rows, qz )
+        var sum float64
+        var nModes int
+        for m := range modes {
+            if beta, ok := f5Rate( modes[m], calibrated[m] ); ok {
+                sum += beta
+                nModes ++
+            }
+        }
+        if nModes > 0 {
+            sr.F5Rate = math.Max( 0, math.Min( 1, sum / float64(nModes) ) )
+        }
+        asymmetry := math.Min( 1, sr.Asymmetry / _JSTEG_ASYMMETRY )
+        sr.Suspicion = math.Max( sr.LSBProbability,
+                                 math.Max( asymmetry, sr.F5Rate ) )
+    }
+    return reports, nil
+}
@@ -0,0 +1,95 @@
+package jpeg
+
+// support for streaming decoded sample rows during parsing
+
+// SampleRows is given to the Control.StreamRows callback with consecutive
+// lines of samples for one component, as soon as the corresponding MCU row
+// has been decoded. Samples are at the component resolution (chroma samples
+// are not upsampled) and are valid only during the call.
+type SampleRows struct {
+    Frame       int         // frame index
+    Component   int         // component index in frame
+    Line        int         // first line, in component samples
+    Lines       int         // number of lines
+    Width       int         // number of samples per line
+    Stride      int         // distance between lines in Samples
+    Samples     []uint8
+}
+
+// streams returns true if the data units of frm are streamed and released
+// as they are decoded: this requires a StreamRows callback and a sequential
+// frame with 8-bit samples, in which each component is coded only once.
+// Other frames are kept entirely in memory.
+func (jpg *Desc) streams( frm *frame ) bool {
+    return jpg.StreamRows != nil && frm.resolution.samplePrecision == 8 &&
+           (frm.encoding == HuffmanBaselineSequential ||
+            frm.encoding == HuffmanExtendedSequential)
+}
+
+// streamRows calls the StreamRows callback with the samples of all rows of
+// data units completed in scan, for each scan component, and then releases
+// those data units. The whole frame is never decoded at once, so that the
+// memory used is limited to a few MCU rows, in addition to the JPEG data.
+func (jpg *Desc) streamRows( frm *frame, scan *scan ) {
+    if ! jpg.streams( frm ) {
+        return
+    }
+    frm.streamed = true
+    for i := range scan.sComps {
+        sc := &scan.sComps[i]
+        ci := -1
+        for j := range frm.components {
+            if frm.components[j].Id == sc.cId {
+                ci = j
+                break
+            }
+        }
+        if ci == -1 {
+            continue
+        }
+        cmp := &frm.components[ci]
+        rows := *sc.iDCTdata
+        end := sc.nRows
+        if end > uint(len(rows)) {
+            end = uint(len(rows))
+        }
+        if cmp.flushed >= end {
+            continue
+        }
+        if cmp.QS > 3 {
+            continue
+        }
+        qz := jpg.qdefs[cmp.QS]
+        if cmp.qt != nil {
+            qz = *cmp.qt
+        }
+        stride := cmp.nUnitsRow << 3
+        samples := jpg.scratch.sampleBuffer( int((end - cmp.flushed) * stride * 8) )
+        for r := cmp.flushed; r < end; r++ {
+            start := ((r - cmp.flushed) * cmp.nUnitsRow) << 6
+            for c := range rows[r] {
+                du := rows[r][c]            // dequantize a copy
+                dequantizeUnit( &du, &qz )
+                inverseDCT8( &du, samples[start + uint(c << 3):], stride )
+            }
+            jpg.scratch.releaseRow( rows[r] )   // reuse data units
+            rows[r] = nil
+        }
+        sr := SampleRows{ Frame: int(frm.id), Component: ci,
+                          Line: int(cmp.flushed << 3),
+                          Lines: int((end - cmp.flushed) << 3),
+                          Width: int(stride), Stride: int(stride),
+                          Samples: samples }
+        cmp.flushed = end
+        if frm.actualLines() != 0 {         // crop to component size
+            cols, lines := frm.componentSize( cmp )
+            sr.Width = cols
+            if sr.Line + sr.Lines > lines {
+                sr.Lines = lines - sr.Line
+            }
+        }
+        if sr.Lines > 0 {
+            jpg.StreamRows( &sr )
+        }
+    }
+}
@@ -0,0 +1,72 @@
+package jpeg
+
+// support for checking streamed sample rows, and that the frame data units
+// released after streaming are not used by any other decoding function.
+
+import (
+    "bytes"
+    "os"
+    "path/filepath"
+    "testing"
+)
+
+func TestStreamRows( t *testing.T ) {
+    data, err := os.ReadFile( filepath.Join( "testdata", "ycc420.jpg" ) )
+    if err != nil {
+        t.Fatal( err )
+    }
+    ref, err := Parse( data, &Control{ } )
+    if err != nil {
+        t.Fatal( err )
+    }
+    samples, err := ref.MakeFrameRawPicture( 0 )
+    if err != nil {
+        t.Fatal( err )
+    }
+
+    var nLines [3]int
+    c := &Control{ StreamRows: func( rows *SampleRows ) {
+        if rows.Line != nLines[rows.Component] {
+            t.Errorf( "component %d: line %d, expected %d",
+                      rows.Component, rows.Line, nLines[rows.Component] )
+        }
+        plane := *samples[rows.Component]
+        for l := 0; l < rows.Lines; l++ {
+            got := rows.Samples[l*rows.Stride:l*rows.Stride+rows.Width]
+            start := (rows.Line + l) * rows.Stride
+            if ! bytes.Equal( got, plane[start:start+rows.Width] ) {
+                t.Errorf( "component %d line %d differs from MakeFrameRawPicture",
+                          rows.Component, rows.Line + l )
+            }
+        }
+        nLines[rows.Component] += rows.Lines
+    } }
+    jpg, err := Parse( data, c )
+    if err != nil {
+        t.Fatalf( "Parse: %v", err )
+    }
+    for ci, n := range nLines {
+        cols, lines := jpg.frames[0].componentSize( &jpg.frames[0].components[ci] )
+        if n != lines || cols == 0 {
+            t.Errorf( "component %d: %d lines streamed, expected %d", ci, n, lines )
+        }
+    }
+
+    raw := filepath.Join( t.TempDir( ), "picture.rgb" )
+    for name, decode := range map[string]func( ) error {
+        "MakeFrameRawPicture": func( ) error {
+            _, err := jpg.MakeFrameRawPicture( 0 ); return err },
+        "LumaImage": func( ) error { _, err := jpg.LumaImage( ); return err },
+        "SaveRawPicture": func( ) error {
+            _, _, _, err := jpg.SaveRawPicture( raw, false, nil ); return err },
+        "CheckSubsampling": func( ) error {
+            _, err := jpg.CheckSubsampling( ); return err },
+        "StegoAnalysis": func( ) error {
+            _, err := jpg.StegoAnalysis( ); return err },
+        "RGBA": func( ) error { _, err := jpg.RGBA( ); return err },
+    } {
+        if err := decode( ); err == nil {
+            t.Errorf( "%s: no error after streaming", name )
+        }
+    }
+}
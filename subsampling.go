@@ -0,0 +1,159 @@
+package jpeg
+
+// support for verifying the effective chroma subsampling
+
+import (
+    "fmt"
+    "math"
+)
+
+const (
+    _HALVED_SHARE_RATIO = 0.3   // max ratio of chroma to luma high frequency
+                                // share for a halved chroma resolution
+    _MAX_DUP_RESIDUAL   = 0.25  // max relative residual for duplicated pixels
+    _MIN_AC_ENERGY      = 1.0   // min mean AC energy per data unit to decide
+)
+
+// ChromaResolution gives the spectral content of one chroma component
+type ChromaResolution struct {
+    Component       int     // component index in frame
+    HShare, VShare  float64 // share of the AC energy in the upper half of
+                            // horizontal or vertical frequencies
+    HalvedH         bool    // content has half the stored horizontal resolution
+    HalvedV         bool    // content has half the stored vertical resolution
+}
+
+// SubsamplingReport is the result of CheckSubsampling
+type SubsamplingReport struct {
+    Declared        string  // subsampling declared by sampling factors
+    Effective       string  // subsampling given by the chroma content, or
+                            // empty if not representable as J:a:b
+    LumaHShare      float64 // reference luma shares, as in ChromaResolution
+    LumaVShare      float64
+    Chroma          []ChromaResolution
+}
+
+type spectrum struct {
+    acEnergy        float64 // mean AC energy per data unit
+    hShare, vShare  float64 // share of AC energy in upper frequencies
+    hDup, vDup      float64 // pixel duplication residual, relative to the
+                            // upper frequency energy
+}
+
+var dupTan [4]float64       // tan(uπ/16), for u in [0, 3]
+
+func init( ) {
+    for u := 1; u < 4; u++ {
+        dupTan[u] = math.Tan( float64(u) * math.Pi / 16 )
+    }
+}
+
+// spectralContent returns the spectral content of the component. Data units
+// must have been dequantized.
+//
+// If the samples were duplicated in pairs horizontally, the coefficients in
+// each row of a data unit satisfy X[8-u] = -tan(uπ/16) X[u] for u in [1, 3]
+// and X[4] = 0. The duplication residual is the energy of the deviation from
+// those relations, relative to the energy in upper horizontal frequencies
+// (and similarly in columns for vertical duplication).
+func spectralContent( cmp *component ) (sp spectrum) {
+    var eh, ev, rh, rv float64
+    var n int
+    for _, row := range cmp.iDCTdata {
+        for k := range row {
+            du := &row[k]                           // natural order
+            for i := 1; i < 64; i++ {
+                c := float64(du[i])
+                e := c * c
+                sp.acEnergy += e
+                if i & 7 >= 4 {                     // horizontal frequency
+                    eh += e
+                }
+                if i >> 3 >= 4 {                    // vertical frequency
+                    ev += e
+                }
+            }
+            for l := 0; l < 8; l++ {                // row or column l
+                h4, v4 := float64(du[l*8+4]), float64(du[32+l])
+                rh += h4 * h4
+                rv += v4 * v4
+                for u := 1; u < 4; u++ {
+                    d := float64(du[l*8+8-u]) + dupTan[u] * float64(du[l*8+u])
+                    rh += d * d
+                    d = float64(du[(8-u)*8+l]) + dupTan[u] * float64(du[u*8+l])
+                    rv += d * d
+                }
+            }
+            n ++
+        }
+    }
+    if sp.acEnergy == 0 {
+        return
+    }
+    sp.hShare, sp.vShare = eh / sp.acEnergy, ev / sp.acEnergy
+    if eh > 0 {
+        sp.hDup = rh / eh
+    }
+    if ev > 0 {
+        sp.vDup = rv / ev
+    }
+    sp.acEnergy /= float64(n)
+    return
+}
+
+// CheckSubsampling compares the chroma subsampling declared by the sampling
+// factors of the first frame with the actual spectral content of the chroma
+// components, in order to detect chroma that was subsampled and upsampled
+// again before the last compression (e.g. 4:2:0 content stored as 4:4:4).
+// The chroma resolution is considered halved in one direction if the share
+// of AC energy in the upper half of the frequencies in that direction is much
+// lower than for luma (less than 30%), as after a smooth upsampling, or if the
+// coefficients show that samples were duplicated in pairs, as after a simple
+// upsampling. Chroma components without enough AC energy to decide (flat
+// chroma) keep their declared resolution.
+func (jpg *Desc) CheckSubsampling( ) (*SubsamplingReport, error) {
+    if len(jpg.frames) == 0 {
+        return nil, fmt.Errorf( "CheckSubsampling: no frame\n" )
+    }
+    frm := &jpg.frames[0]
+    if len(frm.components) != 3 {
+        return nil, fmt.Errorf( "CheckSubsampling: not a YCbCr picture\n" )
+    }
+    if err := jpg.dequantize( frm ); err != nil {
+        return nil, jpgForwardError( "CheckSubsampling", err )
+    }
+    sr := new( SubsamplingReport )
+    luma := spectralContent( &frm.components[0] )
+    sr.LumaHShare, sr.LumaVShare = luma.hShare, luma.vShare
+
+    hsf, vsf := make( []uint8, 3 ), make( []uint8, 3 )
+    for i, cmp := range frm.components {
+        hsf[i], vsf[i] = cmp.HSF, cmp.VSF
+    }
+    sr.Declared = chromaSubsampling( hsf, vsf )
+
+    halvedH, halvedV := true, true
+    for ci := 1; ci < 3; ci++ {
+        sp := spectralContent( &frm.components[ci] )
+        cr := ChromaResolution{ Component: ci, HShare: sp.hShare, VShare: sp.vShare }
+        if sp.acEnergy >= _MIN_AC_ENERGY {
+            cr.HalvedH = sp.hShare < luma.hShare * _HALVED_SHARE_RATIO ||
+                         sp.hDup < _MAX_DUP_RESIDUAL
+            cr.HalvedV = sp.vShare < luma.vShare * _HALVED_SHARE_RATIO ||
+                         sp.vDup < _MAX_DUP_RESIDUAL
+        }
+        halvedH = halvedH && cr.HalvedH
+        halvedV = halvedV && cr.HalvedV
+        sr.Chroma = append( sr.Chroma, cr )
+    }
+    if halvedH {            // effective luma to chroma ratio is doubled
+        hsf[0] *= 2
+    }
+    if halvedV {
+        vsf[0] *= 2
+    }
+    if vsf[0] <= 2 * vsf[1] {   // J:a:b notation can only halve vertically
+        sr.Effective = chromaSubsampling( hsf, vsf )
+    }
+    return sr, nil
+}
@@ -0,0 +1,244 @@
+package jpeg
+
+// support for generating filtered thumbnails
+
+import (
+    "fmt"
+    "bytes"
+    "image"
+    stdjpeg "image/jpeg"
+    "math"
+)
+
+// Filter is the resampling filter used by MakeThumbnail. The kernels are the
+// same as the golang.org/x/image/draw scalers, plus Lanczos3.
+type Filter int
+const (
+    NearestNeighbor Filter = iota   // fastest, aliased
+    BiLinear                        // triangle kernel, radius 1
+    CatmullRom                      // cubic kernel, radius 2 (sharp)
+    Lanczos3                        // windowed sinc, radius 3 (sharpest)
+)
+
+func (f Filter)String( ) string {
+    switch f {
+    case NearestNeighbor:   return "Nearest neighbor"
+    case BiLinear:          return "Bilinear"
+    case CatmullRom:        return "Catmull-Rom"
+    case Lanczos3:          return "Lanczos3"
+    }
+    return "Unknown Filter"
+}
+
+// support returns the kernel radius, 0 for nearest neighbor
+func (f Filter)support( ) float64 {
+    switch f {
+    case BiLinear:      return 1
+    case CatmullRom:    return 2
+    case Lanczos3:      return 3
+    }
+    return 0
+}
+
+func sinc( x float64 ) float64 {
+    if x == 0 {
+        return 1
+    }
+    x *= math.Pi
+    return math.Sin( x ) / x
+}
+
+func (f Filter)kernel( x float64 ) float64 {
+    x = math.Abs( x )
+    switch f {
+    case BiLinear:
+        if x < 1 {
+            return 1 - x
+        }
+    case CatmullRom:
+        if x < 1 {
+            return (1.5 * x - 2.5) * x * x + 1
+        }
+        if x < 2 {
+            return ((-0.5 * x + 2.5) * x - 4) * x + 2
+        }
+    case Lanczos3:
+        if x < 3 {
+            return sinc( x ) * sinc( x / 3 )
+        }
+    }
+    return 0
+}
+
+// contribution gives the source samples and their normalized weights for one
+// destination sample
+type contribution struct {
+    start   int
+    weights []float64
+}
+
+// contributions returns the contributions of src samples to each of the dst
+// samples, with the filter kernel stretched when reducing.
+func (f Filter)contributions( src, dst int ) []contribution {
+    cs := make( []contribution, dst )
+    scale := float64(src) / float64(dst)
+    if f == NearestNeighbor {
+        for i := range cs {
+            cs[i] = contribution{ int((float64(i) + 0.5) * scale), []float64{ 1 } }
+        }
+        return cs
+    }
+    fScale := math.Max( scale, 1 )
+    radius := f.support( ) * fScale
+    for i := range cs {
+        center := (float64(i) + 0.5) * scale - 0.5
+        start := int(math.Ceil( center - radius ))
+        end := int(math.Floor( center + radius ))
+        weights := make( []float64, end - start + 1 )
+        var sum float64
+        for j := range weights {
+            weights[j] = f.kernel( (float64(start + j) - center) / fScale )
+            sum += weights[j]
+        }
+        if sum != 0 {
+            for j := range weights {
+                weights[j] /= sum
+            }
+        }
+        cs[i] = contribution{ start, weights }
+    }
+    return cs
+}
+
+func clampIndex( i, n int ) int {
+    if i < 0 {
+        return 0
+    }
+    if i >= n {
+        return n - 1
+    }
+    return i
+}
+
+// resample resizes plane from cols x rows to dCols x dRows, horizontally then
+// vertically, replicating edge samples for the kernel.
+func resample( plane []uint8, cols, rows, dCols, dRows int, f Filter ) []uint8 {
+    hcs := f.contributions( cols, dCols )
+    tmp := make( []float32, dCols * rows )
+    for r := 0; r < rows; r++ {
+        src := plane[r*cols:(r+1)*cols]
+        for c, hc := range hcs {
+            var v float64
+            for j, w := range hc.weights {
+                v += w * float64(src[clampIndex( hc.start + j, cols )])
+            }
+            tmp[r*dCols+c] = float32(v)
+        }
+    }
+    vcs := f.contributions( rows, dRows )
+    dst := make( []uint8, dCols * dRows )
+    for r, vc := range vcs {
+        for c := 0; c < dCols; c++ {
+            var v float64
+            for j, w := range vc.weights {
+                v += w * float64(tmp[clampIndex( vc.start + j, rows )*dCols+c])
+            }
+            dst[r*dCols+c] = clampSample( v )
+        }
+    }
+    return dst
+}
+
+func clampSample( v float64 ) uint8 {
+    if v <= 0 {
+        return 0
+    }
+    if v >= 255 {
+        return 255
+    }
+    return uint8(v + 0.5)
+}
+
+// thumbnailSize returns the size fitting in maxDim x maxDim, keeping the
+// aspect ratio, without enlarging.
+func thumbnailSize( cols, rows, maxDim int ) (int, int) {
+    if cols <= maxDim && rows <= maxDim {
+        return cols, rows
+    }
+    if cols >= rows {
+        return maxDim, max1( (rows * maxDim + cols / 2) / cols )
+    }
+    return max1( (cols * maxDim + rows / 2) / rows ), maxDim
+}
+
+func max1( v int ) int {
+    if v < 1 {
+        return 1
+    }
+    return v
+}
+
+// MakeThumbnail decodes the first frame and returns it reduced to fit in
+// maxDim x maxDim samples, keeping its aspect ratio, as an image.Gray for one
+// component or as a 4:4:4 image.YCbCr for 3 components. The picture is not
+// enlarged if it fits already.
+//
+// When the picture is much larger than the thumbnail, it is first reduced by
+// 2, 4 or 8 by averaging blocks of samples, as ScaledImage does, as long as
+// the reduced picture remains at least twice as large as the thumbnail. It is
+// then resampled with the given filter, which removes the remaining aliasing.
+// The orientation given by metadata is not applied, so that the result can
+// be embedded as a thumbnail in the same file.
+func (jpg *Desc) MakeThumbnail( maxDim int, filter Filter ) (image.Image, error) {
+    if maxDim < 1 {
+        return nil, fmt.Errorf( "MakeThumbnail: invalid size %d\n", maxDim )
+    }
+    if filter < NearestNeighbor || filter > Lanczos3 {
+        return nil, fmt.Errorf( "MakeThumbnail: invalid filter %d\n", filter )
+    }
+    cols, rows, planes, err := jpg.fullPlanes( )
+    if err != nil {
+        return nil, jpgForwardError( "MakeThumbnail", err )
+    }
+    dCols, dRows := thumbnailSize( cols, rows, maxDim )
+
+    factor := 8
+    for factor > 1 && (cols / factor < 2 * dCols || rows / factor < 2 * dRows) {
+        factor /= 2
+    }
+    if factor > 1 {
+        var bCols, bRows int
+        for i, p := range planes {
+            planes[i], bCols, bRows = boxScale( p, cols, rows, factor )
+        }
+        cols, rows = bCols, bRows
+    }
+    if cols != dCols || rows != dRows {
+        for i, p := range planes {
+            planes[i] = resample( p, cols, rows, dCols, dRows, filter )
+        }
+    }
+    return makeImage( planes, dCols, dRows ), nil
+}
+
+// MakeThumbnailJPEG returns the thumbnail made by MakeThumbnail, encoded as a
+// baseline JPEG with the given quality (1 to 100, 0 for the default quality
+// 75), without metadata.
+func (jpg *Desc) MakeThumbnailJPEG( maxDim int, filter Filter,
+                                    quality int ) ([]byte, error) {
+    if quality < 0 || quality > 100 {
+        return nil, fmt.Errorf( "MakeThumbnailJPEG: invalid quality %d\n", quality )
+    }
+    if quality == 0 {
+        quality = stdjpeg.DefaultQuality
+    }
+    img, err := jpg.MakeThumbnail( maxDim, filter )
+    if err != nil {
+        return nil, jpgForwardError( "MakeThumbnailJPEG", err )
+    }
+    var b bytes.Buffer
+    if err = stdjpeg.Encode( &b, img, &stdjpeg.Options{ Quality: quality } ); err != nil {
+        return nil, fmt.Errorf( "MakeThumbnailJPEG: %v\n", err )
+    }
+    return b.Bytes(), nil
+}
@@ -0,0 +1,113 @@
+package jpeg
+
+// support for checking the resampling filters of MakeThumbnail against values
+// computed by hand: kernel values, the resampling of a few samples, and the
+// resampling of a linear ramp, which all normalized symmetric kernels
+// reproduce exactly away from the edges.
+
+import (
+    "image"
+    "math"
+    "os"
+    "path/filepath"
+    "testing"
+)
+
+func TestFilterKernels( t *testing.T ) {
+    for _, k := range []struct{
+        filter  Filter
+        x, v    float64
+    }{
+        { BiLinear, 0, 1 }, { BiLinear, 0.5, 0.5 }, { BiLinear, -0.25, 0.75 },
+        { BiLinear, 1, 0 },
+        { CatmullRom, 0, 1 }, { CatmullRom, 0.5, 0.5625 }, { CatmullRom, 1, 0 },
+        { CatmullRom, -1.5, -0.0625 }, { CatmullRom, 2, 0 },
+        { Lanczos3, 0, 1 }, { Lanczos3, 1, 0 }, { Lanczos3, 2, 0 },
+        { Lanczos3, 0.5, 6 / (math.Pi * math.Pi) },             // 2/π x 3/π
+        { Lanczos3, -1.5, -4 / (3 * math.Pi * math.Pi) },       // -2/3π x 2/π
+        { Lanczos3, 3, 0 },
+    } {
+        if v := k.filter.kernel( k.x ); math.Abs( v - k.v ) > 1e-12 {
+            t.Errorf( "%s kernel(%g) is %g, expected %g", k.filter, k.x, v, k.v )
+        }
+    }
+}
+
+func TestResample( t *testing.T ) {
+    // 4 samples reduced to 2, the kernels being stretched by 2, with edge
+    // samples replicated: bilinear weights are 1/8, 3/8, 3/8, 1/8, and
+    // Catmull-Rom weights are -3/256, -9/256, 29/256, 111/256 and symmetric
+    src := []uint8{ 0, 40, 80, 120 }
+    for _, r := range []struct{
+        filter  Filter
+        dst     []uint8
+    }{
+        { NearestNeighbor, []uint8{ 40, 120 } },
+        { BiLinear, []uint8{ 25, 95 } },            // 20 x 3/8 + ..., 95
+        { CatmullRom, []uint8{ 21, 99 } },          // 20.78, 99.22
+    } {
+        for _, vertical := range []bool{ false, true } {
+            cols, rows, dCols, dRows := 4, 1, 2, 1
+            if vertical {
+                cols, rows, dCols, dRows = 1, 4, 1, 2
+            }
+            dst := resample( src, cols, rows, dCols, dRows, r.filter )
+            if string(dst) != string(r.dst) {
+                t.Errorf( "%s (vertical %v): %v, expected %v",
+                          r.filter, vertical, dst, r.dst )
+            }
+        }
+    }
+
+    // ramp 8x + 3 on 32 samples reduced to 8: destination sample i is
+    // centered on source sample 4i + 1.5, or 4i + 2 for nearest neighbor
+    ramp := make( []uint8, 32 )
+    for x := range ramp {
+        ramp[x] = uint8(8 * x + 3)
+    }
+    for _, filter := range []Filter{ NearestNeighbor, BiLinear, CatmullRom, Lanczos3 } {
+        dst := resample( ramp, 32, 1, 8, 1, filter )
+        for i, c := range filter.contributions( 32, 8 ) {
+            if c.start < 0 || c.start + len(c.weights) > 32 {
+                continue                            // edge samples replicated
+            }
+            expected := uint8(32 * i + 15)
+            if filter == NearestNeighbor {
+                expected = uint8(32 * i + 19)
+            }
+            if dst[i] != expected {
+                t.Errorf( "%s ramp sample %d is %d, expected %d",
+                          filter, i, dst[i], expected )
+            }
+        }
+    }
+}
+
+func TestMakeThumbnail( t *testing.T ) {
+    data, err := os.ReadFile( filepath.Join( "testdata", "ycc444.jpg" ) )
+    if err != nil {
+        t.Fatal( err )
+    }
+    jpg, err := Parse( data, &Control{ } )
+    if err != nil {
+        t.Fatal( err )
+    }
+    for _, s := range []struct{ maxDim, cols, rows int }{
+        { 20, 20, 13 }, { 45, 45, 29 }, { 100, 45, 29 }, { 1, 1, 1 },
+    } {
+        for _, filter := range []Filter{ NearestNeighbor, BiLinear,
+                                         CatmullRom, Lanczos3 } {
+            img, err := jpg.MakeThumbnail( s.maxDim, filter )
+            if err != nil {
+                t.Fatalf( "MakeThumbnail: %v", err )
+            }
+            if _, ok := img.(*image.YCbCr); ! ok {
+                t.Fatalf( "MakeThumbnail: %T instead of *image.YCbCr", img )
+            }
+            if r := img.Bounds( ); r.Dx( ) != s.cols || r.Dy( ) != s.rows {
+                t.Errorf( "%s %d: %dx%d, expected %dx%d", filter, s.maxDim,
+                          r.Dx( ), r.Dy( ), s.cols, s.rows )
+            }
+        }
+    }
+}